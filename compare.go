@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+// compareMain compares results of a run to those of a baseline run and
+// exits with code 2 when they regressed beyond tolerances.
+func compareMain(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	throughput := fs.Float64("max-throughput-drop", 10, "Max drop of connect, message and byte rates in percent, negative disables")
+	errorRate := fs.Float64("max-error-rate-rise", 1, "Max rise of the error rate in percentage points, negative disables")
+	latency := fs.Float64("max-latency-rise", 20, "Max rise of latency p50, p90 and p99 in percent, negative disables")
+	jsonOut := fs.Bool("json", false, "Write changes as JSON to stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: wsbm compare [options] baseline current\n"+
+			"    results are JSON reports or raw results\noptions:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	base, err := readResult(fs.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+	current, err := readResult(fs.Arg(1))
+	if err != nil {
+		panic(err)
+	}
+	changes := wsbm.Compare(base, current, wsbm.Tolerances{
+		ThroughputDrop: *throughput,
+		ErrorRateRise:  *errorRate,
+		LatencyRise:    *latency,
+	})
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(changes)
+	} else {
+		wsbm.WriteChanges(os.Stdout, changes)
+	}
+
+	for _, c := range changes {
+		if c.Regressed {
+			os.Exit(2)
+		}
+	}
+}
+
+// readResult reads the JSON report or raw results at path, raw results are
+// analyzed as a whole.
+func readResult(path string) (*wsbm.Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw, err := wsbm.ReadRaw(file)
+	if err == nil {
+		result := wsbm.Analyze(raw, time.Second)
+		result.Tags = raw.Tags
+		return result, nil
+	}
+	if !errors.Is(err, wsbm.ErrNotRaw) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	result, err := wsbm.ReadJSON(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return result, nil
+}
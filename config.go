@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPattern matches '${NAME}' references to environment variables, a
+// bare '$NAME' is left alone as payloads may well contain it.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var flagConfig = flag.String("f", "", "YAML config file of options by flag name, eg: 'c: 100', 'H: [...]' and 'url: ...', command line flags override it")
+
+// parseFlags parses command line args and the -f config file, whose
+// options are set unless given on the command line too.
+func parseFlags(args []string) {
+	flag.CommandLine.Parse(args)
+	if *flagConfig == "" {
+		return
+	}
+	if err := loadConfig(*flagConfig); err != nil {
+		panic(fmt.Errorf("config %s: %w", *flagConfig, err))
+	}
+}
+
+// loadConfig sets flags of the config file at path, lists set repeated
+// flags once per item. 'url' is a url or list of urls used when none are
+// given as arguments.
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(expandEnv(string(data))), &config); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var urls []string
+	for _, name := range names {
+		values, err := configValues(config[name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if name == "url" {
+			urls = values
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %s", name)
+		}
+		if set[name] || name == "f" {
+			continue
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	if flag.NArg() == 0 && len(urls) > 0 {
+		return flag.CommandLine.Parse(urls)
+	}
+	return nil
+}
+
+// configValues returns the flag values of a config value, a scalar or a
+// list of scalars.
+func configValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}:
+				return nil, fmt.Errorf("nested value %v", item)
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	case map[string]interface{}:
+		return nil, fmt.Errorf("unexpected mapping, want a value or list")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// expandEnv replaces '${NAME}' in s by the environment variable NAME, an
+// unset variable by nothing like the shell does.
+func expandEnv(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(envPattern.FindStringSubmatch(ref)[1])
+	})
+}
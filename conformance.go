@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+// conformanceMain checks the server of the url, echoing messages, follows
+// RFC 6455 by conformance cases, failed cases exit with code 2.
+func conformanceMain(args []string) {
+	cases := stringsVar("case", "Conformance case or group run instead of all, repeatable, groups: "+conformanceGroups())
+	parseFlags(args)
+	run(func(opts *wsbm.Options) error {
+		opts.Conformance = true
+		opts.ConformanceCases = *cases
+		return nil
+	})
+}
+
+// conformanceGroups returns the groups of conformance cases separated by
+// commas.
+func conformanceGroups() string {
+	var groups []string
+	for _, c := range wsbm.ConformanceCases {
+		if len(groups) == 0 || groups[len(groups)-1] != c.Group {
+			groups = append(groups, c.Group)
+		}
+	}
+	return strings.Join(groups, ", ")
+}
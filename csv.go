@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+// csvWriter writes a row per connection result.
+type csvWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+}
+
+func createCSV(path string) (*csvWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &csvWriter{file: file, w: csv.NewWriter(file)}
+	c.w.Write([]string{"id", "url", "start", "dial_ms", "dns_ms", "tcp_ms", "tls_ms", "upgrade_ms",
+		"handshake_ms", "first_message_ms", "messages", "bytes", "duration_ms", "close", "schema_violations",
+		"rtt_count", "rtt_min_ms", "rtt_avg_ms", "rtt_p50_ms", "rtt_p90_ms", "rtt_p99_ms", "rtt_max_ms", "sha256", "error"})
+	return c, nil
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+func (c *csvWriter) Write(r wsbm.ConnResult) {
+	var start, errText string
+	if !r.Start.IsZero() {
+		start = r.Start.Format(time.RFC3339Nano)
+	}
+	if r.Err != nil {
+		errText = r.Err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write([]string{strconv.Itoa(r.ID), r.URL, start, ms(r.Connect), ms(r.DNS), ms(r.TCP),
+		ms(r.TLS), ms(r.Upgrade), ms(r.Handshake), ms(r.FirstMessage),
+		strconv.FormatInt(r.Messages, 10), strconv.FormatInt(r.Bytes, 10),
+		ms(r.Duration), r.Close, strconv.FormatInt(r.SchemaViolations, 10),
+		strconv.Itoa(r.RTT.Count), ms(r.RTT.Min), ms(r.RTT.Avg), ms(r.RTT.P50), ms(r.RTT.P90), ms(r.RTT.P99), ms(r.RTT.Max),
+		r.Hash, errText})
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
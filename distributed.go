@@ -0,0 +1,353 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+func agentMain(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:7070", "Listen address of coordinator requests, eg: :7070 for all interfaces")
+	token := fs.String("token", os.Getenv("WSBM_AGENT_TOKEN"), "Shared token coordinators must send, WSBM_AGENT_TOKEN by default")
+	localAddrs := fs.String("local-addrs", "", "Comma separated source ips of this host bound by connections in turn")
+	logLevel := fs.String("log-level", "info", "Log level, 'debug' dials and ends of connections, 'info' jobs and progress, 'warn' failures of connections or 'error'")
+	logFormat := fs.String("log-format", "text", "Log format, 'text' or 'json' lines")
+	pprofAddr := fs.String("pprof-addr", "", "Listen address serving pprof profiles of the agent on /debug/pprof/, eg: localhost:6060")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: wsbm agent [options]\noptions:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	setLogger(*logLevel, *logFormat)
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "wsbm agent: -token or WSBM_AGENT_TOKEN is required")
+		os.Exit(1)
+	}
+
+	agent := wsbm.NewAgent(logger)
+	agent.Token = *token
+	var err error
+	if agent.LocalAddrs, err = parseLocalAddrs(*localAddrs); err != nil {
+		panic(err)
+	}
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+	logf("agent listen on %s", *addr)
+	if err := http.ListenAndServe(*addr, agent); err != nil {
+		panic(err)
+	}
+}
+
+// coordinatorMain runs the benchmark of run options on agents and writes
+// the merged result like a local run.
+func coordinatorMain(args []string) {
+	agents := flag.String("agents", "", "Comma separated agent addresses, eg: host1:7070,host2:7070")
+	agentToken := flag.String("agent-token", os.Getenv("WSBM_AGENT_TOKEN"), "Shared token of -agents, WSBM_AGENT_TOKEN by default")
+	parseFlags(args)
+
+	if (flag.Arg(0) == "" && *flagURLs == "") || *agents == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	setLogger(logLevel(), *flagLogFormat)
+	if *agentToken == "" {
+		panic(fmt.Errorf("-agent-token or WSBM_AGENT_TOKEN is required"))
+	}
+	if err := checkCoordinatorFlags(); err != nil {
+		panic(err)
+	}
+
+	job, err := loadJob()
+	if err != nil {
+		panic(err)
+	}
+	logf("request: %d, concurrency:%d, duration:%s, agents: %s",
+		job.Requests, job.Concurrency, job.Duration, *agents)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	token, err := loadToken(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if token != nil {
+		job.Token = token.Token()
+	}
+
+	result, err := wsbm.RunAgents(ctx, strings.Split(*agents, ","), *agentToken, job, logger)
+	if err != nil {
+		panic(err)
+	}
+	finish(result)
+}
+
+// agentSinks are flags writing results of connections or messages, which
+// stay on agents.
+var agentSinks = []string{"o", "o-shards", "o-filter", "o-sample", "o-format", "csv", "raw",
+	"otlp", "out", "statsd", "statsd-prefix", "statsd-tags", "metrics-addr"}
+
+// checkCoordinatorFlags fails on flags of outputs of agentSinks, as agents
+// only return merged results to the coordinator, and on -token-command, as
+// agents are sent a static token.
+func checkCoordinatorFlags() error {
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range agentSinks {
+			if f.Name == name {
+				set = append(set, "-"+name)
+			}
+		}
+	})
+	if len(set) > 0 {
+		return fmt.Errorf("%s not supported with -agents, agents only return merged results", strings.Join(set, ", "))
+	}
+	if *flagTokenCommand != "" {
+		return fmt.Errorf("-token-command not supported with -agents, agents would keep its first token")
+	}
+	return nil
+}
+
+// loadJob returns the job of run flags, agents verify TLS certificates
+// with their system roots and don't send client certificates.
+func loadJob() (wsbm.Job, error) {
+	targets, err := loadTargets()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	queries, err := loadQueries()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	header, err := loadHeaders()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	subscribe, err := loadSubscribe()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	keepalive, err := loadKeepalive()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	golden, err := loadGolden()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	var schema []byte
+	if *flagValidateSchema != "" {
+		if schema, err = os.ReadFile(*flagValidateSchema); err != nil {
+			return wsbm.Job{}, err
+		}
+		if _, err := wsbm.ParseSchema(schema); err != nil {
+			return wsbm.Job{}, err
+		}
+	}
+
+	cookies, err := loadCookies()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	preRequest, err := loadPreRequest()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	sigv4, err := loadSigV4()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	maxRecvRate, err := parseByteRate(*flagMaxRecvRate)
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	maxSendRate, err := parseByteRate(*flagMaxSendRate)
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	readStall, err := loadReadStall()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	shape, err := loadShape()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	chaosDrop, err := loadChaosDrop()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	if sigv4 != nil {
+		sigv4 = &wsbm.SigV4{Region: sigv4.Region, Service: sigv4.Service}
+	}
+
+	var scenario []byte
+	switch {
+	case *flagPattern != "":
+		// agents run the pattern as scenario, files of messages are read here
+		s, err := loadScenario()
+		if err != nil {
+			return wsbm.Job{}, err
+		}
+		if scenario, err = s.YAML(); err != nil {
+			return wsbm.Job{}, err
+		}
+	case *flagScenario != "":
+		if scenario, err = os.ReadFile(*flagScenario); err != nil {
+			return wsbm.Job{}, err
+		}
+		scenario = []byte(expandEnv(string(scenario)))
+	}
+
+	ramp, err := loadRamp()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	// agents share the seed to pick queries in the same shuffled order.
+	seed := *flagFeedSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	connectJitter, err := loadConnectJitter()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	resolve, err := parseResolve(*flagResolve)
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	expectClose, err := parseCloseCodes(*flagExpectClose)
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+	traceFrames, err := loadTraceFrames()
+	if err != nil {
+		return wsbm.Job{}, err
+	}
+
+	var findMax *wsbm.FindMax
+	if *flagFindMax {
+		findMax = &wsbm.FindMax{
+			Batch:        int(*flagFindMaxBatch),
+			Interval:     *flagFindMaxInterval,
+			MaxErrorRate: *flagFindMaxErrors,
+			MaxP99:       *flagFindMaxP99,
+		}
+	}
+
+	arrivalSeed := *flagArrivalSeed
+	if arrivalSeed == 0 {
+		arrivalSeed = time.Now().UnixNano()
+	}
+	thinkSeed := *flagThinkSeed
+	if thinkSeed == 0 {
+		thinkSeed = time.Now().UnixNano()
+	}
+
+	request, concurrency := counts(queries, ramp)
+	return wsbm.Job{
+		URL:              expandEnv(flag.Arg(0)),
+		Targets:          targets,
+		Queries:          queries,
+		QueryVars:        *flagQueryVars,
+		Feed:             *flagFeed,
+		FeedSeed:         seed,
+		Header:           header,
+		Cookies:          cookies,
+		CookieJar:        *flagCookieJar,
+		PreRequest:       preRequest,
+		SigV4:            sigv4,
+		Requests:         request,
+		Concurrency:      concurrency,
+		Duration:         *flagDuration,
+		Rate:             *flagRate,
+		ConnectJitter:    connectJitter,
+		Arrival:          *flagArrival,
+		MaxInflight:      int(*flagMaxInflight),
+		ArrivalSeed:      arrivalSeed,
+		AutoTune:         *flagAutoTune,
+		AutoTuneWindow:   *flagAutoTuneWindow,
+		FindMax:          findMax,
+		Ramp:             ramp,
+		Scenario:         string(scenario),
+		Hold:             *flagHold,
+		Engine:           *flagEngine,
+		Churn:            int(*flagChurn),
+		Publishers:       int(*flagPublishers),
+		PublishInterval:  *flagPublishInterval,
+		FanoutMessage:    *flagFanoutMsg,
+		FanoutTs:         *flagFanoutTs,
+		Echo:             *flagEcho,
+		Fuzz:             *flagFuzz,
+		FuzzCases:        *flagFuzzCases,
+		Messages:         sendMessages,
+		SendInterval:     *flagSendInterval,
+		Think:            *flagThink,
+		ThinkSeed:        thinkSeed,
+		MaxMessages:      int(*flagMessages),
+		ExpectRegex:      *flagExpectRegex,
+		ExpectJSONPath:   *flagExpectJSONPath,
+		ExpectFirst:      *flagExpectFirst,
+		CorrelateSend:    *flagCorrelateSend,
+		CorrelateRecv:    *flagCorrelateRecv,
+		SeqJSONPath:      *flagSeqJSONPath,
+		Golden:           golden,
+		GoldenNormalize:  *flagExpectNormalize,
+		Schema:           string(schema),
+		Classify:         *flagClassify,
+		HandshakeTimeout: *flagHandshakeTimeout,
+		ReadTimeout:      *flagReadTimeout,
+		Retries:          int(*flagRetries),
+		RetryBackoff:     *flagRetryBackoff,
+		PingInterval:     *flagPingInterval,
+		PingTimeout:      *flagPingTimeout,
+		KeepaliveMessage: keepalive,
+		KeepalivePeriod:  *flagKeepalivePeriod,
+		CloseMode:        *flagCloseMode,
+		CloseCode:        *flagCloseCode,
+		CloseReason:      *flagCloseReason,
+		CloseTimeout:     *flagCloseTimeout,
+		ExpectClose:      expectClose,
+		TraceFrames:      traceFrames,
+		Protocol:         *flagProtocol,
+		Subscribe:        subscribe,
+		Publish:          *flagPublish,
+		MQTTVersion:      *flagMQTTVersion,
+		QoS:              *flagQoS,
+		Compress:         *flagCompress,
+		HTTP2:            *flagHTTP2,
+		Resolve:          resolve,
+		DNSServer:        *flagDNSServer,
+		Networks:         loadNetworks(),
+		ReadBufferSize:   int(*flagReadBuffer),
+		WriteBufferSize:  int(*flagWriteBuffer),
+		MaxRecvRate:      maxRecvRate,
+		MaxSendRate:      maxSendRate,
+		ReadStall:        readStall,
+		Shape:            shape,
+		ChaosDrop:        chaosDrop,
+		Insecure:         *flagInsecure,
+		Proxy:            *flagProxy,
+		Interval:         *flagInterval,
+		OutputHash:       *flagOutputHash,
+	}, nil
+}
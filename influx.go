@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+const (
+	// influxFlushInterval is how often buffered lines are written, sooner
+	// when influxFlushLines are buffered.
+	influxFlushInterval = time.Second
+	influxFlushLines    = 5000
+)
+
+var (
+	influxTagEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxFieldEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxWriter streams samples of the run and results of connections to
+// InfluxDB as line protocol, wsbm_interval and wsbm_conn measurements.
+type influxWriter struct {
+	url    string
+	client *http.Client
+	// tags are escaped tags of the run added to measurements.
+	tags string
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	lines int
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newInfluxWriter writes to the database at the end of the url path, eg:
+// http://host:8086/db, using the InfluxDB 1.x write API. Measurements are
+// tagged by tags.
+func newInfluxWriter(rawURL string, tags wsbm.Tags) (*influxWriter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	db := path.Base(u.Path)
+	if u.Host == "" || db == "" || db == "/" || db == "." {
+		return nil, fmt.Errorf("invalid influxdb url %s, want http://host:8086/db", rawURL)
+	}
+	q := u.Query()
+	q.Set("db", db)
+	q.Set("precision", "ns")
+	u.Path = path.Join(path.Dir(u.Path), "write")
+	u.RawQuery = q.Encode()
+
+	w := &influxWriter{
+		url:     u.String(),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, k := range tags.Keys() {
+		w.tags += "," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k])
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *influxWriter) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(influxFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			w.flush()
+			return
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// WriteSample writes the interval sample s.
+func (w *influxWriter) WriteSample(s wsbm.Sample) {
+	secs := s.Interval.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	w.write(fmt.Sprintf("wsbm_interval%s active=%di,connections=%di,messages=%di,bytes=%di,errors=%di,"+
+		"connect_rate=%g,msg_rate=%g,byte_rate=%g,elapsed_s=%g %d",
+		w.tags, s.Active, s.Connections, s.Messages, s.Bytes, s.Errors,
+		float64(s.Connections)/secs, float64(s.Messages)/secs, float64(s.Bytes)/secs,
+		s.Elapsed.Seconds(), s.Time.UnixNano()))
+}
+
+// WriteResult writes the result of a connection at its start.
+func (w *influxWriter) WriteResult(r wsbm.ConnResult) {
+	status := "ok"
+	if r.Err != nil {
+		status = "error"
+	}
+	var line strings.Builder
+	fmt.Fprintf(&line, "wsbm_conn%s,url=%s,status=%s", w.tags, influxTagEscaper.Replace(r.URL), status)
+	if r.Close != "" {
+		fmt.Fprintf(&line, ",close=%s", influxTagEscaper.Replace(r.Close))
+	}
+	fmt.Fprintf(&line, " id=%di,dns_ms=%s,tcp_ms=%s,tls_ms=%s,upgrade_ms=%s,handshake_ms=%s,first_message_ms=%s,"+
+		"messages=%di,bytes=%di,duration_ms=%s",
+		r.ID, ms(r.DNS), ms(r.TCP), ms(r.TLS), ms(r.Upgrade), ms(r.Handshake), ms(r.FirstMessage),
+		r.Messages, r.Bytes, ms(r.Duration))
+	if r.Err != nil {
+		fmt.Fprintf(&line, `,error="%s"`, influxFieldEscaper.Replace(r.Err.Error()))
+	}
+	start := r.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	fmt.Fprintf(&line, " %d", start.UnixNano())
+	w.write(line.String())
+}
+
+func (w *influxWriter) write(line string) {
+	w.mu.Lock()
+	w.buf.WriteString(line)
+	w.buf.WriteByte('\n')
+	w.lines++
+	full := w.lines >= influxFlushLines
+	w.mu.Unlock()
+	if full {
+		w.flush()
+	}
+}
+
+// flush posts buffered lines, they are dropped when the write fails.
+func (w *influxWriter) flush() {
+	w.mu.Lock()
+	if w.lines == 0 {
+		w.mu.Unlock()
+		return
+	}
+	body := append([]byte(nil), w.buf.Bytes()...)
+	w.buf.Reset()
+	w.lines = 0
+	w.mu.Unlock()
+
+	resp, err := w.client.Post(w.url, "text/plain; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("write influxdb", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		logger.Warn("write influxdb", "status", resp.Status, "body", strings.TrimSpace(string(msg)))
+	}
+}
+
+// Close writes lines left.
+func (w *influxWriter) Close() error {
+	close(w.done)
+	<-w.stopped
+	return nil
+}
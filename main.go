@@ -3,36 +3,506 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
-	"github.com/gorilla/websocket"
+	"github.com/go-T/wsbm/wsbm"
 )
 
 var (
-	flagRequest     = flag.Uint("n", 0, "Total request")
-	flagConcurrency = flag.Uint("c", 1, "Concurrency")
-	flagDryRun      = flag.Bool("dryrun", false, "Dryrun")
-	flagQueries     = flag.String("q", "", "Text file contans url query per line, json or plain text")
-	flagOutput      = flag.String("o", "-", "Output file, '-':stdout, '':null, 'filepath':'filepath.out'")
+	flagRequest          = flag.Uint("n", 0, "Total request")
+	flagConcurrency      = flag.Uint("c", 1, "Concurrency")
+	flagDryRun           = flag.Bool("dryrun", false, "Dryrun")
+	flagURLs             = flag.String("urls", "", "File of target urls, 'url [weight]' per line, connections are distributed by weight")
+	flagQueries          = flag.String("q", "", "Text file contans url query per line, json or plain text, or a .csv file with header row")
+	flagFeed             = flag.String("feed", "sequential", "How connections pick -q values, 'sequential', 'shuffle', 'random' or 'once' using each once then stop")
+	flagFeedSeed         = flag.Int64("feed-seed", 0, "Seed of shuffle and random feeds, 0 means current time")
+	flagQueryVars        = flag.Bool("q-vars", false, "Use -q values only as template variables, not merged into url query")
+	flagOutput           = flag.String("o", "-", "Output file, '-':stdout, '':null, 'filepath':'filepath.out'")
+	flagOutputShards     = flag.Int("o-shards", 0, "Write all connections into n files with connection id prefixed lines, 'filepath' for 1 or 'filepath.<shard>', 0 means a file per connection")
+	flagOutputFilter     = flag.String("o-filter", "", "Write only messages matching a regexp, or a JSONPath starting with '$' like '$.type==trade'")
+	flagOutputSample     = flag.String("o-sample", "", "Write a sampled fraction of messages, eg: 1/100")
+	flagOutputHash       = flag.Bool("o-hash", false, "Write a line per connection with message and byte counts and SHA-256 of received messages instead of content")
+	flagOutputFormat     = flag.String("o-format", "raw", "Output format, 'raw' message content, 'jsonl' message with conn, seq, ts, type and size")
+	flagSend             = messagesVar("send", false, "Text message sent after connect, repeatable")
+	flagSendBinary       = messagesVar("send-binary", true, "Binary message sent after connect, 'hex:...', 'base64:...' or '@file', repeatable")
+	flagSendInterval     = flag.Duration("send-interval", 0, "Interval between sent messages")
+	flagThink            = flag.String("think", "", "Think time between sent messages replacing -send-interval, eg: 100ms, exp(200ms), uniform(50ms,150ms), normal(100ms,20ms)")
+	flagThinkSeed        = flag.Int64("think-seed", 0, "Seed of think times, 0 means current time")
+	flagDuration         = flag.Duration("d", 0, "Run connections until duration elapsed, eg: 30s")
+	flagRamp             = flag.String("ramp", "", "Concurrency stages from:to:duration, eg: 0:100:60s,100:500:120s")
+	flagRate             = flag.Float64("rate", 0, "Max new connections per second, 0 means unlimited")
+	flagConnectJitter    = flag.String("connect-jitter", "", "Random delay of each connection, eg: 0..500ms or 500ms")
+	flagArrival          = flag.String("arrival", "", "Open-loop arrival of new connections per second regardless of running ones, replacing -c workers, eg: 100, constant:100 or poisson:100 with exponential inter-arrival times")
+	flagAutoTune         = flag.String("auto-tune", "", "Search the most concurrency meeting a latency percentile of -auto-tune-window, from -c, eg: p99=100ms or handshake.p90=50ms")
+	flagAutoTuneWindow   = flag.Duration("auto-tune-window", 5*time.Second, "How long each concurrency of -auto-tune runs")
+	flagFindMax          = flag.Bool("find-max", false, "Hold connections added in batches until a batch fails, reporting the most stable connections")
+	flagFindMaxBatch     = flag.Uint("find-max-batch", 100, "Connections added at a time by -find-max")
+	flagFindMaxInterval  = flag.Duration("find-max-interval", 5*time.Second, "How long each batch of -find-max settles")
+	flagFindMaxErrors    = flag.Float64("find-max-errors", 1, "Percentage of failed connections failing a batch of -find-max")
+	flagFindMaxP99       = flag.Duration("find-max-p99", time.Second, "Handshake p99 failing a batch of -find-max")
+	flagArrivalSeed      = flag.Int64("arrival-seed", 0, "Seed of poisson arrivals, 0 means current time")
+	flagMaxInflight      = flag.Uint("max-inflight", 0, "Max running connections of -arrival, arrivals beyond are dropped, 0 means unlimited")
+	flagInterval         = flag.Duration("interval", 0, "Interval of progress stats line, 0 means disabled")
+	flagUI               = flag.Bool("ui", false, "Show a live dashboard on stderr instead of log lines")
+	flagProgress         = flag.Bool("progress", true, "Show a progress bar of -n runs when stderr is a terminal")
+	flagLogLevel         = flag.String("log-level", "info", "Log level, 'debug' dials and ends of connections, 'info' progress, 'warn' failures of connections or 'error'")
+	flagLogFormat        = flag.String("log-format", "text", "Log format, 'text' or 'json' lines")
+	flagQuiet            = flag.Bool("quiet", false, "Log only failures and the summary, like -log-level warn")
+	flagVerbose          = flag.Bool("v", false, "Log at debug level and trace frames of a -v-sample of connections")
+	flagVerboseSample    = flag.String("v-sample", "1/100", "Fraction of connections whose frames -v traces, eg: 1/100 or 1 for all")
+	flagMessages         = flag.Uint("m", 0, "Close connection after m messages received, 0 means unlimited")
+	flagHandshakeTimeout = flag.Duration("handshake-timeout", 45*time.Second, "Handshake timeout")
+	flagHandshakeDump    = flag.String("handshake-dump", "", "File the responses of refused handshakes are written to, '' means none")
+	flagHandshakeDumps   = flag.Uint("handshake-dumps", 10, "Max refused handshakes written to -handshake-dump")
+	flagRetries          = flag.Uint("retries", 0, "Retries of handshakes failing by timeout, network error, 408, 429, 500, 502, 503 or 504, others are fatal")
+	flagRetryBackoff     = flag.Duration("retry-backoff", 100*time.Millisecond, "Backoff before the first retry, doubled by retry up to 30s, or Retry-After if longer")
+	flagReadTimeout      = flag.Duration("read-timeout", 0, "Max wait for next message, 0 means no timeout")
+	flagPingInterval     = flag.Duration("ping-interval", 0, "Interval of ping frames, 0 means no ping")
+	flagPingTimeout      = flag.Duration("ping-timeout", 10*time.Second, "Kill connection when pong is not received in timeout")
+	flagKeepaliveMsg     = flag.String("keepalive-msg", "", "Message sent every -keepalive-interval like '{\"type\":\"ping\"}', binary with 'hex:...' or 'base64:...'")
+	flagKeepalivePeriod  = flag.Duration("keepalive-interval", 30*time.Second, "Interval of -keepalive-msg")
+	flagCloseMode        = flag.String("close-mode", "graceful", "How connections are closed, 'graceful' close frame and wait, 'frame' close frame without wait, 'rst' TCP reset")
+	flagCloseCode        = flag.Int("close-code", 1000, "Close frame status code")
+	flagCloseReason      = flag.String("close-reason", "", "Close frame reason")
+	flagCloseTimeout     = flag.Duration("close-timeout", time.Second, "Max wait for server closing after close frame")
+	flagExpectClose      = flag.String("expect-close", "", "Comma separated close codes from server not counted as errors, eg: 1000,1001, '' means 1000")
+	flagProtocol         = flag.String("protocol", "", "Protocol spoken over connections, 'socketio', 'graphql-ws', 'stomp', 'mqtt', 'signalr', 'sockjs', 'phoenix' or 'jsonrpc', -send messages are framed as its events, operations or requests")
+	flagSubscribe        = stringsVar("subscribe", "Channel joined after -protocol handshake, the namespace of socketio, query or '@file' of graphql-ws, destination of stomp, topic of mqtt or phoenix, repeatable")
+	flagPublish          = flag.String("publish", "", "Destination of sent messages of -protocol, defaults to the first -subscribe")
+	flagMQTTVersion      = flag.Int("mqtt-version", 4, "MQTT protocol level, 4 for 3.1.1 or 5")
+	flagQoS              = flag.Int("qos", 0, "QoS of mqtt subscriptions and publishes, 0 or 1")
+	flagCompress         = flag.Bool("compress", false, "Negotiate permessage-deflate compression")
+	flagHTTP2            = flag.Bool("http2", false, "Connect as streams of HTTP/2 connections by extended CONNECT (RFC 8441), TLS for wss and prior knowledge for ws")
+	flagReadBuffer       = flag.Uint("read-buffer", 0, "Read buffer size of connections in bytes, 0 means 4096, or 64KB shared by connections of a poller with -engine netpoll")
+	flagWriteBuffer      = flag.Uint("write-buffer", 0, "Write buffer size of connections in bytes, pooled between writes, 0 means 4096")
+	flagMaxRecvRate      = flag.String("max-recv-rate", "", "Max bytes per second read by each connection, eg: 16KB, to simulate slow consumers")
+	flagMaxSendRate      = flag.String("max-send-rate", "", "Max bytes per second written by each connection, eg: 1MB")
+	flagReadStall        = flag.String("read-stall", "", "Stop reading of connections for a while periodically since connected, eg: 5s/30s stalls 5s every 30s")
+	flagReadStallSample  = flag.String("read-stall-sample", "1", "Fraction of connections -read-stall stalls, eg: 1/10")
+	flagNetDelay         = flag.Duration("net-delay", 0, "Delay of data received by connections, to simulate network latency")
+	flagNetJitter        = flag.Duration("net-jitter", 0, "Random variation of -net-delay, eg: 20ms delays by -net-delay plus or minus up to 20ms")
+	flagNetLoss          = flag.String("net-loss", "", "Fraction of data received delayed by a retransmission of 200ms, to simulate packet loss, eg: 1/100")
+	flagNetReset         = flag.String("net-reset", "", "Probability of each read or write resetting the connection, eg: 1/10000")
+	flagNetSample        = flag.String("net-sample", "1", "Fraction of connections -net-delay, -net-jitter, -net-loss and -net-reset degrade, eg: 1/10")
+	flagChaosDrop        = flag.String("chaos-drop", "", "Drop a fraction of connections a period at random, eg: 2%/min, to exercise session cleanup of servers")
+	flagChaosMode        = flag.String("chaos-mode", "random", "How -chaos-drop drops connections, 'close' close frame, 'rst' TCP reset or 'random' either")
+	flagChaosReconnect   = flag.Bool("chaos-reconnect", false, "Reconnect connections dropped by -chaos-drop, not supported with -echo, -scenario or -churn")
+	flagInsecure         = flag.Bool("insecure", false, "Skip TLS certificate verification")
+	flagCA               = flag.String("ca", "", "CA certificate file verifying server")
+	flagCert             = flag.String("cert", "", "Client certificate file")
+	flagKey              = flag.String("key", "", "Client private key file")
+	flagIPv4             = flag.Bool("4", false, "Connect over IPv4 only, with -6 connections alternate and results are broken down by family")
+	flagIPv6             = flag.Bool("6", false, "Connect over IPv6 only, with -4 connections alternate and results are broken down by family")
+	flagResolve          = stringsVar("resolve", "Connect 'host:port:addr' to addr keeping host for Host header and SNI, like curl, repeatable")
+	flagDNSServer        = flag.String("dns-server", "", "DNS server 'ip:port' resolving hosts, port 53 by default, defaults to the system resolver")
+	flagLocalAddrs       = flag.String("local-addrs", "", "Comma separated source ips bound by connections in turn, eg: 10.0.0.1,10.0.0.2, agents take their own -local-addrs")
+	flagProxy            = flag.String("proxy", "", "Proxy url, http://host:port or socks5://host:port, defaults to HTTPS_PROXY/HTTP_PROXY")
+	flagExpectRegex      = flag.String("expect-regex", "", "Regexp received messages must match")
+	flagExpectJSONPath   = flag.String("expect-jsonpath", "", "JSONPath received messages must have, '$.status' or '$.status==ok'")
+	flagCorrelateSend    = flag.String("correlate-send", "", "JSONPath of the request id of sent messages, eg: '$.id'")
+	flagCorrelateRecv    = flag.String("correlate-recv", "", "JSONPath of the request id replied by received messages, eg: '$.replyTo', latency is reported as reply")
+	flagSeqJSONPath      = flag.String("seq-jsonpath", "", "JSONPath of sequence numbers of received messages, reporting gaps, duplicates and out of order, eg: '$.seq'")
+	flagExpectFile       = flag.String("expect-file", "", "Transcript of messages each connection must receive, JSON lines like 'wsbm record' writes, diverged connections are reported")
+	flagExpectNormalize  = flag.Bool("expect-normalize", false, "Compare JSON messages of -expect-file by value, ignoring key order and whitespace")
+	flagValidateSchema   = flag.String("validate-schema", "", "JSON Schema file received text messages must be valid by, violations are counted per connection")
+	flagClassify         = flag.String("classify", "", "JSONPath of the class of received messages, reporting counts, bytes and intervals by class, eg: '$.type'")
+	flagExpectFirst      = flag.Bool("expect-first", false, "Check only the first message of each connection")
+	flagExpectMaxFail    = flag.Float64("expect-max-fail", 0, "Exit with code 2 when failed assertions exceed the percentage")
+	flagMaxErrorRate     = percentVar("max-error-rate", "Exit with code 2 when failed connections exceed the rate, eg: 1%")
+	flagMaxP99           = flag.Duration("max-p99", 0, "Exit with code 2 when handshake or echo rtt p99 exceeds, eg: 200ms")
+	flagHeaders          = stringsVar("H", "Request header 'Name: value', repeatable")
+	flagCookies          = stringsVar("cookie", "Cookie 'name=value' sent by every handshake, repeatable")
+	flagPreURL           = flag.String("pre-url", "", "HTTP request made before each dial, eg: login returning a token")
+	flagPreMethod        = flag.String("pre-method", "", "Method of -pre-url, defaults to POST with -pre-body, GET without")
+	flagPreBody          = flag.String("pre-body", "", "Body of -pre-url")
+	flagPreHeaders       = stringsVar("pre-header", "Header 'Name: value' of -pre-url, repeatable")
+	flagPreExtract       = stringsVar("pre-extract", "Template variable of -pre-url response, 'name=$.json.path', 'name=cookie:name' or 'name=header:Name', repeatable")
+	flagToken            = flag.String("token", "", "Bearer token sent as Authorization header")
+	flagTokenCommand     = flag.String("token-command", "", "Shell command printing the bearer token, replaces -token, not supported with -agents")
+	flagTokenRefresh     = flag.Duration("token-refresh", 0, "Interval of re-running -token-command, 0 means run once")
+	flagAWSSigV4         = flag.Bool("aws-sigv4", false, "Sign handshakes with AWS Signature V4 using AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	flagAWSRegion        = flag.String("aws-region", os.Getenv("AWS_REGION"), "AWS region of -aws-sigv4")
+	flagAWSService       = flag.String("aws-service", "execute-api", "AWS service of -aws-sigv4")
+	flagCookieJar        = flag.Bool("cookie-jar", false, "Share a cookie jar so cookies set by handshakes are sent by later connections")
+	flagPublishers       = flag.Uint("publishers", 0, "Fan-out run where the first n connections publish and the others subscribe, reporting delivery latency and loss, not supported with -agents")
+	flagPublishInterval  = flag.Duration("publish-interval", time.Second, "Interval of fan-out messages of each publisher")
+	flagFanoutMsg        = flag.String("fanout-msg", "", "Fan-out message template embedding a timestamp at -fanout-ts, defaults to '{\"publisher\":id,\"seq\":n,\"ts\":unixnano}'")
+	flagFanoutTs         = flag.String("fanout-ts", "$.ts", "JSONPath of the unix timestamp of fan-out messages, in s, ms, us or ns")
+	flagHold             = flag.Bool("hold", false, "Hold -c connections open with pings until -d elapsed, reporting how many are alive")
+	flagEngine           = flag.String("engine", "gorilla", "Connection engine, 'gorilla' or 'netpoll' with epoll pollers sharing read buffers for 500k+ connections on linux")
+	flagChurn            = flag.Uint("churn", 0, "Reconnect each connection after exchanging n messages until -d elapsed, reporting connect rate")
+	flagEcho             = flag.Bool("echo", false, "Send timestamped messages to an echo server and measure round-trip time")
+	flagFuzz             = flag.Bool("fuzz", false, "Send malformed frames, a case by connection in turn, and report how the server responds: close code, drop, hang or down")
+	flagFuzzCases        = stringsVar("fuzz-case", "Case of -fuzz run instead of all: "+fuzzCaseNames()+", repeatable")
+	flagScenario         = flag.String("scenario", "", "YAML scenario file of steps run by each connection")
+	flagPattern          = flag.String("pattern", "", "Steps run by each connection, eg: 'send:subscribe.json, wait:ack, loop(100){ send:order.json, expect:fill, sleep:50ms }'")
+	flagHgrm             = flag.String("hgrm", "", "Write latency histograms to 'prefix.<name>.hgrm' files")
+	flagCSV              = flag.String("csv", "", "CSV file of per connection results")
+	flagTags             = stringsVar("tag", "Tag of the run as key=value added to reports, metrics and raw results, eg: build=1234, repeatable")
+	flagRaw              = flag.String("raw", "", "Raw results file of connections and latencies of their messages, compact binary analyzed later by 'wsbm report'")
+	flagStatsd           = flag.String("statsd", "", "StatsD address the results of connections and samples of every -interval are sent to, eg: localhost:8125")
+	flagStatsdPrefix     = flag.String("statsd-prefix", "wsbm.", "Prefix of -statsd metric names")
+	flagStatsdTags       = flag.String("statsd-tags", "", "Comma separated DogStatsD tags of -statsd metrics, eg: env:staging,service:chat")
+	flagOTLP             = flag.String("otlp", "", "OTLP/HTTP endpoint traces of connections are exported to, handshakes send their traceparent, eg: http://localhost:4318")
+	flagOut              = stringsVar("out", "Stream results of connections and samples of every -interval, 1s by default, to an output, eg: influxdb=http://host:8086/db")
+	flagMetricsAddr      = flag.String("metrics-addr", "", "Listen address serving prometheus metrics on /metrics, eg: :9090")
+	flagPprofAddr        = flag.String("pprof-addr", "", "Listen address serving pprof profiles of wsbm itself on /debug/pprof/, eg: localhost:6060")
+	flagControlAddr      = flag.String("control-addr", "", "Listen address serving live stats on /stats and changing concurrency, rate, duration and pause by POST /controls, eg: localhost:9091")
+	flagReport           = flag.String("report", "", "Report format written after run, '':none, 'json' or 'html' page with charts")
+	flagReportFile       = flag.String("report-file", "-", "Report file, '-':stdout")
 )
 
-func logf(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", v...)
+func init() {
+	flag.DurationVar(flagDuration, "duration", 0, "Alias of -d")
+}
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+func stringsVar(name, usage string) *stringsFlag {
+	var v stringsFlag
+	flag.Var(&v, name, usage)
+	return &v
+}
+
+// sendMessages are -send and -send-binary messages in command line order.
+var sendMessages []wsbm.Message
+
+type messagesFlag struct {
+	binary bool
+}
+
+func (m messagesFlag) String() string { return "" }
+
+func (m messagesFlag) Set(v string) error {
+	if !m.binary {
+		sendMessages = append(sendMessages, wsbm.Message{Data: []byte(expandEnv(v))})
+		return nil
+	}
+	data, err := wsbm.ParsePayload(v)
+	if err != nil {
+		return err
+	}
+	sendMessages = append(sendMessages, wsbm.Message{Binary: true, Data: data})
+	return nil
+}
+
+func messagesVar(name string, binary bool, usage string) messagesFlag {
+	v := messagesFlag{binary: binary}
+	flag.Var(v, name, usage)
+	return v
+}
+
+// percentFlag is a percentage like '1%' or '1', negative means unset.
+type percentFlag float64
+
+func (p *percentFlag) String() string {
+	if p == nil || *p < 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*p), 'f', -1, 64) + "%"
+}
+
+func (p *percentFlag) Set(v string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+	if err != nil {
+		return err
+	}
+	*p = percentFlag(f)
+	return nil
+}
+
+func percentVar(name, usage string) *percentFlag {
+	v := percentFlag(-1)
+	flag.Var(&v, name, usage)
+	return &v
+}
+
+// loadConnectJitter parses -connect-jitter like '100..500ms', a single
+// duration is the max from 0.
+func loadConnectJitter() ([2]time.Duration, error) {
+	var jitter [2]time.Duration
+	if *flagConnectJitter == "" {
+		return jitter, nil
+	}
+	min, max, ok := strings.Cut(*flagConnectJitter, "..")
+	if !ok {
+		min, max = "0", min
+	}
+	var err error
+	if jitter[1], err = time.ParseDuration(strings.TrimSpace(max)); err != nil {
+		return jitter, fmt.Errorf("invalid connect jitter %q", *flagConnectJitter)
+	}
+	// the unit of max applies to min without one, like 100..500ms
+	min = strings.TrimSpace(min)
+	if jitter[0], err = time.ParseDuration(min); err != nil {
+		unit := strings.TrimLeft(strings.TrimSpace(max), "0123456789.")
+		if jitter[0], err = time.ParseDuration(min + unit); err != nil {
+			return jitter, fmt.Errorf("invalid connect jitter %q", *flagConnectJitter)
+		}
+	}
+	return jitter, nil
+}
+
+// loadNetworks returns the networks of -4 and -6.
+func loadNetworks() []string {
+	var networks []string
+	if *flagIPv4 {
+		networks = append(networks, "tcp4")
+	}
+	if *flagIPv6 {
+		networks = append(networks, "tcp6")
+	}
+	return networks
+}
+
+// parseResolve parses 'host:port:addr' overrides into addr by 'host:port',
+// ipv6 addrs may be in brackets.
+func parseResolve(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	resolve := make(map[string]string)
+	for _, v := range values {
+		host, rest, _ := strings.Cut(v, ":")
+		port, addr, ok := strings.Cut(rest, ":")
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil || !ok || host == "" || net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid resolve %q, want host:port:addr", v)
+		}
+		resolve[net.JoinHostPort(host, port)] = addr
+	}
+	return resolve, nil
+}
+
+// parseTags parses 'key=value' tags.
+func parseTags(values []string) (wsbm.Tags, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	tags := make(wsbm.Tags)
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, want key=value", v)
+		}
+		tags[key] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// parseLocalAddrs parses comma separated ips.
+func parseLocalAddrs(s string) ([]net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ips []net.IP
+	for _, v := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local addr %q", v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseCloseCodes parses comma separated close codes like '1000,1001'.
+func parseCloseCodes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var codes []int
+	for _, v := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid close code %q", v)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// parseByteRate parses bytes per second like '512', '64KB' or '1MB/s',
+// empty means no limit.
+func parseByteRate(v string) (float64, error) {
+	s := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(v), "/s"))
+	if s == "" {
+		return 0, nil
+	}
+	unit := 1.0
+	for _, u := range []struct {
+		suffix string
+		size   float64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte rate %q", v)
+	}
+	return n * unit, nil
+}
+
+// parseFraction parses a fraction like '1/100' or '0.01'.
+func parseFraction(v string) (float64, error) {
+	num, den, ok := strings.Cut(v, "/")
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || !ok {
+		return n, err
+	}
+	d, err := strconv.ParseFloat(strings.TrimSpace(den), 64)
+	if err != nil {
+		return 0, err
+	}
+	if d == 0 {
+		return 0, fmt.Errorf("invalid fraction %s", v)
+	}
+	return n / d, nil
+}
+
+func loadOutputFilter() (*wsbm.Assertion, error) {
+	if strings.HasPrefix(*flagOutputFilter, "$") {
+		return wsbm.NewAssertion("", *flagOutputFilter, false)
+	}
+	return wsbm.NewAssertion(*flagOutputFilter, "", false)
+}
+
+// logger logs to stderr, by -log-level and -log-format once set by
+// setLogger.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setLogger sets logger of level, debug, info, warn or error, and format,
+// text or json.
+func setLogger(level, format string) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		panic(fmt.Errorf("invalid log level %q", level))
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		panic(fmt.Errorf("unknown log format %q", format))
+	}
+}
+
+// logLevel returns -log-level, overridden by -quiet or -v.
+func logLevel() string {
+	switch {
+	case *flagVerbose:
+		return "debug"
+	case *flagQuiet:
+		return "warn"
+	default:
+		return *flagLogLevel
+	}
 }
 
-type discard struct{}
+// loadReadStall returns the read stall of -read-stall on the fraction of
+// connections of -read-stall-sample.
+func loadReadStall() (*wsbm.ReadStall, error) {
+	if *flagReadStall == "" {
+		return nil, nil
+	}
+	stall, err := wsbm.ParseReadStall(*flagReadStall)
+	if err != nil {
+		return nil, err
+	}
+	if stall.Fraction, err = parseFraction(*flagReadStallSample); err != nil {
+		return nil, err
+	}
+	return stall, nil
+}
+
+// loadShape returns the shape of -net-delay, -net-jitter, -net-loss and
+// -net-reset on the fraction of connections of -net-sample.
+func loadShape() (*wsbm.Shape, error) {
+	if *flagNetDelay == 0 && *flagNetJitter == 0 && *flagNetLoss == "" && *flagNetReset == "" {
+		return nil, nil
+	}
+	shape := &wsbm.Shape{Delay: *flagNetDelay, Jitter: *flagNetJitter}
+	var err error
+	if *flagNetLoss != "" {
+		if shape.Loss, err = parseFraction(*flagNetLoss); err != nil {
+			return nil, err
+		}
+	}
+	if *flagNetReset != "" {
+		if shape.Reset, err = parseFraction(*flagNetReset); err != nil {
+			return nil, err
+		}
+	}
+	if shape.Fraction, err = parseFraction(*flagNetSample); err != nil {
+		return nil, err
+	}
+	return shape, nil
+}
+
+// loadChaosDrop returns the drops of -chaos-drop by -chaos-mode.
+func loadChaosDrop() (*wsbm.ChaosDrop, error) {
+	if *flagChaosDrop == "" {
+		return nil, nil
+	}
+	drop, err := wsbm.ParseChaosDrop(*flagChaosDrop)
+	if err != nil {
+		return nil, err
+	}
+	drop.Mode = *flagChaosMode
+	drop.Reconnect = *flagChaosReconnect
+	return drop, nil
+}
+
+// fuzzCaseNames returns the names of fuzz cases separated by commas.
+func fuzzCaseNames() string {
+	names := make([]string, len(wsbm.FuzzCases))
+	for i, c := range wsbm.FuzzCases {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// loadTraceFrames returns the fraction of connections traced by -v.
+func loadTraceFrames() (float64, error) {
+	if !*flagVerbose {
+		return 0, nil
+	}
+	return parseFraction(*flagVerboseSample)
+}
 
-func (d discard) Close() error                      { return nil }
-func (d discard) Write(p []byte) (n int, err error) { return len(p), nil }
+func logf(format string, v ...interface{}) {
+	logger.Info(fmt.Sprintf(format, v...))
+}
 
 type stdout struct{}
 
@@ -46,8 +516,6 @@ func (s stdout) Write(p []byte) (n int, err error) {
 
 func openOutput(id int) (io.WriteCloser, error) {
 	switch *flagOutput {
-	case "":
-		return discard{}, nil
 	case "-":
 		return stdout{}, nil
 	default:
@@ -78,11 +546,15 @@ func loadQueries() ([]url.Values, error) {
 		return nil, nil
 	}
 
-	file, err := os.Open(*flagQueries)
+	data, err := os.ReadFile(*flagQueries)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	file := strings.NewReader(expandEnv(string(data)))
+
+	if strings.EqualFold(filepath.Ext(*flagQueries), ".csv") {
+		return loadCSVQueries(file)
+	}
 
 	var quries []url.Values
 	var q url.Values
@@ -113,149 +585,990 @@ func loadQueries() ([]url.Values, error) {
 	return quries, nil
 }
 
-type WsBenchmark struct {
-	url     string
-	queries []url.Values
-}
+// loadCSVQueries reads rows of a csv file, columns are named by header row.
+func loadCSVQueries(r io.Reader) ([]url.Values, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var queries []url.Values
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logf("parse csv row err:%s", err)
+			continue
+		}
 
-func NewWsBenchmark(url string, queries []url.Values) *WsBenchmark {
-	return &WsBenchmark{
-		url:     url,
-		queries: queries,
+		q := url.Values{}
+		for i, value := range row {
+			q.Set(header[i], value)
+		}
+		queries = append(queries, q)
 	}
+	return queries, nil
 }
 
-func (b *WsBenchmark) Run(request, concurrency int) {
-	var wg sync.WaitGroup
-	wg.Add(concurrency)
-
-	var count int32
-	for i := 0; i < concurrency; i++ {
-		go func() {
-			defer wg.Done()
-			for {
-				id := int(atomic.AddInt32(&count, 1))
-				if id > request {
-					return
-				}
+// loadTargets returns urls of arguments and -urls file, nil for a single
+// url argument.
+func loadTargets() ([]wsbm.Target, error) {
+	var targets []wsbm.Target
+	for _, arg := range flag.Args() {
+		targets = append(targets, wsbm.Target{URL: expandEnv(arg), Weight: 1})
+	}
 
-				if err := b.runTask(id); err != nil {
-					logf("run task %d err:%s", id, err)
-				} else {
-					logf("run task %d OK", id)
+	if *flagURLs != "" {
+		data, err := os.ReadFile(*flagURLs)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(expandEnv(string(data)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			target := wsbm.Target{URL: fields[0], Weight: 1}
+			if len(fields) > 1 {
+				if target.Weight, err = strconv.Atoi(fields[1]); err != nil {
+					return nil, fmt.Errorf("invalid weight of %s: %s", fields[0], err)
 				}
 			}
-		}()
+			targets = append(targets, target)
+		}
+	}
+
+	if len(targets) < 2 && *flagURLs == "" {
+		return nil, nil
 	}
-	wg.Wait()
+	return targets, nil
 }
 
-func (b *WsBenchmark) DryRun(request, concurrency int) {
-	for id := 1; id <= request; id++ {
-		url, err := b.getUrl(id)
-		if err != nil {
-			logf("get url %d err:%s", id, err)
-			continue
+func loadScenario() (*wsbm.Scenario, error) {
+	if *flagPattern != "" {
+		if *flagScenario != "" {
+			return nil, errors.New("-pattern and -scenario are exclusive")
 		}
-		logf("+ %d %s", id, url.String())
+		return wsbm.ParsePattern(*flagPattern, loadPatternMessage)
+	}
+	if *flagScenario == "" {
+		return nil, nil
 	}
-}
 
-func (b *WsBenchmark) getUrl(id int) (*url.URL, error) {
-	rawUrl := strings.Replace(b.url, "<id>", fmt.Sprint(id), -1)
+	data, err := os.ReadFile(*flagScenario)
+	if err != nil {
+		return nil, err
+	}
+	return wsbm.ParseScenario([]byte(expandEnv(string(data))))
+}
 
-	u, err := url.Parse(rawUrl)
+// loadPatternMessage returns the content of a send:file of -pattern, or
+// the argument itself when it's not a file.
+func loadPatternMessage(arg string) (string, error) {
+	data, err := os.ReadFile(arg)
 	if err != nil {
-		return nil, fmt.Errorf("parse url %s err:%s", rawUrl, err.Error())
+		if errors.Is(err, os.ErrNotExist) {
+			return arg, nil
+		}
+		return "", err
 	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: *flagInsecure}
 
-	if len(b.queries) > 0 {
-		newQuery := b.queries[id%len(b.queries)]
-		query := u.Query()
-		for name, value := range newQuery {
-			query[name] = value
+	if *flagCA != "" {
+		pem, err := os.ReadFile(*flagCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", *flagCA)
 		}
-		u.RawQuery = query.Encode()
 	}
 
-	switch u.Scheme {
-	case "http":
-		u.Scheme = "ws"
-	case "https":
-		u.Scheme = "wss"
-	default:
+	if *flagCert != "" || *flagKey != "" {
+		cert, err := tls.LoadX509KeyPair(*flagCert, *flagKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
+	return config, nil
+}
 
-	return u, nil
+func loadCookies() ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	for _, c := range *flagCookies {
+		name, value, ok := strings.Cut(c, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid cookie %q", c)
+		}
+		cookies = append(cookies, &http.Cookie{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return cookies, nil
 }
 
-func (b *WsBenchmark) runTask(id int) error {
-	url, err := b.getUrl(id)
-	if err != nil {
-		return err
+func loadPreRequest() (*wsbm.PreRequest, error) {
+	if *flagPreURL == "" {
+		return nil, nil
 	}
 
-	output, err := openOutput(id)
+	header, err := parseHeaders(*flagPreHeaders)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	p := &wsbm.PreRequest{
+		Method:  *flagPreMethod,
+		URL:     *flagPreURL,
+		Header:  header,
+		Body:    *flagPreBody,
+		Extract: make(map[string]string),
+	}
+	for _, e := range *flagPreExtract {
+		name, from, ok := strings.Cut(e, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid extract %q", e)
+		}
+		p.Extract[name] = strings.TrimSpace(from)
 	}
-	defer output.Close()
+	return p, nil
+}
 
-	logf("+ %d %s", id, url.String())
+func loadSigV4() (*wsbm.SigV4, error) {
+	if !*flagAWSSigV4 {
+		return nil, nil
+	}
+	s := &wsbm.SigV4{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Region:       *flagAWSRegion,
+		Service:      *flagAWSService,
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required by -aws-sigv4")
+	}
+	if s.Region == "" {
+		return nil, fmt.Errorf("-aws-region is required by -aws-sigv4")
+	}
+	return s, nil
+}
 
-	h := http.Header{"Origin": {"http://" + url.Host}}
-	conn, _, err := websocket.DefaultDialer.Dial(url.String(), h)
+// loadKeepalive returns -keepalive-msg, nil if not set.
+func loadKeepalive() (*wsbm.Message, error) {
+	spec := *flagKeepaliveMsg
+	if spec == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(spec, "hex:") && !strings.HasPrefix(spec, "base64:") {
+		return &wsbm.Message{Data: []byte(spec)}, nil
+	}
+	data, err := wsbm.ParsePayload(spec)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer conn.Close()
+	return &wsbm.Message{Binary: true, Data: data}, nil
+}
 
-	for {
-		msgType, content, err := conn.ReadMessage()
-		if err != nil {
-			return err
+// loadGolden returns frames of -expect-file, nil if not set.
+func loadGolden() ([]wsbm.Frame, error) {
+	if *flagExpectFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(*flagExpectFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames, err := wsbm.ReadFrames(f)
+	if err != nil {
+		return nil, err
+	}
+	if frames == nil {
+		frames = []wsbm.Frame{}
+	}
+	return frames, nil
+}
+
+// loadSubscribe returns -subscribe channels, '@file' is read as a query.
+func loadSubscribe() ([]string, error) {
+	var channels []string
+	for _, v := range *flagSubscribe {
+		if strings.HasPrefix(v, "@") {
+			data, err := os.ReadFile(v[1:])
+			if err != nil {
+				return nil, err
+			}
+			v = string(data)
 		}
-		switch msgType {
-		case websocket.TextMessage, websocket.BinaryMessage:
-			output.Write(content)
+		channels = append(channels, v)
+	}
+	return channels, nil
+}
+
+func loadHeaders() (http.Header, error) {
+	return parseHeaders(*flagHeaders)
+}
+
+func parseHeaders(lines []string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q", line)
 		}
+		header.Add(name, expandEnv(strings.TrimSpace(value)))
 	}
+	return header, nil
 }
 
 func main() {
 	flag.Usage = func() {
-		const usage = `Usage: wsbm [options] <url>
+		const usage = `Usage: wsbm [run] [options] <url>...
+       wsbm [run] -f wsbm.yaml [options] [url]...
+       wsbm serve [options]
+       wsbm report [-format html] [options] report.json
+       wsbm report [-window 1m..5m] [-sections 4] [-tag k=v] [-url regexp] [options] results.raw...
+       wsbm compare [options] baseline.json current.json
+       wsbm record -file frames.jsonl [options] <url>
+       wsbm replay -file frames.jsonl [-speed 1] [options] <url>
+       wsbm conformance [-case name] [options] <url>
+       wsbm agent -token token [-addr localhost:7070]
+       wsbm coordinator -agents host:7070,... -agent-token token [options] <url>
     '<id>' in url will be replace by connection id
+    url, -H values and sent messages are templates supporting {{.ID}},
+    {{uuid}}, {{randInt 1 100}}, {{timestamp}} and {{.name}} of -q values
+    ${NAME} in urls, -H and -send values and -f, -q, -urls and -scenario
+    files is replaced by environment variable NAME
+    SIGUSR1 pauses new connections and sends of a run, the next one resumes
 options:`
 		fmt.Fprintln(os.Stderr, usage)
 		flag.PrintDefaults()
 	}
-	flag.Parse()
 
-	if flag.Arg(0) == "" {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			command(args[1:])
+			return
+		}
+	}
+	runMain(args)
+}
+
+// commands are subcommands by name, 'wsbm <url>' runs 'wsbm run <url>'.
+var commands = map[string]func(args []string){
+	"run":         runMain,
+	"serve":       serveMain,
+	"report":      reportMain,
+	"compare":     compareMain,
+	"record":      recordMain,
+	"replay":      replayMain,
+	"conformance": conformanceMain,
+	"agent":       agentMain,
+	"coordinator": coordinatorMain,
+}
+
+// runMain runs the benchmark of options and urls of args.
+func runMain(args []string) {
+	parseFlags(args)
+	run(nil)
+}
+
+// run runs the benchmark of flags, configure changes options of
+// subcommands running it.
+func run(configure func(opts *wsbm.Options) error) {
+	setLogger(logLevel(), *flagLogFormat)
+	if flag.Arg(0) == "" && *flagURLs == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	targets, err := loadTargets()
+	if err != nil {
+		panic(err)
+	}
+
 	queries, err := loadQueries()
 	if err != nil {
 		panic(err)
 	}
 
-	request := int(*flagRequest)
-	concurrency := int(*flagConcurrency)
-	if request < 1 && len(queries) > 0 {
-		request = len(queries)
+	header, err := loadHeaders()
+	if err != nil {
+		panic(err)
 	}
-	if request < concurrency {
-		request = concurrency
+
+	subscribe, err := loadSubscribe()
+	if err != nil {
+		panic(err)
 	}
-	logf("request: %d, concurrency:%d", request, concurrency)
 
-	bm := NewWsBenchmark(flag.Arg(0), queries)
+	keepalive, err := loadKeepalive()
+	if err != nil {
+		panic(err)
+	}
+
+	cookies, err := loadCookies()
+	if err != nil {
+		panic(err)
+	}
+
+	preRequest, err := loadPreRequest()
+	if err != nil {
+		panic(err)
+	}
+
+	sigv4, err := loadSigV4()
+	if err != nil {
+		panic(err)
+	}
+
+	var jar http.CookieJar
+	if *flagCookieJar {
+		if jar, err = cookiejar.New(nil); err != nil {
+			panic(err)
+		}
+	}
+
+	scenario, err := loadScenario()
+	if err != nil {
+		panic(err)
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	expect, err := wsbm.NewAssertion(*flagExpectRegex, *flagExpectJSONPath, *flagExpectFirst)
+	if err != nil {
+		panic(err)
+	}
+
+	correlateSend, correlateRecv, err := wsbm.ParseCorrelation(*flagCorrelateSend, *flagCorrelateRecv)
+	if err != nil {
+		panic(err)
+	}
+
+	golden, err := loadGolden()
+	if err != nil {
+		panic(err)
+	}
+
+	var schema *wsbm.Schema
+	if *flagValidateSchema != "" {
+		data, err := os.ReadFile(*flagValidateSchema)
+		if err != nil {
+			panic(err)
+		}
+		if schema, err = wsbm.ParseSchema(data); err != nil {
+			panic(err)
+		}
+	}
+
+	connectJitter, err := loadConnectJitter()
+	if err != nil {
+		panic(err)
+	}
+
+	var arrival *wsbm.Arrival
+	if *flagArrival != "" {
+		if arrival, err = wsbm.ParseArrival(*flagArrival); err != nil {
+			panic(err)
+		}
+	}
+
+	var autoTune *wsbm.AutoTune
+	if *flagAutoTune != "" {
+		if autoTune, err = wsbm.ParseAutoTune(*flagAutoTune); err != nil {
+			panic(err)
+		}
+		autoTune.Window = *flagAutoTuneWindow
+	}
+
+	var findMax *wsbm.FindMax
+	if *flagFindMax {
+		findMax = &wsbm.FindMax{
+			Batch:        int(*flagFindMaxBatch),
+			Interval:     *flagFindMaxInterval,
+			MaxErrorRate: *flagFindMaxErrors,
+			MaxP99:       *flagFindMaxP99,
+		}
+	}
+
+	var think *wsbm.Think
+	if *flagThink != "" {
+		if think, err = wsbm.ParseThink(*flagThink); err != nil {
+			panic(err)
+		}
+	}
+
+	var classify *wsbm.JSONPath
+	if *flagClassify != "" {
+		if classify, err = wsbm.ParseJSONPath(*flagClassify); err != nil {
+			panic(err)
+		}
+	}
+
+	var seqJSONPath *wsbm.JSONPath
+	if *flagSeqJSONPath != "" {
+		if seqJSONPath, err = wsbm.ParseJSONPath(*flagSeqJSONPath); err != nil {
+			panic(err)
+		}
+	}
+
+	fanoutTs, err := wsbm.ParseJSONPath(*flagFanoutTs)
+	if err != nil {
+		panic(err)
+	}
+
+	ramp, err := loadRamp()
+	if err != nil {
+		panic(err)
+	}
+
+	outputFilter, err := loadOutputFilter()
+	if err != nil {
+		panic(err)
+	}
+
+	maxRecvRate, err := parseByteRate(*flagMaxRecvRate)
+	if err != nil {
+		panic(err)
+	}
+	maxSendRate, err := parseByteRate(*flagMaxSendRate)
+	if err != nil {
+		panic(err)
+	}
+	readStall, err := loadReadStall()
+	if err != nil {
+		panic(err)
+	}
+	shape, err := loadShape()
+	if err != nil {
+		panic(err)
+	}
+	chaosDrop, err := loadChaosDrop()
+	if err != nil {
+		panic(err)
+	}
+
+	var outputSample float64
+	if *flagOutputSample != "" {
+		if outputSample, err = parseFraction(*flagOutputSample); err != nil {
+			panic(err)
+		}
+	}
+
+	var proxy *url.URL
+	if *flagProxy != "" {
+		if proxy, err = url.Parse(*flagProxy); err != nil {
+			panic(err)
+		}
+	}
+
+	localAddrs, err := parseLocalAddrs(*flagLocalAddrs)
+	if err != nil {
+		panic(err)
+	}
+	resolve, err := parseResolve(*flagResolve)
+	if err != nil {
+		panic(err)
+	}
+	expectClose, err := parseCloseCodes(*flagExpectClose)
+	if err != nil {
+		panic(err)
+	}
+	traceFrames, err := loadTraceFrames()
+	if err != nil {
+		panic(err)
+	}
+
+	request, concurrency := counts(queries, ramp)
+	logf("request: %d, concurrency:%d, duration:%s", request, concurrency, *flagDuration)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	token, err := loadToken(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	opts := wsbm.Options{
+		URL:              expandEnv(flag.Arg(0)),
+		Targets:          targets,
+		Queries:          queries,
+		QueryVars:        *flagQueryVars,
+		Feed:             *flagFeed,
+		FeedSeed:         *flagFeedSeed,
+		Header:           header,
+		Cookies:          cookies,
+		Jar:              jar,
+		PreRequest:       preRequest,
+		SigV4:            sigv4,
+		Requests:         request,
+		Concurrency:      concurrency,
+		Duration:         *flagDuration,
+		Rate:             *flagRate,
+		ConnectJitter:    connectJitter,
+		Arrival:          arrival,
+		MaxInflight:      int(*flagMaxInflight),
+		ArrivalSeed:      *flagArrivalSeed,
+		AutoTune:         autoTune,
+		FindMax:          findMax,
+		Ramp:             ramp,
+		Scenario:         scenario,
+		Hold:             *flagHold,
+		Engine:           *flagEngine,
+		Churn:            int(*flagChurn),
+		Publishers:       int(*flagPublishers),
+		PublishInterval:  *flagPublishInterval,
+		FanoutMessage:    *flagFanoutMsg,
+		FanoutTs:         fanoutTs,
+		Echo:             *flagEcho,
+		Fuzz:             *flagFuzz,
+		FuzzCases:        *flagFuzzCases,
+		Messages:         sendMessages,
+		SendInterval:     *flagSendInterval,
+		Think:            think,
+		ThinkSeed:        *flagThinkSeed,
+		MaxMessages:      int(*flagMessages),
+		Expect:           expect,
+		CorrelateSend:    correlateSend,
+		CorrelateRecv:    correlateRecv,
+		SeqJSONPath:      seqJSONPath,
+		Golden:           golden,
+		GoldenNormalize:  *flagExpectNormalize,
+		Schema:           schema,
+		Classify:         classify,
+		HandshakeTimeout: *flagHandshakeTimeout,
+		ReadTimeout:      *flagReadTimeout,
+		Retries:          int(*flagRetries),
+		RetryBackoff:     *flagRetryBackoff,
+		PingInterval:     *flagPingInterval,
+		PingTimeout:      *flagPingTimeout,
+		KeepaliveMessage: keepalive,
+		KeepalivePeriod:  *flagKeepalivePeriod,
+		CloseMode:        *flagCloseMode,
+		CloseCode:        *flagCloseCode,
+		CloseReason:      *flagCloseReason,
+		CloseTimeout:     *flagCloseTimeout,
+		ExpectClose:      expectClose,
+		Protocol:         *flagProtocol,
+		Subscribe:        subscribe,
+		Publish:          *flagPublish,
+		MQTTVersion:      *flagMQTTVersion,
+		QoS:              *flagQoS,
+		Compress:         *flagCompress,
+		HTTP2:            *flagHTTP2,
+		ReadBufferSize:   int(*flagReadBuffer),
+		WriteBufferSize:  int(*flagWriteBuffer),
+		MaxRecvRate:      maxRecvRate,
+		MaxSendRate:      maxSendRate,
+		ReadStall:        readStall,
+		Shape:            shape,
+		ChaosDrop:        chaosDrop,
+		TLSConfig:        tlsConfig,
+		Proxy:            proxy,
+		Resolve:          resolve,
+		DNSServer:        *flagDNSServer,
+		Networks:         loadNetworks(),
+		LocalAddrs:       localAddrs,
+		OutputFormat:     *flagOutputFormat,
+		OutputFilter:     outputFilter,
+		OutputSample:     outputSample,
+		OutputHash:       *flagOutputHash,
+		Interval:         *flagInterval,
+		Logger:           logger,
+		TraceFrames:      traceFrames,
+	}
+	var shared *sharedOutput
+	switch {
+	case *flagOutput == "":
+	case *flagOutput != "-" && *flagOutputShards > 0 && !*flagDryRun:
+		if shared, err = createSharedOutput(*flagOutput, *flagOutputShards, *flagOutputFormat != "jsonl" && !*flagOutputHash); err != nil {
+			panic(err)
+		}
+		opts.Output = shared.open
+	default:
+		opts.Output = openOutput
+	}
+	if token != nil {
+		opts.Token = token.Token
+	}
+	if *flagUI && !*flagDryRun {
+		opts.Dashboard = os.Stderr
+	} else if *flagProgress && !*flagDryRun && isTerminal(os.Stderr) {
+		opts.Progress = os.Stderr
+	}
+	if configure != nil {
+		if err := configure(&opts); err != nil {
+			panic(err)
+		}
+	}
+
+	tags, err := parseTags(*flagTags)
+	if err != nil {
+		panic(err)
+	}
+	var onResult []func(wsbm.ConnResult)
+	var onSample []func(wsbm.Sample)
+	var results *csvWriter
+	if *flagCSV != "" && !*flagDryRun {
+		if results, err = createCSV(*flagCSV); err != nil {
+			panic(err)
+		}
+		onResult = append(onResult, results.Write)
+	}
+	var raw *os.File
+	var rawWriter *wsbm.RawWriter
+	if *flagRaw != "" && !*flagDryRun {
+		if raw, err = os.Create(*flagRaw); err != nil {
+			panic(err)
+		}
+		if rawWriter, err = wsbm.NewRawWriter(raw, tags); err != nil {
+			panic(err)
+		}
+		onResult = append(onResult, rawWriter.Write)
+		opts.OnLatency = rawWriter.WriteLatency
+	}
+	var influx *influxWriter
+	for _, out := range *flagOut {
+		if *flagDryRun {
+			break
+		}
+		kind, addr, ok := strings.Cut(out, "=")
+		switch {
+		case !ok || addr == "":
+			panic(fmt.Errorf("invalid -out %q, want kind=address", out))
+		case kind == "influxdb":
+			if influx, err = newInfluxWriter(addr, tags); err != nil {
+				panic(err)
+			}
+			onResult = append(onResult, influx.WriteResult)
+			onSample = append(onSample, influx.WriteSample)
+		default:
+			panic(fmt.Errorf("unknown -out %s", kind))
+		}
+	}
+	var statsd *statsdWriter
+	if *flagStatsd != "" && !*flagDryRun {
+		var statsdTags []string
+		if *flagStatsdTags != "" {
+			statsdTags = strings.Split(*flagStatsdTags, ",")
+		}
+		for _, k := range tags.Keys() {
+			statsdTags = append(statsdTags, k+":"+tags[k])
+		}
+		if statsd, err = newStatsdWriter(*flagStatsd, *flagStatsdPrefix, statsdTags); err != nil {
+			panic(err)
+		}
+		onResult = append(onResult, statsd.WriteResult)
+		onSample = append(onSample, statsd.WriteSample)
+	}
+	var otlp *otlpExporter
+	if *flagOTLP != "" && !*flagDryRun {
+		otlp = newOTLPExporter(*flagOTLP, tags)
+		onResult = append(onResult, otlp.WriteResult)
+		opts.Traceparent = true
+	}
+	if len(onResult) > 0 {
+		opts.OnResult = func(r wsbm.ConnResult) {
+			for _, f := range onResult {
+				f(r)
+			}
+		}
+	}
+	if len(onSample) > 0 {
+		opts.SampleInterval = *flagInterval
+		opts.OnSample = func(s wsbm.Sample) {
+			for _, f := range onSample {
+				f(s)
+			}
+		}
+	}
+	var dump *os.File
+	if *flagHandshakeDump != "" && !*flagDryRun {
+		if dump, err = os.Create(*flagHandshakeDump); err != nil {
+			panic(err)
+		}
+		opts.HandshakeDump = dump
+		opts.HandshakeDumps = int(*flagHandshakeDumps)
+	}
+
+	bm, err := wsbm.New(opts)
+	if err != nil {
+		panic(err)
+	}
 	if *flagDryRun {
-		bm.DryRun(request, concurrency)
-	} else {
-		bm.Run(request, concurrency)
+		for id := 1; id <= opts.Requests; id++ {
+			url, err := bm.URL(id)
+			if err != nil {
+				logf("get url %d err:%s", id, err)
+				continue
+			}
+			logf("+ %d %s", id, url.String())
+		}
+		return
 	}
+
+	if *flagMetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", bm.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(*flagMetricsAddr, mux); err != nil {
+				logf("serve metrics err:%s", err)
+			}
+		}()
+	}
+	if *flagControlAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*flagControlAddr, bm.ControlHandler()); err != nil {
+				logf("serve control err:%s", err)
+			}
+		}()
+	}
+	go handlePause(ctx, bm)
+	if *flagPprofAddr != "" {
+		go servePprof(*flagPprofAddr)
+	}
+
+	result := bm.Run(ctx)
+	if shared != nil {
+		if err := shared.Close(); err != nil {
+			logf("write output err:%s", err)
+		}
+	}
+	if results != nil {
+		if err := results.Close(); err != nil {
+			logf("write csv err:%s", err)
+		}
+	}
+	if raw != nil {
+		err := rawWriter.Flush()
+		if closeErr := raw.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logf("write raw results err:%s", err)
+		}
+	}
+	if influx != nil {
+		influx.Close()
+	}
+	if statsd != nil {
+		statsd.Close()
+	}
+	if otlp != nil {
+		otlp.Close()
+	}
+	if dump != nil {
+		if err := dump.Close(); err != nil {
+			logf("write handshake dump err:%s", err)
+		}
+	}
+	finish(result)
+}
+
+func loadRamp() ([]wsbm.Stage, error) {
+	if *flagRamp == "" {
+		return nil, nil
+	}
+	return wsbm.ParseRamp(*flagRamp)
+}
+
+// counts returns total requests and concurrency of flags, requests are 0
+// when running until duration elapsed.
+func counts(queries []url.Values, ramp []wsbm.Stage) (request, concurrency int) {
+	request = int(*flagRequest)
+	concurrency = int(*flagConcurrency)
+	if *flagFindMax {
+		// find max runs until a batch fails or -n connections
+		return request, concurrency
+	}
+	if *flagHold && request > concurrency {
+		concurrency = request
+	}
+	if (*flagDuration <= 0 && ramp == nil) || request > 0 || *flagDryRun || *flagFeed == "once" {
+		if request < 1 && len(queries) > 0 {
+			request = len(queries)
+		}
+		if request < concurrency {
+			request = concurrency
+		}
+	}
+	return request, concurrency
+}
+
+// isTerminal tells whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// signalContext returns a context cancelled by the first signal, which
+// stops running tasks and prints the summary, the next one kills the
+// process as usual.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// servePprof serves profiles of the process on /debug/pprof/ of addr.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logf("serve pprof err:%s", err)
+	}
+}
+
+// handlePause pauses bm on pauseSignal and resumes it on the next one,
+// until ctx is done.
+func handlePause(ctx context.Context, bm *wsbm.Benchmark) {
+	if pauseSignal == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, pauseSignal)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if bm.Paused() {
+				bm.Resume()
+			} else {
+				bm.Pause()
+			}
+		}
+	}
+}
+
+// finish writes the summary and reports of result, and exits with code 2
+// when thresholds are violated.
+func finish(result *wsbm.Result) {
+	tags, err := parseTags(*flagTags)
+	if err != nil {
+		panic(err)
+	}
+	for k, v := range tags {
+		if result.Tags == nil {
+			result.Tags = make(wsbm.Tags)
+		}
+		result.Tags[k] = v
+	}
+	result.Write(os.Stderr)
+	if err := writeReport(result); err != nil {
+		logf("write report err:%s", err)
+	}
+	if *flagHgrm != "" {
+		if err := writeHgrm(*flagHgrm, result); err != nil {
+			logf("write hgrm err:%s", err)
+		}
+	}
+
+	violations := result.Violations(wsbm.Thresholds{
+		MaxErrorRate:      float64(*flagMaxErrorRate),
+		MaxP99:            *flagMaxP99,
+		MaxAssertFailRate: *flagExpectMaxFail,
+	})
+	for _, v := range violations {
+		logf("threshold violated: %s", v)
+	}
+	if len(violations) > 0 {
+		os.Exit(2)
+	}
+}
+
+func writeHgrm(prefix string, result *wsbm.Result) error {
+	latencies := map[string]wsbm.LatencySummary{
+		"pre_request":   result.PreRequest,
+		"handshake":     result.Handshake,
+		"dns":           result.DNS,
+		"tcp_connect":   result.TCP,
+		"tls_handshake": result.TLS,
+		"upgrade":       result.Upgrade,
+		"proxy_connect": result.ProxyConnect,
+		"first_message": result.FirstMessage,
+		"rtt":           result.RTT,
+		"pong_rtt":      result.PongRTT,
+		"reply":         result.Reply,
+		"fanout":        result.Fanout.Latency,
+		"arrival_lag":   result.Arrival.Lag,
+	}
+	for _, step := range result.Steps {
+		name := strings.Map(func(r rune) rune {
+			if r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return '_'
+		}, step.Name)
+		latencies["step_"+name] = step.Latency
+	}
+
+	for name, l := range latencies {
+		if l.Count == 0 || l.Histogram == nil {
+			continue
+		}
+		file, err := os.Create(fmt.Sprintf("%s.%s.hgrm", prefix, name))
+		if err != nil {
+			return err
+		}
+		err = l.WriteHgrm(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeReport(result *wsbm.Result) error {
+	var write func(w io.Writer) error
+	switch *flagReport {
+	case "":
+		return nil
+	case "json":
+		write = result.WriteJSON
+	case "html":
+		write = result.WriteHTML
+	default:
+		return fmt.Errorf("unknown report format %s", *flagReport)
+	}
+
+	if *flagReportFile == "-" {
+		return write(os.Stdout)
+	}
+
+	file, err := os.Create(*flagReportFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return write(file)
 }
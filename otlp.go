@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+const (
+	// otlpFlushInterval is how often spans are exported, sooner when
+	// otlpFlushSpans are buffered.
+	otlpFlushInterval = time.Second
+	otlpFlushSpans    = 2048
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindClient  = 3
+	otlpStatusError = 2
+)
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Events       []otlpEvent     `json:"events,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	Time       string          `json:"timeUnixNano"`
+	Name       string          `json:"name"`
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// otlpInt encodes int values as strings like OTLP JSON does for 64 bits.
+func otlpInt(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpSpanID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// otlpExporter exports a trace per connection to an OTLP/HTTP collector
+// as JSON. The span of the connection is the parent of the traceparent
+// sent by its handshake, its children are phases of the handshake.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+	// resource are attributes of the service, with tags of the run.
+	resource []otlpAttribute
+
+	mu    sync.Mutex
+	spans []otlpSpan
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newOTLPExporter exports spans to endpoint, eg: http://localhost:4318,
+// at its /v1/traces path if it has none. Tags are resource attributes
+// prefixed by 'wsbm.tag.'.
+func newOTLPExporter(endpoint string, tags wsbm.Tags) *otlpExporter {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	e := &otlpExporter{
+		url:     endpoint,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	e.resource = []otlpAttribute{otlpString("service.name", "wsbm")}
+	for _, k := range tags.Keys() {
+		e.resource = append(e.resource, otlpString("wsbm.tag."+k, tags[k]))
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+// WriteResult adds the spans of the connection of r, connections dialed
+// without traceparent are left out.
+func (e *otlpExporter) WriteResult(r wsbm.ConnResult) {
+	if r.TraceID == "" || r.Start.IsZero() {
+		return
+	}
+	end := r.Start.Add(r.Duration)
+	if r.Duration <= 0 {
+		end = r.Start.Add(r.Handshake)
+	}
+	root := otlpSpan{
+		TraceID: r.TraceID,
+		SpanID:  r.SpanID,
+		Name:    "websocket",
+		Kind:    otlpKindClient,
+		Start:   otlpTime(r.Start),
+		End:     otlpTime(end),
+		Attributes: []otlpAttribute{
+			otlpString("url.full", r.URL),
+			otlpInt("wsbm.connection", int64(r.ID)),
+			otlpInt("wsbm.messages", r.Messages),
+			otlpInt("wsbm.bytes", r.Bytes),
+		},
+	}
+	if r.RTT.Count > 0 {
+		root.Attributes = append(root.Attributes,
+			otlpInt("wsbm.rtt.count", int64(r.RTT.Count)),
+			otlpInt("wsbm.rtt.p50_us", r.RTT.P50.Microseconds()),
+			otlpInt("wsbm.rtt.p99_us", r.RTT.P99.Microseconds()),
+			otlpInt("wsbm.rtt.max_us", r.RTT.Max.Microseconds()))
+	}
+	if r.FirstMessage > 0 {
+		root.Events = append(root.Events, otlpEvent{Time: otlpTime(r.Start.Add(r.FirstMessage)), Name: "first message"})
+	}
+	if r.Close != "" {
+		root.Events = append(root.Events, otlpEvent{
+			Time:       otlpTime(end),
+			Name:       "close",
+			Attributes: []otlpAttribute{otlpString("wsbm.close", r.Close)},
+		})
+	}
+	if r.Err != nil {
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: r.Err.Error()}
+	}
+	spans := []otlpSpan{root}
+
+	// phases follow each other from the start of the dial, the upgrade
+	// ends the handshake.
+	child := func(name string, start time.Time, d time.Duration) {
+		spans = append(spans, otlpSpan{
+			TraceID:      r.TraceID,
+			SpanID:       otlpSpanID(),
+			ParentSpanID: r.SpanID,
+			Name:         name,
+			Kind:         otlpKindClient,
+			Start:        otlpTime(start),
+			End:          otlpTime(start.Add(d)),
+		})
+	}
+	at := r.Start
+	for _, phase := range []struct {
+		name string
+		d    time.Duration
+	}{{"dns", r.DNS}, {"tcp connect", r.TCP}, {"tls handshake", r.TLS}} {
+		if phase.d > 0 {
+			child(phase.name, at, phase.d)
+			at = at.Add(phase.d)
+		}
+	}
+	if r.Upgrade > 0 && r.Handshake > 0 {
+		child("upgrade", r.Start.Add(r.Handshake-r.Upgrade), r.Upgrade)
+	}
+
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	full := len(e.spans) >= otlpFlushSpans
+	e.mu.Unlock()
+	if full {
+		e.flush()
+	}
+}
+
+// flush exports buffered spans, they are dropped when the export fails.
+func (e *otlpExporter) flush() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": e.resource,
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "wsbm"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Warn("export otlp", "err", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("export otlp", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		logger.Warn("export otlp", "status", resp.Status, "body", strings.TrimSpace(string(msg)))
+	}
+}
+
+// Close exports spans left.
+func (e *otlpExporter) Close() error {
+	close(e.done)
+	<-e.stopped
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// pauseSignal is only SIGUSR1 on unix, runs are paused by the control API
+// elsewhere.
+var pauseSignal os.Signal
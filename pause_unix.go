@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignal pauses a run and resumes it when sent again.
+var pauseSignal os.Signal = syscall.SIGUSR1
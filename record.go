@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+// recordMain records received frames of one connection to a file.
+func recordMain(args []string) {
+	file := flag.String("file", "", "File of recorded frames, JSON lines")
+	parseFlags(args)
+	if *file == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	run(func(opts *wsbm.Options) error {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		opts.Requests = 1
+		opts.Concurrency = 1
+		opts.Record = true
+		opts.Output = func(id int) (io.WriteCloser, error) {
+			return f, nil
+		}
+		return nil
+	})
+}
+
+// replayMain sends recorded frames to the server keeping their timing.
+func replayMain(args []string) {
+	file := flag.String("file", "", "File of recorded frames, JSON lines")
+	speed := flag.Float64("speed", 1, "Replay speed factor of recorded timing, 0 sends frames without delay")
+	parseFlags(args)
+	if *file == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	run(func(opts *wsbm.Options) error {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		opts.Replay, err = wsbm.ReadFrames(f)
+		opts.ReplaySpeed = *speed
+		return err
+	})
+}
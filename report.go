@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+// reportMain writes the summary and -report of a JSON report or raw
+// results of former runs, and checks it against thresholds like the run
+// did. Raw results are analyzed again, of files with -tag tags, within
+// -window, of urls matching -url and by -sections.
+func reportMain(args []string) {
+	format := flag.String("format", "", "Report format, 'json' or 'html', like -report")
+	window := flag.String("window", "", "Time window of raw results from the first connection, eg: 30s..5m, 1m.. or ..90s")
+	urlFilter := flag.String("url", "", "Regexp of urls of connections of raw results, eg: /room/1$")
+	sections := flag.Int("sections", 0, "Split the window of raw results in sections compared side by side")
+	parseFlags(args)
+	if *format != "" {
+		*flagReport = *format
+	}
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	setLogger(logLevel(), *flagLogFormat)
+
+	tags, err := parseTags(*flagTags)
+	if err != nil {
+		panic(err)
+	}
+	var urlRe *regexp.Regexp
+	if *urlFilter != "" {
+		if urlRe, err = regexp.Compile(*urlFilter); err != nil {
+			panic(fmt.Errorf("invalid -url: %w", err))
+		}
+	}
+	var from, to time.Duration
+	if *window != "" {
+		if from, to, err = parseWindow(*window); err != nil {
+			panic(err)
+		}
+	}
+
+	var merged *wsbm.RawResults
+	for _, path := range flag.Args() {
+		raw, err := readRaw(path)
+		if errors.Is(err, wsbm.ErrNotRaw) && flag.NArg() == 1 {
+			file, err := os.Open(path)
+			if err != nil {
+				panic(err)
+			}
+			result, err := wsbm.ReadJSON(file)
+			file.Close()
+			if err != nil {
+				panic(err)
+			}
+			finish(result)
+			return
+		}
+		if err != nil {
+			panic(fmt.Errorf("%s: %w", path, err))
+		}
+		if !hasTags(raw.Tags, tags) {
+			continue
+		}
+		// windows and urls are filtered by file, ids of connections are
+		// only unique in their run.
+		if urlRe != nil {
+			raw = wsbm.FilterRawURL(raw, urlRe)
+		}
+		if *window != "" {
+			raw = wsbm.FilterRaw(raw, from, to)
+		}
+		merged = mergeRaw(merged, raw)
+	}
+	if merged == nil {
+		panic(fmt.Errorf("no raw results with tags %s", strings.Join(*flagTags, ", ")))
+	}
+	if *sections > 1 {
+		writeSections(os.Stderr, merged, *sections)
+	}
+	result := wsbm.Analyze(merged, time.Second)
+	result.Tags = merged.Tags
+	finish(result)
+}
+
+// readRaw reads the raw results at path.
+func readRaw(path string) (*wsbm.RawResults, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return wsbm.ReadRaw(file)
+}
+
+// hasTags reports whether tags has all of want.
+func hasTags(tags, want wsbm.Tags) bool {
+	for k, v := range want {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRaw returns raw results of a and b, tagged by their common tags.
+// Connections of b are numbered after those of a, so ids stay unique.
+func mergeRaw(a, b *wsbm.RawResults) *wsbm.RawResults {
+	if a == nil {
+		return b
+	}
+	var offset int
+	for _, r := range a.Results {
+		if r.ID > offset {
+			offset = r.ID
+		}
+	}
+	merged := &wsbm.RawResults{
+		Results:   append(a.Results, b.Results...),
+		Latencies: append(a.Latencies, b.Latencies...),
+	}
+	for i := len(a.Results); i < len(merged.Results); i++ {
+		merged.Results[i].ID += offset
+	}
+	for i := len(a.Latencies); i < len(merged.Latencies); i++ {
+		merged.Latencies[i].ID += offset
+	}
+	for k, v := range a.Tags {
+		if b.Tags[k] == v {
+			if merged.Tags == nil {
+				merged.Tags = make(wsbm.Tags)
+			}
+			merged.Tags[k] = v
+		}
+	}
+	return merged
+}
+
+// parseWindow parses a window 'from..to' of durations, either may be left
+// out.
+func parseWindow(window string) (from, to time.Duration, err error) {
+	start, end, ok := strings.Cut(window, "..")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid window %q, want from..to", window)
+	}
+	if start = strings.TrimSpace(start); start != "" {
+		if from, err = time.ParseDuration(start); err != nil {
+			return 0, 0, fmt.Errorf("invalid window %q: %s", window, err)
+		}
+	}
+	if end = strings.TrimSpace(end); end != "" {
+		if to, err = time.ParseDuration(end); err != nil {
+			return 0, 0, fmt.Errorf("invalid window %q: %s", window, err)
+		}
+	}
+	if to > 0 && to <= from {
+		return 0, 0, fmt.Errorf("invalid window %q, ends before it starts", window)
+	}
+	return from, to, nil
+}
+
+// writeSections writes a line of results of each of n sections of equal
+// time of results.
+func writeSections(w io.Writer, raw *wsbm.RawResults, n int) {
+	var first, last time.Time
+	for _, r := range raw.Results {
+		if r.Start.IsZero() {
+			continue
+		}
+		if first.IsZero() || r.Start.Before(first) {
+			first = r.Start
+		}
+		if r.Start.After(last) {
+			last = r.Start
+		}
+	}
+	if first.IsZero() {
+		return
+	}
+	size := last.Sub(first)/time.Duration(n) + 1
+
+	fmt.Fprintf(w, "%-17s %8s %8s %10s %10s %10s %10s\n", "section", "conns", "errors",
+		"msg/s", "hs p50", "hs p99", "first p99")
+	for i := 0; i < n; i++ {
+		from := time.Duration(i) * size
+		r := wsbm.Analyze(wsbm.FilterRaw(raw, from, from+size), time.Second)
+		msgRate := 0.0
+		if r.Elapsed > 0 {
+			msgRate = float64(r.Messages) / r.Elapsed.Seconds()
+		}
+		fmt.Fprintf(w, "%-17s %8d %8d %10.1f %10s %10s %10s\n",
+			fmt.Sprintf("%s..%s", from.Truncate(time.Second), (from+size).Truncate(time.Second)),
+			r.Connections, r.Errors, msgRate,
+			r.Handshake.P50.Round(time.Microsecond), r.Handshake.P99.Round(time.Microsecond),
+			r.FirstMessage.P99.Round(time.Microsecond))
+	}
+}
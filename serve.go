@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "Listen address")
+	mode := fs.String("mode", "echo", "Server mode, echo, drain or broadcast")
+	rate := fs.Float64("rate", 1, "Broadcast messages per second")
+	size := fs.Int("size", 64, "Broadcast message size in bytes")
+	logLevel := fs.String("log-level", "info", "Log level, debug, info, warn or error")
+	logFormat := fs.String("log-format", "text", "Log format, 'text' or 'json' lines")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: wsbm serve [options]\noptions:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	setLogger(*logLevel, *logFormat)
+
+	srv, err := wsbm.NewServer(wsbm.ServerOptions{
+		Mode:   *mode,
+		Rate:   *rate,
+		Size:   *size,
+		Logger: logger,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	logf("serve %s on %s", *mode, *addr)
+	if err := http.ListenAndServe(*addr, srv); err != nil {
+		panic(err)
+	}
+}
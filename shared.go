@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// sharedOutput writes messages of all connections into a few files, a
+// connection writes into file id%shards.
+type sharedOutput struct {
+	files []*sharedFile
+	// prefix lines with connection id, jsonl lines have it already.
+	prefix bool
+}
+
+type sharedFile struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// createSharedOutput creates path with 1 shard, or 'path.<shard>' files.
+func createSharedOutput(path string, shards int, prefix bool) (*sharedOutput, error) {
+	o := &sharedOutput{prefix: prefix}
+	for i := 0; i < shards; i++ {
+		name := path
+		if shards > 1 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		file, err := os.Create(name)
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		o.files = append(o.files, &sharedFile{file: file, w: bufio.NewWriterSize(file, 64<<10)})
+	}
+	return o, nil
+}
+
+func (o *sharedOutput) open(id int) (io.WriteCloser, error) {
+	c := &sharedConn{file: o.files[id%len(o.files)]}
+	if o.prefix {
+		c.prefix = []byte(strconv.Itoa(id) + " ")
+	}
+	return c, nil
+}
+
+// Close flushes and closes files.
+func (o *sharedOutput) Close() error {
+	var err error
+	for _, f := range o.files {
+		f.mu.Lock()
+		if e := f.w.Flush(); e != nil && err == nil {
+			err = e
+		}
+		if e := f.file.Close(); e != nil && err == nil {
+			err = e
+		}
+		f.mu.Unlock()
+	}
+	return err
+}
+
+// sharedConn writes each message of a connection as a line.
+type sharedConn struct {
+	file   *sharedFile
+	prefix []byte
+}
+
+func (c *sharedConn) Close() error { return nil }
+func (c *sharedConn) Write(p []byte) (n int, err error) {
+	line := bytes.TrimRight(p, "\r\n")
+	f := c.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.w.Write(c.prefix)
+	f.w.Write(line)
+	if err = f.w.WriteByte('\n'); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-T/wsbm/wsbm"
+)
+
+const (
+	// statsdPacketSize keeps packets of metrics under the MTU of most
+	// networks, they are sent every statsdFlushInterval if not full sooner.
+	statsdPacketSize    = 1432
+	statsdFlushInterval = time.Second
+)
+
+// statsdWriter emits samples of the run and results of connections as
+// StatsD metrics over UDP, with tags in the DogStatsD format.
+type statsdWriter struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+
+	mu  sync.Mutex
+	buf []byte
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newStatsdWriter sends metrics named prefix+name to addr, tags like
+// 'env:prod' are added to every metric.
+func newStatsdWriter(addr, prefix string, tags []string) (*statsdWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &statsdWriter{
+		conn:    conn,
+		prefix:  prefix,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if len(tags) > 0 {
+		w.tags = "|#" + strings.Join(tags, ",")
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *statsdWriter) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			w.flush()
+			return
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// WriteSample emits counts of the interval sample s and active gauge.
+func (w *statsdWriter) WriteSample(s wsbm.Sample) {
+	w.metric("active", fmt.Sprint(s.Active), "g", "")
+	w.metric("connections", fmt.Sprint(s.Connections), "c", "")
+	w.metric("messages", fmt.Sprint(s.Messages), "c", "")
+	w.metric("bytes", fmt.Sprint(s.Bytes), "c", "")
+	w.metric("errors", fmt.Sprint(s.Errors), "c", "")
+}
+
+// WriteResult emits the end of a connection and timings of its handshake,
+// tagged with its status and close code, reasons are left out as tags
+// values should be few.
+func (w *statsdWriter) WriteResult(r wsbm.ConnResult) {
+	tags := "status:ok"
+	if r.Err != nil {
+		tags = "status:error"
+	}
+	if code, _, _ := strings.Cut(r.Close, " "); code != "" {
+		tags += ",close:" + code
+	}
+	w.metric("conn", "1", "c", tags)
+	if r.Handshake > 0 {
+		w.metric("handshake", ms(r.Handshake), "ms", tags)
+	}
+	if r.FirstMessage > 0 {
+		w.metric("first_message", ms(r.FirstMessage), "ms", tags)
+	}
+	if r.Duration > 0 {
+		w.metric("duration", ms(r.Duration), "ms", tags)
+	}
+}
+
+// metric buffers a metric of value and type, with tags added to those of
+// the writer.
+func (w *statsdWriter) metric(name, value, typ, tags string) {
+	line := w.prefix + name + ":" + value + "|" + typ
+	switch {
+	case tags != "" && w.tags != "":
+		line += w.tags + "," + tags
+	case tags != "":
+		line += "|#" + tags
+	default:
+		line += w.tags
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 && len(w.buf)+1+len(line) > statsdPacketSize {
+		w.send()
+	}
+	if len(w.buf) > 0 {
+		w.buf = append(w.buf, '\n')
+	}
+	w.buf = append(w.buf, line...)
+}
+
+func (w *statsdWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.send()
+}
+
+// send writes the buffered packet, the caller holds w.mu. Failures are
+// logged, metrics are lost like any UDP packet.
+func (w *statsdWriter) send() {
+	if len(w.buf) == 0 {
+		return
+	}
+	if _, err := w.conn.Write(w.buf); err != nil {
+		logger.Warn("write statsd", "err", err)
+	}
+	w.buf = w.buf[:0]
+}
+
+// Close sends metrics left.
+func (w *statsdWriter) Close() error {
+	close(w.done)
+	<-w.stopped
+	return w.conn.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenSource is the bearer token of -token or the output of -token-command.
+type tokenSource struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func (t *tokenSource) Token() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.token
+}
+
+func (t *tokenSource) refresh(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "sh", "-c", *flagTokenCommand).Output()
+	if err != nil {
+		return fmt.Errorf("token command err:%s", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return fmt.Errorf("token command output is empty")
+	}
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
+	return nil
+}
+
+// loadToken returns the token source of flags, nil if there is no token. A
+// command token is refreshed every -token-refresh until ctx is done, failed
+// refreshes keep the previous token.
+func loadToken(ctx context.Context) (*tokenSource, error) {
+	if *flagTokenCommand == "" {
+		if *flagToken == "" {
+			return nil, nil
+		}
+		return &tokenSource{token: *flagToken}, nil
+	}
+
+	t := &tokenSource{}
+	if err := t.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if *flagTokenRefresh > 0 {
+		go func() {
+			ticker := time.NewTicker(*flagTokenRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := t.refresh(ctx); err != nil {
+					logf("refresh %s", err)
+				}
+			}
+		}()
+	}
+	return t, nil
+}
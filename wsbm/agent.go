@@ -0,0 +1,581 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Job is a benchmark sent by a coordinator to agents, it has the options
+// of a run that can be sent over the network, files are sent as content.
+type Job struct {
+	URL        string         `json:"url"`
+	Targets    []Target       `json:"targets,omitempty"`
+	Queries    []url.Values   `json:"queries,omitempty"`
+	QueryVars  bool           `json:"query_vars"`
+	Feed       string         `json:"feed,omitempty"`
+	FeedSeed   int64          `json:"feed_seed"`
+	Header     http.Header    `json:"header,omitempty"`
+	Cookies    []*http.Cookie `json:"cookies,omitempty"`
+	CookieJar  bool           `json:"cookie_jar"`
+	PreRequest *PreRequest    `json:"pre_request,omitempty"`
+	// SigV4 credentials are not sent, agents use their AWS environment.
+	SigV4 *SigV4 `json:"sigv4,omitempty"`
+	// Token is the bearer token when the job is sent.
+	Token       string        `json:"token,omitempty"`
+	Requests    int           `json:"requests"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration"`
+	Rate        float64       `json:"rate"`
+	Arrival     string        `json:"arrival,omitempty"`
+	MaxInflight int           `json:"max_inflight"`
+	ArrivalSeed int64         `json:"arrival_seed"`
+	Ramp        []Stage       `json:"ramp,omitempty"`
+	// ConnectJitter is the min and max delay of connections.
+	ConnectJitter [2]time.Duration `json:"connect_jitter"`
+	// AutoTune is tuned by each agent on its own.
+	AutoTune       string        `json:"auto_tune,omitempty"`
+	AutoTuneWindow time.Duration `json:"auto_tune_window"`
+	FindMax        *FindMax      `json:"find_max,omitempty"`
+	// Scenario is the YAML scenario.
+	Scenario         string        `json:"scenario,omitempty"`
+	Hold             bool          `json:"hold"`
+	Engine           string        `json:"engine,omitempty"`
+	Churn            int           `json:"churn"`
+	Publishers       int           `json:"publishers"`
+	PublishInterval  time.Duration `json:"publish_interval"`
+	FanoutMessage    string        `json:"fanout_message,omitempty"`
+	FanoutTs         string        `json:"fanout_ts,omitempty"`
+	Echo             bool          `json:"echo"`
+	Messages         []Message     `json:"messages,omitempty"`
+	SendInterval     time.Duration `json:"send_interval"`
+	Think            string        `json:"think,omitempty"`
+	ThinkSeed        int64         `json:"think_seed"`
+	MaxMessages      int           `json:"max_messages"`
+	ExpectRegex      string        `json:"expect_regex,omitempty"`
+	ExpectJSONPath   string        `json:"expect_jsonpath,omitempty"`
+	ExpectFirst      bool          `json:"expect_first"`
+	CorrelateSend    string        `json:"correlate_send,omitempty"`
+	CorrelateRecv    string        `json:"correlate_recv,omitempty"`
+	SeqJSONPath      string        `json:"seq_jsonpath,omitempty"`
+	Golden           []Frame       `json:"golden,omitempty"`
+	GoldenNormalize  bool          `json:"golden_normalize"`
+	Schema           string        `json:"schema,omitempty"`
+	Classify         string        `json:"classify,omitempty"`
+	HandshakeTimeout time.Duration `json:"handshake_timeout"`
+	ReadTimeout      time.Duration `json:"read_timeout"`
+	Retries          int           `json:"retries,omitempty"`
+	RetryBackoff     time.Duration `json:"retry_backoff,omitempty"`
+	PingInterval     time.Duration `json:"ping_interval"`
+	PingTimeout      time.Duration `json:"ping_timeout"`
+	KeepaliveMessage *Message      `json:"keepalive_message,omitempty"`
+	KeepalivePeriod  time.Duration `json:"keepalive_interval"`
+	CloseMode        string        `json:"close_mode,omitempty"`
+	CloseCode        int           `json:"close_code,omitempty"`
+	CloseReason      string        `json:"close_reason,omitempty"`
+	CloseTimeout     time.Duration `json:"close_timeout"`
+	ExpectClose      []int         `json:"expect_close,omitempty"`
+	TraceFrames      float64       `json:"trace_frames,omitempty"`
+	Protocol         string        `json:"protocol,omitempty"`
+	Subscribe        []string      `json:"subscribe,omitempty"`
+	Publish          string        `json:"publish,omitempty"`
+	MQTTVersion      int           `json:"mqtt_version,omitempty"`
+	QoS              int           `json:"qos"`
+	Compress         bool          `json:"compress"`
+	HTTP2            bool          `json:"http2"`
+	ReadBufferSize   int           `json:"read_buffer_size,omitempty"`
+	WriteBufferSize  int           `json:"write_buffer_size,omitempty"`
+	MaxRecvRate      float64       `json:"max_recv_rate,omitempty"`
+	MaxSendRate      float64       `json:"max_send_rate,omitempty"`
+	ReadStall        *ReadStall    `json:"read_stall,omitempty"`
+	Shape            *Shape        `json:"shape,omitempty"`
+	ChaosDrop        *ChaosDrop    `json:"chaos_drop,omitempty"`
+	Fuzz             bool          `json:"fuzz,omitempty"`
+	FuzzCases        []string      `json:"fuzz_cases,omitempty"`
+	Insecure         bool          `json:"insecure"`
+	Proxy            string        `json:"proxy,omitempty"`
+	Interval         time.Duration `json:"interval"`
+	OutputHash       bool          `json:"output_hash"`
+	Shard            int           `json:"shard"`
+	Shards           int           `json:"shards"`
+	// Resolve overrides ips of 'host:port' addresses.
+	Resolve   map[string]string `json:"resolve,omitempty"`
+	DNSServer string            `json:"dns_server,omitempty"`
+	Networks  []string          `json:"networks,omitempty"`
+}
+
+// Options returns the options of the job, received messages are discarded.
+func (j *Job) Options() (Options, error) {
+	opts := Options{
+		URL:              j.URL,
+		Targets:          j.Targets,
+		Queries:          j.Queries,
+		QueryVars:        j.QueryVars,
+		Feed:             j.Feed,
+		FeedSeed:         j.FeedSeed,
+		Header:           j.Header,
+		Cookies:          j.Cookies,
+		PreRequest:       j.PreRequest,
+		Requests:         j.Requests,
+		Concurrency:      j.Concurrency,
+		Duration:         j.Duration,
+		Rate:             j.Rate,
+		ConnectJitter:    j.ConnectJitter,
+		MaxInflight:      j.MaxInflight,
+		FindMax:          j.FindMax,
+		ArrivalSeed:      j.ArrivalSeed,
+		Ramp:             j.Ramp,
+		Hold:             j.Hold,
+		Engine:           j.Engine,
+		Churn:            j.Churn,
+		Publishers:       j.Publishers,
+		PublishInterval:  j.PublishInterval,
+		FanoutMessage:    j.FanoutMessage,
+		Echo:             j.Echo,
+		Messages:         j.Messages,
+		SendInterval:     j.SendInterval,
+		ThinkSeed:        j.ThinkSeed,
+		MaxMessages:      j.MaxMessages,
+		Golden:           j.Golden,
+		GoldenNormalize:  j.GoldenNormalize,
+		HandshakeTimeout: j.HandshakeTimeout,
+		ReadTimeout:      j.ReadTimeout,
+		Retries:          j.Retries,
+		RetryBackoff:     j.RetryBackoff,
+		PingInterval:     j.PingInterval,
+		PingTimeout:      j.PingTimeout,
+		KeepaliveMessage: j.KeepaliveMessage,
+		KeepalivePeriod:  j.KeepalivePeriod,
+		CloseMode:        j.CloseMode,
+		CloseCode:        j.CloseCode,
+		CloseReason:      j.CloseReason,
+		CloseTimeout:     j.CloseTimeout,
+		ExpectClose:      j.ExpectClose,
+		TraceFrames:      j.TraceFrames,
+		Protocol:         j.Protocol,
+		Subscribe:        j.Subscribe,
+		Publish:          j.Publish,
+		MQTTVersion:      j.MQTTVersion,
+		QoS:              j.QoS,
+		Compress:         j.Compress,
+		HTTP2:            j.HTTP2,
+		Resolve:          j.Resolve,
+		DNSServer:        j.DNSServer,
+		Networks:         j.Networks,
+		ReadBufferSize:   j.ReadBufferSize,
+		WriteBufferSize:  j.WriteBufferSize,
+		MaxRecvRate:      j.MaxRecvRate,
+		MaxSendRate:      j.MaxSendRate,
+		ReadStall:        j.ReadStall,
+		Shape:            j.Shape,
+		ChaosDrop:        j.ChaosDrop,
+		Fuzz:             j.Fuzz,
+		FuzzCases:        j.FuzzCases,
+		TLSConfig:        &tls.Config{InsecureSkipVerify: j.Insecure},
+		Interval:         j.Interval,
+		OutputHash:       j.OutputHash,
+		Shard:            j.Shard,
+		Shards:           j.Shards,
+	}
+
+	if j.SigV4 != nil {
+		opts.SigV4 = &SigV4{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			Region:       j.SigV4.Region,
+			Service:      j.SigV4.Service,
+		}
+	}
+	if j.Token != "" {
+		token := j.Token
+		opts.Token = func() string { return token }
+	}
+
+	var err error
+	if j.CookieJar {
+		if opts.Jar, err = cookiejar.New(nil); err != nil {
+			return opts, err
+		}
+	}
+	if j.Scenario != "" {
+		if opts.Scenario, err = ParseScenario([]byte(j.Scenario)); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Expect, err = NewAssertion(j.ExpectRegex, j.ExpectJSONPath, j.ExpectFirst); err != nil {
+		return opts, err
+	}
+	if opts.CorrelateSend, opts.CorrelateRecv, err = ParseCorrelation(j.CorrelateSend, j.CorrelateRecv); err != nil {
+		return opts, err
+	}
+	if j.FanoutTs != "" {
+		if opts.FanoutTs, err = ParseJSONPath(j.FanoutTs); err != nil {
+			return opts, err
+		}
+	}
+	if j.Schema != "" {
+		if opts.Schema, err = ParseSchema([]byte(j.Schema)); err != nil {
+			return opts, err
+		}
+	}
+	if j.AutoTune != "" {
+		if opts.AutoTune, err = ParseAutoTune(j.AutoTune); err != nil {
+			return opts, err
+		}
+		opts.AutoTune.Window = j.AutoTuneWindow
+	}
+	if j.Arrival != "" {
+		if opts.Arrival, err = ParseArrival(j.Arrival); err != nil {
+			return opts, err
+		}
+	}
+	if j.Think != "" {
+		if opts.Think, err = ParseThink(j.Think); err != nil {
+			return opts, err
+		}
+	}
+	if j.Classify != "" {
+		if opts.Classify, err = ParseJSONPath(j.Classify); err != nil {
+			return opts, err
+		}
+	}
+	if j.SeqJSONPath != "" {
+		if opts.SeqJSONPath, err = ParseJSONPath(j.SeqJSONPath); err != nil {
+			return opts, err
+		}
+	}
+	if j.Proxy != "" {
+		if opts.Proxy, err = url.Parse(j.Proxy); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// share returns part i of v split into n parts.
+func share(v, n, i int) int {
+	s := v / n
+	if i < v%n {
+		s++
+	}
+	return s
+}
+
+// Split splits requests, concurrency, rate and ramp stages of the job
+// into n shards.
+func (j *Job) Split(n int) []Job {
+	jobs := make([]Job, n)
+	for i := range jobs {
+		s := *j
+		s.Shard, s.Shards = i, n
+		s.Requests = share(j.Requests, n, i)
+		s.Concurrency = share(j.Concurrency, n, i)
+		s.Rate = j.Rate / float64(n)
+		s.MaxInflight = share(j.MaxInflight, n, i)
+		if j.FindMax != nil {
+			fm := *j.FindMax
+			if fm.Batch = share(fm.Batch, n, i); fm.Batch < 1 {
+				fm.Batch = 1
+			}
+			s.FindMax = &fm
+		}
+		if a, err := ParseArrival(j.Arrival); err == nil {
+			s.Arrival = a.split(n).String()
+		}
+		s.Ramp = nil
+		for _, stage := range j.Ramp {
+			s.Ramp = append(s.Ramp, Stage{
+				From:     share(stage.From, n, i),
+				To:       share(stage.To, n, i),
+				Duration: stage.Duration,
+			})
+		}
+		jobs[i] = s
+	}
+	return jobs
+}
+
+// agentResult is a result sent by an agent with histograms to merge.
+type agentResult struct {
+	Elapsed    time.Duration                     `json:"elapsed"`
+	Result     *Result                           `json:"result"`
+	Histograms map[string]*hdrhistogram.Snapshot `json:"histograms"`
+}
+
+func newAgentResult(r *Result) *agentResult {
+	a := &agentResult{
+		Elapsed:    r.Elapsed,
+		Result:     r,
+		Histograms: make(map[string]*hdrhistogram.Snapshot),
+	}
+	for name, l := range agentLatencies(r) {
+		if l.Histogram != nil {
+			a.Histograms[name] = l.Histogram.Export()
+		}
+	}
+	return a
+}
+
+func (a *agentResult) result() *Result {
+	r := a.Result
+	r.Elapsed = a.Elapsed
+	for i := range r.Targets {
+		r.Targets[i].Elapsed = a.Elapsed
+	}
+	for i := range r.Families {
+		r.Families[i].Elapsed = a.Elapsed
+	}
+	for name, l := range agentLatencies(r) {
+		if s, ok := a.Histograms[name]; ok {
+			*l = summarize(hdrhistogram.Import(s))
+		} else {
+			*l = LatencySummary{}
+		}
+	}
+	return r
+}
+
+// agentLatencies returns latencies of the result, its targets and address
+// families.
+func agentLatencies(r *Result) map[string]*LatencySummary {
+	latencies := r.latencies()
+	for i, t := range r.Targets {
+		for name, l := range t.latencies() {
+			latencies[fmt.Sprintf("target.%d.%s", i, name)] = l
+		}
+	}
+	for i, f := range r.Families {
+		for name, l := range f.latencies() {
+			latencies[fmt.Sprintf("family.%d.%s", i, name)] = l
+		}
+	}
+	return latencies
+}
+
+// Agent runs jobs posted to /run by a coordinator and responds their
+// results, POST /stop stops running jobs. Requests must carry the shared
+// token of the agent as bearer token.
+type Agent struct {
+	// LocalAddrs of the agent host are bound by connections of jobs.
+	LocalAddrs []net.IP
+	// Token is the shared token of coordinators, no request is allowed if
+	// empty.
+	Token string
+
+	log *slog.Logger
+
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+}
+
+func NewAgent(logger *slog.Logger) *Agent {
+	if logger == nil {
+		logger = slog.New(discardHandler{})
+	}
+	return &Agent{
+		log:     logger,
+		cancels: make(map[int]context.CancelFunc),
+	}
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/run":
+		a.run(w, r)
+	case "/stop":
+		a.stop()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Agent) run(w http.ResponseWriter, r *http.Request) {
+	var job Job
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := job.Options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Logger = a.log
+	opts.LocalAddrs = a.LocalAddrs
+	bm, err := New(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.mu.Lock()
+	a.next++
+	id := a.next
+	a.cancels[id] = cancel
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.cancels, id)
+		a.mu.Unlock()
+		cancel()
+	}()
+
+	a.log.Info("run job", "shard", job.Shard+1, "shards", job.Shards, "url", job.URL,
+		"requests", job.Requests, "concurrency", job.Concurrency, "duration", job.Duration)
+	result := bm.Run(ctx)
+	a.log.Info("job done", "connections", result.Connections, "errors", result.Errors)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newAgentResult(result)); err != nil {
+		a.log.Warn("write result", "err", err)
+	}
+}
+
+func (a *Agent) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cancel := range a.cancels {
+		cancel()
+	}
+}
+
+// agentURL returns url of path on agent addr, 'host:port' or an http url.
+func agentURL(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// postAgent posts body to path on agent addr with token.
+func postAgent(addr, path, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, agentURL(addr, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func runAgent(addr, token string, job Job) (*Result, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postAgent(addr, "/run", token, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+
+	var result agentResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.result(), nil
+}
+
+// RunAgents splits the job into agents sharing token, runs them and merges
+// their results. Agents are stopped when ctx is done and results are still
+// collected, agents failing are logged and left out.
+func RunAgents(ctx context.Context, agents []string, token string, job Job, logger *slog.Logger) (*Result, error) {
+	if logger == nil {
+		logger = slog.New(discardHandler{})
+	}
+	if job.Publishers > 0 {
+		return nil, fmt.Errorf("publishers not supported with agents, fan-out loss is counted per process")
+	}
+	// Closed-loop runs need a worker per agent, open-loop runs split their
+	// rate or search over all of them.
+	closed := len(job.Ramp) == 0 && job.Arrival == "" && job.FindMax == nil && job.AutoTune == ""
+	if closed && job.Concurrency < len(agents) {
+		agents = agents[:job.Concurrency]
+	}
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("no agent")
+	}
+
+	jobs := job.Split(len(agents))
+	results := make([]*Result, len(agents))
+	errs := make([]error, len(agents))
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		for _, addr := range agents {
+			resp, err := postAgent(addr, "/stop", token, nil)
+			if err != nil {
+				logger.Warn("stop agent", "agent", addr, "err", err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(len(agents))
+	for i, addr := range agents {
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i], errs[i] = runAgent(addr, token, jobs[i])
+		}(i, addr)
+	}
+	wg.Wait()
+	close(done)
+
+	var result *Result
+	for i, addr := range agents {
+		if errs[i] != nil {
+			logger.Warn("agent failed", "agent", addr, "err", errs[i])
+			continue
+		}
+		logger.Info("agent done", "agent", addr, "connections", results[i].Connections, "errors", results[i].Errors)
+		if result == nil {
+			result = results[i]
+		} else {
+			result.Merge(results[i])
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("all %d agents failed", len(agents))
+	}
+	return result, nil
+}
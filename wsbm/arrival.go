@@ -0,0 +1,129 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Arrival is the open-loop arrival process of connections, like '100' or
+// 'constant:100' starting 100 connections per second, or 'poisson:100'
+// starting 100 per second on average with exponential inter-arrival times.
+type Arrival struct {
+	// Rate is arrivals per second.
+	Rate    float64
+	Poisson bool
+}
+
+func ParseArrival(spec string) (*Arrival, error) {
+	a := &Arrival{}
+	spec = strings.TrimSpace(spec)
+	if name, value, ok := strings.Cut(spec, ":"); ok {
+		switch name {
+		case "constant":
+		case "poisson":
+			a.Poisson = true
+		default:
+			return nil, fmt.Errorf("unknown arrival %q, want constant:rate or poisson:rate", spec)
+		}
+		spec = value
+	}
+	rate, err := strconv.ParseFloat(spec, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid arrival rate %q", spec)
+	}
+	a.Rate = rate
+	return a, nil
+}
+
+func (a *Arrival) String() string {
+	name := "constant:"
+	if a.Poisson {
+		name = "poisson:"
+	}
+	return name + strconv.FormatFloat(a.Rate, 'g', -1, 64)
+}
+
+// split returns the arrival of a shard of n.
+func (a *Arrival) split(n int) *Arrival {
+	return &Arrival{Rate: a.Rate / float64(n), Poisson: a.Poisson}
+}
+
+// next returns the time to the next arrival, drawn from r if Poisson.
+func (a *Arrival) next(r *mrand.Rand) time.Duration {
+	if a.Poisson {
+		return time.Duration(r.ExpFloat64() / a.Rate * float64(time.Second))
+	}
+	return time.Duration(float64(time.Second) / a.Rate)
+}
+
+// ArrivalResult is the schedule of open-loop arrivals, Lag is the delay of
+// connection starts from their scheduled time.
+type ArrivalResult struct {
+	Scheduled int64          `json:"scheduled"`
+	Dropped   int64          `json:"dropped"`
+	Lag       LatencySummary `json:"lag"`
+}
+
+// arrive starts a task at every arrival until all requests are started or
+// ctx is done. Arrivals are scheduled from the start of the run, so a slow
+// server doesn't delay the following ones, and are dropped when
+// MaxInflight tasks are running.
+func (b *Benchmark) arrive(ctx context.Context, wg *sync.WaitGroup, count *int32) {
+	var inflight int32
+	r := mrand.New(mrand.NewSource(b.opts.ArrivalSeed + int64(b.opts.Shard)))
+	scheduled := time.Now()
+	for i := 0; ; i++ {
+		if i > 0 {
+			scheduled = scheduled.Add(b.opts.Arrival.next(r))
+		}
+		if !sleepUntil(ctx, scheduled) {
+			return
+		}
+
+		atomic.AddInt64(&b.stats.Arrivals, 1)
+		if b.opts.MaxInflight > 0 && int(atomic.LoadInt32(&inflight)) >= b.opts.MaxInflight {
+			atomic.AddInt64(&b.stats.ArrivalDropped, 1)
+			continue
+		}
+		n := int(atomic.AddInt32(count, 1))
+		if b.opts.Requests > 0 && n > b.opts.Requests {
+			return
+		}
+
+		at := scheduled
+		atomic.AddInt32(&inflight, 1)
+		wg.Add(1)
+		go func() {
+			done := func() {
+				atomic.AddInt32(&inflight, -1)
+				wg.Done()
+			}
+			b.stats.ArrivalLag.Add(time.Since(at))
+			if !b.run(ctx, n, done) {
+				done()
+			}
+		}()
+	}
+}
+
+// sleepUntil returns at t, false if ctx is done.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,66 @@
+package wsbm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Assertion validates received messages, failed assertions are counted
+// and don't close the connection.
+type Assertion struct {
+	// Regex must match the message.
+	Regex *regexp.Regexp
+	// JSONPath must exist in the message, and equal Value if not nil.
+	JSONPath *JSONPath
+	Value    *string
+	// First checks only the first message of each connection.
+	First bool
+}
+
+// NewAssertion returns the assertion of a regex and a jsonpath expression
+// like '$.status' or '$.status==ok', nil if both are empty.
+func NewAssertion(regex, jsonpath string, first bool) (*Assertion, error) {
+	if regex == "" && jsonpath == "" {
+		return nil, nil
+	}
+
+	a := &Assertion{First: first}
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, err
+		}
+		a.Regex = re
+	}
+	if jsonpath != "" {
+		path, value, ok := strings.Cut(jsonpath, "==")
+		p, err := ParseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		a.JSONPath = p
+		if ok {
+			value = strings.TrimSpace(value)
+			a.Value = &value
+		}
+	}
+	return a, nil
+}
+
+// Check returns why content fails the assertion, nil if it passes.
+func (a *Assertion) Check(content []byte) error {
+	if a.Regex != nil && !a.Regex.Match(content) {
+		return fmt.Errorf("message doesn't match %s", a.Regex)
+	}
+	if a.JSONPath != nil {
+		v, ok := a.JSONPath.LookupJSON(content)
+		if !ok {
+			return fmt.Errorf("message has no %s", a.JSONPath)
+		}
+		if a.Value != nil && jsonString(v) != *a.Value {
+			return fmt.Errorf("%s is %s, want %s", a.JSONPath, jsonString(v), *a.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// AutoTune searches the most concurrency keeping a latency percentile of
+// windows at most Target, like 'p99=100ms' or 'handshake.p90=50ms'.
+type AutoTune struct {
+	// Metric is handshake, first_message, rtt, pong_rtt, reply or fanout,
+	// empty means rtt with Echo, reply with correlation and else handshake.
+	Metric string
+	// Percentile is 50, 90, 99 or any from 0 to 100.
+	Percentile float64
+	Target     time.Duration
+	// Window is how long each concurrency runs, 5s by default.
+	Window time.Duration
+}
+
+func ParseAutoTune(spec string) (*AutoTune, error) {
+	name, value, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid auto tune %q, want p99=100ms", spec)
+	}
+	a := &AutoTune{}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		a.Metric, name = name[:i], name[i+1:]
+		if _, ok := autoTuneMetrics[a.Metric]; !ok {
+			return nil, fmt.Errorf("invalid auto tune %q, unknown metric %s", spec, a.Metric)
+		}
+	}
+	p, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+	if err != nil || !strings.HasPrefix(name, "p") || p <= 0 || p > 100 {
+		return nil, fmt.Errorf("invalid auto tune %q, unknown percentile %s", spec, name)
+	}
+	a.Percentile = p
+	if a.Target, err = time.ParseDuration(value); err != nil || a.Target <= 0 {
+		return nil, fmt.Errorf("invalid auto tune %q, invalid latency %s", spec, value)
+	}
+	return a, nil
+}
+
+func (a *AutoTune) String() string {
+	name := "p" + strconv.FormatFloat(a.Percentile, 'g', -1, 64)
+	if a.Metric != "" {
+		name = a.Metric + "." + name
+	}
+	return name + "=" + a.Target.String()
+}
+
+// autoTuneMetrics are latencies of stats by metric name.
+var autoTuneMetrics = map[string]func(s *stats) *latency{
+	"handshake":     func(s *stats) *latency { return &s.Handshake },
+	"first_message": func(s *stats) *latency { return &s.FirstMessage },
+	"rtt":           func(s *stats) *latency { return &s.RTT },
+	"pong_rtt":      func(s *stats) *latency { return &s.PongRTT },
+	"reply":         func(s *stats) *latency { return &s.Reply },
+	"fanout":        func(s *stats) *latency { return &s.Fanout },
+}
+
+// AutoTuneResult is the most concurrency meeting the target and its rates,
+// Steps are the windows of the search.
+type AutoTuneResult struct {
+	Target      string         `json:"target"`
+	Concurrency int            `json:"concurrency"`
+	ConnectRate float64        `json:"connect_rate"`
+	MessageRate float64        `json:"message_rate"`
+	Latency     time.Duration  `json:"latency"`
+	Steps       []AutoTuneStep `json:"steps"`
+}
+
+// AutoTuneStep is a window run at a concurrency, OK if it met the target.
+type AutoTuneStep struct {
+	Concurrency int           `json:"concurrency"`
+	Latency     time.Duration `json:"latency"`
+	Samples     int64         `json:"samples"`
+	ConnectRate float64       `json:"connect_rate"`
+	MessageRate float64       `json:"message_rate"`
+	Errors      int64         `json:"errors"`
+	OK          bool          `json:"ok"`
+}
+
+func (r *AutoTuneResult) Write(w io.Writer) {
+	if r.Concurrency == 0 {
+		fmt.Fprintf(w, "auto tune %s: not met\n", r.Target)
+		return
+	}
+	fmt.Fprintf(w, "auto tune %s: concurrency: %d, connect rate: %.1f/s, msg rate: %.1f/s, latency: %s\n",
+		r.Target, r.Concurrency, r.ConnectRate, r.MessageRate, round(r.Latency))
+}
+
+// merge adds the result of an agent tuned on its own.
+func (r *AutoTuneResult) merge(o *AutoTuneResult) {
+	r.Target = o.Target
+	r.Concurrency += o.Concurrency
+	r.ConnectRate += o.ConnectRate
+	r.MessageRate += o.MessageRate
+	if o.Latency > r.Latency {
+		r.Latency = o.Latency
+	}
+}
+
+// autoTune runs workers at a concurrency for a window at a time, doubling
+// it while the target is met and then bisecting between the most meeting
+// and the least missing it, until they are within 5% or ctx is done.
+// Windows with more than 1% errors or without samples of the metric miss
+// the target.
+func (b *Benchmark) autoTune(ctx context.Context, wg *sync.WaitGroup, count *int32) {
+	tune := b.opts.AutoTune
+	l := autoTuneMetrics[tune.Metric](&b.stats)
+	b.tuned = &AutoTuneResult{Target: tune.String()}
+
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	// good meets the target and bad is the least missing it, 0 if none.
+	var good, bad int
+	concurrency := b.opts.Concurrency
+	for {
+		for len(cancels) < concurrency {
+			workerCtx, cancel := context.WithCancel(ctx)
+			cancels = append(cancels, cancel)
+			wg.Add(1)
+			go b.work(workerCtx, count, wg.Done)
+		}
+		for len(cancels) > concurrency {
+			cancels[len(cancels)-1]()
+			cancels = cancels[:len(cancels)-1]
+		}
+
+		last, lastTime, hist := b.stats.snapshot(), time.Now(), l.snapshot()
+		if !sleepUntil(ctx, lastTime.Add(tune.Window)) {
+			return
+		}
+		cur, secs := b.stats.snapshot(), time.Since(lastTime).Seconds()
+		d, samples := windowPercentile(hist, l.snapshot(), tune.Percentile)
+		step := AutoTuneStep{
+			Concurrency: concurrency,
+			Latency:     d,
+			Samples:     samples,
+			ConnectRate: float64(cur.connections-last.connections) / secs,
+			MessageRate: float64(cur.messages-last.messages) / secs,
+			Errors:      cur.errors - last.errors,
+		}
+		step.OK = samples > 0 && d <= tune.Target && step.Errors*100 <= cur.connections-last.connections
+		b.tuned.Steps = append(b.tuned.Steps, step)
+		b.log.Info("auto tune", "concurrency", concurrency, "target", tune.String(), "latency", round(d), "samples", samples,
+			"connect_rate", step.ConnectRate, "msg_rate", step.MessageRate, "errors", step.Errors, "ok", step.OK)
+
+		if step.OK && concurrency > good {
+			good = concurrency
+			b.tuned.Concurrency = concurrency
+			b.tuned.ConnectRate = step.ConnectRate
+			b.tuned.MessageRate = step.MessageRate
+			b.tuned.Latency = d
+		} else if !step.OK && (bad == 0 || concurrency < bad) {
+			bad = concurrency
+		}
+
+		switch {
+		case bad == 0:
+			concurrency *= 2
+		case bad-good <= 1 || bad-good <= good/20:
+			return
+		default:
+			concurrency = (good + bad) / 2
+			if concurrency < 1 {
+				concurrency = 1
+			}
+		}
+		if b.opts.Requests > 0 && int(atomic.LoadInt32(count)) >= b.opts.Requests {
+			return
+		}
+	}
+}
+
+func (l *latency) snapshot() *hdrhistogram.Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hist == nil {
+		return nil
+	}
+	return l.hist.Export()
+}
+
+// windowPercentile returns the percentile of durations recorded between
+// snapshots prev and cur of a latency, and how many they are.
+func windowPercentile(prev, cur *hdrhistogram.Snapshot, percentile float64) (time.Duration, int64) {
+	if cur == nil {
+		return 0, 0
+	}
+	diff := *cur
+	diff.Counts = make([]int64, len(cur.Counts))
+	var total int64
+	for i, n := range cur.Counts {
+		if prev != nil && i < len(prev.Counts) {
+			n -= prev.Counts[i]
+		}
+		diff.Counts[i] = n
+		total += n
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return time.Duration(hdrhistogram.Import(&diff).ValueAtQuantile(percentile)) * latencyUnit, total
+}
@@ -0,0 +1,1101 @@
+// Package wsbm is a WebSocket benchmark engine, it dials connections with
+// configurable concurrency, sends and reads messages and collects stats.
+package wsbm
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+type Options struct {
+	// URL to connect, '<id>' in url will be replaced by connection id,
+	// http and https schemes are converted to ws and wss.
+	//
+	// URL, header values and sent messages are text/template templates with
+	// .ID, the values of the picked query and uuid, randInt and timestamp
+	// functions, eg: {{.ID}}, {{.user}}, {{randInt 1 100}}.
+	URL string
+	// Targets replace URL with several urls connections are distributed
+	// to by weight, results are also broken down by target.
+	Targets []Target
+	// Queries are merged into url query, connection id picks one of them.
+	Queries []url.Values
+	// QueryVars uses Queries only as template variables.
+	QueryVars bool
+	// Feed is how connections pick Queries, 'sequential' or '' by id,
+	// 'shuffle' by id from a shuffled order, 'random' at random, and
+	// 'once' uses each query once and limits Requests to them.
+	Feed string
+	// FeedSeed seeds shuffle and random feeds, 0 means current time.
+	FeedSeed int64
+	// Header is added to handshake request, overrides default Origin.
+	Header http.Header
+	// Cookies are sent by every handshake request.
+	Cookies []*http.Cookie
+	// Jar is shared by connections, cookies set by handshake responses are
+	// sent by following handshakes.
+	Jar http.CookieJar
+	// Token returns the bearer token sent as Authorization header.
+	Token func() string
+	// Traceparent sends a W3C traceparent header with handshakes, its ids
+	// are TraceID and SpanID of ConnResult.
+	Traceparent bool
+	// Protocol is the application protocol spoken over connections, ''
+	// sends and receives plain messages, 'socketio' Socket.IO events,
+	// 'graphql-ws' GraphQL operations, 'stomp' STOMP frames, 'mqtt' MQTT
+	// publishes, 'signalr' SignalR hub invocations, 'sockjs' SockJS
+	// messages, 'phoenix' Phoenix Channels pushes, 'jsonrpc' JSON-RPC 2.0
+	// requests.
+	Protocol string
+	// Subscribe are channels joined after the protocol handshake, the
+	// namespaces of socketio, subscription queries of graphql-ws,
+	// destinations of stomp, topics of mqtt or phoenix. Queries and
+	// phoenix topics are templates.
+	Subscribe []string
+	// Publish is the destination of sent messages, defaults to the first
+	// of Subscribe.
+	Publish string
+	// MQTTVersion is the MQTT protocol level, 4 for 3.1.1 or 5, 0 means 4.
+	MQTTVersion int
+	// QoS is the MQTT QoS of subscriptions and publishes, 0 or 1.
+	QoS int
+
+	// SigV4 signs handshake requests with AWS credentials.
+	SigV4 *SigV4
+	// PreRequest is made before each dial.
+	PreRequest *PreRequest
+
+	// Requests is total connections, < 1 means no limit.
+	Requests    int
+	Concurrency int
+	// Duration stops the run after elapsed, 0 means no limit.
+	Duration time.Duration
+	// Rate is max new connections per second, 0 means no limit.
+	Rate float64
+	// ConnectJitter delays each connection by a random duration from
+	// ConnectJitter[0] to ConnectJitter[1], to spread dials of workers.
+	ConnectJitter [2]time.Duration
+	// Arrival starts connections open-loop at its rate regardless of
+	// running ones instead of Concurrency workers. MaxInflight caps running
+	// connections, arrivals beyond are dropped, 0 means no limit.
+	// ArrivalSeed seeds Poisson arrivals, 0 means current time.
+	Arrival     *Arrival
+	MaxInflight int
+	ArrivalSeed int64
+	// AutoTune replaces Concurrency workers by the search of the most
+	// concurrency meeting a latency target, starting at Concurrency.
+	AutoTune *AutoTune
+	// FindMax replaces Concurrency workers by batches of held connections
+	// until a batch fails, implying Hold.
+	FindMax *FindMax
+	// Ramp replaces Concurrency with stages changing it over time,
+	// Duration defaults to the sum of stages.
+	Ramp []Stage
+
+	// Scenario replaces the default connect, send and read task.
+	Scenario *Scenario
+
+	// Hold keeps each of Concurrency connections open until the run stops
+	// without reconnecting, pinging them and sampling how many are alive
+	// every Interval, for connection capacity tests.
+	Hold bool
+
+	// Engine runs connections, 'gorilla' or '' with goroutines and buffers
+	// per connection, 'netpoll' with epoll pollers owning connections and
+	// sharing read buffers for hundreds of thousands of connections, on
+	// linux. netpoll only sends Messages and receives on ws urls.
+	Engine string
+
+	// Churn closes each connection after exchanging Churn messages, sending
+	// Messages in turn and reading a message after each, and workers
+	// reconnect at once to measure sustained connect rate.
+	Churn int
+
+	// Echo sends timestamped messages every SendInterval, or after previous
+	// echo if SendInterval is 0, and measures their round-trip times.
+	Echo bool
+
+	// Fuzz sends malformed frames of FuzzCases, or of the named ones, a
+	// case by connection in turn, and records how the server responds.
+	Fuzz      bool
+	FuzzCases []string
+	// Conformance runs ConformanceCases on a server echoing messages, or
+	// the named cases or groups, a case by connection.
+	Conformance      bool
+	ConformanceCases []string
+
+	// Messages are sent after connect, paced by SendInterval.
+	Messages     []Message
+	SendInterval time.Duration
+	// Think replaces SendInterval by think times drawn from a distribution
+	// seeded by ThinkSeed and the connection id, 0 means current time.
+	Think     *Think
+	ThinkSeed int64
+	// Replay sends recorded frames instead of Messages, at their offsets
+	// divided by ReplaySpeed, 0 sends them without delay.
+	Replay      []Frame
+	ReplaySpeed float64
+	// Record writes received messages to Output as JSON line frames with
+	// offsets from connect, to be read by ReadFrames.
+	Record bool
+	// MaxMessages closes connection after received, 0 means no limit.
+	MaxMessages int
+	// Expect validates received messages.
+	Expect *Assertion
+	// CorrelateSend selects request ids of sent messages and CorrelateRecv
+	// the ids replied by received messages, the latency from request to
+	// reply is recorded.
+	CorrelateSend *JSONPath
+	CorrelateRecv *JSONPath
+	// Publishers are the first connections of a fan-out run, publishing
+	// FanoutMessage every PublishInterval, 1s by default, while the others
+	// subscribe and record delivery latency from the FanoutTs timestamp,
+	// $.ts by default, and loss of messages published while connected.
+	// FanoutMessage is a template, by default a JSON message with a ts in
+	// nanoseconds. Loss is counted against messages published by this
+	// process, so RunAgents rejects fan-out runs.
+	Publishers      int
+	PublishInterval time.Duration
+	FanoutMessage   string
+	FanoutTs        *JSONPath
+	// Golden is the transcript of messages each connection must receive,
+	// connections diverging from it are reported with the index of the
+	// first differing message. GoldenNormalize compares JSON messages by
+	// value.
+	Golden          []Frame
+	GoldenNormalize bool
+	// Schema validates received text messages, violations are counted
+	// per connection.
+	Schema *Schema
+	// Classify selects the class of received messages, counts, bytes and
+	// intervals are reported by class.
+	Classify *JSONPath
+	// SeqJSONPath selects sequence numbers of received messages, gaps,
+	// duplicates and out of order numbers are counted per connection.
+	SeqJSONPath *JSONPath
+
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	// Retries retries handshakes failing by timeouts, network errors or
+	// statuses like 429 and 503 but not 400 or 403, waiting RetryBackoff,
+	// 100ms by default, doubled by retry and jittered.
+	Retries      int
+	RetryBackoff time.Duration
+	// PingInterval of ping frames, 0 means no ping. Connection is killed
+	// when pong is not received in PingTimeout, 0 means no timeout.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// KeepaliveMessage is sent every KeepalivePeriod, for servers wanting
+	// an application ping like '{"type":"ping"}' instead of ping frames.
+	KeepaliveMessage *Message
+	KeepalivePeriod  time.Duration
+	// CloseMode is how connections are closed by us, 'graceful' or '' sends
+	// a close frame and waits for server closing in CloseTimeout, 1s by
+	// default, 'frame' sends a close frame and closes the socket, 'rst'
+	// resets the TCP connection without close frame.
+	CloseMode    string
+	CloseCode    int
+	CloseReason  string
+	CloseTimeout time.Duration
+	// ExpectClose are close codes from server not failing connections,
+	// normal closure by default.
+	ExpectClose []int
+	// Compress negotiates permessage-deflate.
+	Compress bool
+	// HTTP2 bootstraps connections as streams of HTTP/2 connections by the
+	// extended CONNECT of RFC 8441, over TLS for wss urls and with prior
+	// knowledge for ws urls, without proxy.
+	HTTP2 bool
+	// ReadBufferSize and WriteBufferSize are I/O buffer sizes of
+	// connections, 0 means 4096. Write buffers are pooled between writes,
+	// netpoll pollers share a read buffer of ReadBufferSize, 64KB by
+	// default.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// MaxRecvRate and MaxSendRate limit bytes read and written per second
+	// by each connection on the wire, 0 means no limit. Slow reads fill
+	// the TCP window to simulate slow consumers.
+	MaxRecvRate float64
+	MaxSendRate float64
+	// ReadStall stops reading of connections for a while periodically.
+	ReadStall *ReadStall
+	// Shape delays, loses and resets data of connections to simulate a
+	// degraded network.
+	Shape *Shape
+	// ChaosDrop drops connections at random.
+	ChaosDrop *ChaosDrop
+	// TLSConfig is used by wss connections.
+	TLSConfig *tls.Config
+	// Proxy is a http or socks5 proxy url, nil means HTTP_PROXY and
+	// HTTPS_PROXY from environment.
+	Proxy *url.URL
+	// Resolve overrides the ip of 'host:port' addresses, keeping the host of
+	// urls for Host header and SNI. DNSServer is the 'ip:port' of the DNS
+	// server resolving other hosts, port 53 by default, '' means the
+	// system resolver.
+	Resolve   map[string]string
+	DNSServer string
+	// Networks force the address family of connections, tcp4 or tcp6,
+	// connections alternate between both and results are broken down by
+	// family.
+	Networks []string
+	// LocalAddrs are bound by connections in turn, to exceed the ephemeral
+	// ports of a single source ip.
+	LocalAddrs []net.IP
+
+	// Shard is the index of this benchmark of Shards in a distributed run,
+	// connection ids of shards are interleaved so they don't overlap.
+	Shard  int
+	Shards int
+
+	// Output opens the writer of received messages per connection,
+	// nil discards them.
+	Output func(id int) (io.WriteCloser, error)
+	// OutputFormat is 'raw' or '' writing message content, or 'jsonl'
+	// writing a JSON line with connection, sequence, time, type and size.
+	OutputFormat string
+	// OutputFilter writes only messages passing it.
+	OutputFilter *Assertion
+	// OutputSample is the fraction of messages written, 0 writes all.
+	OutputSample float64
+	// OutputHash writes a JSON line per connection with message and byte
+	// counts and a SHA-256 of received messages instead of their content.
+	OutputHash bool
+	// HandshakeDump writes the response of the first HandshakeDumps
+	// refused handshakes, 10 by default, nil disables it.
+	HandshakeDump  io.Writer
+	HandshakeDumps int
+	// OnResult is called from workers when a connection ends.
+	OnResult func(ConnResult)
+	// OnLatency is called with every latency of messages recorded by
+	// connections.
+	OnLatency func(MessageLatency)
+	// OnSample is called with the progress of the run every
+	// SampleInterval, 1s by default, and once more at its end. Samples
+	// are the Timeline of the result.
+	OnSample       func(Sample)
+	SampleInterval time.Duration
+	// Interval of progress log line, 0 means disabled.
+	Interval time.Duration
+	// Dashboard draws live stats on the terminal every Interval, 1s by
+	// default, instead of progress lines, Logger records are shown in it.
+	Dashboard io.Writer
+	// Progress draws a bar of completed Requests with their ETA on the
+	// terminal instead of progress lines, without Dashboard or Hold.
+	Progress io.Writer
+	// Logger logs progress at info level, failures of connections at warn
+	// and their dials and ends at debug, nil discards logs.
+	Logger *slog.Logger
+	// TraceFrames is the fraction of connections whose frames are logged
+	// at debug level with their opcode and size, 1 traces all.
+	TraceFrames float64
+}
+
+type Benchmark struct {
+	opts       Options
+	templates  templates
+	dialer     *websocket.Dialer
+	limiter    *RateLimiter
+	control    control
+	stats      stats
+	dashboard  *dashboard
+	progress   *progressBar
+	log        *slog.Logger
+	httpClient *http.Client
+	// preVars are values extracted by PreRequest by connection id.
+	preVars sync.Map
+	// targets are stats of Targets, families of Networks if both.
+	targets  []stats
+	families []stats
+	// feed is the shuffled order of queries.
+	feed []int
+	// written counts messages passing OutputFilter for sampling.
+	written int64
+	// local counts dials picking LocalAddrs.
+	local    uint32
+	resolver *net.Resolver
+	// tuned is the result of AutoTune, found of FindMax.
+	tuned *AutoTuneResult
+	found *FindMaxResult
+	// client samples resources of the process along the timeline.
+	client *clientMonitor
+	// netpoll runs connections of the netpoll engine.
+	netpoll *netpoll
+	// http2 multiplexes streams of HTTP2 connections, by url scheme.
+	http2 map[string]*http2.Transport
+	// fuzz are the cases of Fuzz, conformance of Conformance.
+	fuzz        []FuzzCase
+	conformance []ConformanceCase
+	// dumped counts refused handshakes written to HandshakeDump.
+	dumped int64
+	dumpMu sync.Mutex
+}
+
+func New(opts Options) (*Benchmark, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(discardHandler{})
+	}
+	if len(opts.Ramp) > 0 && opts.Duration <= 0 {
+		opts.Duration = rampDuration(opts.Ramp)
+	}
+	if opts.ConnectJitter[0] < 0 || opts.ConnectJitter[1] < opts.ConnectJitter[0] {
+		return nil, fmt.Errorf("invalid connect jitter %s..%s", opts.ConnectJitter[0], opts.ConnectJitter[1])
+	}
+	if opts.FindMax != nil {
+		if opts.AutoTune != nil || opts.Arrival != nil || len(opts.Ramp) > 0 {
+			return nil, errors.New("find max excludes auto tune, arrival and ramp")
+		}
+		fm := *opts.FindMax
+		if fm.Batch <= 0 {
+			fm.Batch = 100
+		}
+		if fm.Interval <= 0 {
+			fm.Interval = 5 * time.Second
+		}
+		if fm.MaxErrorRate <= 0 {
+			fm.MaxErrorRate = 1
+		}
+		if fm.MaxP99 <= 0 {
+			fm.MaxP99 = time.Second
+		}
+		opts.FindMax = &fm
+		opts.Hold = true
+	}
+	if opts.Hold {
+		if opts.PingInterval <= 0 {
+			opts.PingInterval = 30 * time.Second
+		}
+		if opts.Interval <= 0 {
+			opts.Interval = 10 * time.Second
+		}
+	}
+
+	if err := validProtocol(opts.Protocol); err != nil {
+		return nil, err
+	}
+	if opts.HTTP2 && opts.Proxy != nil {
+		return nil, errors.New("http2 excludes proxy")
+	}
+	for _, network := range opts.Networks {
+		if network != "tcp4" && network != "tcp6" {
+			return nil, fmt.Errorf("unknown network %q, want tcp4 or tcp6", network)
+		}
+	}
+	switch opts.Engine {
+	case "", "gorilla", "netpoll":
+	default:
+		return nil, fmt.Errorf("unknown engine %q", opts.Engine)
+	}
+	if names := netpollUnsupported(&opts); opts.Engine == "netpoll" && len(names) > 0 {
+		return nil, fmt.Errorf("netpoll engine doesn't support %s", strings.Join(names, ", "))
+	}
+	if opts.Publishers > 0 {
+		if opts.PublishInterval <= 0 {
+			opts.PublishInterval = time.Second
+		}
+		if opts.FanoutTs == nil {
+			opts.FanoutTs, _ = ParseJSONPath("$.ts")
+		}
+	}
+	if opts.MQTTVersion != 0 && opts.MQTTVersion != 4 && opts.MQTTVersion != 5 {
+		return nil, fmt.Errorf("unsupported mqtt version %d", opts.MQTTVersion)
+	}
+	if opts.QoS < 0 || opts.QoS > 1 {
+		return nil, fmt.Errorf("unsupported qos %d", opts.QoS)
+	}
+	switch opts.Feed {
+	case "", "sequential", "shuffle", "random":
+	case "once":
+		if n := len(opts.Queries); n > 0 && (opts.Requests <= 0 || opts.Requests > n) {
+			opts.Requests = n
+		}
+	default:
+		return nil, fmt.Errorf("unknown feed %q", opts.Feed)
+	}
+	if opts.FeedSeed == 0 {
+		opts.FeedSeed = time.Now().UnixNano()
+	}
+	if opts.AutoTune != nil {
+		if opts.Arrival != nil || len(opts.Ramp) > 0 {
+			return nil, errors.New("auto tune excludes arrival and ramp")
+		}
+		tune := *opts.AutoTune
+		if tune.Metric == "" {
+			switch {
+			case opts.Echo:
+				tune.Metric = "rtt"
+			case opts.CorrelateRecv != nil:
+				tune.Metric = "reply"
+			default:
+				tune.Metric = "handshake"
+			}
+		}
+		if tune.Window <= 0 {
+			tune.Window = 5 * time.Second
+		}
+		opts.AutoTune = &tune
+	}
+	if opts.ArrivalSeed == 0 {
+		opts.ArrivalSeed = time.Now().UnixNano()
+	}
+	if opts.ThinkSeed == 0 {
+		opts.ThinkSeed = time.Now().UnixNano()
+	}
+	switch opts.CloseMode {
+	case "", "graceful", "frame", "rst":
+	default:
+		return nil, fmt.Errorf("unknown close mode %q", opts.CloseMode)
+	}
+	if opts.CloseCode == 0 {
+		opts.CloseCode = websocket.CloseNormalClosure
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = time.Second
+	}
+	for _, code := range opts.ExpectClose {
+		if code < websocket.CloseNormalClosure || code > 4999 {
+			return nil, fmt.Errorf("invalid expect close code %d", code)
+		}
+	}
+	switch opts.OutputFormat {
+	case "", "raw", "jsonl":
+	default:
+		return nil, fmt.Errorf("unknown output format %q", opts.OutputFormat)
+	}
+	if opts.SampleInterval <= 0 {
+		opts.SampleInterval = time.Second
+	}
+	if opts.Dashboard != nil && opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.MaxRecvRate < 0 || opts.MaxSendRate < 0 {
+		return nil, fmt.Errorf("invalid max recv rate %g or max send rate %g", opts.MaxRecvRate, opts.MaxSendRate)
+	}
+	if s := opts.Shape; s != nil && (s.Delay < 0 || s.Jitter < 0 || s.Loss < 0 || s.Loss > 1 || s.Reset < 0 || s.Reset > 1) {
+		return nil, fmt.Errorf("invalid shape delay %s, jitter %s, loss %g or reset %g", s.Delay, s.Jitter, s.Loss, s.Reset)
+	}
+	if d := opts.ChaosDrop; d != nil {
+		switch d.Mode {
+		case "", "random", "close", "rst":
+		default:
+			return nil, fmt.Errorf("unknown chaos mode %q", d.Mode)
+		}
+		// echo, scenario and churn sessions end with their connection
+		if d.Reconnect && (opts.Echo || opts.Scenario != nil || opts.Churn > 0) {
+			return nil, fmt.Errorf("chaos reconnect not supported with echo, scenario or churn")
+		}
+	}
+	if opts.Retries > 0 && opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+	if opts.HandshakeDumps <= 0 {
+		opts.HandshakeDumps = 10
+	}
+	if err := checkFDLimit(&opts); err != nil {
+		return nil, err
+	}
+
+	var fuzz []FuzzCase
+	if opts.Fuzz {
+		if opts.HTTP2 || opts.Proxy != nil {
+			return nil, errors.New("fuzz excludes http2 and proxy")
+		}
+		fuzz = FuzzCases
+		if len(opts.FuzzCases) > 0 {
+			fuzz = nil
+			for _, name := range opts.FuzzCases {
+				c, ok := fuzzCase(name)
+				if !ok {
+					return nil, fmt.Errorf("unknown fuzz case %q", name)
+				}
+				fuzz = append(fuzz, c)
+			}
+		}
+	}
+
+	var conformance []ConformanceCase
+	if opts.Conformance {
+		if opts.Fuzz || opts.HTTP2 || opts.Proxy != nil {
+			return nil, errors.New("conformance excludes fuzz, http2 and proxy")
+		}
+		var err error
+		if conformance, err = conformanceCases(opts.ConformanceCases); err != nil {
+			return nil, err
+		}
+		opts.Requests = len(conformance)
+	}
+
+	b := &Benchmark{
+		opts:        opts,
+		log:         opts.Logger,
+		fuzz:        fuzz,
+		conformance: conformance,
+	}
+	if opts.Dashboard != nil {
+		b.dashboard = &dashboard{w: opts.Dashboard}
+		b.log = slog.New(&dashboardHandler{d: b.dashboard, next: opts.Logger.Handler()})
+	} else if opts.Progress != nil && opts.Requests > 0 && !opts.Hold {
+		b.progress = &progressBar{w: opts.Progress, total: int64(opts.Requests)}
+		b.log = slog.New(&progressHandler{p: b.progress, next: opts.Logger.Handler()})
+	}
+	b.dialer = &websocket.Dialer{
+		Proxy:             b.proxy,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		EnableCompression: opts.Compress,
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		WriteBufferPool:   &sync.Pool{},
+		TLSClientConfig:   opts.TLSConfig,
+		NetDialContext:    b.netDialContext,
+		Jar:               opts.Jar,
+	}
+	if opts.HTTP2 {
+		b.http2 = b.newHTTP2Transports()
+		b.dialer.Proxy = nil
+		b.dialer.NetDialContext = b.http2Dial("http")
+		b.dialer.NetDialTLSContext = b.http2Dial("https")
+	}
+	b.resolver = newResolver(opts.DNSServer)
+	b.httpClient = b.newHTTPClient()
+	if len(opts.Targets) > 0 {
+		b.targets = make([]stats, len(opts.Targets))
+	}
+	if len(opts.Networks) > 1 {
+		b.families = make([]stats, len(opts.Networks))
+	}
+	if opts.Feed == "shuffle" {
+		b.feed = mrand.New(mrand.NewSource(opts.FeedSeed)).Perm(len(opts.Queries))
+	}
+	b.limiter = NewRateLimiter(opts.Rate)
+	b.control = control{
+		concurrency: int32(opts.Concurrency),
+		changed:     make(chan struct{}, 1),
+		rate:        opts.Rate,
+		duration:    opts.Duration,
+	}
+	if opts.Scenario != nil {
+		b.stats.Steps = make([]latency, len(opts.Scenario.all()))
+	}
+	if err := b.parseTemplates(); err != nil {
+		return nil, err
+	}
+	if opts.Engine == "netpoll" {
+		var err error
+		if b.netpoll, err = newNetpoll(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// discardHandler discards records of loggers, none are enabled.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Run starts workers that run tasks until all requests are done, duration
+// elapsed or ctx is done, and returns the result.
+func (b *Benchmark) Run(ctx context.Context) *Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b.stats.Start = time.Now()
+	b.client = newClientMonitor()
+	b.control.start(b.stats.Start, cancel)
+	defer b.control.end()
+
+	if b.dashboard != nil {
+		done, stopped := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+		go func() {
+			defer close(stopped)
+			b.runDashboard(b.opts.Interval, done)
+		}()
+	} else if b.progress != nil {
+		done, stopped := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+		go func() {
+			defer close(stopped)
+			b.runProgressBar(done)
+		}()
+	} else if b.opts.Interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go b.reportProgress(b.opts.Interval, done)
+	}
+	sampling, sampled := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(sampled)
+		b.runSampler(b.opts.SampleInterval, sampling)
+	}()
+
+	if b.netpoll != nil {
+		b.netpoll.start()
+		defer b.netpoll.stop()
+	}
+
+	var wg sync.WaitGroup
+	var count int32
+	if b.opts.FindMax != nil {
+		b.findMax(ctx, &wg, &count)
+	} else if b.opts.AutoTune != nil {
+		b.autoTune(ctx, &wg, &count)
+	} else if b.opts.Arrival != nil {
+		b.arrive(ctx, &wg, &count)
+	} else if len(b.opts.Ramp) > 0 {
+		b.ramp(ctx, &wg, &count)
+	} else {
+		b.workers(ctx, &wg, &count)
+	}
+	wg.Wait()
+	close(sampling)
+	<-sampled
+
+	b.stats.End = time.Now()
+	result := b.stats.Result(b.opts.Scenario)
+	result.Targets = b.targetResults()
+	result.Families = b.familyResults()
+	result.AutoTune = b.tuned
+	result.FindMax = b.found
+	result.Client = b.client.Result()
+	return result
+}
+
+// work runs tasks until all requests are started or ctx is done, then
+// calls exit. When a task is detached, its end resumes work in a new
+// goroutine, so no goroutine waits for connections of pollers.
+func (b *Benchmark) work(ctx context.Context, count *int32, exit func()) {
+	resume := func() {
+		if b.opts.Hold {
+			exit()
+			return
+		}
+		b.work(ctx, count, exit)
+	}
+	for ctx.Err() == nil {
+		n := int(atomic.AddInt32(count, 1))
+		if b.opts.Requests > 0 && n > b.opts.Requests {
+			break
+		}
+		if b.run(ctx, n, resume) {
+			return
+		}
+		if b.opts.Hold {
+			break
+		}
+	}
+	exit()
+}
+
+// run runs the n-th task of the run, given the id of n in its shard. It
+// returns true if the task was detached, resume is then called once the
+// task ended.
+func (b *Benchmark) run(ctx context.Context, n int, resume func()) bool {
+	id := n
+	if b.opts.Shards > 1 {
+		id = (n-1)*b.opts.Shards + b.opts.Shard + 1
+	}
+
+	t := &task{id: id}
+	t.result.ID = id
+	t.resume = func(err error) {
+		b.endTask(t, err)
+		resume()
+	}
+	err := b.doTask(ctx, t)
+	if err == errDetached {
+		return true
+	}
+	b.endTask(t, err)
+	return false
+}
+
+// query returns the query of connection id picked by Feed.
+func (b *Benchmark) query(id int) url.Values {
+	n := len(b.opts.Queries)
+	switch b.opts.Feed {
+	case "shuffle":
+		return b.opts.Queries[b.feed[id%n]]
+	case "random":
+		return b.opts.Queries[mrand.New(mrand.NewSource(b.opts.FeedSeed+int64(id))).Intn(n)]
+	case "once":
+		return b.opts.Queries[(id-1)%n]
+	default:
+		return b.opts.Queries[id%n]
+	}
+}
+
+// URL returns the url of connection id.
+func (b *Benchmark) URL(id int) (*url.URL, error) {
+	rawUrl, err := b.templates.execute(b.rawURL(id), b.templateData(id))
+	if err != nil {
+		return nil, err
+	}
+	rawUrl = strings.Replace(rawUrl, "<id>", fmt.Sprint(id), -1)
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("parse url %s err:%s", rawUrl, err.Error())
+	}
+
+	if len(b.opts.Queries) > 0 && !b.opts.QueryVars {
+		newQuery := b.query(id)
+		query := u.Query()
+		for name, value := range newQuery {
+			query[name] = value
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+	}
+
+	return u, nil
+}
+
+type discard struct{}
+
+func (d discard) Close() error                      { return nil }
+func (d discard) Write(p []byte) (n int, err error) { return len(p), nil }
+
+func (b *Benchmark) openOutput(id int) (io.WriteCloser, error) {
+	if b.opts.Output == nil {
+		return discard{}, nil
+	}
+	return b.opts.Output(id)
+}
+
+// endTask records the result of task t ended with err.
+func (b *Benchmark) endTask(t *task, err error) {
+	t.end()
+	if !t.result.Start.IsZero() {
+		t.result.Duration = time.Since(t.result.Start)
+	}
+	t.result.Err = err
+	if len(b.targets) > 0 {
+		b.targets[b.target(t.id)].addResult(t.result)
+	}
+	if len(b.families) > 0 {
+		b.families[t.id%len(b.families)].addResult(t.result)
+	}
+	if b.opts.OnResult != nil && (err != nil || !t.result.Start.IsZero()) {
+		b.opts.OnResult(t.result)
+	}
+
+	atomic.AddInt64(&b.stats.Done, 1)
+	if err != nil {
+		b.stats.AddError(err)
+		b.log.Warn("run task", "task", t.id, "err", err)
+	} else {
+		b.log.Debug("run task", "task", t.id)
+	}
+}
+
+// doTask runs task t, errDetached when its connection was handed over to
+// a poller.
+func (b *Benchmark) doTask(ctx context.Context, t *task) error {
+	if jitter := b.opts.ConnectJitter; jitter[1] > 0 {
+		d := jitter[0] + time.Duration(mrand.Int63n(int64(jitter[1]-jitter[0])+1))
+		if !sleepUntil(ctx, time.Now().Add(d)) {
+			return nil
+		}
+	}
+	if !b.control.wait(ctx) {
+		return nil
+	}
+	if err := b.limiter.Wait(ctx); err != nil {
+		return nil
+	}
+
+	if b.opts.PreRequest != nil {
+		t.atEnd(func() { b.preVars.Delete(t.id) })
+		if err := b.preRequest(ctx, t.id); err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	var err error
+	t.url, err = b.URL(t.id)
+	if err != nil {
+		return err
+	}
+	t.result.URL = t.url.String()
+
+	output, err := b.openOutput(t.id)
+	if err != nil {
+		return err
+	}
+	t.atEnd(func() { output.Close() })
+	t.output = output
+	if b.opts.OutputHash {
+		t.atEnd(func() { b.writeHash(t) })
+	}
+
+	if b.opts.Fuzz {
+		return b.runFuzz(ctx, t)
+	}
+	if b.opts.Conformance {
+		return b.runConformance(ctx, t)
+	}
+	if b.opts.Scenario != nil {
+		return b.runScenario(ctx, t)
+	}
+	if b.opts.Echo {
+		return b.runEcho(ctx, t)
+	}
+	if b.opts.Churn > 0 {
+		return b.runChurn(ctx, t)
+	}
+	if b.netpoll != nil {
+		return b.runNetpoll(ctx, t)
+	}
+
+	for {
+		s, err := b.open(ctx, t)
+		if s == nil {
+			return err
+		}
+		err = b.runSession(s)
+		if !s.isDropped() || !b.opts.ChaosDrop.Reconnect || ctx.Err() != nil {
+			return err
+		}
+		b.log.Debug("reconnect dropped", "task", t.id)
+	}
+}
+
+// runSession sends messages of the session and reads it until it ends.
+func (b *Benchmark) runSession(s *session) error {
+	defer s.Close()
+
+	if len(b.opts.Replay) > 0 {
+		go b.replay(s)
+	} else if len(b.opts.Messages) > 0 {
+		go b.sendMessages(s)
+	}
+	if b.opts.Publishers > 0 {
+		if b.publisher(s.id) {
+			go b.publishFanout(s)
+		} else {
+			s.subscribe()
+		}
+	}
+
+	for {
+		s.setReadTimeout(b.opts.ReadTimeout)
+		if _, _, err := s.read(); err != nil {
+			return s.err(err)
+		}
+		if !s.closing && b.opts.MaxMessages > 0 && s.received >= b.opts.MaxMessages {
+			s.shutdown()
+		}
+	}
+}
+
+// dial connects url of task and records handshake stats, it returns a nil
+// conn with nil error when ctx is done.
+func (b *Benchmark) dial(ctx context.Context, t *task) (*websocket.Conn, error) {
+	b.log.Debug("dial", "task", t.id, "url", t.url.String())
+
+	h, err := b.header(t.id, t.url)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range t.header {
+		h[name] = append(h[name], values...)
+	}
+	if b.opts.Traceparent {
+		h.Set("Traceparent", t.traceparent())
+	}
+	if t.attempt == 0 {
+		atomic.AddInt64(&b.stats.Connections, 1)
+	}
+	start := time.Now()
+	t.result.Start = start
+	traceCtx, trace := withDialTrace(ctx)
+	trace.network = b.network(t.id)
+	trace.shaped = b.shaped(t.id)
+	conn, resp, err := b.dialer.DialContext(traceCtx, t.url.String(), h)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if resp != nil && errors.Is(err, websocket.ErrBadHandshake) {
+			return nil, b.handshakeFailed(t.id, t.url.String(), resp)
+		}
+		if isTimeout(err) {
+			return nil, fmt.Errorf("%w: %s", ErrHandshakeTimeout, err)
+		}
+		return nil, err
+	}
+	t.result.Handshake = time.Since(start)
+	b.stats.Handshake.Add(t.result.Handshake)
+	trace.record(&b.stats, &t.result)
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		b.stats.AddExtension(ext)
+	}
+	return conn, nil
+}
+
+func (b *Benchmark) header(id int, url *url.URL) (http.Header, error) {
+	h := http.Header{"Origin": {"http://" + url.Host}}
+	data := b.templateData(id)
+	for name, values := range b.opts.Header {
+		h[name] = make([]string, len(values))
+		for i, value := range values {
+			v, err := b.templates.execute(value, data)
+			if err != nil {
+				return nil, err
+			}
+			h[name][i] = v
+		}
+	}
+	if b.opts.Token != nil {
+		if token := b.opts.Token(); token != "" {
+			h.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if len(b.opts.Cookies) > 0 {
+		cookies := make([]string, len(b.opts.Cookies))
+		for i, c := range b.opts.Cookies {
+			cookies[i] = c.String()
+		}
+		h.Add("Cookie", strings.Join(cookies, "; "))
+	}
+	if b.opts.SigV4 != nil {
+		b.opts.SigV4.sign(h, url, time.Now())
+	}
+	return h, nil
+}
+
+// message renders text sent by connection id.
+func (b *Benchmark) message(id int, text string) ([]byte, error) {
+	msg, err := b.templates.execute(text, b.templateData(id))
+	return []byte(msg), err
+}
+
+// sampled reports whether a received message is written to output.
+func (b *Benchmark) sampled(content []byte) bool {
+	if b.opts.OutputFilter != nil && b.opts.OutputFilter.Check(content) != nil {
+		return false
+	}
+	if b.opts.OutputSample <= 0 || b.opts.OutputSample >= 1 {
+		return true
+	}
+	return picked(atomic.AddInt64(&b.written, 1), b.opts.OutputSample, 0)
+}
+
+// picked reports whether item i, counted from 0, is of fraction f of
+// items spread evenly, one every 1/f items. Items are picked from the
+// first one shifted by phase of [0, 1), so that options picking equal
+// fractions of connections pick different ones.
+func picked(i int64, f, phase float64) bool {
+	n := float64(i)
+	return math.Floor(n*f+phase) > math.Floor((n-1)*f+phase)
+}
+
+// receive records a received message and writes it to output.
+func (b *Benchmark) receive(t *task, msgType int, content []byte) {
+	b.stats.AddMessage(len(content))
+	switch msgType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		if b.opts.OutputHash {
+			t.hashMessage(msgType, content)
+			return
+		}
+		if !b.sampled(content) {
+			return
+		}
+		switch {
+		case b.opts.Record:
+			b.record(t, msgType, content)
+		case b.opts.OutputFormat == "jsonl":
+			b.writeJSONL(t, msgType, content)
+		default:
+			t.output.Write(content)
+		}
+	}
+}
+
+// closeConn ends the connection by CloseMode, graceful close sends a close
+// frame and gives the server CloseTimeout to close its side.
+func (b *Benchmark) closeConn(conn *websocket.Conn) {
+	if b.opts.CloseMode == "rst" {
+		if tcp := tcpConn(conn.UnderlyingConn()); tcp != nil {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+		return
+	}
+
+	deadline := time.Now().Add(b.opts.CloseTimeout)
+	msg := websocket.FormatCloseMessage(b.opts.CloseCode, b.opts.CloseReason)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil || b.opts.CloseMode == "frame" {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(deadline)
+}
+
+func (b *Benchmark) sendMessages(s *session) {
+	for i, msg := range b.opts.Messages {
+		if i > 0 && !s.pause() {
+			return
+		}
+
+		if err := b.sendMessage(s, msg); err != nil {
+			b.log.Warn("send", "task", s.id, "err", err)
+			return
+		}
+	}
+}
+
+// sendMessage sends msg, text messages are rendered as templates.
+func (b *Benchmark) sendMessage(s *session, msg Message) error {
+	msgType, data, err := b.renderMessage(s.id, msg)
+	if err != nil {
+		return err
+	}
+	return s.send(msgType, data)
+}
+
+// renderMessage returns the type and data of msg sent by connection id.
+func (b *Benchmark) renderMessage(id int, msg Message) (int, []byte, error) {
+	if msg.Binary {
+		return websocket.BinaryMessage, msg.Data, nil
+	}
+	data, err := b.message(id, string(msg.Data))
+	return websocket.TextMessage, data, err
+}
@@ -0,0 +1,60 @@
+package wsbm
+
+import (
+	"io"
+	"sync"
+)
+
+// messageBuffers are buffers sessions read messages into, put back when
+// sessions close so that connections reuse buffers of ended ones.
+var messageBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// maxPooledBuffer is the largest buffer put back to messageBuffers, those
+// grown larger by big messages are left to the garbage collector.
+const maxPooledBuffer = 1 << 20
+
+// readMessage reads the next message into the buffer of the session
+// without allocating, content is only valid until the next read.
+func (s *session) readMessage() (int, []byte, error) {
+	msgType, r, err := s.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	if s.buf == nil {
+		s.buf = messageBuffers.Get().(*[]byte)
+	}
+
+	buf := (*s.buf)[:0]
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			*s.buf = buf
+			return msgType, nil, err
+		}
+	}
+	*s.buf = buf
+	if s.trace {
+		s.b.traceFrame(s.id, "recv", msgType, true, len(buf))
+	}
+	return msgType, buf, nil
+}
+
+// releaseBuffer puts the buffer of the session back to messageBuffers.
+func (s *session) releaseBuffer() {
+	if s.buf != nil && cap(*s.buf) <= maxPooledBuffer {
+		messageBuffers.Put(s.buf)
+	}
+	s.buf = nil
+}
@@ -0,0 +1,118 @@
+package wsbm
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ChaosDrop drops a Fraction of connections every Every at random, closing
+// them gracefully or by a TCP reset by Mode, and reconnects them if
+// Reconnect is set, to exercise cleanup of sessions by servers. Reconnect
+// is not supported by echo, scenario and churn runs.
+type ChaosDrop struct {
+	Fraction float64
+	Every    time.Duration
+	// Mode is 'close' frame, 'rst' TCP reset, or 'random' or '' for either.
+	Mode      string
+	Reconnect bool
+}
+
+// ParseChaosDrop parses drops like '2%/min', dropping 2% of connections a
+// minute, fractions may be like '0.02' and periods like '30s'.
+func ParseChaosDrop(spec string) (*ChaosDrop, error) {
+	fraction, every, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid chaos drop %q, want fraction/period", spec)
+	}
+	d := &ChaosDrop{}
+	fraction = strings.TrimSpace(fraction)
+	var err error
+	if strings.HasSuffix(fraction, "%") {
+		d.Fraction, err = strconv.ParseFloat(strings.TrimSuffix(fraction, "%"), 64)
+		d.Fraction /= 100
+	} else {
+		d.Fraction, err = strconv.ParseFloat(fraction, 64)
+	}
+	if err != nil || d.Fraction <= 0 || d.Fraction >= 1 {
+		return nil, fmt.Errorf("invalid chaos drop %q, fraction must be between 0 and 100%%", spec)
+	}
+	switch every = strings.TrimSpace(every); every {
+	case "s", "sec":
+		d.Every = time.Second
+	case "m", "min":
+		d.Every = time.Minute
+	case "h", "hour":
+		d.Every = time.Hour
+	default:
+		if d.Every, err = time.ParseDuration(every); err != nil || d.Every <= 0 {
+			return nil, fmt.Errorf("invalid chaos drop %q, invalid period %s", spec, every)
+		}
+	}
+	return d, nil
+}
+
+func (d *ChaosDrop) String() string {
+	return strconv.FormatFloat(d.Fraction*100, 'f', -1, 64) + "%/" + d.Every.String()
+}
+
+// after returns a random time until a connection is dropped, exponentially
+// distributed so Fraction of them are dropped every Every.
+func (d *ChaosDrop) after() time.Duration {
+	rate := -math.Log(1-d.Fraction) / float64(d.Every)
+	return time.Duration(rand.ExpFloat64() / rate)
+}
+
+// scheduleDrop drops the session at a random time by ChaosDrop.
+func (s *session) scheduleDrop() {
+	if s.b.opts.ChaosDrop == nil {
+		return
+	}
+	timer := time.AfterFunc(s.b.opts.ChaosDrop.after(), s.drop)
+	go func() {
+		<-s.ctx.Done()
+		timer.Stop()
+	}()
+}
+
+// drop closes the connection by ChaosDrop, ending its reads.
+func (s *session) drop() {
+	if s.ctx.Err() != nil || !atomic.CompareAndSwapInt32(&s.dropped, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&s.b.stats.ChaosDrops, 1)
+	mode := s.b.opts.ChaosDrop.Mode
+	if mode == "" || mode == "random" {
+		mode = "close"
+		if rand.Intn(2) == 0 {
+			mode = "rst"
+		}
+	}
+	s.b.log.Debug("chaos drop", "task", s.id, "mode", mode)
+
+	if mode == "rst" {
+		if tcp := tcpConn(s.UnderlyingConn()); tcp != nil {
+			tcp.SetLinger(0)
+		}
+		s.Conn.Close()
+		return
+	}
+	deadline := time.Now().Add(s.b.opts.CloseTimeout)
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "chaos drop")
+	if err := s.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+		s.Conn.Close()
+		return
+	}
+	s.SetReadDeadline(deadline)
+}
+
+// isDropped reports whether the session was dropped by ChaosDrop.
+func (s *session) isDropped() bool {
+	return atomic.LoadInt32(&s.dropped) == 1
+}
@@ -0,0 +1,28 @@
+package wsbm
+
+import "context"
+
+// runChurn exchanges Churn messages and closes the connection gracefully,
+// without Messages it only reads them.
+func (b *Benchmark) runChurn(ctx context.Context, t *task) error {
+	s, err := b.open(ctx, t)
+	if s == nil {
+		return err
+	}
+	defer s.Close()
+
+	for i := 0; i < b.opts.Churn; i++ {
+		if len(b.opts.Messages) > 0 {
+			if err := b.sendMessage(s, b.opts.Messages[i%len(b.opts.Messages)]); err != nil {
+				return s.err(err)
+			}
+		}
+		s.setReadTimeout(b.opts.ReadTimeout)
+		if _, _, err := s.read(); err != nil {
+			return s.err(err)
+		}
+	}
+
+	s.shutdown()
+	return s.drain()
+}
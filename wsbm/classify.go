@@ -0,0 +1,127 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// maxClasses is the most classes counted, messages of more classes are
+// counted as classOther.
+const maxClasses = 100
+
+const (
+	// classNone is the class of messages without the Classify field.
+	classNone  = "(none)"
+	classOther = "(other)"
+)
+
+// class is the stats of received messages of a class, interval is the
+// time between messages of the class on a connection.
+type class struct {
+	messages int64
+	bytes    int64
+	interval latency
+}
+
+// ClassResult is the stats of received messages by the value of the
+// Classify field.
+type ClassResult struct {
+	Name     string         `json:"name"`
+	Messages int64          `json:"messages"`
+	Bytes    int64          `json:"bytes"`
+	Interval LatencySummary `json:"interval"`
+}
+
+// classify records a received message by its class.
+func (s *session) classify(content []byte) {
+	name := classNone
+	if v, ok := s.b.opts.Classify.LookupJSON(content); ok {
+		name = jsonString(v)
+	}
+
+	c, name := s.b.stats.class(name)
+	atomic.AddInt64(&c.messages, 1)
+	atomic.AddInt64(&c.bytes, int64(len(content)))
+
+	now := time.Now()
+	if s.classLast == nil {
+		s.classLast = make(map[string]time.Time)
+	}
+	if last, ok := s.classLast[name]; ok {
+		c.interval.Add(now.Sub(last))
+	}
+	s.classLast[name] = now
+}
+
+// class returns the stats of a class and its name, classOther when there
+// are maxClasses classes.
+func (s *stats) class(name string) (*class, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.classes == nil {
+		s.classes = make(map[string]*class)
+	}
+	c := s.classes[name]
+	if c != nil {
+		return c, name
+	}
+	if len(s.classes) >= maxClasses {
+		name = classOther
+		if c = s.classes[name]; c != nil {
+			return c, name
+		}
+	}
+	c = &class{}
+	s.classes[name] = c
+	return c, name
+}
+
+func (s *stats) classResults() []ClassResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var classes []ClassResult
+	for name, c := range s.classes {
+		classes = append(classes, ClassResult{
+			Name:     name,
+			Messages: atomic.LoadInt64(&c.messages),
+			Bytes:    atomic.LoadInt64(&c.bytes),
+			Interval: c.interval.Summary(),
+		})
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Name < classes[j].Name })
+	return classes
+}
+
+// mergeClasses adds counts of classes in o, intervals are merged with
+// other latencies.
+func (r *Result) mergeClasses(o *Result) {
+	for _, oc := range o.Classes {
+		i := sort.Search(len(r.Classes), func(i int) bool { return r.Classes[i].Name >= oc.Name })
+		if i == len(r.Classes) || r.Classes[i].Name != oc.Name {
+			r.Classes = append(r.Classes, ClassResult{})
+			copy(r.Classes[i+1:], r.Classes[i:])
+			r.Classes[i] = ClassResult{Name: oc.Name}
+		}
+		r.Classes[i].Messages += oc.Messages
+		r.Classes[i].Bytes += oc.Bytes
+	}
+}
+
+func writeClasses(w io.Writer, classes []ClassResult, elapsed time.Duration) {
+	fmt.Fprintln(w, "classes:")
+	for _, c := range classes {
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(c.Messages) / elapsed.Seconds()
+		}
+		fmt.Fprintf(w, "  %-13s %8d %10.1f/s %12d bytes\n", c.Name+":", c.Messages, rate, c.Bytes)
+	}
+	for _, c := range classes {
+		if c.Interval.Count > 0 {
+			c.Interval.Write(w, "  "+c.Name+" interval")
+		}
+	}
+}
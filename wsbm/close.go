@@ -0,0 +1,134 @@
+package wsbm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeNames are names of close codes of RFC 6455.
+var closeNames = map[int]string{
+	websocket.CloseNormalClosure:           "normal closure",
+	websocket.CloseGoingAway:               "going away",
+	websocket.CloseProtocolError:           "protocol error",
+	websocket.CloseUnsupportedData:         "unsupported data",
+	websocket.CloseNoStatusReceived:        "no status",
+	websocket.CloseAbnormalClosure:         "abnormal closure",
+	websocket.CloseInvalidFramePayloadData: "invalid payload",
+	websocket.ClosePolicyViolation:         "policy violation",
+	websocket.CloseMessageTooBig:           "message too big",
+	websocket.CloseMandatoryExtension:      "mandatory extension",
+	websocket.CloseInternalServerErr:       "internal error",
+	websocket.CloseServiceRestart:          "service restart",
+	websocket.CloseTryAgainLater:           "try again later",
+	websocket.CloseTLSHandshake:            "tls handshake",
+}
+
+// CloseResult counts connections closed by Code from server, 0 for those
+// closed by us, Reason is the first reason of the code.
+type CloseResult struct {
+	Code   int    `json:"code"`
+	Count  int64  `json:"count"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Name returns the name of the close code, 'client' for closes by us.
+func (c CloseResult) Name() string {
+	if c.Code == 0 {
+		return "client"
+	}
+	if name, ok := closeNames[c.Code]; ok {
+		return fmt.Sprintf("%d %s", c.Code, name)
+	}
+	return fmt.Sprint(c.Code)
+}
+
+// expectedClose tells whether err is a close by a code of ExpectClose,
+// normal closure by default.
+func (b *Benchmark) expectedClose(err error) bool {
+	if len(b.opts.ExpectClose) == 0 {
+		return websocket.IsCloseError(err, websocket.CloseNormalClosure)
+	}
+	return websocket.IsCloseError(err, b.opts.ExpectClose...)
+}
+
+// addClose counts how the connection ending by err was closed, by us when
+// client, and returns the close of the task result.
+func (s *stats) addClose(client bool, err error) string {
+	var closeErr *websocket.CloseError
+	code, reason := 0, ""
+	switch {
+	case client:
+	case errors.As(err, &closeErr):
+		code, reason = closeErr.Code, closeErr.Text
+	default:
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closes == nil {
+		s.closes = make(map[int]*CloseResult)
+	}
+	c := s.closes[code]
+	if c == nil {
+		c = &CloseResult{Code: code, Reason: reason}
+		s.closes[code] = c
+	}
+	c.Count++
+	if client {
+		return "client"
+	}
+	if reason == "" {
+		return fmt.Sprint(code)
+	}
+	return fmt.Sprintf("%d %s", code, reason)
+}
+
+func (s *stats) Closes() []CloseResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var closes []CloseResult
+	for _, c := range s.closes {
+		closes = append(closes, *c)
+	}
+	sortCloses(closes)
+	return closes
+}
+
+func sortCloses(closes []CloseResult) {
+	sort.Slice(closes, func(i, j int) bool { return closes[i].Code < closes[j].Code })
+}
+
+// mergeCloses adds counts of close codes of o to r.
+func (r *Result) mergeCloses(o *Result) {
+	for _, oc := range o.Closes {
+		i := 0
+		for i < len(r.Closes) && r.Closes[i].Code != oc.Code {
+			i++
+		}
+		if i == len(r.Closes) {
+			r.Closes = append(r.Closes, CloseResult{Code: oc.Code, Reason: oc.Reason})
+		}
+		r.Closes[i].Count += oc.Count
+	}
+	sortCloses(r.Closes)
+}
+
+// writeCloses writes the table of close codes with their first reason.
+func writeCloses(w io.Writer, closes []CloseResult) {
+	if len(closes) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "close codes:")
+	for _, c := range closes {
+		fmt.Fprintf(w, "  %-26s %8d", c.Name()+":", c.Count)
+		if c.Reason != "" {
+			fmt.Fprintf(w, "  %q", c.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,122 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Tolerances of Compare are how much worse than its baseline a result may
+// be before its change is a regression, negative ones are disabled.
+type Tolerances struct {
+	// ThroughputDrop of connect, message and byte rates in percent.
+	ThroughputDrop float64
+	// ErrorRateRise of the error rate in percentage points.
+	ErrorRateRise float64
+	// LatencyRise of latency percentiles in percent.
+	LatencyRise float64
+}
+
+// Change is a metric of a result compared to its baseline, Delta is the
+// change in percent, or in percentage points for rates in percent.
+type Change struct {
+	Metric    string  `json:"metric"`
+	Unit      string  `json:"unit"`
+	Base      float64 `json:"base"`
+	Current   float64 `json:"current"`
+	Delta     float64 `json:"delta"`
+	Regressed bool    `json:"regressed"`
+}
+
+// Compare returns changes of throughput, error rate and latencies of r
+// measured in both results since base.
+func Compare(base, r *Result, t Tolerances) []Change {
+	var changes []Change
+	throughput := func(metric string, b, c float64) {
+		change := Change{Metric: metric, Unit: "/s", Base: b, Current: c, Delta: percentChange(b, c)}
+		change.Regressed = t.ThroughputDrop >= 0 && b > 0 && -change.Delta > t.ThroughputDrop
+		changes = append(changes, change)
+	}
+	throughput("connect rate", base.connectRate(), r.connectRate())
+	throughput("message rate", perSecond(base.Messages, base.Elapsed), perSecond(r.Messages, r.Elapsed))
+	throughput("byte rate", perSecond(base.Bytes, base.Elapsed), perSecond(r.Bytes, r.Elapsed))
+
+	errorRate := Change{Metric: "error rate", Unit: "%", Base: base.errorRate(), Current: r.errorRate()}
+	errorRate.Delta = errorRate.Current - errorRate.Base
+	errorRate.Regressed = t.ErrorRateRise >= 0 && errorRate.Delta > t.ErrorRateRise
+	changes = append(changes, errorRate)
+
+	for _, l := range []struct {
+		name    string
+		base, r LatencySummary
+	}{
+		{"handshake", base.Handshake, r.Handshake},
+		{"first message", base.FirstMessage, r.FirstMessage},
+		{"rtt", base.RTT, r.RTT},
+		{"pong rtt", base.PongRTT, r.PongRTT},
+		{"reply", base.Reply, r.Reply},
+		{"fan-out", base.Fanout.Latency, r.Fanout.Latency},
+	} {
+		if l.base.Count == 0 || l.r.Count == 0 {
+			continue
+		}
+		for _, p := range []struct {
+			name    string
+			base, r time.Duration
+		}{{"p50", l.base.P50, l.r.P50}, {"p90", l.base.P90, l.r.P90}, {"p99", l.base.P99, l.r.P99}} {
+			change := Change{
+				Metric:  l.name + " " + p.name,
+				Unit:    "ms",
+				Base:    milliseconds(p.base),
+				Current: milliseconds(p.r),
+				Delta:   percentChange(milliseconds(p.base), milliseconds(p.r)),
+			}
+			change.Regressed = t.LatencyRise >= 0 && p.base > 0 && change.Delta > t.LatencyRise
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func (r *Result) errorRate() float64 {
+	if r.Connections <= 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Connections) * 100
+}
+
+// percentChange returns the change from b to c in percent of b, 0 if b is.
+func percentChange(b, c float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return (c - b) / b * 100
+}
+
+// WriteChanges writes the table of changes, marking regressions.
+func WriteChanges(w io.Writer, changes []Change) {
+	fmt.Fprintf(w, "%-20s %14s %14s %10s\n", "", "baseline", "current", "delta")
+	for _, c := range changes {
+		delta := fmt.Sprintf("%+.1f%%", c.Delta)
+		if c.Unit == "%" {
+			delta = fmt.Sprintf("%+.2fpp", c.Delta)
+		}
+		mark := ""
+		if c.Regressed {
+			mark = "  REGRESSION"
+		}
+		fmt.Fprintf(w, "%-20s %14s %14s %10s%s\n", c.Metric+":",
+			formatChange(c.Base, c.Unit), formatChange(c.Current, c.Unit), delta, mark)
+	}
+}
+
+func formatChange(v float64, unit string) string {
+	switch unit {
+	case "ms":
+		return fmt.Sprintf("%.3fms", v)
+	case "%":
+		return fmt.Sprintf("%.2f%%", v)
+	default:
+		return fmt.Sprintf("%.1f%s", v, unit)
+	}
+}
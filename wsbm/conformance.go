@@ -0,0 +1,445 @@
+package wsbm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConformanceCase checks a behavior of RFC 6455 on servers echoing
+// messages, by frames sent and the messages and pongs answered in order,
+// or the close codes the server must close with. Cases with Drop pass too
+// when the server fails fast closing the connection without close frame.
+type ConformanceCase struct {
+	Name   string
+	Group  string
+	Drop   bool
+	Closes []int
+	frames []rawFrame
+	want   []echoFrame
+}
+
+// echoFrame is a whole message or a control frame answered by the server.
+type echoFrame struct {
+	op      int
+	payload string
+}
+
+func (f echoFrame) String() string {
+	name, ok := opcodeNames[f.op]
+	if !ok {
+		name = fmt.Sprint(f.op)
+	}
+	if len(f.payload) > 32 {
+		return fmt.Sprintf("%s of %d bytes", name, len(f.payload))
+	}
+	return fmt.Sprintf("%s %q", name, f.payload)
+}
+
+// textFrame, pingFrame and pongFrame return single frames of payload.
+func textFrame(payload string) rawFrame {
+	return rawFrame{First: frameFin | websocket.TextMessage, Payload: []byte(payload)}
+}
+
+func pingFrame(payload string) rawFrame {
+	return rawFrame{First: frameFin | websocket.PingMessage, Payload: []byte(payload)}
+}
+
+func pongFrame(payload string) rawFrame {
+	return rawFrame{First: frameFin | websocket.PongMessage, Payload: []byte(payload)}
+}
+
+// closeFrame returns a close frame of code and reason, without payload if
+// code is 0.
+func closeFrame(code int, reason string) rawFrame {
+	f := rawFrame{First: frameFin | websocket.CloseMessage}
+	if code != 0 {
+		f.Payload = append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+	}
+	return f
+}
+
+// fragments splits payload into frames of a message of op, the first of
+// which is empty if payload is.
+func fragments(op int, payload string, n int) []rawFrame {
+	frames := make([]rawFrame, n)
+	size := (len(payload) + n - 1) / n
+	for i := range frames {
+		start, end := i*size, (i+1)*size
+		if start > len(payload) {
+			start = len(payload)
+		}
+		if end > len(payload) {
+			end = len(payload)
+		}
+		frames[i].Payload = []byte(payload[start:end])
+	}
+	frames[0].First = byte(op)
+	frames[n-1].First |= frameFin
+	return frames
+}
+
+func joinFrames(frames ...[]rawFrame) []rawFrame {
+	var joined []rawFrame
+	for _, f := range frames {
+		joined = append(joined, f...)
+	}
+	return joined
+}
+
+// utf8Valid is κόσμε, utf8Invalid is it followed by a surrogate, invalid
+// in UTF-8.
+const (
+	utf8Valid   = "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"
+	utf8Invalid = utf8Valid + "\xed\xa0\x80edited"
+)
+
+var (
+	closesProtocol = []int{websocket.CloseProtocolError}
+	closesInvalid  = []int{websocket.CloseInvalidFramePayloadData}
+	closesNormal   = []int{websocket.CloseNormalClosure}
+)
+
+// ConformanceCases are the cases of conformance runs, see
+// Options.Conformance.
+var ConformanceCases = []ConformanceCase{
+	{Name: "fragmented-text", Group: "fragmentation",
+		frames: fragments(websocket.TextMessage, "fragmented", 3),
+		want:   []echoFrame{{websocket.TextMessage, "fragmented"}}},
+	{Name: "fragmented-binary", Group: "fragmentation",
+		frames: fragments(websocket.BinaryMessage, "\x00\x01\x02\x03", 2),
+		want:   []echoFrame{{websocket.BinaryMessage, "\x00\x01\x02\x03"}}},
+	{Name: "empty-fragments", Group: "fragmentation",
+		frames: []rawFrame{{First: websocket.TextMessage}, {Payload: []byte("fragment")}, {}, {First: frameFin}},
+		want:   []echoFrame{{websocket.TextMessage, "fragment"}}},
+	{Name: "many-fragments", Group: "fragmentation",
+		frames: fragments(websocket.TextMessage, strings.Repeat("x", 100), 100),
+		want:   []echoFrame{{websocket.TextMessage, strings.Repeat("x", 100)}}},
+	{Name: "continuation-without-start", Group: "fragmentation", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{{First: frameFin, Payload: []byte("continuation")}}},
+	{Name: "message-during-fragments", Group: "fragmentation", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{{First: websocket.TextMessage, Payload: []byte("fragment")}, textFrame("message")}},
+	{Name: "unfinished-fragments-then-new", Group: "fragmentation", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{{First: websocket.BinaryMessage, Payload: []byte("fragment")}, {First: websocket.TextMessage, Payload: []byte("new")}}},
+
+	{Name: "ping", Group: "control",
+		frames: []rawFrame{pingFrame("hello")},
+		want:   []echoFrame{{websocket.PongMessage, "hello"}}},
+	{Name: "ping-empty", Group: "control",
+		frames: []rawFrame{pingFrame("")},
+		want:   []echoFrame{{websocket.PongMessage, ""}}},
+	{Name: "ping-max-payload", Group: "control",
+		frames: []rawFrame{pingFrame(strings.Repeat("p", 125))},
+		want:   []echoFrame{{websocket.PongMessage, strings.Repeat("p", 125)}}},
+	{Name: "ping-oversized", Group: "control", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{pingFrame(strings.Repeat("p", 126))}},
+	{Name: "ping-fragmented", Group: "control", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{{First: websocket.PingMessage, Payload: []byte("frag")}, {First: frameFin, Payload: []byte("ment")}}},
+	{Name: "ping-between-fragments", Group: "control",
+		frames: joinFrames(fragments(websocket.TextMessage, "fragmented", 2)[:1], []rawFrame{pingFrame("ping")}, fragments(websocket.TextMessage, "fragmented", 2)[1:]),
+		want:   []echoFrame{{websocket.PongMessage, "ping"}, {websocket.TextMessage, "fragmented"}}},
+	{Name: "pong-between-fragments", Group: "control",
+		frames: joinFrames(fragments(websocket.TextMessage, "fragmented", 2)[:1], []rawFrame{pongFrame("pong")}, fragments(websocket.TextMessage, "fragmented", 2)[1:]),
+		want:   []echoFrame{{websocket.TextMessage, "fragmented"}}},
+	{Name: "unsolicited-pong", Group: "control",
+		frames: []rawFrame{pongFrame("pong"), textFrame("after pong")},
+		want:   []echoFrame{{websocket.TextMessage, "after pong"}}},
+	{Name: "close-between-fragments", Group: "control", Closes: closesNormal,
+		frames: joinFrames(fragments(websocket.TextMessage, "fragmented", 2)[:1], []rawFrame{closeFrame(websocket.CloseNormalClosure, "")})},
+
+	{Name: "valid-utf8", Group: "utf8",
+		frames: []rawFrame{textFrame(utf8Valid)},
+		want:   []echoFrame{{websocket.TextMessage, utf8Valid}}},
+	{Name: "valid-utf8-split-codepoint", Group: "utf8",
+		frames: []rawFrame{{First: websocket.TextMessage, Payload: []byte("\xce\xba\xe1\xbd")}, {First: frameFin, Payload: []byte("\xb9\xcf\x83\xce\xbc\xce\xb5")}},
+		want:   []echoFrame{{websocket.TextMessage, utf8Valid}}},
+	{Name: "invalid-utf8", Group: "utf8", Drop: true, Closes: closesInvalid,
+		frames: []rawFrame{textFrame(utf8Invalid)}},
+	{Name: "invalid-utf8-fragmented", Group: "utf8", Drop: true, Closes: closesInvalid,
+		frames: []rawFrame{{First: websocket.TextMessage, Payload: []byte("hello\xce")}, {First: frameFin, Payload: []byte("\xff world")}}},
+	{Name: "utf8-overlong", Group: "utf8", Drop: true, Closes: closesInvalid,
+		frames: []rawFrame{textFrame("\xc0\xaf")}},
+	{Name: "utf8-beyond-max-codepoint", Group: "utf8", Drop: true, Closes: closesInvalid,
+		frames: []rawFrame{textFrame("\xf4\x90\x80\x80")}},
+
+	{Name: "close-normal", Group: "close", Closes: closesNormal,
+		frames: []rawFrame{closeFrame(websocket.CloseNormalClosure, "")}},
+	{Name: "close-with-reason", Group: "close", Closes: closesNormal,
+		frames: []rawFrame{closeFrame(websocket.CloseNormalClosure, "bye")}},
+	{Name: "close-empty", Group: "close", Closes: []int{websocket.CloseNormalClosure, websocket.CloseNoStatusReceived},
+		frames: []rawFrame{closeFrame(0, "")}},
+	{Name: "close-then-message", Group: "close", Closes: closesNormal,
+		frames: []rawFrame{closeFrame(websocket.CloseNormalClosure, ""), textFrame("after close")}},
+	{Name: "close-invalid-code", Group: "close", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{closeFrame(999, "")}},
+	{Name: "close-reserved-code", Group: "close", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{closeFrame(1004, "")}},
+	{Name: "close-one-byte-payload", Group: "close", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{{First: frameFin | websocket.CloseMessage, Payload: []byte{0x03}}}},
+	{Name: "close-invalid-reason", Group: "close", Drop: true, Closes: closesInvalid,
+		frames: []rawFrame{closeFrame(websocket.CloseNormalClosure, utf8Invalid)}},
+	{Name: "close-oversized", Group: "close", Drop: true, Closes: closesProtocol,
+		frames: []rawFrame{closeFrame(websocket.CloseNormalClosure, strings.Repeat("r", 124))}},
+}
+
+// conformanceCases returns the cases or groups of cases named by names,
+// all of them if none.
+func conformanceCases(names []string) ([]ConformanceCase, error) {
+	if len(names) == 0 {
+		return ConformanceCases, nil
+	}
+	var cases []ConformanceCase
+	for _, name := range names {
+		found := false
+		for _, c := range ConformanceCases {
+			if c.Name == name || c.Group == name {
+				cases = append(cases, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown conformance case %q", name)
+		}
+	}
+	return cases, nil
+}
+
+// check sends the frames of the case and returns why the responses read
+// from br fail it, empty if they pass.
+func (c *ConformanceCase) check(conn net.Conn, br *bufio.Reader) string {
+	var frames []byte
+	for _, f := range c.frames {
+		frames = appendFrame(frames, f)
+	}
+	// a write failing on a server closing at an invalid frame is fine for
+	// cases expecting a close, which is read below
+	if _, err := conn.Write(frames); err != nil && len(c.Closes) == 0 {
+		return "write: " + err.Error()
+	}
+	initiated := false
+	for _, f := range c.frames {
+		initiated = initiated || f.First&0x0f == websocket.CloseMessage
+	}
+
+	want := c.want
+	var msg []byte
+	var msgOp int
+	for len(want) > 0 || len(c.Closes) > 0 {
+		fin, op, payload, err := readFrame(br)
+		switch {
+		case err == nil:
+		case len(want) > 0 && isTimeout(err):
+			return fmt.Sprintf("timeout waiting for %s", want[0])
+		case len(want) > 0:
+			return fmt.Sprintf("dropped waiting for %s", want[0])
+		case isTimeout(err):
+			return "timeout waiting for close"
+		case c.Drop:
+			return ""
+		default:
+			return "dropped without close frame"
+		}
+
+		var got echoFrame
+		switch op {
+		case websocket.CloseMessage:
+			code := websocket.CloseNoStatusReceived
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if len(want) > 0 {
+				return fmt.Sprintf("close %d waiting for %s", code, want[0])
+			}
+			if !containsCode(c.Closes, code) {
+				return fmt.Sprintf("close %d, want %s", code, formatCodes(c.Closes))
+			}
+			if !initiated {
+				conn.Write(appendFrame(nil, closeFrame(code, "")))
+			}
+			// the server closes the connection once the close handshake
+			// is done
+			if _, _, _, err := readFrame(br); err == nil || isTimeout(err) {
+				return "connection not closed after close handshake"
+			}
+			return ""
+		case websocket.PingMessage:
+			conn.Write(appendFrame(nil, pongFrame(string(payload))))
+			continue
+		case websocket.PongMessage:
+			got = echoFrame{op, string(payload)}
+		default:
+			if op != 0 {
+				msgOp, msg = op, nil
+			}
+			msg = append(msg, payload...)
+			if !fin {
+				continue
+			}
+			got = echoFrame{msgOp, string(msg)}
+		}
+		if len(want) == 0 {
+			return fmt.Sprintf("unexpected %s waiting for close", got)
+		}
+		if got != want[0] {
+			return fmt.Sprintf("got %s, want %s", got, want[0])
+		}
+		want = want[1:]
+	}
+	conn.Write(appendFrame(nil, closeFrame(websocket.CloseNormalClosure, "")))
+	return ""
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func formatCodes(codes []int) string {
+	s := make([]string, len(codes))
+	for i, code := range codes {
+		s[i] = fmt.Sprint(code)
+	}
+	return strings.Join(s, " or ")
+}
+
+// runConformance runs the conformance case of the task on a connection.
+func (b *Benchmark) runConformance(ctx context.Context, t *task) error {
+	c := b.conformance[(t.id-1)%len(b.conformance)]
+	conn, br, err := b.dialRaw(ctx, t)
+	if conn == nil {
+		if err != nil {
+			b.stats.addConformance(c, "dial: "+err.Error())
+		}
+		return err
+	}
+	b.stats.AddActive()
+	defer atomic.AddInt64(&b.stats.Active, -1)
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	b.log.Debug("conformance", "task", t.id, "case", c.Name)
+	timeout := b.opts.ReadTimeout
+	if timeout <= 0 {
+		timeout = rawTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	failure := c.check(conn, br)
+	if ctx.Err() != nil {
+		return nil
+	}
+	b.stats.addConformance(c, failure)
+	return nil
+}
+
+// ConformResult counts runs of a conformance case, Failure is why the
+// first failed run failed.
+type ConformResult struct {
+	Case    string `json:"case"`
+	Group   string `json:"group"`
+	Runs    int64  `json:"runs"`
+	Passed  int64  `json:"passed"`
+	Failure string `json:"failure,omitempty"`
+}
+
+func (s *stats) addConformance(c ConformanceCase, failure string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conformance == nil {
+		s.conformance = make(map[string]*ConformResult)
+	}
+	r := s.conformance[c.Name]
+	if r == nil {
+		r = &ConformResult{Case: c.Name, Group: c.Group}
+		s.conformance[c.Name] = r
+	}
+	r.Runs++
+	if failure == "" {
+		r.Passed++
+	} else if r.Failure == "" {
+		r.Failure = failure
+	}
+}
+
+func (s *stats) conformanceResults() []ConformResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var results []ConformResult
+	for _, r := range s.conformance {
+		results = append(results, *r)
+	}
+	sortConformance(results)
+	return results
+}
+
+// sortConformance sorts results in the order of ConformanceCases.
+func sortConformance(results []ConformResult) {
+	index := make(map[string]int, len(ConformanceCases))
+	for i, c := range ConformanceCases {
+		index[c.Name] = i
+	}
+	sort.Slice(results, func(i, j int) bool { return index[results[i].Case] < index[results[j].Case] })
+}
+
+// mergeConformance adds runs of conformance cases of o to r.
+func (r *Result) mergeConformance(o *Result) {
+	for _, oc := range o.Conformance {
+		i := 0
+		for i < len(r.Conformance) && r.Conformance[i].Case != oc.Case {
+			i++
+		}
+		if i == len(r.Conformance) {
+			r.Conformance = append(r.Conformance, ConformResult{Case: oc.Case, Group: oc.Group})
+		}
+		r.Conformance[i].Runs += oc.Runs
+		r.Conformance[i].Passed += oc.Passed
+		if r.Conformance[i].Failure == "" {
+			r.Conformance[i].Failure = oc.Failure
+		}
+	}
+	sortConformance(r.Conformance)
+}
+
+// writeConformance writes pass or fail of conformance cases by group.
+func writeConformance(w io.Writer, results []ConformResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "conformance:")
+	var passed int
+	group := ""
+	for _, r := range results {
+		if r.Group != group {
+			group = r.Group
+			fmt.Fprintf(w, "  %s:\n", group)
+		}
+		status := "FAIL"
+		if r.Passed == r.Runs {
+			status = "pass"
+			passed++
+		}
+		var line bytes.Buffer
+		fmt.Fprintf(&line, "    %-4s %-30s", status, r.Case)
+		if r.Runs > 1 {
+			fmt.Fprintf(&line, " %d/%d", r.Passed, r.Runs)
+		}
+		if r.Failure != "" {
+			fmt.Fprintf(&line, " %s", r.Failure)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
+	fmt.Fprintf(w, "  passed %d of %d cases\n", passed, len(results))
+}
@@ -0,0 +1,132 @@
+package wsbm
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countConn counts bytes read from and written to the network.
+type countConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// netDialContext dials addr from the next of LocalAddrs if any, counts and
+// throttles bytes of the connection, and shapes it.
+func (b *Benchmark) netDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if n := len(b.opts.LocalAddrs); n > 0 {
+		i := int(atomic.AddUint32(&b.local, 1)-1) % n
+		d.LocalAddr = &net.TCPAddr{IP: b.opts.LocalAddrs[i]}
+	}
+	conn, err := b.dialAddr(ctx, &d, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !b.opts.HTTP2 {
+		// streams of HTTP/2 connections are shaped instead
+		conn = b.shapedConn(ctx, conn)
+	}
+	return b.throttled(&countConn{Conn: conn, read: &b.stats.WireBytesIn, written: &b.stats.WireBytesOut}), nil
+}
+
+// dialAddr resolves addr by Resolve or DNS and dials its ips in turn,
+// timing both for dial trace of ctx and over its network if set.
+func (b *Benchmark) dialAddr(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := getDialTrace(ctx)
+	if trace != nil && trace.network != "" {
+		network = trace.network
+	}
+	ips := []string{host}
+	if ip, ok := b.opts.Resolve[addr]; ok {
+		ips[0] = ip
+	} else if net.ParseIP(host) == nil {
+		start := time.Now()
+		addrs, err := b.resolver.LookupIP(ctx, lookupNetwork(network), host)
+		if err != nil {
+			return nil, err
+		}
+		if trace != nil {
+			trace.dns = time.Since(start)
+		}
+		ips = ips[:0]
+		for _, ip := range addrs {
+			ips = append(ips, ip.String())
+		}
+	}
+
+	var conn net.Conn
+	start := time.Now()
+	for _, ip := range ips {
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil {
+		trace.tcp = time.Since(start)
+	}
+	return conn, nil
+}
+
+// newResolver returns the resolver querying DNS server addr, port 53 by
+// default, or the default resolver if addr is empty.
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// tcpConn returns the TCP connection under TLS, counting, throttling and
+// shaping wrappers.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v
+		case *tls.Conn:
+			c = v.NetConn()
+		case *countConn:
+			c = v.Conn
+		case *throttleConn:
+			c = v.Conn
+		case *shapeConn:
+			c = v.Conn
+		default:
+			return nil
+		}
+	}
+}
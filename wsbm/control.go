@@ -0,0 +1,350 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// control holds settings of a run changed while it runs, by SetConcurrency,
+// SetRate, SetDuration and Pause.
+type control struct {
+	// concurrency of workers, changed signals them to be scaled.
+	concurrency int32
+	changed     chan struct{}
+	// paused is set while resumed is open, closed by Resume.
+	paused  int32
+	resumed chan struct{}
+
+	mu       sync.Mutex
+	rate     float64
+	duration time.Duration
+	// stop ends the run when its duration elapsed by timer, nil until the
+	// run starts.
+	stop  context.CancelFunc
+	timer *time.Timer
+}
+
+// Controls are settings of a running benchmark, Duration is from its
+// start, 0 means no limit, and so does Rate.
+type Controls struct {
+	Concurrency int           `json:"concurrency"`
+	Rate        float64       `json:"rate"`
+	Duration    time.Duration `json:"-"`
+	Paused      bool          `json:"paused"`
+}
+
+func (c Controls) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Concurrency int     `json:"concurrency"`
+		Rate        float64 `json:"rate"`
+		Duration    string  `json:"duration"`
+		Paused      bool    `json:"paused"`
+	}{c.Concurrency, c.Rate, c.Duration.String(), c.Paused})
+}
+
+// Controls returns current settings of the run.
+func (b *Benchmark) Controls() Controls {
+	c := &b.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Controls{
+		Concurrency: int(atomic.LoadInt32(&c.concurrency)),
+		Rate:        c.rate,
+		Duration:    c.duration,
+		Paused:      c.resumed != nil,
+	}
+}
+
+// SetConcurrency starts or stops workers to run n at once, stopped ones
+// close their connections gracefully. Ramp, AutoTune, FindMax and Arrival
+// runs set their concurrency themselves.
+func (b *Benchmark) SetConcurrency(n int) error {
+	switch {
+	case n < 1:
+		return fmt.Errorf("invalid concurrency %d", n)
+	case len(b.opts.Ramp) > 0 || b.opts.AutoTune != nil || b.opts.FindMax != nil || b.opts.Arrival != nil:
+		return errors.New("concurrency is set by ramp, auto tune, find max or arrival")
+	}
+	atomic.StoreInt32(&b.control.concurrency, int32(n))
+	select {
+	case b.control.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetRate limits new connections to rate per second, 0 means no limit.
+func (b *Benchmark) SetRate(rate float64) error {
+	if rate < 0 {
+		return fmt.Errorf("invalid rate %g", rate)
+	}
+	b.control.mu.Lock()
+	b.control.rate = rate
+	b.control.mu.Unlock()
+	b.limiter.SetRate(rate)
+	return nil
+}
+
+// SetDuration stops the run after d elapsed since its start, at once if
+// it already did, 0 means no limit.
+func (b *Benchmark) SetDuration(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid duration %s", d)
+	}
+	c := &b.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.duration = d
+	if c.stop != nil {
+		c.schedule(b.stats.Start)
+	}
+	return nil
+}
+
+// Pause holds new connections and sends of messages until Resume, open
+// connections are kept alive by pings and keepalive messages.
+func (b *Benchmark) Pause() {
+	c := &b.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+		atomic.StoreInt32(&c.paused, 1)
+		b.log.Info("pause")
+	}
+}
+
+// Resume lets connections and sends held by Pause go on.
+func (b *Benchmark) Resume() {
+	c := &b.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		atomic.StoreInt32(&c.paused, 0)
+		close(c.resumed)
+		c.resumed = nil
+		b.log.Info("resume")
+	}
+}
+
+// Paused reports whether the run is paused.
+func (b *Benchmark) Paused() bool {
+	return atomic.LoadInt32(&b.control.paused) != 0
+}
+
+// wait blocks while the run is paused, it returns false when ctx is done.
+func (c *control) wait(ctx context.Context) bool {
+	if atomic.LoadInt32(&c.paused) == 0 {
+		return ctx.Err() == nil
+	}
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// start arms the timer of the duration of the run started at start, stop
+// ends it.
+func (c *control) start(start time.Time, stop context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop = stop
+	c.schedule(start)
+}
+
+func (c *control) schedule(start time.Time) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.duration <= 0 {
+		return
+	}
+	if left := time.Until(start.Add(c.duration)); left > 0 {
+		c.timer = time.AfterFunc(left, c.stop)
+	} else {
+		c.stop()
+	}
+}
+
+// end stops the timer of the run.
+func (c *control) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// workers runs workers at the concurrency of the control, starting and
+// stopping them as it changes, until all of them returned or ctx is done.
+func (b *Benchmark) workers(ctx context.Context, wg *sync.WaitGroup, count *int32) {
+	var cancels []context.CancelFunc
+	var live int32
+	exited := make(chan struct{}, 1)
+	for {
+		target := int(atomic.LoadInt32(&b.control.concurrency))
+		for len(cancels) < target {
+			workerCtx, cancel := context.WithCancel(ctx)
+			cancels = append(cancels, cancel)
+			atomic.AddInt32(&live, 1)
+			wg.Add(1)
+			go b.work(workerCtx, count, func() {
+				defer wg.Done()
+				atomic.AddInt32(&live, -1)
+				select {
+				case exited <- struct{}{}:
+				default:
+				}
+			})
+		}
+		for len(cancels) > target {
+			cancels[len(cancels)-1]()
+			cancels = cancels[:len(cancels)-1]
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.control.changed:
+		case <-exited:
+			if atomic.LoadInt32(&live) == 0 {
+				return
+			}
+		}
+	}
+}
+
+// liveStats are totals of a running benchmark, the last sample of its
+// timeline and its controls.
+type liveStats struct {
+	Elapsed     float64  `json:"elapsed_s"`
+	Active      int64    `json:"active"`
+	Connections int64    `json:"connections"`
+	Messages    int64    `json:"messages"`
+	Bytes       int64    `json:"bytes"`
+	Errors      int64    `json:"errors"`
+	Last        *Sample  `json:"last,omitempty"`
+	Controls    Controls `json:"controls"`
+}
+
+// ControlHandler serves live stats on GET /stats, and the controls of the
+// run on /controls, changed by POST with form values concurrency, rate,
+// duration and paused, eg: curl -d concurrency=200 -d duration=30m
+// host/controls or curl -d paused=true host/controls.
+func (b *Benchmark) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s := &b.stats
+		cur := s.snapshot()
+		live := liveStats{
+			Active:      atomic.LoadInt64(&s.Active),
+			Connections: cur.connections,
+			Messages:    cur.messages,
+			Bytes:       cur.bytes,
+			Errors:      cur.errors,
+			Controls:    b.Controls(),
+		}
+		s.mu.Lock()
+		if !s.Start.IsZero() {
+			live.Elapsed = time.Since(s.Start).Seconds()
+		}
+		if n := len(s.timeline); n > 0 {
+			last := s.timeline[n-1]
+			live.Last = &last
+		}
+		s.mu.Unlock()
+		writeControlJSON(w, live)
+	})
+	mux.HandleFunc("/controls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := b.setControls(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeControlJSON(w, b.Controls())
+	})
+	return mux
+}
+
+// setControls applies the controls of the form of r, all are checked
+// before any is set.
+func (b *Benchmark) setControls(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	var set []func() error
+	if v := r.PostForm.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid concurrency %q", v)
+		}
+		set = append(set, func() error { return b.SetConcurrency(n) })
+	}
+	if v := r.PostForm.Get("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("invalid rate %q", v)
+		}
+		set = append(set, func() error { return b.SetRate(rate) })
+	}
+	if v := r.PostForm.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		set = append(set, func() error { return b.SetDuration(d) })
+	}
+	if v := r.PostForm.Get("paused"); v != "" {
+		paused, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid paused %q", v)
+		}
+		set = append(set, func() error {
+			if paused {
+				b.Pause()
+			} else {
+				b.Resume()
+			}
+			return nil
+		})
+	}
+	for _, f := range set {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
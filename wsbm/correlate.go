@@ -0,0 +1,78 @@
+package wsbm
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ParseCorrelation parses the JSONPaths of request ids of sent messages
+// and of replies, both or none are set.
+func ParseCorrelation(send, recv string) (*JSONPath, *JSONPath, error) {
+	if send == "" && recv == "" {
+		return nil, nil, nil
+	}
+	if send == "" || recv == "" {
+		return nil, nil, errors.New("correlation needs both send and recv jsonpath")
+	}
+	sendPath, err := ParseJSONPath(send)
+	if err != nil {
+		return nil, nil, err
+	}
+	recvPath, err := ParseJSONPath(recv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sendPath, recvPath, nil
+}
+
+// sent remembers when a message with a CorrelateSend value was sent.
+func (s *session) sent(data []byte) {
+	id, ok := correlationID(s.b.opts.CorrelateSend, data)
+	if !ok {
+		return
+	}
+	s.rmu.Lock()
+	if s.requests == nil {
+		s.requests = make(map[string]time.Time)
+	}
+	s.requests[id] = time.Now()
+	s.rmu.Unlock()
+}
+
+// replied records the latency of the request a received message with a
+// CorrelateRecv value replies to.
+func (s *session) replied(content []byte) {
+	id, ok := correlationID(s.b.opts.CorrelateRecv, content)
+	if !ok {
+		return
+	}
+	s.rmu.Lock()
+	start, ok := s.requests[id]
+	delete(s.requests, id)
+	s.rmu.Unlock()
+	if ok {
+		s.b.addLatency(MetricReply, s.id, time.Since(start))
+	}
+}
+
+// lostReplies counts requests not replied when the session closes.
+func (s *session) lostReplies() {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if len(s.requests) > 0 {
+		atomic.AddInt64(&s.b.stats.LostReplies, int64(len(s.requests)))
+		s.requests = nil
+	}
+}
+
+func correlationID(path *JSONPath, data []byte) (string, bool) {
+	if path == nil {
+		return "", false
+	}
+	v, ok := path.LookupJSON(data)
+	if !ok || v == nil {
+		return "", false
+	}
+	return jsonString(v), true
+}
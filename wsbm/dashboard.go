@@ -0,0 +1,234 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dashboardWidth is the number of samples in sparklines and heat map.
+	dashboardWidth = 60
+	dashboardLogs  = 5
+)
+
+var (
+	sparks = []rune("▁▂▃▄▅▆▇█")
+	shades = []rune(" ░▒▓█")
+)
+
+// dashboard draws live stats in place on a terminal, recent log records
+// are kept to show instead of passing them to Logger.
+type dashboard struct {
+	w io.Writer
+
+	connects []float64
+	messages []float64
+	errors   []float64
+	// heat are handshake latency bucket counts of samples, the last one
+	// counts latencies over the largest bucket.
+	heat        [][len(latencyBuckets) + 1]int64
+	lastBuckets [len(latencyBuckets) + 1]int64
+
+	mu   sync.Mutex
+	logs []string
+}
+
+func (d *dashboard) log(line string) {
+	d.mu.Lock()
+	d.logs = append(d.logs, line)
+	if len(d.logs) > dashboardLogs {
+		d.logs = d.logs[len(d.logs)-dashboardLogs:]
+	}
+	d.mu.Unlock()
+}
+
+// dashboardHandler keeps records enabled by the next handler as lines of
+// the dashboard.
+type dashboardHandler struct {
+	d     *dashboard
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *dashboardHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *dashboardHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		fmt.Fprintf(&sb, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	h.d.log(sb.String())
+	return nil
+}
+
+func (h *dashboardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &dashboardHandler{d: h.d, next: h.next, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *dashboardHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// push appends a sample to history keeping dashboardWidth samples.
+func push(history []float64, v float64) []float64 {
+	history = append(history, v)
+	if len(history) > dashboardWidth {
+		history = history[1:]
+	}
+	return history
+}
+
+func sparkline(history []float64) string {
+	var max float64
+	for _, v := range history {
+		if v > max {
+			max = v
+		}
+	}
+	var sb strings.Builder
+	for _, v := range history {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparks)-1))
+		}
+		sb.WriteRune(sparks[i])
+	}
+	return sb.String()
+}
+
+// sample records rates of the last secs and handshake latencies since the
+// previous sample.
+func (d *dashboard) sample(s *stats, cur, last snapshot, secs float64) {
+	d.connects = push(d.connects, float64(cur.connections-last.connections)/secs)
+	d.messages = push(d.messages, float64(cur.messages-last.messages)/secs)
+	d.errors = push(d.errors, float64(cur.errors-last.errors)/secs)
+
+	var buckets [len(latencyBuckets) + 1]int64
+	s.Handshake.mu.Lock()
+	copy(buckets[:], s.Handshake.buckets[:])
+	buckets[len(latencyBuckets)] = s.Handshake.count()
+	s.Handshake.mu.Unlock()
+	for _, n := range buckets[:len(latencyBuckets)] {
+		buckets[len(latencyBuckets)] -= n
+	}
+
+	var delta [len(latencyBuckets) + 1]int64
+	for i := range buckets {
+		delta[i] = buckets[i] - d.lastBuckets[i]
+	}
+	d.lastBuckets = buckets
+	d.heat = append(d.heat, delta)
+	if len(d.heat) > dashboardWidth {
+		d.heat = d.heat[1:]
+	}
+}
+
+func (d *dashboard) draw(s *stats, elapsed time.Duration) {
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&sb, "elapsed: %s, active: %d, connections: %d, messages: %d, errors: %d\n\n",
+		elapsed.Truncate(time.Second), atomic.LoadInt64(&s.Active),
+		atomic.LoadInt64(&s.Connections), atomic.LoadInt64(&s.Messages), s.ErrorCount())
+
+	for _, line := range []struct {
+		name    string
+		history []float64
+	}{
+		{"connect/s", d.connects},
+		{"msg/s", d.messages},
+		{"errors/s", d.errors},
+	} {
+		var cur float64
+		if len(line.history) > 0 {
+			cur = line.history[len(line.history)-1]
+		}
+		fmt.Fprintf(&sb, "%-10s %10.1f %s\n", line.name, cur, sparkline(line.history))
+	}
+
+	var max int64
+	for _, col := range d.heat {
+		for _, n := range col {
+			if n > max {
+				max = n
+			}
+		}
+	}
+	sb.WriteString("\nhandshake latency\n")
+	for row := len(latencyBuckets); row >= 0; row-- {
+		label := ">" + fmtSeconds(latencyBuckets[len(latencyBuckets)-1])
+		if row < len(latencyBuckets) {
+			label = "<=" + fmtSeconds(latencyBuckets[row])
+		}
+		fmt.Fprintf(&sb, "%10s |", label)
+		for _, col := range d.heat {
+			i := 0
+			if col[row] > 0 {
+				i = 1 + int(float64(col[row])/float64(max)*float64(len(shades)-2))
+			}
+			sb.WriteRune(shades[i])
+		}
+		sb.WriteString("\n")
+	}
+
+	if errors := s.Errors(); len(errors) > 0 {
+		sb.WriteString("\nerrors:\n")
+		writeCounts(&sb, errors)
+	}
+
+	d.mu.Lock()
+	if len(d.logs) > 0 {
+		sb.WriteString("\nlog:\n")
+		for _, line := range d.logs {
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+	d.mu.Unlock()
+
+	io.WriteString(d.w, sb.String())
+}
+
+func fmtSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).String()
+}
+
+// runDashboard draws the dashboard every interval until done is closed,
+// and once more before returning.
+func (b *Benchmark) runDashboard(interval time.Duration, done <-chan struct{}) {
+	s, d := &b.stats, b.dashboard
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	io.WriteString(d.w, "\x1b[?25l")
+	defer io.WriteString(d.w, "\x1b[?25h")
+
+	last, lastTime := s.snapshot(), time.Now()
+	for {
+		select {
+		case <-done:
+			d.draw(s, time.Since(s.Start))
+			return
+		case now := <-ticker.C:
+			cur := s.snapshot()
+			if b.opts.Hold {
+				s.AddAlive(now.Sub(s.Start), atomic.LoadInt64(&s.Active))
+			}
+			d.sample(s, cur, last, now.Sub(lastTime).Seconds())
+			d.draw(s, now.Sub(s.Start))
+			last, lastTime = cur, now
+		}
+	}
+}
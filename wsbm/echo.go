@@ -0,0 +1,100 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoMessage is sent in echo mode, rtt is measured when it comes back.
+type echoMessage struct {
+	Seq int64 `json:"seq"`
+	Ts  int64 `json:"ts"`
+}
+
+// runEcho sends echo messages every SendInterval, or after previous echo
+// arrived if SendInterval is 0, or after think times of Think, and records
+// their round-trip times, summarized per connection by ConnResult.RTT.
+func (b *Benchmark) runEcho(ctx context.Context, t *task) error {
+	id := t.id
+	s, err := b.open(ctx, t)
+	if s == nil {
+		return err
+	}
+	defer s.Close()
+
+	next := make(chan struct{}, 1)
+	go b.sendEcho(s, next)
+
+	rtt := latency{sigfigs: 2}
+	defer func() {
+		if sum := rtt.Summary(); sum.Count > 0 {
+			b.log.Debug("echo rtt", "task", id, "count", sum.Count, "min", round(sum.Min), "avg", round(sum.Avg),
+				"max", round(sum.Max), "p50", round(sum.P50), "p90", round(sum.P90), "p99", round(sum.P99))
+			sum.Histogram = nil
+			t.result.RTT = sum
+		}
+	}()
+
+	var echoed int
+	for {
+		s.setReadTimeout(b.opts.ReadTimeout)
+		_, content, err := s.read()
+		if err != nil {
+			return s.err(err)
+		}
+		if s.closing {
+			continue
+		}
+
+		var msg echoMessage
+		if json.Unmarshal(content, &msg) != nil || msg.Seq == 0 {
+			continue
+		}
+		d := time.Since(time.Unix(0, msg.Ts))
+		rtt.Add(d)
+		b.addLatency(MetricRTT, id, d)
+		select {
+		case next <- struct{}{}:
+		default:
+		}
+
+		echoed++
+		if b.opts.MaxMessages > 0 && echoed >= b.opts.MaxMessages {
+			s.shutdown()
+		}
+	}
+}
+
+func (b *Benchmark) sendEcho(s *session, next <-chan struct{}) {
+	var tick <-chan time.Time
+	if b.opts.SendInterval > 0 {
+		ticker := time.NewTicker(b.opts.SendInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		next = nil
+	}
+
+	for seq := int64(1); b.opts.MaxMessages <= 0 || seq <= int64(b.opts.MaxMessages); seq++ {
+		data, _ := json.Marshal(echoMessage{Seq: seq, Ts: time.Now().UnixNano()})
+		if err := s.send(websocket.TextMessage, data); err != nil {
+			b.log.Warn("send", "task", s.id, "err", err)
+			return
+		}
+
+		if b.opts.Think != nil {
+			if !s.pause() {
+				return
+			}
+			continue
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-tick:
+		case <-next:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package wsbm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxErrorExamples is the most distinct messages kept per error category.
+const maxErrorExamples = 3
+
+// ErrorCategory counts errors of a stage of connections, dns, dial, tls,
+// upgrade, read, write, timeout, close, protocol, pre-request, injected or
+// other,
+// with example messages.
+type ErrorCategory struct {
+	Name     string   `json:"name"`
+	Count    int64    `json:"count"`
+	Examples []string `json:"examples,omitempty"`
+}
+
+// errorCategory returns the category of err, timeouts of any stage are
+// timeouts.
+func errorCategory(err error) string {
+	var closeErr *websocket.CloseError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var rawErr *rawError
+	switch {
+	case errors.As(err, &rawErr):
+		return rawErr.category
+	case errors.Is(err, ErrHandshakeTimeout), errors.Is(err, ErrReadTimeout),
+		errors.Is(err, ErrPongTimeout), isTimeout(err):
+		return "timeout"
+	case errors.Is(err, ErrPreRequest):
+		return "pre-request"
+	case errors.Is(err, ErrProtocol):
+		return "protocol"
+	case errors.Is(err, ErrInjectedReset):
+		return "injected"
+	case errors.As(err, &closeErr):
+		return "close"
+	case errors.Is(err, websocket.ErrBadHandshake):
+		return "upgrade"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case isTLSError(err):
+		return "tls"
+	case errors.As(err, &opErr):
+		switch opErr.Op {
+		case "dial", "proxyconnect":
+			return "dial"
+		case "write":
+			return "write"
+		default:
+			return "read"
+		}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "read"
+	default:
+		return "other"
+	}
+}
+
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || strings.Contains(err.Error(), "tls: ")
+}
+
+// addCategory counts err in its category, keeping its message if new.
+// The caller holds s.mu.
+func (s *stats) addCategory(err error) {
+	if s.categories == nil {
+		s.categories = make(map[string]*ErrorCategory)
+	}
+	name := errorCategory(err)
+	c := s.categories[name]
+	if c == nil {
+		c = &ErrorCategory{Name: name}
+		s.categories[name] = c
+	}
+	c.Count++
+	c.addExample(err.Error())
+}
+
+func (c *ErrorCategory) addExample(msg string) {
+	if len(c.Examples) >= maxErrorExamples {
+		return
+	}
+	for _, example := range c.Examples {
+		if example == msg {
+			return
+		}
+	}
+	c.Examples = append(c.Examples, msg)
+}
+
+func (s *stats) Categories() []ErrorCategory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var categories []ErrorCategory
+	for _, c := range s.categories {
+		categories = append(categories, ErrorCategory{
+			Name:     c.Name,
+			Count:    c.Count,
+			Examples: append([]string(nil), c.Examples...),
+		})
+	}
+	sortCategories(categories)
+	return categories
+}
+
+// sortCategories sorts categories by count, the most frequent first.
+func sortCategories(categories []ErrorCategory) {
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Count != categories[j].Count {
+			return categories[i].Count > categories[j].Count
+		}
+		return categories[i].Name < categories[j].Name
+	})
+}
+
+// mergeCategories adds counts and examples of o to r.
+func (r *Result) mergeCategories(o *Result) {
+	for _, oc := range o.Failures {
+		i := 0
+		for i < len(r.Failures) && r.Failures[i].Name != oc.Name {
+			i++
+		}
+		if i == len(r.Failures) {
+			r.Failures = append(r.Failures, ErrorCategory{Name: oc.Name})
+		}
+		c := &r.Failures[i]
+		c.Count += oc.Count
+		for _, example := range oc.Examples {
+			c.addExample(example)
+		}
+	}
+	sortCategories(r.Failures)
+}
+
+// writeCategories writes errors by category with their examples.
+func writeCategories(w io.Writer, categories []ErrorCategory) {
+	if len(categories) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "error categories:")
+	for _, c := range categories {
+		fmt.Fprintf(w, "  %-13s %8d\n", c.Name+":", c.Count)
+		for _, example := range c.Examples {
+			fmt.Fprintf(w, "    e.g. %s\n", example)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+)
+
+// FamilyResult is the result of connections over an address family,
+// Network is tcp4 or tcp6.
+type FamilyResult struct {
+	Network string `json:"network"`
+	*Result
+}
+
+// network returns the network connection id dials by Networks, empty for
+// any family.
+func (b *Benchmark) network(id int) string {
+	if len(b.opts.Networks) == 0 {
+		return ""
+	}
+	return b.opts.Networks[id%len(b.opts.Networks)]
+}
+
+// lookupNetwork returns the ip network resolving hosts dialed by network.
+func lookupNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "ip4"
+	case "tcp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+func (b *Benchmark) familyResults() []FamilyResult {
+	var results []FamilyResult
+	for i := range b.families {
+		s := &b.families[i]
+		s.Start, s.End = b.stats.Start, b.stats.End
+		results = append(results, FamilyResult{Network: b.opts.Networks[i], Result: s.Result(nil)})
+	}
+	return results
+}
+
+// writeFamilies writes per address family summaries.
+func writeFamilies(w io.Writer, families []FamilyResult) {
+	if len(families) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "address families:")
+	for _, f := range families {
+		writeBreakdown(w, f.Network, f.Result)
+	}
+}
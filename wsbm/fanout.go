@@ -0,0 +1,104 @@
+package wsbm
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// publisher reports whether connection id publishes in fan-out runs, the
+// first Publishers connections publish and the others subscribe.
+func (b *Benchmark) publisher(id int) bool {
+	return id <= b.opts.Publishers
+}
+
+// publishFanout sends FanoutMessage every PublishInterval, by default a
+// JSON message with the publisher id and a timestamp in nanoseconds.
+func (b *Benchmark) publishFanout(s *session) {
+	ticker := time.NewTicker(b.opts.PublishInterval)
+	defer ticker.Stop()
+
+	for seq := 1; ; seq++ {
+		var data []byte
+		if b.opts.FanoutMessage == "" {
+			data = []byte(fmt.Sprintf(`{"publisher":%d,"seq":%d,"ts":%d}`, s.id, seq, time.Now().UnixNano()))
+		} else {
+			var err error
+			if data, err = b.message(s.id, b.opts.FanoutMessage); err != nil {
+				b.log.Warn("publish", "task", s.id, "err", err)
+				return
+			}
+		}
+		if err := s.send(websocket.TextMessage, data); err != nil {
+			b.log.Warn("publish", "task", s.id, "err", err)
+			return
+		}
+		atomic.AddInt64(&b.stats.FanoutPublished, 1)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribe starts counting messages published while a subscriber is
+// connected.
+func (s *session) subscribe() {
+	s.fanout = true
+	s.fanoutStart = atomic.LoadInt64(&s.b.stats.FanoutPublished)
+}
+
+// delivered records the delivery latency of a received message with a
+// FanoutTs timestamp.
+func (s *session) delivered(content []byte) {
+	v, ok := s.b.opts.FanoutTs.LookupJSON(content)
+	if !ok {
+		return
+	}
+	ts, err := strconv.ParseInt(jsonString(v), 10, 64)
+	if err != nil {
+		return
+	}
+	s.fanoutReceived++
+	atomic.AddInt64(&s.b.stats.FanoutDelivered, 1)
+	s.b.addLatency(MetricFanout, s.id, time.Since(unixTime(ts)))
+}
+
+// fanoutLoss counts messages published while the subscriber was connected
+// but not delivered to it.
+func (s *session) fanoutLoss() {
+	expected := atomic.LoadInt64(&s.b.stats.FanoutPublished) - s.fanoutStart
+	atomic.AddInt64(&s.b.stats.FanoutExpected, expected)
+	lost := expected - s.fanoutReceived
+	if lost <= 0 {
+		return
+	}
+	atomic.AddInt64(&s.b.stats.FanoutLost, lost)
+	atomic.AddInt64(&s.b.stats.FanoutLossySubscribers, 1)
+	for {
+		max := atomic.LoadInt64(&s.b.stats.FanoutMaxLost)
+		if lost <= max || atomic.CompareAndSwapInt64(&s.b.stats.FanoutMaxLost, max, lost) {
+			return
+		}
+	}
+}
+
+// unixTime returns the time of a unix timestamp in seconds, milliseconds,
+// microseconds or nanoseconds, told apart by magnitude.
+func unixTime(ts int64) time.Time {
+	switch {
+	case ts > 1e17:
+		return time.Unix(0, ts)
+	case ts > 1e14:
+		return time.UnixMicro(ts)
+	case ts > 1e11:
+		return time.UnixMilli(ts)
+	default:
+		return time.Unix(ts, 0)
+	}
+}
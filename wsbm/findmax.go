@@ -0,0 +1,105 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FindMax adds Batch held connections every Interval until a batch fails,
+// to find the most connections a server keeps.
+type FindMax struct {
+	// Batch is connections added at a time, 100 by default.
+	Batch int
+	// Interval is how long connections of a batch settle, 5s by default.
+	Interval time.Duration
+	// MaxErrorRate is the percentage of failed connections failing a
+	// batch, 1 by default.
+	MaxErrorRate float64
+	// MaxP99 is the handshake p99 failing a batch, 1s by default.
+	MaxP99 time.Duration
+}
+
+// FindMaxResult is the most connections alive after a batch that didn't
+// fail, Reason why the search stopped.
+type FindMaxResult struct {
+	Stable  int64         `json:"stable"`
+	Peak    int64         `json:"peak"`
+	Reason  string        `json:"reason"`
+	Batches []FindMaxStep `json:"batches"`
+}
+
+// FindMaxStep is a batch with the connections alive after it settled.
+type FindMaxStep struct {
+	Connections int           `json:"connections"`
+	Active      int64         `json:"active"`
+	Errors      int64         `json:"errors"`
+	P99         time.Duration `json:"handshake_p99"`
+}
+
+func (r *FindMaxResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "find max: stable connections: %d, peak: %d, stopped: %s\n", r.Stable, r.Peak, r.Reason)
+}
+
+// merge adds the result of an agent searching on its own.
+func (r *FindMaxResult) merge(o *FindMaxResult) {
+	r.Stable += o.Stable
+	r.Peak += o.Peak
+	if r.Reason == "" {
+		r.Reason = o.Reason
+	}
+}
+
+// findMax starts batches of workers holding connections until a batch
+// fails, requests are started or ctx is done, and then stops the run.
+func (b *Benchmark) findMax(ctx context.Context, wg *sync.WaitGroup, count *int32) {
+	fm := b.opts.FindMax
+	b.found = &FindMaxResult{}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var workers int
+	for {
+		last, hist := b.stats.snapshot(), b.stats.Handshake.snapshot()
+		wg.Add(fm.Batch)
+		for i := 0; i < fm.Batch; i++ {
+			go b.work(ctx, count, wg.Done)
+		}
+		workers += fm.Batch
+
+		if !sleepUntil(ctx, time.Now().Add(fm.Interval)) {
+			b.found.Reason = "run stopped"
+			return
+		}
+		cur := b.stats.snapshot()
+		step := FindMaxStep{
+			Connections: workers,
+			Active:      atomic.LoadInt64(&b.stats.Active),
+			Errors:      cur.errors - last.errors,
+		}
+		step.P99, _ = windowPercentile(hist, b.stats.Handshake.snapshot(), 99)
+		b.found.Batches = append(b.found.Batches, step)
+		if step.Active > b.found.Peak {
+			b.found.Peak = step.Active
+		}
+		b.log.Info("find max", "connections", workers, "active", step.Active, "errors", step.Errors,
+			"handshake_p99", round(step.P99))
+
+		switch {
+		case float64(step.Errors)*100 > fm.MaxErrorRate*float64(fm.Batch):
+			b.found.Reason = fmt.Sprintf("%d errors in batch of %d", step.Errors, fm.Batch)
+			return
+		case step.P99 > fm.MaxP99:
+			b.found.Reason = fmt.Sprintf("handshake p99 %s exceeds %s", round(step.P99), fm.MaxP99)
+			return
+		case b.opts.Requests > 0 && int(atomic.LoadInt32(count)) >= b.opts.Requests:
+			b.found.Stable = step.Active
+			b.found.Reason = "requests reached"
+			return
+		}
+		b.found.Stable = step.Active
+	}
+}
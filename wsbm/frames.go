@@ -0,0 +1,61 @@
+package wsbm
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// opcodeNames are names of frame opcodes in traces.
+var opcodeNames = map[int]string{
+	0:                       "continuation",
+	websocket.TextMessage:   "text",
+	websocket.BinaryMessage: "binary",
+	websocket.CloseMessage:  "close",
+	websocket.PingMessage:   "ping",
+	websocket.PongMessage:   "pong",
+}
+
+// traced tells whether frames of connection id are traced, TraceFrames of
+// connections are from the first one.
+func (b *Benchmark) traced(id int) bool {
+	f := b.opts.TraceFrames
+	if f <= 0 {
+		return false
+	}
+	if f >= 1 {
+		return true
+	}
+	return picked(int64(id-1), f, 0)
+}
+
+// traceFrame logs a frame of connection id sent or received at debug
+// level, messages of the default engine are logged as single frames.
+func (b *Benchmark) traceFrame(id int, dir string, op int, fin bool, size int) {
+	name, ok := opcodeNames[op]
+	if !ok {
+		name = strconv.Itoa(op)
+	}
+	b.log.Debug("frame", "task", id, "dir", dir, "opcode", name, "fin", fin, "size", size)
+}
+
+// traceControl makes the session trace control frames it receives, it
+// answers pings and closes like the default handlers.
+func (s *session) traceControl() {
+	s.SetPingHandler(func(data string) error {
+		s.b.traceFrame(s.id, "recv", websocket.PingMessage, true, len(data))
+		s.b.traceFrame(s.id, "send", websocket.PongMessage, true, len(data))
+		err := s.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	s.SetCloseHandler(func(code int, text string) error {
+		s.b.traceFrame(s.id, "recv", websocket.CloseMessage, true, 2+len(text))
+		s.b.traceFrame(s.id, "send", websocket.CloseMessage, true, 2)
+		s.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		return nil
+	})
+}
@@ -0,0 +1,367 @@
+package wsbm
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rawTimeout is how long the server is given to respond to fuzz and
+// conformance cases without ReadTimeout.
+const rawTimeout = 5 * time.Second
+
+// maxFramePayload bounds payloads of frames read raw, larger ones are
+// skipped.
+const maxFramePayload = 1 << 20
+
+// Frame header bits.
+const (
+	frameFin  = 0x80
+	frameRsv1 = 0x40
+	frameRsv2 = 0x20
+	frameRsv3 = 0x10
+	frameMask = 0x80
+)
+
+// rawFrame is a frame sent raw, the first byte holds fin, rsv bits and the
+// opcode. Size is the length in the header, of Payload unless set, and
+// Unmasked frames are sent without a masking key.
+type rawFrame struct {
+	First    byte
+	Payload  []byte
+	Size     uint64
+	Unmasked bool
+}
+
+// appendFrame appends f to buf, masked by a random key unless Unmasked.
+func appendFrame(buf []byte, f rawFrame) []byte {
+	size := f.Size
+	if size == 0 {
+		size = uint64(len(f.Payload))
+	}
+	var mask byte = frameMask
+	if f.Unmasked {
+		mask = 0
+	}
+	buf = append(buf, f.First)
+	switch {
+	case size < 126:
+		buf = append(buf, mask|byte(size))
+	case size <= 0xffff:
+		buf = append(buf, mask|126, byte(size>>8), byte(size))
+	default:
+		buf = append(buf, mask|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], size)
+	}
+	if f.Unmasked {
+		return append(buf, f.Payload...)
+	}
+	var key [4]byte
+	binary.LittleEndian.PutUint32(key[:], mrand.Uint32())
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, f.Payload...)
+	for i := range buf[start:] {
+		buf[start+i] ^= key[i&3]
+	}
+	return buf
+}
+
+// readFrame reads a frame from the server, payloads over maxFramePayload
+// are skipped.
+func readFrame(r *bufio.Reader) (fin bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&frameFin != 0, int(head[0]&0x0f)
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var key [4]byte
+	masked := head[1]&frameMask != 0
+	if masked {
+		if _, err = io.ReadFull(r, key[:]); err != nil {
+			return
+		}
+	}
+	if size > maxFramePayload {
+		_, err = io.CopyN(io.Discard, r, int64(size))
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	return
+}
+
+// closeOnCancel closes conn when ctx is done until the returned stop is
+// called.
+func closeOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// FuzzCase is a malformed sequence of frames, and the close code servers
+// should answer it with by RFC 6455.
+type FuzzCase struct {
+	Name   string
+	Expect int
+	frames []rawFrame
+}
+
+// FuzzCases are the cases of fuzz runs, see Options.Fuzz.
+var FuzzCases = []FuzzCase{
+	{"invalid-utf8", websocket.CloseInvalidFramePayloadData, []rawFrame{
+		{First: frameFin | websocket.TextMessage, Payload: []byte(utf8Invalid)},
+	}},
+	{"invalid-utf8-fragmented", websocket.CloseInvalidFramePayloadData, []rawFrame{
+		{First: websocket.TextMessage, Payload: []byte("hello\xce")},
+		{First: frameFin, Payload: []byte("\xff world")},
+	}},
+	{"oversized-payload", websocket.CloseMessageTooBig, []rawFrame{
+		{First: frameFin | websocket.BinaryMessage, Payload: make([]byte, 1024), Size: 1 << 62},
+	}},
+	{"oversized-control", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin | websocket.PingMessage, Payload: make([]byte, 126)},
+	}},
+	{"reserved-opcode", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin | 3, Payload: []byte("reserved")},
+	}},
+	{"reserved-control-opcode", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin | 11, Payload: []byte("reserved")},
+	}},
+	{"reserved-bits", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin | frameRsv1 | frameRsv2 | frameRsv3 | websocket.TextMessage, Payload: []byte("reserved")},
+	}},
+	{"continuation-without-start", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin, Payload: []byte("continuation")},
+	}},
+	{"message-during-fragments", websocket.CloseProtocolError, []rawFrame{
+		{First: websocket.TextMessage, Payload: []byte("fragment")},
+		{First: frameFin | websocket.TextMessage, Payload: []byte("message")},
+	}},
+	{"fragmented-control", websocket.CloseProtocolError, []rawFrame{
+		{First: websocket.PingMessage, Payload: []byte("fragment")},
+		{First: frameFin, Payload: []byte("ed ping")},
+	}},
+	{"unmasked", websocket.CloseProtocolError, []rawFrame{
+		{First: frameFin | websocket.TextMessage, Payload: []byte("unmasked"), Unmasked: true},
+	}},
+}
+
+// fuzzCase returns the case named name.
+func fuzzCase(name string) (FuzzCase, bool) {
+	for _, c := range FuzzCases {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return FuzzCase{}, false
+}
+
+// FuzzResult counts responses of the server to a fuzz case by outcome,
+// 'close N' for close frames of code N, 'drop' when it closed without a
+// close frame, 'ignored' when it only sent other frames and 'hang' when it
+// sent nothing in time, 'down' when new connections were refused after
+// either. Passed are closes by the Expect code.
+type FuzzResult struct {
+	Case     string           `json:"case"`
+	Expect   int              `json:"expect"`
+	Runs     int64            `json:"runs"`
+	Passed   int64            `json:"passed"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+// runFuzz sends the malformed frames of the fuzz case of the task and
+// records how the server responds.
+func (b *Benchmark) runFuzz(ctx context.Context, t *task) error {
+	c := b.fuzz[(t.id-1)%len(b.fuzz)]
+	conn, br, err := b.dialRaw(ctx, t)
+	if conn == nil {
+		return err
+	}
+	b.stats.AddActive()
+	defer atomic.AddInt64(&b.stats.Active, -1)
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	b.log.Debug("fuzz", "task", t.id, "case", c.Name)
+	var frames []byte
+	for _, f := range c.frames {
+		frames = appendFrame(frames, f)
+	}
+	timeout := b.opts.ReadTimeout
+	if timeout <= 0 {
+		timeout = rawTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// the server may close before reading all frames, what it replies tells
+	_, werr := conn.Write(frames)
+
+	outcome := "hang"
+	for {
+		_, op, payload, err := readFrame(br)
+		if err != nil {
+			if !isTimeout(err) || (werr != nil && !isTimeout(werr)) {
+				outcome = "drop"
+			}
+			break
+		}
+		if op == websocket.CloseMessage {
+			code := websocket.CloseNoStatusReceived
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			outcome = fmt.Sprintf("close %d", code)
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			var reply []byte
+			if len(payload) >= 2 {
+				reply = payload[:2]
+			}
+			conn.Write(appendFrame(nil, rawFrame{First: frameFin | websocket.CloseMessage, Payload: reply}))
+			break
+		}
+		outcome = "ignored"
+	}
+	if (outcome == "drop" || outcome == "hang") && ctx.Err() == nil && b.serverDown(ctx, t) {
+		outcome = "down"
+	}
+	if ctx.Err() != nil && !strings.HasPrefix(outcome, "close") {
+		return nil
+	}
+	t.result.Close = outcome
+	b.stats.addFuzz(c, outcome)
+	return nil
+}
+
+// serverDown reports whether the server of the task refuses connections.
+func (b *Benchmark) serverDown(ctx context.Context, t *task) bool {
+	ctx, cancel := context.WithTimeout(ctx, rawTimeout)
+	defer cancel()
+	conn, err := b.dialAddr(ctx, &net.Dialer{}, "tcp", hostPort(t.url))
+	if err != nil {
+		return !errors.Is(ctx.Err(), context.Canceled)
+	}
+	conn.Close()
+	return false
+}
+
+func (s *stats) addFuzz(c FuzzCase, outcome string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fuzz == nil {
+		s.fuzz = make(map[string]*FuzzResult)
+	}
+	r := s.fuzz[c.Name]
+	if r == nil {
+		r = &FuzzResult{Case: c.Name, Expect: c.Expect, Outcomes: make(map[string]int64)}
+		s.fuzz[c.Name] = r
+	}
+	r.Runs++
+	if outcome == fmt.Sprintf("close %d", c.Expect) {
+		r.Passed++
+	}
+	r.Outcomes[outcome]++
+}
+
+func (s *stats) fuzzResults() []FuzzResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var results []FuzzResult
+	for _, r := range s.fuzz {
+		c := *r
+		c.Outcomes = make(map[string]int64, len(r.Outcomes))
+		addCounts(&c.Outcomes, r.Outcomes)
+		results = append(results, c)
+	}
+	sortFuzz(results)
+	return results
+}
+
+// sortFuzz sorts results in the order of FuzzCases.
+func sortFuzz(results []FuzzResult) {
+	index := make(map[string]int, len(FuzzCases))
+	for i, c := range FuzzCases {
+		index[c.Name] = i
+	}
+	sort.Slice(results, func(i, j int) bool { return index[results[i].Case] < index[results[j].Case] })
+}
+
+// mergeFuzz adds outcomes of fuzz cases of o to r.
+func (r *Result) mergeFuzz(o *Result) {
+	for _, of := range o.Fuzz {
+		i := 0
+		for i < len(r.Fuzz) && r.Fuzz[i].Case != of.Case {
+			i++
+		}
+		if i == len(r.Fuzz) {
+			r.Fuzz = append(r.Fuzz, FuzzResult{Case: of.Case, Expect: of.Expect})
+		}
+		r.Fuzz[i].Runs += of.Runs
+		r.Fuzz[i].Passed += of.Passed
+		addCounts(&r.Fuzz[i].Outcomes, of.Outcomes)
+	}
+	sortFuzz(r.Fuzz)
+}
+
+// writeFuzz writes outcomes of fuzz cases, most frequent first.
+func writeFuzz(w io.Writer, results []FuzzResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "fuzz:")
+	for _, r := range results {
+		outcomes := make([]string, 0, len(r.Outcomes))
+		for outcome := range r.Outcomes {
+			outcomes = append(outcomes, outcome)
+		}
+		sort.Slice(outcomes, func(i, j int) bool {
+			if r.Outcomes[outcomes[i]] != r.Outcomes[outcomes[j]] {
+				return r.Outcomes[outcomes[i]] > r.Outcomes[outcomes[j]]
+			}
+			return outcomes[i] < outcomes[j]
+		})
+		for i, outcome := range outcomes {
+			outcomes[i] = fmt.Sprintf("%s: %d", outcome, r.Outcomes[outcome])
+		}
+		fmt.Fprintf(w, "  %-28s passed %d/%d, expect close %d, %s\n",
+			r.Case+":", r.Passed, r.Runs, r.Expect, strings.Join(outcomes, ", "))
+	}
+}
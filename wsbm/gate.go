@@ -0,0 +1,47 @@
+package wsbm
+
+import (
+	"fmt"
+	"time"
+)
+
+// Thresholds fail a run when exceeded, negative rates and zero durations
+// are disabled. Rates are percentages.
+type Thresholds struct {
+	// MaxErrorRate of failed connections.
+	MaxErrorRate float64
+	// MaxP99 of handshake latency, and of echo rtt if measured.
+	MaxP99 time.Duration
+	// MaxAssertFailRate of failed assertions.
+	MaxAssertFailRate float64
+}
+
+// Violations returns thresholds exceeded by the result, and failed
+// conformance cases.
+func (r *Result) Violations(t Thresholds) []string {
+	var violations []string
+	if t.MaxErrorRate >= 0 && r.Connections > 0 {
+		if rate := float64(r.Errors) / float64(r.Connections) * 100; rate > t.MaxErrorRate {
+			violations = append(violations, fmt.Sprintf("error rate %.2f%% exceeds %.2f%%", rate, t.MaxErrorRate))
+		}
+	}
+	if t.MaxP99 > 0 {
+		if r.Handshake.P99 > t.MaxP99 {
+			violations = append(violations, fmt.Sprintf("handshake p99 %s exceeds %s", round(r.Handshake.P99), t.MaxP99))
+		}
+		if r.RTT.P99 > t.MaxP99 {
+			violations = append(violations, fmt.Sprintf("rtt p99 %s exceeds %s", round(r.RTT.P99), t.MaxP99))
+		}
+	}
+	if t.MaxAssertFailRate >= 0 && r.Assertions > 0 {
+		if rate := float64(r.AssertFailures) / float64(r.Assertions) * 100; rate > t.MaxAssertFailRate {
+			violations = append(violations, fmt.Sprintf("failed assertions %.2f%% exceed %.2f%%", rate, t.MaxAssertFailRate))
+		}
+	}
+	for _, c := range r.Conformance {
+		if c.Passed < c.Runs {
+			violations = append(violations, fmt.Sprintf("conformance case %s failed: %s", c.Case, c.Failure))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,93 @@
+package wsbm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxDivergences is the most divergences kept in results.
+const maxDivergences = 100
+
+// Divergence is where messages of a connection first differed from the
+// Golden transcript.
+type Divergence struct {
+	Conn   int    `json:"conn"`
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// compareGolden compares a received message to the next Golden frame.
+func (s *session) compareGolden(msgType int, content []byte) {
+	if s.diverged {
+		return
+	}
+	golden := s.b.opts.Golden
+	i := s.goldenIndex
+	s.goldenIndex++
+	if i >= len(golden) {
+		s.diverge(i, fmt.Sprintf("unexpected message %s", truncate(content)))
+		return
+	}
+
+	want := golden[i]
+	if want.Binary != (msgType == websocket.BinaryMessage) {
+		s.diverge(i, "message type differs")
+		return
+	}
+	if !equalMessage(want.Data, content, s.b.opts.GoldenNormalize && !want.Binary) {
+		s.diverge(i, fmt.Sprintf("expected %s got %s", truncate(want.Data), truncate(content)))
+	}
+}
+
+// goldenMissing reports Golden frames not received when the connection ends.
+func (s *session) goldenMissing() {
+	if !s.diverged && s.goldenIndex < len(s.b.opts.Golden) {
+		s.diverge(s.goldenIndex, fmt.Sprintf("missing %d messages", len(s.b.opts.Golden)-s.goldenIndex))
+	}
+}
+
+func (s *session) diverge(index int, reason string) {
+	s.diverged = true
+	atomic.AddInt64(&s.b.stats.Diverged, 1)
+	s.b.stats.AddDivergence(Divergence{Conn: s.id, Index: index, Reason: reason})
+}
+
+// equalMessage compares messages, JSON messages are compared by value
+// ignoring key order and whitespace when normalize is set.
+func equalMessage(want, got []byte, normalize bool) bool {
+	if bytes.Equal(want, got) {
+		return true
+	}
+	if !normalize {
+		return false
+	}
+	a, ok := normalizeJSON(want)
+	if !ok {
+		return false
+	}
+	b, ok := normalizeJSON(got)
+	return ok && bytes.Equal(a, b)
+}
+
+func normalizeJSON(data []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	normalized, err := json.Marshal(v)
+	return normalized, err == nil
+}
+
+// truncate quotes data up to 64 bytes.
+func truncate(data []byte) string {
+	if len(data) > 64 {
+		return fmt.Sprintf("%q...", data[:64])
+	}
+	return fmt.Sprintf("%q", data)
+}
@@ -0,0 +1,123 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// graphQLWS speaks the graphql-transport-ws protocol of graphql-ws, each
+// Subscribe query is subscribed after connection_ack and received payloads
+// are counted by subscription. Sent messages are operations like mutations,
+// a GraphQL document or a JSON payload with query and variables.
+type graphQLWS struct {
+	b      *Benchmark
+	lastID int64
+}
+
+type graphQLMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphQLPayload returns the payload of an operation, text is a JSON
+// payload or a GraphQL document.
+func graphQLPayload(text []byte) json.RawMessage {
+	if trimmed := bytes.TrimSpace(text); len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		return trimmed
+	}
+	payload, _ := json.Marshal(struct {
+		Query string `json:"query"`
+	}{string(text)})
+	return payload
+}
+
+func (p *graphQLWS) prepare(ctx context.Context, t *task) error {
+	t.addHeader("Sec-WebSocket-Protocol", "graphql-transport-ws")
+	return nil
+}
+
+func (p *graphQLWS) writeMessage(s *session, msg graphQLMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.TextMessage, data)
+}
+
+// open initializes the connection and subscribes Subscribe queries.
+func (p *graphQLWS) open(s *session) error {
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	if err := p.writeMessage(s, graphQLMessage{Type: "connection_init"}); err != nil {
+		return err
+	}
+	for acked := false; !acked; {
+		_, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var msg graphQLMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("invalid message %q", data)
+		}
+		switch msg.Type {
+		case "connection_ack":
+			acked = true
+		case "ping":
+			if err := p.writeMessage(s, graphQLMessage{Type: "pong"}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, query := range s.b.opts.Subscribe {
+		text, err := s.b.message(s.id, query)
+		if err != nil {
+			return err
+		}
+		id := strconv.FormatInt(atomic.AddInt64(&p.lastID, 1), 10)
+		if err := p.writeMessage(s, graphQLMessage{ID: id, Type: "subscribe", Payload: graphQLPayload(text)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *graphQLWS) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	if msgType != websocket.TextMessage {
+		return 0, nil, errors.New("graphql-ws: binary operations are not supported")
+	}
+	id := strconv.FormatInt(atomic.AddInt64(&p.lastID, 1), 10)
+	data, err := json.Marshal(graphQLMessage{ID: id, Type: "subscribe", Payload: graphQLPayload(data)})
+	return msgType, data, err
+}
+
+// decode returns payloads of next messages, on channel 'subscription N'
+// for the Nth Subscribe query and 'operation' for sent operations.
+func (p *graphQLWS) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	var msg graphQLMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, protocolError("graphql-ws", fmt.Errorf("invalid message %q", data))
+	}
+	switch msg.Type {
+	case "next":
+		channel := "operation"
+		if n, err := strconv.Atoi(msg.ID); err == nil && n <= len(s.b.opts.Subscribe) {
+			channel = "subscription " + msg.ID
+		}
+		return []Message{{Data: msg.Payload, Channel: channel}}, nil
+	case "ping":
+		return nil, p.writeMessage(s, graphQLMessage{Type: "pong"})
+	case "error":
+		return nil, protocolError("graphql-ws", fmt.Errorf("operation %s error %s", msg.ID, msg.Payload))
+	default:
+		return nil, nil
+	}
+}
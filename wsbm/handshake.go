@@ -0,0 +1,156 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxHandshakeBody is the most of the body of refused handshakes kept, as
+// much as the dialer reads.
+const maxHandshakeBody = 1024
+
+// handshakeHeaders are the headers of refused handshakes kept in results,
+// along with rate limit headers.
+var handshakeHeaders = []string{"Content-Type", "Location", "Retry-After", "Server", "Www-Authenticate"}
+
+// HandshakeError is a handshake refused by the server, with the status,
+// the headers worth debugging and the start of the body of its response.
+type HandshakeError struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s", websocket.ErrBadHandshake, e.Status)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return websocket.ErrBadHandshake
+}
+
+// newHandshakeError returns the error of the refused handshake of resp.
+func newHandshakeError(resp *http.Response) *HandshakeError {
+	e := &HandshakeError{StatusCode: resp.StatusCode, Status: resp.Status}
+	for name, values := range resp.Header {
+		if isHandshakeHeader(name) {
+			if e.Header == nil {
+				e.Header = make(http.Header)
+			}
+			e.Header[name] = values
+		}
+	}
+	if resp.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxHandshakeBody))
+		e.Body = string(body)
+	}
+	return e
+}
+
+func isHandshakeHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range handshakeHeaders {
+		if name == h {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, "Ratelimit") || strings.HasPrefix(name, "X-Ratelimit")
+}
+
+// handshakeFailed records the refused handshake of resp of connection id,
+// dumping the full response while HandshakeDumps are left.
+func (b *Benchmark) handshakeFailed(id int, u string, resp *http.Response) error {
+	e := newHandshakeError(resp)
+	b.stats.AddRefusal(e)
+	if b.opts.HandshakeDump != nil && atomic.AddInt64(&b.dumped, 1) <= int64(b.opts.HandshakeDumps) {
+		b.dumpMu.Lock()
+		defer b.dumpMu.Unlock()
+		w := b.opts.HandshakeDump
+		fmt.Fprintf(w, "# conn %d %s %s\n", id, u, time.Now().Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "%s %s\r\n", resp.Proto, resp.Status)
+		resp.Header.Write(w)
+		fmt.Fprintf(w, "\r\n%s\n\n", e.Body)
+	}
+	return e
+}
+
+// AddRefusal keeps e if it is the first refused handshake of its status.
+func (s *stats) AddRefusal(e *HandshakeError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refusals == nil {
+		s.refusals = make(map[int]HandshakeError)
+	}
+	if _, ok := s.refusals[e.StatusCode]; !ok {
+		s.refusals[e.StatusCode] = *e
+	}
+}
+
+// Refusals returns the first refused handshake of each status.
+func (s *stats) Refusals() []HandshakeError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refusals []HandshakeError
+	for _, e := range s.refusals {
+		refusals = append(refusals, e)
+	}
+	sortRefusals(refusals)
+	return refusals
+}
+
+func sortRefusals(refusals []HandshakeError) {
+	sort.Slice(refusals, func(i, j int) bool { return refusals[i].StatusCode < refusals[j].StatusCode })
+}
+
+// mergeRefusals adds those of statuses r is missing of o.
+func (r *Result) mergeRefusals(o *Result) {
+	for _, e := range o.Refusals {
+		found := false
+		for _, have := range r.Refusals {
+			if have.StatusCode == e.StatusCode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r.Refusals = append(r.Refusals, e)
+		}
+	}
+	sortRefusals(r.Refusals)
+}
+
+// writeRefusals writes refused handshakes by status with the headers and
+// body of the first of each.
+func writeRefusals(w io.Writer, r *Result) {
+	if len(r.Refusals) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "refused handshakes:")
+	for _, e := range r.Refusals {
+		fmt.Fprintf(w, "  %s: %d\n", e.Status, r.ErrorTypes[handshakeErrorType(e.StatusCode)])
+		names := make([]string, 0, len(e.Header))
+		for name := range e.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "    %s: %s\n", name, strings.Join(e.Header[name], ", "))
+		}
+		if e.Body != "" {
+			fmt.Fprintf(w, "    body: %s\n", truncate([]byte(e.Body)))
+		}
+	}
+}
+
+// handshakeErrorType is the error type of handshakes refused with status.
+func handshakeErrorType(status int) string {
+	return fmt.Sprintf("handshake %d", status)
+}
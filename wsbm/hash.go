@@ -0,0 +1,54 @@
+package wsbm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// hashLine is the line of a connection written by OutputHash.
+type hashLine struct {
+	Conn     int    `json:"conn"`
+	Messages int64  `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+}
+
+// hashMessage adds a received message to the running checksum of the task,
+// type and length are hashed so message boundaries count.
+func (t *task) hashMessage(msgType int, content []byte) {
+	if t.hash == nil {
+		t.hash = sha256.New()
+	}
+	var head [9]byte
+	head[0] = byte(msgType)
+	binary.BigEndian.PutUint64(head[1:], uint64(len(content)))
+	t.hash.Write(head[:])
+	t.hash.Write(content)
+}
+
+// writeHash sets the checksum of received messages to the task result and
+// writes it to output as a JSON line.
+func (b *Benchmark) writeHash(t *task) {
+	if t.result.Start.IsZero() {
+		return
+	}
+	h := t.hash
+	if h == nil {
+		h = sha256.New()
+	}
+	t.result.Hash = hex.EncodeToString(h.Sum(nil))
+	b.stats.AddHash(t.result.Hash)
+
+	data, err := json.Marshal(hashLine{
+		Conn:     t.id,
+		Messages: t.result.Messages,
+		Bytes:    t.result.Bytes,
+		SHA256:   t.result.Hash,
+	})
+	if err != nil {
+		return
+	}
+	t.output.Write(append(data, '\n'))
+}
@@ -0,0 +1,287 @@
+package wsbm
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// Sizes of charts of the HTML report in pixels.
+const (
+	chartWidth  = 640
+	chartHeight = 160
+	chartMargin = 48
+	barHeight   = 18
+)
+
+// namedLatency is a latency of the HTML report.
+type namedLatency struct {
+	Name string
+	LatencySummary
+}
+
+// htmlLatencies returns latencies of r measured in the order of Write.
+func htmlLatencies(r *Result) []namedLatency {
+	latencies := []namedLatency{
+		{"pre request", r.PreRequest},
+		{"handshake", r.Handshake},
+		{"dns", r.DNS},
+		{"tcp connect", r.TCP},
+		{"tls", r.TLS},
+		{"upgrade", r.Upgrade},
+		{"proxy connect", r.ProxyConnect},
+		{"first message", r.FirstMessage},
+		{"rtt", r.RTT},
+		{"pong rtt", r.PongRTT},
+		{"reply", r.Reply},
+		{"fan-out", r.Fanout.Latency},
+		{"arrival lag", r.Arrival.Lag},
+	}
+	for _, step := range r.Steps {
+		latencies = append(latencies, namedLatency{step.Name, step.Latency})
+	}
+	for _, call := range r.Calls {
+		latencies = append(latencies, namedLatency{"call " + call.Name, call.Latency})
+	}
+	measured := latencies[:0]
+	for _, l := range latencies {
+		if l.Count > 0 {
+			measured = append(measured, l)
+		}
+	}
+	return measured
+}
+
+// WriteHTML writes the result as a standalone HTML page with charts of
+// throughput over the timeline, latency percentiles and errors.
+func (r *Result) WriteHTML(w io.Writer) error {
+	return htmlReport.Execute(w, r)
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"round":          round,
+	"size":           formatSize,
+	"rate":           func(n int64, d time.Duration) string { return fmt.Sprintf("%.1f", perSecond(n, d)) },
+	"latencies":      htmlLatencies,
+	"latencyChart":   latencyChart,
+	"timelineCharts": timelineCharts,
+	"errorChart":     errorChart,
+	"sortedCounts": func(counts map[string]int64) []ErrorCategory {
+		var sorted []ErrorCategory
+		for name, n := range counts {
+			sorted = append(sorted, ErrorCategory{Name: name, Count: n})
+		}
+		sortCategories(sorted)
+		return sorted
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>wsbm report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 2px 10px; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+svg { display: block; margin-bottom: 1em; }
+svg text { font-size: 11px; fill: #444; }
+.examples { color: #666; font-size: 90%; text-align: left; }
+.warning { color: #c00; }
+</style>
+</head>
+<body>
+<h1>wsbm report</h1>
+<table>
+{{with .Tags}}<tr><td>tags</td><td>{{.Format "=" ", "}}</td></tr>{{end}}
+<tr><td>elapsed</td><td>{{round .Elapsed}}</td></tr>
+<tr><td>connections</td><td>{{.Connections}}</td></tr>
+<tr><td>connect rate</td><td>{{printf "%.1f" .ConnectRate}}/s</td></tr>
+<tr><td>peak active</td><td>{{.PeakActive}}</td></tr>
+<tr><td>errors</td><td>{{.Errors}}</td></tr>
+<tr><td>messages</td><td>{{.Messages}} ({{rate .Messages .Elapsed}}/s)</td></tr>
+<tr><td>bytes</td><td>{{.Bytes}} ({{rate .Bytes .Elapsed}}/s)</td></tr>
+</table>
+{{if .Timeline}}
+<h2>Throughput</h2>
+{{timelineCharts .Timeline}}
+{{end}}
+{{with latencies .}}
+<h2>Latency</h2>
+<table>
+<tr><th></th><th>count</th><th>min</th><th>avg</th><th>max</th><th>p50</th><th>p90</th><th>p99</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{round .Min}}</td><td>{{round .Avg}}</td><td>{{round .Max}}</td><td>{{round .P50}}</td><td>{{round .P90}}</td><td>{{round .P99}}</td></tr>
+{{end}}</table>
+{{range .}}{{latencyChart .}}{{end}}
+{{end}}
+{{if .Failures}}
+<h2>Errors</h2>
+{{errorChart .Failures}}
+<table>
+<tr><th>category</th><th>count</th><th class="examples">examples</th></tr>
+{{range .Failures}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td class="examples">{{range .Examples}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with sortedCounts .ErrorTypes}}
+<table>
+<tr><th>error type</th><th>count</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Client}}
+<h2>Client</h2>
+<table>
+<tr><td>cpu</td><td>avg {{printf "%.1f" .CPUAvg}}%, peak {{printf "%.1f" .CPUPeak}}% of {{.Cores}} cores</td></tr>
+<tr><td>memory</td><td>{{size .MemoryPeak}}, heap {{size .HeapPeak}}</td></tr>
+<tr><td>goroutines</td><td>{{.Goroutines}}</td></tr>
+{{if .FDs}}<tr><td>open fds</td><td>{{.FDs}} of {{.FDLimit}}</td></tr>{{end}}
+<tr><td>gc</td><td>{{.GCs}}, pause total {{round .GCPauseTotal}}, max {{round .GCPauseMax}}, cpu {{printf "%.1f" .GCCPU}}%</td></tr>
+{{range .Bottlenecks}}<tr><td>bottleneck</td><td class="warning">{{.}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Closes}}
+<h2>Close codes</h2>
+<table>
+<tr><th>code</th><th>count</th><th>reason</th></tr>
+{{range .Closes}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+func perSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// timelineCharts draws rates and active connections over samples.
+func timelineCharts(samples []Sample) template.HTML {
+	charts := []struct {
+		title string
+		value func(Sample) float64
+	}{
+		{"messages/s", func(s Sample) float64 { return perSecond(s.Messages, s.Interval) }},
+		{"bytes/s", func(s Sample) float64 { return perSecond(s.Bytes, s.Interval) }},
+		{"connects/s", func(s Sample) float64 { return perSecond(s.Connections, s.Interval) }},
+		{"active connections", func(s Sample) float64 { return float64(s.Active) }},
+		{"errors/s", func(s Sample) float64 { return perSecond(s.Errors, s.Interval) }},
+	}
+	var html template.HTML
+	for _, c := range charts {
+		html += timelineChart(samples, c.title, c.value)
+	}
+	return html
+}
+
+// timelineChart draws value of samples over their elapsed time as a line.
+func timelineChart(samples []Sample, title string, value func(Sample) float64) template.HTML {
+	if len(samples) == 0 {
+		return ""
+	}
+	end := samples[len(samples)-1].Elapsed.Seconds()
+	if end <= 0 {
+		end = 1
+	}
+	max := 0.0
+	for _, s := range samples {
+		if v := value(s); v > max {
+			max = v
+		}
+	}
+	if max <= 0 {
+		max = 1
+	}
+
+	var b strings.Builder
+	width, height := chartWidth-2*chartMargin, chartHeight-chartMargin
+	fmt.Fprintf(&b, `<svg width="%d" height="%d">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="14">%s</text>`, chartMargin, template.HTMLEscapeString(title))
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="#ccc"/>`,
+		chartMargin, chartMargin/2, width, height)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartMargin-4, chartMargin/2+10, formatValue(max))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartMargin-4, chartMargin/2+height)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartMargin+width, chartHeight-8,
+		round(samples[len(samples)-1].Elapsed))
+	b.WriteString(`<polyline fill="none" stroke="#3366cc" stroke-width="1.5" points="`)
+	for _, s := range samples {
+		x := float64(chartMargin) + s.Elapsed.Seconds()/end*float64(width)
+		y := float64(chartMargin/2+height) - value(s)/max*float64(height)
+		fmt.Fprintf(&b, "%.1f,%.1f ", x, y)
+	}
+	b.WriteString(`"/></svg>`)
+	return template.HTML(b.String())
+}
+
+// latencyChart draws percentiles of l as bars.
+func latencyChart(l namedLatency) template.HTML {
+	bars := []struct {
+		name  string
+		value time.Duration
+	}{{"min", l.Min}, {"p50", l.P50}, {"avg", l.Avg}, {"p90", l.P90}, {"p99", l.P99}, {"max", l.Max}}
+	labels := make([]string, len(bars))
+	values := make([]float64, len(bars))
+	texts := make([]string, len(bars))
+	for i, bar := range bars {
+		labels[i], values[i], texts[i] = bar.name, float64(bar.value), round(bar.value).String()
+	}
+	return barChart(l.Name, labels, values, texts)
+}
+
+// errorChart draws counts of error categories as bars, the most frequent
+// first.
+func errorChart(categories []ErrorCategory) template.HTML {
+	labels := make([]string, len(categories))
+	values := make([]float64, len(categories))
+	texts := make([]string, len(categories))
+	for i, c := range categories {
+		labels[i], values[i], texts[i] = c.Name, float64(c.Count), fmt.Sprint(c.Count)
+	}
+	return barChart("errors by category", labels, values, texts)
+}
+
+// barChart draws horizontal bars of values with their labels and texts.
+func barChart(title string, labels []string, values []float64, texts []string) template.HTML {
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	if max <= 0 {
+		max = 1
+	}
+
+	var b strings.Builder
+	labelWidth, textWidth := 96, 80
+	width := chartWidth - labelWidth - textWidth
+	fmt.Fprintf(&b, `<svg width="%d" height="%d">`, chartWidth, 20+len(values)*(barHeight+4))
+	fmt.Fprintf(&b, `<text x="0" y="14">%s</text>`, template.HTMLEscapeString(title))
+	for i, v := range values {
+		y := 20 + i*(barHeight+4)
+		w := int(v / max * float64(width))
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`,
+			labelWidth-6, y+barHeight-5, template.HTMLEscapeString(labels[i]))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#3366cc"/>`, labelWidth, y, w, barHeight)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`,
+			labelWidth+w+6, y+barHeight-5, template.HTMLEscapeString(texts[i]))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// formatValue formats axis values with k and M suffixes.
+func formatValue(v float64) string {
+	switch {
+	case v >= 1e6:
+		return fmt.Sprintf("%.1fM", v/1e6)
+	case v >= 1e3:
+		return fmt.Sprintf("%.1fk", v/1e3)
+	default:
+		return fmt.Sprintf("%.1f", v)
+	}
+}
@@ -0,0 +1,318 @@
+package wsbm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Result counts HTTP/2 connections and the WebSocket streams of RFC
+// 8441 multiplexed over them.
+type HTTP2Result struct {
+	Connections int64 `json:"connections"`
+	Streams     int64 `json:"streams"`
+}
+
+func (r *HTTP2Result) Write(w io.Writer) {
+	fmt.Fprintf(w, "http2 connections: %d, streams: %d", r.Connections, r.Streams)
+	if r.Connections > 0 {
+		fmt.Fprintf(w, ", streams per connection: %.1f", float64(r.Streams)/float64(r.Connections))
+	}
+	fmt.Fprintln(w)
+}
+
+// newHTTP2Transports returns the transports of HTTP2 streams by scheme,
+// over TLS for wss urls and with prior knowledge for ws urls.
+func (b *Benchmark) newHTTP2Transports() map[string]*http2.Transport {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := b.netDialContext(ctx, network, addr)
+		if err == nil {
+			atomic.AddInt64(&b.stats.HTTP2Conns, 1)
+		}
+		return conn, err
+	}
+	return map[string]*http2.Transport{
+		"http": {
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+		"https": {
+			TLSClientConfig: b.opts.TLSConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				t := getDialTrace(ctx)
+				if t != nil {
+					t.tlsStart = time.Now()
+				}
+				tc := tls.Client(conn, cfg)
+				err = tc.HandshakeContext(ctx)
+				if t != nil {
+					t.tlsDone = time.Now()
+				}
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+		},
+	}
+}
+
+// http2Dial returns the dial of the dialer connecting urls of scheme over
+// HTTP/2 streams.
+func (b *Benchmark) http2Dial(scheme string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c := &http2Conn{b: b, ctx: ctx, scheme: scheme, consumed: make(chan struct{}), expired: make(chan struct{}), closed: make(chan struct{})}
+		return b.throttled(b.shapedConn(ctx, c)), nil
+	}
+}
+
+// http2Conn is a WebSocket stream of RFC 8441 posing as a connection to
+// the dialer, the upgrade request written by the dialer is sent as an
+// extended CONNECT and its response is read back as a 101 response.
+type http2Conn struct {
+	b      *Benchmark
+	ctx    context.Context
+	scheme string
+
+	// req is the upgrade request until complete, resp the response read
+	// before the stream.
+	req    bytes.Buffer
+	resp   *bytes.Reader
+	body   io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+
+	// reads are chunks of body read ahead, a chunk is read from the
+	// buffer of the reader until consumed.
+	readOnce sync.Once
+	reads    chan readChunk
+	consumed chan struct{}
+	chunk    readChunk
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type readChunk struct {
+	data []byte
+	err  error
+}
+
+func (c *http2Conn) Write(p []byte) (int, error) {
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+	if c.resp != nil {
+		return 0, io.ErrClosedPipe
+	}
+	c.req.Write(p)
+	if bytes.Contains(c.req.Bytes(), []byte("\r\n\r\n")) {
+		if err := c.connect(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// connect sends the upgrade request as an extended CONNECT and prepares
+// its response.
+func (c *http2Conn) connect() error {
+	upgrade, err := http.ReadRequest(bufio.NewReader(&c.req))
+	if err != nil {
+		return err
+	}
+	key := upgrade.Header.Get("Sec-WebSocket-Key")
+	h := upgrade.Header.Clone()
+	for _, name := range []string{"Upgrade", "Connection", "Sec-WebSocket-Key"} {
+		h.Del(name)
+	}
+	h[":protocol"] = []string{"websocket"}
+
+	// the stream outlives the dial, keeping values like the dial trace,
+	// and is canceled by the dial until the response
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.ctx))
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, c.scheme+"://"+upgrade.Host+upgrade.URL.RequestURI(), pr)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req.Header = h
+	resp, err := c.b.http2[c.scheme].RoundTrip(req)
+	if err != nil {
+		cancel()
+		pw.Close()
+		return err
+	}
+
+	var head bytes.Buffer
+	var body []byte
+	if resp.StatusCode/100 == 2 {
+		atomic.AddInt64(&c.b.stats.HTTP2Streams, 1)
+		c.body, c.w, c.cancel = resp.Body, pw, cancel
+		head.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		head.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	} else {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, maxHandshakeBody))
+		cancel()
+		resp.Body.Close()
+		pw.Close()
+		fmt.Fprintf(&head, "HTTP/1.1 %s\r\nContent-Length: %d\r\n", resp.Status, len(body))
+	}
+	for name, values := range resp.Header {
+		if !strings.EqualFold(name, "Content-Length") {
+			for _, v := range values {
+				head.WriteString(name + ": " + v + "\r\n")
+			}
+		}
+	}
+	head.WriteString("\r\n")
+	head.Write(body)
+	c.resp = bytes.NewReader(head.Bytes())
+	return nil
+}
+
+func (c *http2Conn) Read(p []byte) (int, error) {
+	if c.resp != nil && c.resp.Len() > 0 {
+		return c.resp.Read(p)
+	}
+	if c.body == nil {
+		return 0, io.EOF
+	}
+	c.readOnce.Do(func() {
+		c.reads = make(chan readChunk)
+		go c.readAhead()
+	})
+
+	if len(c.chunk.data) == 0 && c.chunk.err == nil {
+		c.mu.Lock()
+		expired := c.expired
+		c.mu.Unlock()
+		select {
+		case c.chunk = <-c.reads:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	if len(c.chunk.data) == 0 {
+		return 0, c.chunk.err
+	}
+	n := copy(p, c.chunk.data)
+	c.chunk.data = c.chunk.data[n:]
+	if len(c.chunk.data) == 0 && c.chunk.err == nil {
+		select {
+		case c.consumed <- struct{}{}:
+		case <-c.closed:
+		}
+	}
+	return n, nil
+}
+
+// readAhead reads the stream into its buffer, handing over a chunk at a
+// time so that reads can time out.
+func (c *http2Conn) readAhead() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.body.Read(buf)
+		if n == 0 && err == nil {
+			continue
+		}
+		select {
+		case c.reads <- readChunk{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-c.consumed:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *http2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.w != nil {
+			c.w.Close()
+			c.body.Close()
+			c.cancel()
+		}
+	})
+	return nil
+}
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline times out pending and following reads at t, writes have
+// no deadline. Pending reads wait on expired, so it is only replaced once
+// it fired.
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil && !c.timer.Stop() {
+		<-c.expired
+	}
+	c.timer = nil
+	fired := false
+	select {
+	case <-c.expired:
+		fired = true
+	default:
+	}
+	d := time.Until(t)
+	if t.IsZero() || d > 0 {
+		if fired {
+			c.expired = make(chan struct{})
+		}
+		if !t.IsZero() {
+			expired := c.expired
+			c.timer = time.AfterFunc(d, func() { close(expired) })
+		}
+	} else if !fired {
+		close(c.expired)
+	}
+	return nil
+}
+
+func (c *http2Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *http2Conn) LocalAddr() net.Addr  { return http2Addr{} }
+func (c *http2Conn) RemoteAddr() net.Addr { return http2Addr{} }
+
+type http2Addr struct{}
+
+func (http2Addr) Network() string { return "http2" }
+func (http2Addr) String() string  { return "http2" }
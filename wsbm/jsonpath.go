@@ -0,0 +1,122 @@
+package wsbm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath is the subset of JSONPath selecting a single value by object
+// keys and array indexes, eg: $.data.items[0].id, $['type'].
+type JSONPath struct {
+	raw  string
+	keys []interface{}
+}
+
+func ParseJSONPath(path string) (*JSONPath, error) {
+	p := &JSONPath{raw: path}
+	rest := strings.TrimSpace(path)
+	if !strings.HasPrefix(rest, "$") {
+		return nil, fmt.Errorf("jsonpath %q must start with $", path)
+	}
+	rest = rest[1:]
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("jsonpath %q has empty key", path)
+			}
+			p.keys = append(p.keys, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("jsonpath %q has unclosed [", path)
+			}
+			key := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			if len(key) >= 2 && (key[0] == '\'' || key[0] == '"') && key[len(key)-1] == key[0] {
+				p.keys = append(p.keys, key[1:len(key)-1])
+				continue
+			}
+			index, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("jsonpath %q has invalid index %q", path, key)
+			}
+			p.keys = append(p.keys, index)
+		default:
+			return nil, fmt.Errorf("jsonpath %q is invalid near %q", path, rest)
+		}
+	}
+	return p, nil
+}
+
+func (p *JSONPath) String() string {
+	return p.raw
+}
+
+// Lookup returns the value selected in v decoded by encoding/json.
+func (p *JSONPath) Lookup(v interface{}) (interface{}, bool) {
+	for _, key := range p.keys {
+		switch key := key.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[key]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			if key < 0 {
+				key += len(a)
+			}
+			if key < 0 || key >= len(a) {
+				return nil, false
+			}
+			v = a[key]
+		}
+	}
+	return v, true
+}
+
+// LookupJSON decodes data and returns the value selected, numbers are
+// json.Number.
+func (p *JSONPath) LookupJSON(data []byte) (interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	return p.Lookup(v)
+}
+
+// jsonString formats a value selected by JSONPath, strings without quotes.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return "null"
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,107 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jsonRPC speaks JSON-RPC 2.0, sent messages are requests like
+// '{"method":"eth_blockNumber","params":[]}' given auto-incrementing ids,
+// and the latency of their responses is recorded by method. Responses and
+// notifications are received on the channel of their method.
+type jsonRPC struct {
+	b      *Benchmark
+	lastID int64
+	// requests are methods and start times of requests by id.
+	requests sync.Map
+}
+
+type jsonRPCRequest struct {
+	method string
+	start  time.Time
+}
+
+type jsonRPCMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (p *jsonRPC) prepare(ctx context.Context, t *task) error {
+	return nil
+}
+
+func (p *jsonRPC) open(s *session) error {
+	return nil
+}
+
+func (p *jsonRPC) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(data, &request); err != nil {
+		return 0, nil, fmt.Errorf("jsonrpc: invalid request %q", data)
+	}
+	var method string
+	if err := json.Unmarshal(request["method"], &method); err != nil || method == "" {
+		return 0, nil, fmt.Errorf("jsonrpc: no method in request %q", data)
+	}
+	id := atomic.AddInt64(&p.lastID, 1)
+	request["jsonrpc"] = json.RawMessage(`"2.0"`)
+	request["id"] = json.RawMessage(strconv.FormatInt(id, 10))
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.requests.Store(id, jsonRPCRequest{method: method, start: time.Now()})
+	return websocket.TextMessage, data, nil
+}
+
+// decode returns responses, recording the latency of their request, and
+// notifications, a batch is split into its responses.
+func (p *jsonRPC) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	records := []json.RawMessage{data}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, protocolError("jsonrpc", fmt.Errorf("invalid batch %q", data))
+		}
+	}
+
+	msgs := make([]Message, 0, len(records))
+	for _, record := range records {
+		var m jsonRPCMessage
+		if err := json.Unmarshal(record, &m); err != nil {
+			return nil, protocolError("jsonrpc", fmt.Errorf("invalid message %q", record))
+		}
+		if m.Method != "" {
+			msgs = append(msgs, Message{Data: record, Channel: m.Method})
+			continue
+		}
+
+		id, err := strconv.ParseInt(string(m.ID), 10, 64)
+		if err != nil {
+			msgs = append(msgs, Message{Data: record})
+			continue
+		}
+		v, ok := p.requests.LoadAndDelete(id)
+		if !ok {
+			msgs = append(msgs, Message{Data: record})
+			continue
+		}
+		request := v.(jsonRPCRequest)
+		if len(m.Error) > 0 && string(m.Error) != "null" {
+			s.b.log.Warn("jsonrpc request", "task", s.id, "method", request.method, "err", string(m.Error))
+		} else {
+			s.b.stats.AddCall(request.method, time.Since(request.start))
+		}
+		msgs = append(msgs, Message{Data: record, Channel: request.method})
+	}
+	return msgs, nil
+}
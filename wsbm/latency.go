@@ -0,0 +1,96 @@
+package wsbm
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// latencyUnit is the unit of values in histograms, from 1 to latencyMax.
+	latencyUnit = time.Microsecond
+	latencyMax  = int64(time.Hour / latencyUnit)
+)
+
+// latency records durations in a HdrHistogram.
+type latency struct {
+	mu sync.Mutex
+	// sigfigs are significant figures of histogram, 0 means 3.
+	sigfigs int
+	hist    *hdrhistogram.Histogram
+	buckets [len(latencyBuckets)]int64
+	sum     time.Duration
+}
+
+func (l *latency) Add(d time.Duration) {
+	v := int64(d / latencyUnit)
+	if v < 1 {
+		v = 1
+	} else if v > latencyMax {
+		v = latencyMax
+	}
+
+	l.mu.Lock()
+	if l.hist == nil {
+		sigfigs := l.sigfigs
+		if sigfigs == 0 {
+			sigfigs = 3
+		}
+		l.hist = hdrhistogram.New(1, latencyMax, sigfigs)
+	}
+	l.hist.RecordValue(v)
+	l.addBucket(d)
+	l.mu.Unlock()
+}
+
+func (l *latency) count() int64 {
+	if l.hist == nil {
+		return 0
+	}
+	return l.hist.TotalCount()
+}
+
+func (l *latency) Summary() LatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count() == 0 {
+		return LatencySummary{}
+	}
+
+	return summarize(hdrhistogram.Import(l.hist.Export()))
+}
+
+// addLatency records latency d of metric of a message of connection id,
+// and passes it to OnLatency.
+func (b *Benchmark) addLatency(metric string, id int, d time.Duration) {
+	b.stats.messageLatency(metric).Add(d)
+	if b.opts.OnLatency != nil {
+		b.opts.OnLatency(MessageLatency{ID: id, Metric: metric, At: time.Now(), Latency: d})
+	}
+}
+
+// summarize returns the summary of histogram h in latencyUnit.
+func summarize(h *hdrhistogram.Histogram) LatencySummary {
+	return LatencySummary{
+		Count:     int(h.TotalCount()),
+		Min:       time.Duration(h.Min()) * latencyUnit,
+		Avg:       time.Duration(h.Mean() * float64(latencyUnit)),
+		Max:       time.Duration(h.Max()) * latencyUnit,
+		P50:       time.Duration(h.ValueAtQuantile(50)) * latencyUnit,
+		P90:       time.Duration(h.ValueAtQuantile(90)) * latencyUnit,
+		P99:       time.Duration(h.ValueAtQuantile(99)) * latencyUnit,
+		Histogram: h,
+	}
+}
+
+// WriteHgrm writes the histogram in HdrHistogram percentile distribution
+// format with values in milliseconds.
+func (s LatencySummary) WriteHgrm(w io.Writer) error {
+	if s.Histogram == nil {
+		return nil
+	}
+	_, err := s.Histogram.PercentilesPrint(w, 5, float64(time.Millisecond/latencyUnit))
+	return err
+}
@@ -0,0 +1,78 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are upper bounds in seconds of prometheus histograms.
+var latencyBuckets = [...]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsHandler serves live stats in prometheus text format.
+func (b *Benchmark) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes live stats in prometheus text format.
+func (b *Benchmark) WriteMetrics(w io.Writer) {
+	s := &b.stats
+	writeMetric(w, "wsbm_connections_total", "counter", "Connections dialed.", atomic.LoadInt64(&s.Connections))
+	writeMetric(w, "wsbm_active_connections", "gauge", "Connections open.", atomic.LoadInt64(&s.Active))
+	writeMetric(w, "wsbm_messages_received_total", "counter", "Messages received.", atomic.LoadInt64(&s.Messages))
+	writeMetric(w, "wsbm_received_bytes_total", "counter", "Message bytes received.", atomic.LoadInt64(&s.Bytes))
+	writeMetric(w, "wsbm_wire_received_bytes_total", "counter", "Bytes read from network.", atomic.LoadInt64(&s.WireBytesIn))
+	writeMetric(w, "wsbm_wire_sent_bytes_total", "counter", "Bytes written to network.", atomic.LoadInt64(&s.WireBytesOut))
+
+	errors := s.Errors()
+	types := make([]string, 0, len(errors))
+	for t := range errors {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	fmt.Fprintf(w, "# HELP wsbm_errors_total Failed tasks by error type.\n# TYPE wsbm_errors_total counter\n")
+	for _, t := range types {
+		fmt.Fprintf(w, "wsbm_errors_total{type=%q} %d\n", t, errors[t])
+	}
+
+	s.Handshake.writeHistogram(w, "wsbm_handshake_seconds", "Handshake latency.")
+	s.FirstMessage.writeHistogram(w, "wsbm_first_message_seconds", "Time from dial to first message.")
+	s.RTT.writeHistogram(w, "wsbm_echo_rtt_seconds", "Echo message round-trip time.")
+	s.PongRTT.writeHistogram(w, "wsbm_pong_rtt_seconds", "Ping pong round-trip time.")
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+}
+
+func (l *latency) writeHistogram(w io.Writer, name, help string) {
+	l.mu.Lock()
+	counts, sum, count := l.buckets, l.sum, l.count()
+	l.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, le := range latencyBuckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func (l *latency) addBucket(d time.Duration) {
+	l.sum += d
+	for i, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			l.buckets[i]++
+			return
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// MQTT control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttDisconnect = 14
+)
+
+// mqtt speaks MQTT 3.1.1 or 5 in binary frames, it connects with a keep
+// alive of PingInterval, subscribes Subscribe topics and publishes sent
+// messages to Publish at QoS. Received payloads are counted by topic.
+type mqtt struct {
+	b *Benchmark
+	// buf has a partial packet of previous frames.
+	buf      []byte
+	packetID uint32
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func (p *mqtt) v5() bool {
+	return p.b.opts.MQTTVersion == 5
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func marshalMQTT(kind, flags byte, body []byte) []byte {
+	packet := appendMQTTLength([]byte{kind<<4 | flags}, len(body))
+	return append(packet, body...)
+}
+
+// readMQTTLength returns a variable byte integer and its size, size 0 when
+// data is incomplete.
+func readMQTTLength(data []byte) (int, int, error) {
+	n, shift := 0, 0
+	for i, c := range data {
+		if i == 4 {
+			return 0, 0, errors.New("malformed length")
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return n, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, nil
+}
+
+// packets returns complete packets of data appended to partial ones.
+func (p *mqtt) packets(data []byte) ([]mqttPacket, error) {
+	p.buf = append(p.buf, data...)
+	var packets []mqttPacket
+	for len(p.buf) >= 2 {
+		n, size, err := readMQTTLength(p.buf[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 || len(p.buf) < 1+size+n {
+			break
+		}
+		end := 1 + size + n
+		packets = append(packets, mqttPacket{kind: p.buf[0] >> 4, flags: p.buf[0] & 0x0f, body: p.buf[1+size : end]})
+		p.buf = p.buf[end:]
+	}
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+	return packets, nil
+}
+
+func (p *mqtt) nextPacketID() uint16 {
+	for {
+		if id := uint16(atomic.AddUint32(&p.packetID, 1)); id != 0 {
+			return id
+		}
+	}
+}
+
+func (p *mqtt) prepare(ctx context.Context, t *task) error {
+	t.addHeader("Sec-WebSocket-Protocol", "mqtt")
+	return nil
+}
+
+func (p *mqtt) write(s *session, packet []byte) error {
+	return s.write(websocket.BinaryMessage, packet)
+}
+
+// open connects, starts keep alive pings and subscribes topics.
+func (p *mqtt) open(s *session) error {
+	level, flags := byte(4), byte(0x02)
+	if p.v5() {
+		level = 5
+	}
+	user := s.task.url.User
+	if user != nil {
+		flags |= 0x80
+		if _, ok := user.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	keepAlive := uint16((s.b.opts.PingInterval + time.Second - 1) / time.Second)
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, level, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	if p.v5() {
+		body = append(body, 0)
+	}
+	body = appendMQTTString(body, fmt.Sprintf("wsbm-%d-%s", s.id, uuid()[:8]))
+	if user != nil {
+		body = appendMQTTString(body, user.Username())
+		if password, ok := user.Password(); ok {
+			body = appendMQTTString(body, password)
+		}
+	}
+
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	if err := p.write(s, marshalMQTT(mqttConnect, 0, body)); err != nil {
+		return err
+	}
+	for acked := false; !acked; {
+		_, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		packets, err := p.packets(data)
+		if err != nil {
+			return err
+		}
+		for _, packet := range packets {
+			if packet.kind != mqttConnAck {
+				continue
+			}
+			if len(packet.body) < 2 {
+				return errors.New("malformed CONNACK")
+			}
+			if code := packet.body[1]; code != 0 {
+				return fmt.Errorf("connect refused with code %d", code)
+			}
+			acked = true
+		}
+	}
+
+	if keepAlive > 0 {
+		go p.keepAlive(s, time.Duration(keepAlive)*time.Second)
+	}
+	if len(s.b.opts.Subscribe) == 0 {
+		return nil
+	}
+	body = binary.BigEndian.AppendUint16(nil, p.nextPacketID())
+	if p.v5() {
+		body = append(body, 0)
+	}
+	for _, topic := range s.b.opts.Subscribe {
+		body = appendMQTTString(body, topic)
+		body = append(body, byte(s.b.opts.QoS))
+	}
+	return p.write(s, marshalMQTT(mqttSubscribe, 0x02, body))
+}
+
+func (p *mqtt) keepAlive(s *session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.write(s, marshalMQTT(mqttPingReq, 0, nil)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *mqtt) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	topic := s.b.publish()
+	if topic == "" {
+		return 0, nil, errors.New("mqtt: no topic to publish to")
+	}
+	qos := byte(s.b.opts.QoS)
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, p.nextPacketID())
+	}
+	if p.v5() {
+		body = append(body, 0)
+	}
+	return websocket.BinaryMessage, marshalMQTT(mqttPublish, qos<<1, append(body, data...)), nil
+}
+
+// decode returns payloads of PUBLISH packets on their topic, QoS 1
+// messages are acknowledged.
+func (p *mqtt) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	packets, err := p.packets(data)
+	if err != nil {
+		return nil, protocolError("mqtt", err)
+	}
+
+	var msgs []Message
+	for _, packet := range packets {
+		switch packet.kind {
+		case mqttPublish:
+			msg, packetID, err := p.parsePublish(packet)
+			if err != nil {
+				return nil, protocolError("mqtt", err)
+			}
+			if packetID != nil {
+				if err := p.write(s, marshalMQTT(mqttPubAck, 0, packetID)); err != nil {
+					return nil, err
+				}
+			}
+			msgs = append(msgs, msg)
+		case mqttSubAck:
+			if len(packet.body) < 2 {
+				return nil, protocolError("mqtt", errors.New("malformed SUBACK"))
+			}
+			codes := packet.body[2:]
+			if p.v5() {
+				n, size, err := readMQTTLength(codes)
+				if err != nil || size == 0 || len(codes) < size+n {
+					return nil, protocolError("mqtt", errors.New("malformed SUBACK properties"))
+				}
+				codes = codes[size+n:]
+			}
+			// return codes from 0x80 refuse a topic
+			for _, c := range codes {
+				if c >= 0x80 {
+					return nil, protocolError("mqtt", errors.New("subscribe refused"))
+				}
+			}
+		case mqttDisconnect:
+			return nil, protocolError("mqtt", errors.New("disconnected by server"))
+		}
+	}
+	return msgs, nil
+}
+
+// parsePublish returns the message of a PUBLISH packet and its packet id
+// to acknowledge, nil for QoS 0.
+func (p *mqtt) parsePublish(packet mqttPacket) (Message, []byte, error) {
+	body := packet.body
+	if len(body) < 2 {
+		return Message{}, nil, errors.New("malformed PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return Message{}, nil, errors.New("malformed PUBLISH")
+	}
+	topic := string(body[2 : 2+n])
+	body = body[2+n:]
+
+	var packetID []byte
+	if qos := packet.flags >> 1 & 0x03; qos > 0 {
+		if len(body) < 2 {
+			return Message{}, nil, errors.New("malformed PUBLISH")
+		}
+		packetID, body = body[:2], body[2:]
+	}
+	if p.v5() {
+		n, size, err := readMQTTLength(body)
+		if err != nil || size == 0 || len(body) < size+n {
+			return Message{}, nil, errors.New("malformed PUBLISH properties")
+		}
+		body = body[size+n:]
+	}
+	return Message{Binary: !utf8.Valid(body), Data: body, Channel: topic}, packetID, nil
+}
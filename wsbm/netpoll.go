@@ -0,0 +1,594 @@
+package wsbm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// netpollBufferSize is the default read buffer shared by connections of a
+// poller.
+const netpollBufferSize = 64 << 10
+
+// netpollUnsupported returns the sorted options the netpoll engine can't
+// run.
+func netpollUnsupported(opts *Options) []string {
+	var names []string
+	for name, set := range map[string]bool{
+		"scenario":          opts.Scenario != nil,
+		"echo":              opts.Echo,
+		"churn":             opts.Churn > 0,
+		"protocol":          opts.Protocol != "",
+		"publishers":        opts.Publishers > 0,
+		"replay":            len(opts.Replay) > 0,
+		"expect":            opts.Expect != nil,
+		"correlation":       opts.CorrelateSend != nil || opts.CorrelateRecv != nil,
+		"golden":            opts.Golden != nil,
+		"schema":            opts.Schema != nil,
+		"classify":          opts.Classify != nil,
+		"sequence":          opts.SeqJSONPath != nil,
+		"read timeout":      opts.ReadTimeout > 0,
+		"keepalive message": opts.KeepaliveMessage != nil,
+		"compress":          opts.Compress,
+		"proxy":             opts.Proxy != nil,
+		"http2":             opts.HTTP2,
+		"max recv rate":     opts.MaxRecvRate > 0,
+		"max send rate":     opts.MaxSendRate > 0,
+		"read stall":        opts.ReadStall != nil,
+		"shape":             opts.Shape != nil,
+		"chaos drop":        opts.ChaosDrop != nil,
+	} {
+		if set {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pollConn is a connection of the netpoll engine. Its frames are read by
+// a poller into the shared buffer of the poller, only partial frames and
+// fragmented messages are kept by the connection.
+type pollConn struct {
+	conn net.Conn
+	fd   int
+	b    *Benchmark
+	task *task
+
+	// runCtx is done when the run stops, ctx also when conn ended.
+	runCtx context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu is held by the poller reading the connection, ended is set when
+	// it mustn't be read anymore.
+	mu      sync.Mutex
+	ended   bool
+	pending []byte
+	msg     []byte
+	msgType int
+
+	// trace logs frames sent and received, see TraceFrames.
+	trace bool
+
+	wmu      sync.Mutex
+	received int
+	closing  int32
+	pingSent int64
+
+	// remove unregisters the connection from its poller.
+	remove func()
+	// stop stops shutting down the connection when the run stops.
+	stop func() bool
+	once sync.Once
+	// refs are held by the worker until it handed the connection over and
+	// by the connection until it ended, the last one finishes the task.
+	refs   int32
+	endErr error
+}
+
+// runNetpoll dials task t and sends Messages, then hands the connection
+// over to its poller: the task is detached and ended by the poller once
+// the connection ends, so no goroutine waits for it.
+func (b *Benchmark) runNetpoll(ctx context.Context, t *task) error {
+	var c *pollConn
+	err := b.dialRetry(ctx, t, func() (err error) {
+		c, err = b.dialNetpoll(ctx, t)
+		return err
+	})
+	if c == nil {
+		return err
+	}
+	b.stats.AddActive()
+
+	// frames received along with the handshake response are handled
+	// before any read of a poller.
+	if err := c.feed(nil); err != nil {
+		c.end(err)
+	} else if c.ctx.Err() == nil {
+		if err := b.netpoll.add(c); err != nil {
+			c.end(err)
+		}
+	}
+	c.stop = context.AfterFunc(ctx, c.shutdown)
+
+	for i, msg := range b.opts.Messages {
+		if i > 0 && !sleepUntil(c.ctx, time.Now().Add(b.thinkTime(t))) {
+			break
+		}
+		if !b.control.wait(c.ctx) {
+			break
+		}
+		msgType, data, err := b.renderMessage(t.id, msg)
+		if err != nil {
+			c.end(err)
+			break
+		}
+		if err := c.write(msgType, data); err != nil {
+			b.log.Warn("send", "task", t.id, "err", err)
+			break
+		}
+	}
+
+	if atomic.AddInt32(&c.refs, -1) > 0 {
+		return errDetached
+	}
+	return c.finish()
+}
+
+// dialNetpoll connects url of task and upgrades the connection, it returns
+// a nil conn with nil error when ctx is done.
+func (b *Benchmark) dialNetpoll(ctx context.Context, t *task) (*pollConn, error) {
+	if t.url.Scheme != "ws" {
+		return nil, fmt.Errorf("netpoll engine doesn't support %s urls", t.url.Scheme)
+	}
+	conn, br, err := b.dialRaw(ctx, t)
+	if conn == nil {
+		return nil, err
+	}
+	c := &pollConn{conn: conn, b: b, task: t, runCtx: ctx, refs: 2, trace: b.traced(t.id)}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		c.pending = append([]byte(nil), data...)
+	}
+	return c, nil
+}
+
+// dialRaw connects url of task and upgrades the connection without a
+// websocket library, so frames are read and written raw. It records
+// handshake stats and returns a nil conn with nil error when ctx is done,
+// the returned reader holds bytes following the handshake response.
+func (b *Benchmark) dialRaw(ctx context.Context, t *task) (net.Conn, *bufio.Reader, error) {
+	b.log.Debug("dial", "task", t.id, "url", t.url.String())
+
+	h, err := b.header(t.id, t.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b.opts.Traceparent {
+		h.Set("Traceparent", t.traceparent())
+	}
+	httpURL := *t.url
+	httpURL.Scheme = "http"
+	if t.url.Scheme == "wss" {
+		httpURL.Scheme = "https"
+	}
+	if b.opts.Jar != nil {
+		for _, cookie := range b.opts.Jar.Cookies(&httpURL) {
+			h.Add("Cookie", cookie.String())
+		}
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	challenge := base64.StdEncoding.EncodeToString(key)
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Key", challenge)
+	h.Set("Sec-WebSocket-Version", "13")
+
+	if t.attempt == 0 {
+		atomic.AddInt64(&b.stats.Connections, 1)
+	}
+	start := time.Now()
+	t.result.Start = start
+	dialCtx := ctx
+	if b.opts.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, b.opts.HandshakeTimeout)
+		defer cancel()
+	}
+	dialCtx, trace := withDialTrace(dialCtx)
+	trace.network = b.network(t.id)
+
+	trace.getConn = time.Now()
+	conn, err := b.netDialContext(dialCtx, "tcp", hostPort(t.url))
+	if err != nil {
+		return nil, nil, b.dialError(ctx, err)
+	}
+	if t.url.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if b.opts.TLSConfig != nil {
+			cfg = b.opts.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = t.url.Hostname()
+		}
+		cfg.NextProtos = []string{"http/1.1"}
+		trace.tlsStart = time.Now()
+		tc := tls.Client(conn, cfg)
+		err := tc.HandshakeContext(dialCtx)
+		trace.tlsDone = time.Now()
+		if err != nil {
+			conn.Close()
+			return nil, nil, b.dialError(ctx, err)
+		}
+		conn = tc
+	}
+	trace.gotConn = time.Now()
+	resp, br, err := upgrade(dialCtx, conn, t.url, h)
+	if err != nil {
+		conn.Close()
+		return nil, nil, b.dialError(ctx, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(challenge) {
+		conn.Close()
+		return nil, nil, b.handshakeFailed(t.id, t.url.String(), resp)
+	}
+	if b.opts.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			b.opts.Jar.SetCookies(&httpURL, cookies)
+		}
+	}
+
+	t.result.Handshake = time.Since(start)
+	b.stats.Handshake.Add(t.result.Handshake)
+	trace.record(&b.stats, &t.result)
+	return conn, br, nil
+}
+
+// hostPort returns the address of url u, with the default port of its
+// scheme unless it has one.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialError returns err of a failed dial, nil when ctx is done.
+func (b *Benchmark) dialError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if isTimeout(err) {
+		return fmt.Errorf("%w: %s", ErrHandshakeTimeout, err)
+	}
+	return err
+}
+
+// upgrade writes the handshake request of u on conn and reads the response,
+// the returned reader holds bytes following it.
+func upgrade(ctx context.Context, conn net.Conn, u *url.URL, h http.Header) (*http.Response, *bufio.Reader, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\nHost: %s\r\n", u.RequestURI(), u.Host)
+	h.Write(&req)
+	req.WriteString("\r\n")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReaderSize(conn, 1024)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// keep the start of the body of a refused handshake as the dialer
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxHandshakeBody))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, br, nil
+	}
+	resp.Body.Close()
+	return resp, br, nil
+}
+
+// acceptKey returns Sec-WebSocket-Accept of challenge key.
+func acceptKey(challenge string) string {
+	h := sha1.New()
+	h.Write([]byte(challenge + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// feed handles the frames of data read after pending bytes, and keeps a
+// trailing partial frame. data may be the shared buffer of a poller.
+func (c *pollConn) feed(data []byte) error {
+	if len(c.pending) > 0 {
+		c.pending = append(c.pending, data...)
+		data = c.pending
+	}
+	for len(data) > 0 {
+		n, err := c.frame(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		c.pending = nil
+	} else {
+		c.pending = append(c.pending[:0], data...)
+	}
+	return nil
+}
+
+// frame handles the first frame of data and returns its size, 0 if the
+// frame is incomplete.
+func (c *pollConn) frame(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	fin, op := data[0]&0x80 != 0, int(data[0]&0x0f)
+	if data[1]&0x80 != 0 {
+		return 0, errors.New("masked frame from server")
+	}
+	size, head := uint64(data[1]&0x7f), 2
+	switch size {
+	case 126:
+		if len(data) < 4 {
+			return 0, nil
+		}
+		size, head = uint64(binary.BigEndian.Uint16(data[2:])), 4
+	case 127:
+		if len(data) < 10 {
+			return 0, nil
+		}
+		size, head = binary.BigEndian.Uint64(data[2:]), 10
+	}
+	if size > 1<<31 {
+		return 0, fmt.Errorf("frame of %d bytes too large", size)
+	}
+	n := head + int(size)
+	if len(data) < n {
+		return 0, nil
+	}
+	if c.trace {
+		c.b.traceFrame(c.task.id, "recv", op, fin, int(size))
+	}
+	return n, c.handle(fin, op, data[head:n])
+}
+
+func (c *pollConn) handle(fin bool, op int, payload []byte) error {
+	switch op {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		if !fin {
+			c.msgType, c.msg = op, append(c.msg[:0], payload...)
+			return nil
+		}
+		c.message(op, payload)
+	case 0:
+		c.msg = append(c.msg, payload...)
+		if fin {
+			c.message(c.msgType, c.msg)
+			c.msg = nil
+		}
+	case websocket.PingMessage:
+		return c.writeControl(websocket.PongMessage, payload)
+	case websocket.PongMessage:
+		if ts, err := strconv.ParseInt(string(payload), 10, 64); err == nil {
+			c.b.addLatency(MetricPongRTT, c.task.id, time.Since(time.Unix(0, ts)))
+		}
+		atomic.StoreInt64(&c.pingSent, 0)
+	case websocket.CloseMessage:
+		if atomic.LoadInt32(&c.closing) == 1 {
+			c.end(nil)
+			return nil
+		}
+		closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+		if len(payload) >= 2 {
+			closeErr.Code = int(binary.BigEndian.Uint16(payload))
+			closeErr.Text = string(payload[2:])
+		}
+		c.writeControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeErr.Code, ""))
+		c.end(closeErr)
+	default:
+		return fmt.Errorf("unknown opcode %d", op)
+	}
+	return nil
+}
+
+// message records a received message and writes it to output unless
+// closing, content is only valid until it returns.
+func (c *pollConn) message(msgType int, content []byte) {
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return
+	}
+	t := c.task
+	if c.received == 0 {
+		t.result.FirstMessage = time.Since(t.result.Start)
+		c.b.stats.FirstMessage.Add(t.result.FirstMessage)
+	}
+	c.received++
+	t.result.Messages++
+	t.result.Bytes += int64(len(content))
+	c.b.receive(t, msgType, content)
+	if c.b.opts.MaxMessages > 0 && c.received >= c.b.opts.MaxMessages {
+		c.shutdown()
+	}
+}
+
+// write writes a message frame, safe for concurrent use.
+func (c *pollConn) write(op int, payload []byte) error {
+	return c.writeFrame(op, payload, time.Time{})
+}
+
+// writeFrame writes a masked frame by deadline unless zero.
+func (c *pollConn) writeFrame(op int, payload []byte, deadline time.Time) error {
+	if c.trace {
+		c.b.traceFrame(c.task.id, "send", op, true, len(payload))
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(op))
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	var key [4]byte
+	binary.LittleEndian.PutUint32(key[:], mrand.Uint32())
+	frame = append(frame, key[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range frame[start:] {
+		frame[start+i] ^= key[i&3]
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !deadline.IsZero() {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeControl writes a control frame, in a second at most not to stall
+// the poller.
+func (c *pollConn) writeControl(op int, payload []byte) error {
+	return c.writeFrame(op, payload, time.Now().Add(time.Second))
+}
+
+// ping pings the connection, and ends it when the previous ping wasn't
+// answered in PingTimeout.
+func (c *pollConn) ping(now time.Time) {
+	sent := atomic.LoadInt64(&c.pingSent)
+	if timeout := c.b.opts.PingTimeout; sent != 0 && timeout > 0 && now.Sub(time.Unix(0, sent)) > timeout {
+		c.end(ErrPongTimeout)
+		return
+	}
+	ts := now.UnixNano()
+	if err := c.writeControl(websocket.PingMessage, []byte(strconv.FormatInt(ts, 10))); err != nil {
+		return
+	}
+	atomic.CompareAndSwapInt64(&c.pingSent, 0, ts)
+}
+
+// shutdown closes the connection by CloseMode, following messages are not
+// recorded.
+func (c *pollConn) shutdown() {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return
+	}
+	if c.b.opts.CloseMode == "rst" {
+		if tcp := tcpConn(c.conn); tcp != nil {
+			tcp.SetLinger(0)
+		}
+		c.end(nil)
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(c.b.opts.CloseCode, c.b.opts.CloseReason)
+	if err := c.writeControl(websocket.CloseMessage, msg); err != nil || c.b.opts.CloseMode == "frame" {
+		c.end(nil)
+		return
+	}
+	time.AfterFunc(c.b.opts.CloseTimeout, func() { c.end(nil) })
+}
+
+// end ends the connection with err once, it's not read anymore. The task
+// is resumed in a new goroutine if the worker handed it over already, as
+// end may be called by the poller reading the connection.
+func (c *pollConn) end(err error) {
+	c.once.Do(func() {
+		if c.remove != nil {
+			c.remove()
+		}
+		c.cancel()
+		c.endErr = err
+		if atomic.AddInt32(&c.refs, -1) == 0 {
+			go func() { c.task.resume(c.finish()) }()
+		}
+	})
+}
+
+// finish closes the ended connection and returns the error of its task.
+func (c *pollConn) finish() error {
+	if c.stop != nil {
+		c.stop()
+	}
+	c.Close()
+	atomic.AddInt64(&c.b.stats.Active, -1)
+	return c.err(c.endErr)
+}
+
+// err maps the error ending the connection to the task result like
+// session.err.
+func (c *pollConn) err(err error) error {
+	closing := atomic.LoadInt32(&c.closing) == 1 || c.runCtx.Err() != nil
+	c.task.result.Close = c.b.stats.addClose(closing, err)
+
+	if errors.Is(err, ErrPongTimeout) {
+		return err
+	}
+	if closing || c.b.expectedClose(err) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the socket once no poller reads it.
+func (c *pollConn) Close() error {
+	c.end(nil)
+	c.mu.Lock()
+	c.ended = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package wsbm
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// netpoll is the set of epoll pollers of the netpoll engine, one per CPU.
+type netpoll struct {
+	pollers []*poller
+	next    uint32
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// poller reads the connections registered to its epoll instance into its
+// buffer, and pings them every PingInterval.
+type poller struct {
+	b      *Benchmark
+	fd     int
+	buf    []byte
+	pinged time.Time
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+}
+
+func newNetpoll(b *Benchmark) (*netpoll, error) {
+	np := &netpoll{}
+	size := b.opts.ReadBufferSize
+	if size <= 0 {
+		size = netpollBufferSize
+	}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			np.close()
+			return nil, fmt.Errorf("epoll: %w", err)
+		}
+		np.pollers = append(np.pollers, &poller{
+			b:     b,
+			fd:    fd,
+			buf:   make([]byte, size),
+			conns: make(map[int]*pollConn),
+		})
+	}
+	return np, nil
+}
+
+// start starts the pollers until stop.
+func (np *netpoll) start() {
+	np.done = make(chan struct{})
+	np.wg.Add(len(np.pollers))
+	for _, p := range np.pollers {
+		go func(p *poller) {
+			defer np.wg.Done()
+			p.loop(np.done)
+		}(p)
+	}
+}
+
+func (np *netpoll) stop() {
+	close(np.done)
+	np.wg.Wait()
+	np.close()
+}
+
+func (np *netpoll) close() {
+	for _, p := range np.pollers {
+		syscall.Close(p.fd)
+	}
+}
+
+// add registers c to the next poller in turn.
+func (np *netpoll) add(c *pollConn) error {
+	tcp := tcpConn(c.conn)
+	if tcp == nil {
+		return fmt.Errorf("netpoll engine needs a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := raw.Control(func(fd uintptr) { c.fd = int(fd) }); err != nil {
+		return err
+	}
+
+	// remove is set before c is published to ping of the poller.
+	p := np.pollers[int(atomic.AddUint32(&np.next, 1))%len(np.pollers)]
+	c.remove = func() {
+		p.mu.Lock()
+		delete(p.conns, c.fd)
+		p.mu.Unlock()
+		syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+	p.mu.Lock()
+	p.conns[c.fd] = c
+	p.mu.Unlock()
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, c.fd, ev); err != nil {
+		c.remove()
+		return fmt.Errorf("epoll add: %w", err)
+	}
+	return nil
+}
+
+// loop reads ready connections until done, waking up every second at most
+// to ping them.
+func (p *poller) loop(done <-chan struct{}) {
+	p.pinged = time.Now()
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		n, err := syscall.EpollWait(p.fd, events, 1000)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			p.b.log.Error("epoll wait", "err", err)
+			return
+		}
+		for _, ev := range events[:n] {
+			p.mu.Lock()
+			c := p.conns[int(ev.Fd)]
+			p.mu.Unlock()
+			if c != nil {
+				p.read(c)
+			}
+		}
+		if interval := p.b.opts.PingInterval; interval > 0 && time.Since(p.pinged) >= interval {
+			p.ping()
+		}
+	}
+}
+
+// read reads c into the shared buffer and handles its frames. Level
+// triggered epoll reports c again while it has more to read.
+func (p *poller) read(c *pollConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return
+	}
+
+	n, err := syscall.Read(c.fd, p.buf)
+	switch {
+	case err == syscall.EAGAIN || err == syscall.EINTR:
+	case err != nil:
+		c.end(err)
+	case n == 0:
+		c.end(&websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: "unexpected EOF"})
+	default:
+		atomic.AddInt64(&p.b.stats.WireBytesIn, int64(n))
+		if err := c.feed(p.buf[:n]); err != nil {
+			c.end(err)
+		}
+	}
+}
+
+func (p *poller) ping() {
+	p.mu.Lock()
+	conns := make([]*pollConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	p.pinged = time.Now()
+	for _, c := range conns {
+		c.ping(p.pinged)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package wsbm
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// netpoll is only implemented with epoll on linux.
+type netpoll struct{}
+
+func newNetpoll(b *Benchmark) (*netpoll, error) {
+	return nil, fmt.Errorf("netpoll engine is not supported on %s", runtime.GOOS)
+}
+
+func (np *netpoll) start() {}
+
+func (np *netpoll) stop() {}
+
+func (np *netpoll) add(c *pollConn) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package wsbm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// lineBuffers are buffers JSON lines are encoded into.
+var lineBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// messageLine is a received message of jsonl output format.
+type messageLine struct {
+	Conn int    `json:"conn"`
+	Seq  int64  `json:"seq"`
+	Ts   string `json:"ts"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+	Data string `json:"data"`
+}
+
+// writeJSONL writes a received message to output as a JSON line with its
+// connection, sequence and receive time, binary data is base64 encoded.
+func (b *Benchmark) writeJSONL(t *task, msgType int, content []byte) {
+	line := messageLine{
+		Conn: t.id,
+		Seq:  t.result.Messages,
+		Ts:   time.Now().Format(time.RFC3339Nano),
+		Type: "text",
+		Size: len(content),
+		Data: string(content),
+	}
+	if msgType == websocket.BinaryMessage {
+		line.Type = "binary"
+		line.Data = base64.StdEncoding.EncodeToString(content)
+	}
+	buf := lineBuffers.Get().(*bytes.Buffer)
+	defer lineBuffers.Put(buf)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(line); err != nil {
+		return
+	}
+	t.output.Write(buf.Bytes())
+}
@@ -0,0 +1,138 @@
+package wsbm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParsePattern parses a pattern of steps run by every connection into a
+// scenario, eg:
+//
+//	send:subscribe.json, wait:ack, loop(100){ send:order.json, expect:fill, sleep:50ms }
+//
+// Elements are connect, send:message, wait:regexp reading until a message
+// matches, expect:regexp the next message must match, sleep:duration,
+// loop(count){...}, loop{...} until the run stops, and close. The
+// scenario connects first unless the pattern starts with connect. load
+// returns the message of send, nil sends the argument as is.
+func ParsePattern(spec string, load func(arg string) (string, error)) (*Scenario, error) {
+	steps, err := parsePatternSteps(spec, load)
+	if err != nil {
+		return nil, fmt.Errorf("pattern: %s", err)
+	}
+	if len(steps) == 0 || steps[0].Action != "connect" {
+		steps = append([]Step{{Action: "connect"}}, steps...)
+	}
+	s := &Scenario{Steps: steps}
+	if err := s.prepare(); err != nil {
+		return nil, fmt.Errorf("pattern: %s", err)
+	}
+	return s, nil
+}
+
+func parsePatternSteps(spec string, load func(arg string) (string, error)) ([]Step, error) {
+	elems, err := splitPattern(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]Step, 0, len(elems))
+	for _, elem := range elems {
+		if elem == "" {
+			return nil, fmt.Errorf("empty element in %q", spec)
+		}
+		if strings.HasPrefix(elem, "loop") && strings.HasSuffix(elem, "}") {
+			step, err := parseLoop(elem, load)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+			continue
+		}
+
+		action, arg, _ := strings.Cut(elem, ":")
+		step := Step{Action: strings.TrimSpace(action)}
+		arg = strings.TrimSpace(arg)
+		switch step.Action {
+		case "connect", "close":
+		case "send":
+			step.Message = arg
+			if load != nil {
+				if step.Message, err = load(arg); err != nil {
+					return nil, err
+				}
+			}
+		case "wait", "expect":
+			step.Strict = step.Action == "expect"
+			step.Action = "expect"
+			step.Match = arg
+		case "sleep":
+			if step.Duration, err = time.ParseDuration(arg); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown element %q", elem)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// parseLoop parses 'loop(count){...}' or 'loop{...}'.
+func parseLoop(elem string, load func(arg string) (string, error)) (Step, error) {
+	step := Step{Action: "loop"}
+	head, body, _ := strings.Cut(elem, "{")
+	head = strings.TrimSpace(strings.TrimPrefix(head, "loop"))
+	if head != "" {
+		if !strings.HasPrefix(head, "(") || !strings.HasSuffix(head, ")") {
+			return step, fmt.Errorf("invalid loop %q", elem)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(head[1 : len(head)-1]))
+		if err != nil || count <= 0 {
+			return step, fmt.Errorf("invalid loop count in %q", elem)
+		}
+		step.Count = count
+	}
+
+	var err error
+	if step.Steps, err = parsePatternSteps(strings.TrimSuffix(body, "}"), load); err != nil {
+		return step, err
+	}
+	if len(step.Steps) == 0 {
+		return step, fmt.Errorf("empty loop %q", elem)
+	}
+	return step, nil
+}
+
+// splitPattern splits elements by commas outside of braces and
+// parentheses, so that loops and JSON messages are kept whole.
+func splitPattern(spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var elems []string
+	var depth, start int
+	for i, c := range spec {
+		switch c {
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("unbalanced %q in %q", c, spec)
+			}
+		case ',':
+			if depth == 0 {
+				elems = append(elems, strings.TrimSpace(spec[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("unclosed loop in " + strconv.Quote(spec))
+	}
+	return append(elems, strings.TrimSpace(spec[start:])), nil
+}
@@ -0,0 +1,32 @@
+package wsbm
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// Message is sent after connect, text messages are templates.
+type Message struct {
+	Binary bool
+	Data   []byte
+	// Channel is the subscription, destination or topic a message decoded
+	// by a protocol was received on.
+	Channel string `json:",omitempty"`
+}
+
+// ParsePayload decodes a binary payload 'hex:...', 'base64:...' or '@file',
+// anything else is used as is.
+func ParsePayload(spec string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(spec, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(spec, "hex:"))
+	case strings.HasPrefix(spec, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(spec, "base64:"))
+	case strings.HasPrefix(spec, "@"):
+		return os.ReadFile(spec[1:])
+	default:
+		return []byte(spec), nil
+	}
+}
@@ -0,0 +1,239 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// phoenix speaks the Phoenix Channels v2 serializer, Subscribe are topic
+// templates joined after connect and the latency of joins is recorded by
+// template. Sent messages like '{"event":"new_msg","payload":{}}' are
+// pushed to the Publish topic, broadcasts are counted by topic template.
+type phoenix struct {
+	b       *Benchmark
+	lastRef int64
+
+	mu sync.Mutex
+	// templates are Subscribe templates of joined topics.
+	templates map[string]string
+	joinRefs  map[string]string
+	// pushes are events and start times of pushes by ref.
+	pushes map[string]phoenixPush
+}
+
+type phoenixPush struct {
+	event string
+	start time.Time
+}
+
+// phoenixMessage is [join_ref, ref, topic, event, payload].
+type phoenixMessage struct {
+	JoinRef *string
+	Ref     *string
+	Topic   string
+	Event   string
+	Payload json.RawMessage
+}
+
+func (m phoenixMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{m.JoinRef, m.Ref, m.Topic, m.Event, m.Payload})
+}
+
+func (m *phoenixMessage) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &[]interface{}{&m.JoinRef, &m.Ref, &m.Topic, &m.Event, &m.Payload})
+}
+
+func (p *phoenix) prepare(ctx context.Context, t *task) error {
+	u := *t.url
+	if !strings.HasSuffix(u.Path, "/websocket") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/websocket"
+	}
+	q := u.Query()
+	q.Set("vsn", "2.0.0")
+	u.RawQuery = q.Encode()
+	t.url = &u
+	return nil
+}
+
+func (p *phoenix) nextRef() *string {
+	ref := strconv.FormatInt(atomic.AddInt64(&p.lastRef, 1), 10)
+	return &ref
+}
+
+func (p *phoenix) write(s *session, m phoenixMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.TextMessage, data)
+}
+
+// open joins topics one by one and starts heartbeats of PingInterval, 30s
+// by default. Broadcasts received while joining are pending.
+func (p *phoenix) open(s *session) error {
+	p.templates = make(map[string]string)
+	p.joinRefs = make(map[string]string)
+	p.pushes = make(map[string]phoenixPush)
+
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	for _, text := range s.b.opts.Subscribe {
+		topic, err := s.b.message(s.id, text)
+		if err != nil {
+			return err
+		}
+		ref := p.nextRef()
+		start := time.Now()
+		err = p.write(s, phoenixMessage{JoinRef: ref, Ref: ref, Topic: string(topic), Event: "phx_join", Payload: json.RawMessage("{}")})
+		if err != nil {
+			return err
+		}
+		if err := p.awaitJoin(s, *ref); err != nil {
+			return fmt.Errorf("join %s: %s", topic, err)
+		}
+		s.b.stats.AddCall("join "+text, time.Since(start))
+
+		p.mu.Lock()
+		p.templates[string(topic)] = text
+		p.joinRefs[string(topic)] = *ref
+		p.mu.Unlock()
+	}
+
+	interval := s.b.opts.PingInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go p.heartbeat(s, interval)
+	return nil
+}
+
+// awaitJoin reads messages until the reply of join ref.
+func (p *phoenix) awaitJoin(s *session, ref string) error {
+	for {
+		msgType, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var m phoenixMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("invalid message %q", data)
+		}
+		if m.Event == "phx_reply" && m.Ref != nil && *m.Ref == ref {
+			return replyError(m.Payload)
+		}
+		msgs, err := p.decode(s, msgType, data)
+		if err != nil {
+			return err
+		}
+		s.pending = append(s.pending, msgs...)
+	}
+}
+
+// replyError returns the error of a reply payload with status other than ok.
+func replyError(payload json.RawMessage) error {
+	var reply struct {
+		Status   string          `json:"status"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		return err
+	}
+	if reply.Status != "ok" {
+		return fmt.Errorf("status %s %s", reply.Status, reply.Response)
+	}
+	return nil
+}
+
+func (p *phoenix) heartbeat(s *session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			err := p.write(s, phoenixMessage{Ref: p.nextRef(), Topic: "phoenix", Event: "heartbeat", Payload: json.RawMessage("{}")})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// encode pushes an event to the Publish topic, the latency of its reply is
+// recorded by event.
+func (p *phoenix) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	var push struct {
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &push); err != nil || push.Event == "" {
+		return 0, nil, fmt.Errorf("phoenix: invalid push %q", data)
+	}
+	if push.Payload == nil {
+		push.Payload = json.RawMessage("{}")
+	}
+	topic, err := s.b.message(s.id, s.b.publish())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ref := p.nextRef()
+	p.mu.Lock()
+	joinRef, ok := p.joinRefs[string(topic)]
+	if ok {
+		p.pushes[*ref] = phoenixPush{event: push.Event, start: time.Now()}
+	}
+	p.mu.Unlock()
+	if !ok {
+		return 0, nil, fmt.Errorf("phoenix: topic %s is not joined", topic)
+	}
+	data, err = json.Marshal(phoenixMessage{JoinRef: &joinRef, Ref: ref, Topic: string(topic), Event: push.Event, Payload: push.Payload})
+	return websocket.TextMessage, data, err
+}
+
+// decode returns payloads of broadcasts on the template of their topic,
+// replies record the latency of pushes.
+func (p *phoenix) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	var m phoenixMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, protocolError("phoenix", fmt.Errorf("invalid message %q", data))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch m.Event {
+	case "phx_reply":
+		if m.Ref == nil {
+			return nil, nil
+		}
+		if push, ok := p.pushes[*m.Ref]; ok {
+			delete(p.pushes, *m.Ref)
+			if err := replyError(m.Payload); err != nil {
+				s.b.log.Warn("phoenix push", "task", s.id, "event", push.event, "err", err)
+				return nil, nil
+			}
+			s.b.stats.AddCall(push.event, time.Since(push.start))
+		}
+		return nil, nil
+	case "phx_error", "phx_close":
+		if _, ok := p.templates[m.Topic]; ok {
+			return nil, protocolError("phoenix", errors.New(m.Event+" on "+m.Topic))
+		}
+		return nil, nil
+	}
+
+	channel, ok := p.templates[m.Topic]
+	if !ok {
+		channel = m.Topic
+	}
+	return []Message{{Data: m.Payload, Channel: channel}}, nil
+}
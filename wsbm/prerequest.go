@@ -0,0 +1,137 @@
+package wsbm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrPreRequest = errors.New("pre request")
+
+// PreRequest is an HTTP request made before each dial, like a login,
+// values extracted from its response are template variables of the
+// connection. URL, header values and body are templates.
+type PreRequest struct {
+	// Method defaults to POST with body, GET without.
+	Method string
+	URL    string
+	Header http.Header
+	Body   string
+	// Extract maps variable names to a JSONPath of the response body like
+	// '$.token', 'cookie:name' of Set-Cookie, or 'header:Name'.
+	Extract map[string]string
+}
+
+func (b *Benchmark) newHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: b.opts.HandshakeTimeout,
+		Jar:     b.opts.Jar,
+		Transport: &http.Transport{
+			Proxy:           b.proxy,
+			TLSClientConfig: b.opts.TLSConfig,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return b.dialAddr(ctx, &net.Dialer{}, network, addr)
+			},
+		},
+	}
+}
+
+// preRequest makes PreRequest of connection id and keeps its extracted
+// values for templates until the task ends.
+func (b *Benchmark) preRequest(ctx context.Context, id int) error {
+	p := b.opts.PreRequest
+	data := b.templateData(id)
+	rawURL, err := b.templates.execute(p.URL, data)
+	if err != nil {
+		return err
+	}
+	body, err := b.templates.execute(p.Body, data)
+	if err != nil {
+		return err
+	}
+
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+		if body != "" {
+			method = http.MethodPost
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range p.Header {
+		for _, value := range values {
+			v, err := b.templates.execute(value, data)
+			if err != nil {
+				return err
+			}
+			req.Header.Add(name, v)
+		}
+	}
+
+	start := time.Now()
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrPreRequest, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrPreRequest, err)
+	}
+	b.stats.PreRequest.Add(time.Since(start))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: status %s", ErrPreRequest, resp.Status)
+	}
+
+	vars := make(map[string]string, len(p.Extract))
+	for name, from := range p.Extract {
+		v, err := extract(resp, content, from)
+		if err != nil {
+			return fmt.Errorf("%w: extract %s: %s", ErrPreRequest, name, err)
+		}
+		vars[name] = v
+	}
+	b.preVars.Store(id, vars)
+	return nil
+}
+
+// extract returns the value of from in the response.
+func extract(resp *http.Response, body []byte, from string) (string, error) {
+	switch {
+	case strings.HasPrefix(from, "cookie:"):
+		name := strings.TrimPrefix(from, "cookie:")
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				return c.Value, nil
+			}
+		}
+		return "", fmt.Errorf("no cookie %s", name)
+	case strings.HasPrefix(from, "header:"):
+		name := strings.TrimPrefix(from, "header:")
+		if v := resp.Header.Get(name); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("no header %s", name)
+	default:
+		path, err := ParseJSONPath(from)
+		if err != nil {
+			return "", err
+		}
+		v, ok := path.LookupJSON(body)
+		if !ok {
+			return "", fmt.Errorf("no %s in body", path)
+		}
+		return jsonString(v), nil
+	}
+}
@@ -0,0 +1,267 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type snapshot struct {
+	connections int64
+	messages    int64
+	bytes       int64
+	errors      int64
+}
+
+func (s *stats) snapshot() snapshot {
+	return snapshot{
+		connections: atomic.LoadInt64(&s.Connections),
+		messages:    atomic.LoadInt64(&s.Messages),
+		bytes:       atomic.LoadInt64(&s.Bytes),
+		errors:      s.ErrorCount(),
+	}
+}
+
+// reportProgress logs a stats line every interval until done is closed.
+func (b *Benchmark) reportProgress(interval time.Duration, done <-chan struct{}) {
+	s := &b.stats
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, lastTime := s.snapshot(), time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			cur := s.snapshot()
+			secs := now.Sub(lastTime).Seconds()
+			active := atomic.LoadInt64(&s.Active)
+			if b.opts.Hold {
+				s.AddAlive(now.Sub(s.Start), active)
+			}
+			b.log.Info("progress", "elapsed", now.Sub(s.Start).Truncate(time.Second), "active", active,
+				"connect_rate", float64(cur.connections-last.connections)/secs,
+				"msg_rate", float64(cur.messages-last.messages)/secs,
+				"byte_rate", float64(cur.bytes-last.bytes)/secs,
+				"errors", s.ErrorCount())
+			last, lastTime = cur, now
+		}
+	}
+}
+
+// Sample is the progress of a run over the Interval ending at Time,
+// counts are of the interval.
+type Sample struct {
+	Time        time.Time
+	Elapsed     time.Duration
+	Interval    time.Duration
+	Active      int64
+	Connections int64
+	Messages    int64
+	Bytes       int64
+	Errors      int64
+}
+
+// MarshalJSON encodes durations in seconds.
+func (s Sample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sampleJSON{
+		Time:        s.Time,
+		Elapsed:     s.Elapsed.Seconds(),
+		Interval:    s.Interval.Seconds(),
+		Active:      s.Active,
+		Connections: s.Connections,
+		Messages:    s.Messages,
+		Bytes:       s.Bytes,
+		Errors:      s.Errors,
+	})
+}
+
+func (s *Sample) UnmarshalJSON(data []byte) error {
+	var v sampleJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = Sample{
+		Time:        v.Time,
+		Elapsed:     time.Duration(v.Elapsed * float64(time.Second)),
+		Interval:    time.Duration(v.Interval * float64(time.Second)),
+		Active:      v.Active,
+		Connections: v.Connections,
+		Messages:    v.Messages,
+		Bytes:       v.Bytes,
+		Errors:      v.Errors,
+	}
+	return nil
+}
+
+type sampleJSON struct {
+	Time        time.Time `json:"time"`
+	Elapsed     float64   `json:"elapsed_s"`
+	Interval    float64   `json:"interval_s"`
+	Active      int64     `json:"active"`
+	Connections int64     `json:"connections"`
+	Messages    int64     `json:"messages"`
+	Bytes       int64     `json:"bytes"`
+	Errors      int64     `json:"errors"`
+}
+
+// merge adds counts of the same interval of another agent.
+func (s *Sample) merge(o Sample) {
+	s.Active += o.Active
+	s.Connections += o.Connections
+	s.Messages += o.Messages
+	s.Bytes += o.Bytes
+	s.Errors += o.Errors
+}
+
+// runSampler adds a sample to the timeline and calls OnSample every
+// interval until done is closed, and once more with the rest of the last
+// interval.
+func (b *Benchmark) runSampler(interval time.Duration, done <-chan struct{}) {
+	s := &b.stats
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, lastTime := s.snapshot(), s.Start
+	sample := func(now time.Time) {
+		cur := s.snapshot()
+		sample := Sample{
+			Time:        now,
+			Elapsed:     now.Sub(s.Start),
+			Interval:    now.Sub(lastTime),
+			Active:      atomic.LoadInt64(&s.Active),
+			Connections: cur.connections - last.connections,
+			Messages:    cur.messages - last.messages,
+			Bytes:       cur.bytes - last.bytes,
+			Errors:      cur.errors - last.errors,
+		}
+		s.mu.Lock()
+		s.timeline = append(s.timeline, sample)
+		s.mu.Unlock()
+		b.client.sample(now)
+		if b.opts.OnSample != nil {
+			b.opts.OnSample(sample)
+		}
+		last, lastTime = cur, now
+	}
+	for {
+		select {
+		case <-done:
+			sample(time.Now())
+			return
+		case now := <-ticker.C:
+			sample(now)
+		}
+	}
+}
+
+const (
+	// progressInterval is how often the progress bar is drawn, its rate is
+	// of the last progressWindow draws.
+	progressInterval = 500 * time.Millisecond
+	progressWindow   = 10
+	progressWidth    = 30
+)
+
+// progressBar draws completed tasks of Requests in place on a terminal,
+// with their rate of the last seconds and the ETA it gives. Log records
+// are written above it.
+type progressBar struct {
+	w     io.Writer
+	total int64
+
+	mu   sync.Mutex
+	done []int64
+	line string
+}
+
+// update draws done tasks after elapsed, the last of the run when final.
+func (p *progressBar) update(done int64, elapsed time.Duration, final bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = append(p.done, done)
+	if len(p.done) > progressWindow+1 {
+		p.done = p.done[1:]
+	}
+
+	var rate float64
+	if n := len(p.done) - 1; n > 0 && elapsed >= progressWindow*progressInterval {
+		rate = float64(done-p.done[0]) / (float64(n) * progressInterval.Seconds())
+	} else if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+	eta := "ETA -"
+	if final {
+		eta = "in " + round(elapsed).String()
+	} else if rate > 0 {
+		eta = "ETA " + time.Duration(float64(p.total-done)/rate*float64(time.Second)).Round(time.Second).String()
+	}
+
+	filled := int(done * progressWidth / p.total)
+	if filled > progressWidth {
+		filled = progressWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	p.line = fmt.Sprintf("[%s] %d/%d %3.0f%% %.1f/s %s", bar, done, p.total,
+		float64(done)*100/float64(p.total), rate, eta)
+	fmt.Fprintf(p.w, "\r%s\x1b[K", p.line)
+	if final {
+		fmt.Fprintln(p.w)
+		p.line = ""
+	}
+}
+
+// runProgressBar draws the progress bar until done is closed.
+func (b *Benchmark) runProgressBar(done <-chan struct{}) {
+	s := &b.stats
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			b.progress.update(atomic.LoadInt64(&s.Done), time.Since(s.Start), true)
+			return
+		case now := <-ticker.C:
+			b.progress.update(atomic.LoadInt64(&s.Done), now.Sub(s.Start), false)
+		}
+	}
+}
+
+// progressHandler clears the progress bar to log records of next above
+// it.
+type progressHandler struct {
+	p    *progressBar
+	next slog.Handler
+}
+
+func (h *progressHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *progressHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	if h.p.line != "" {
+		io.WriteString(h.p.w, "\r\x1b[K")
+		defer fmt.Fprintf(h.p.w, "%s", h.p.line)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *progressHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &progressHandler{p: h.p, next: h.next.WithAttrs(attrs)}
+}
+
+func (h *progressHandler) WithGroup(name string) slog.Handler {
+	return &progressHandler{p: h.p, next: h.next.WithGroup(name)}
+}
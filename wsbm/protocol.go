@@ -0,0 +1,114 @@
+package wsbm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrProtocol = errors.New("protocol")
+
+// protocol speaks an application protocol over the connection of a task,
+// a protocol is created for each connection.
+type protocol interface {
+	// prepare changes url and header of the task before dial.
+	prepare(ctx context.Context, t *task) error
+	// open runs the protocol handshake after connect.
+	open(s *session) error
+	// encode frames a sent message.
+	encode(s *session, msgType int, data []byte) (int, []byte, error)
+	// decode returns messages of a received frame, replying control frames
+	// like pings of the protocol.
+	decode(s *session, msgType int, data []byte) ([]Message, error)
+}
+
+// newProtocol returns the protocol of a connection, nil for plain
+// WebSocket messages.
+func (b *Benchmark) newProtocol() protocol {
+	switch b.opts.Protocol {
+	case "socketio":
+		return &socketIO{b: b}
+	case "graphql-ws":
+		return &graphQLWS{b: b}
+	case "stomp":
+		return &stomp{b: b}
+	case "mqtt":
+		return &mqtt{b: b}
+	case "signalr":
+		return &signalR{b: b}
+	case "sockjs":
+		return &sockJS{b: b}
+	case "phoenix":
+		return &phoenix{b: b}
+	case "jsonrpc":
+		return &jsonRPC{b: b}
+	default:
+		return nil
+	}
+}
+
+func validProtocol(name string) error {
+	switch name {
+	case "", "socketio", "graphql-ws", "stomp", "mqtt", "signalr", "sockjs", "phoenix", "jsonrpc":
+		return nil
+	default:
+		return fmt.Errorf("unknown protocol %q", name)
+	}
+}
+
+// publish returns the channel sent messages are published to.
+func (b *Benchmark) publish() string {
+	if b.opts.Publish != "" || len(b.opts.Subscribe) == 0 {
+		return b.opts.Publish
+	}
+	return b.opts.Subscribe[0]
+}
+
+// httpURL returns u with the http scheme of a websocket scheme.
+func httpURL(u *url.URL) *url.URL {
+	v := *u
+	switch v.Scheme {
+	case "ws":
+		v.Scheme = "http"
+	case "wss":
+		v.Scheme = "https"
+	}
+	return &v
+}
+
+// wsURL returns u with the websocket scheme of a http scheme.
+func wsURL(u *url.URL) *url.URL {
+	v := *u
+	switch v.Scheme {
+	case "http":
+		v.Scheme = "ws"
+	case "https":
+		v.Scheme = "wss"
+	}
+	return &v
+}
+
+// protocolError wraps errors of protocol handshakes.
+func protocolError(name string, err error) error {
+	return fmt.Errorf("%w %s: %s", ErrProtocol, name, err)
+}
+
+// handshakeTimeout is the read deadline of protocol handshakes.
+func (b *Benchmark) handshakeTimeout() time.Time {
+	timeout := b.opts.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return time.Now().Add(timeout)
+}
+
+// addHeader adds a header of the handshake request of the task.
+func (t *task) addHeader(name, value string) {
+	if t.header == nil {
+		t.header = http.Header{}
+	}
+	t.header.Add(name, value)
+}
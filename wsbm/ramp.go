@@ -0,0 +1,102 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stage changes concurrency linearly from From to To over Duration.
+type Stage struct {
+	From     int
+	To       int
+	Duration time.Duration
+}
+
+// ParseRamp parses stages like '0:100:60s,100:500:120s'.
+func ParseRamp(spec string) ([]Stage, error) {
+	var stages []Stage
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ramp stage %q, want from:to:duration", part)
+		}
+		from, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ramp stage %q: %s", part, err)
+		}
+		to, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ramp stage %q: %s", part, err)
+		}
+		d, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ramp stage %q: %s", part, err)
+		}
+		if from < 0 || to < 0 || d <= 0 {
+			return nil, fmt.Errorf("invalid ramp stage %q", part)
+		}
+		stages = append(stages, Stage{From: from, To: to, Duration: d})
+	}
+	return stages, nil
+}
+
+func rampDuration(stages []Stage) time.Duration {
+	var d time.Duration
+	for _, stage := range stages {
+		d += stage.Duration
+	}
+	return d
+}
+
+// rampTarget returns concurrency at elapsed, the last To after all stages.
+func rampTarget(stages []Stage, elapsed time.Duration) int {
+	for _, stage := range stages {
+		if elapsed < stage.Duration {
+			return stage.From + int(float64(stage.To-stage.From)*float64(elapsed)/float64(stage.Duration))
+		}
+		elapsed -= stage.Duration
+	}
+	return stages[len(stages)-1].To
+}
+
+// ramp starts and stops workers following Options.Ramp until all stages are
+// done, workers stopped by ramp close their connections gracefully.
+func (b *Benchmark) ramp(ctx context.Context, wg *sync.WaitGroup, count *int32) {
+	var cancels []context.CancelFunc
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		elapsed := time.Since(start)
+		target := rampTarget(b.opts.Ramp, elapsed)
+		for len(cancels) < target {
+			workerCtx, cancel := context.WithCancel(ctx)
+			cancels = append(cancels, cancel)
+			wg.Add(1)
+			go b.work(workerCtx, count, wg.Done)
+		}
+		for len(cancels) > target {
+			cancels[len(cancels)-1]()
+			cancels = cancels[:len(cancels)-1]
+		}
+
+		if elapsed >= rampDuration(b.opts.Ramp) {
+			return
+		}
+		if b.opts.Requests > 0 && int(atomic.LoadInt32(count)) >= b.opts.Requests {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
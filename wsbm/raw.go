@@ -0,0 +1,474 @@
+package wsbm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawHeader starts raw results files, followed by tags of the run. The
+// version is of their records, files of rawHeaderV2 have connection
+// records only, without kinds.
+var (
+	rawHeader   = []byte("wsbm raw 3\n")
+	rawHeaderV2 = []byte("wsbm raw 2\n")
+)
+
+// Kinds of records of raw results.
+const (
+	rawConnRecord = iota
+	rawLatencyRecord
+)
+
+// rawMetrics are metrics of latency records by index.
+var rawMetrics = []string{MetricRTT, MetricReply, MetricPongRTT, MetricFanout}
+
+// ErrNotRaw is returned by ReadRaw for a file without raw results.
+var ErrNotRaw = errors.New("not a raw results file")
+
+// RawWriter writes results of connections and latencies of their messages
+// as compact binary records, to analyze them offline with ReadRaw and
+// Analyze. Records are a kind followed by varints of times in nanoseconds,
+// counts and strings, urls are written once and referred to by index.
+type RawWriter struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	buf  []byte
+	urls map[string]uint64
+	err  error
+}
+
+// NewRawWriter writes the header of raw results of a run tagged by tags
+// to w.
+func NewRawWriter(w io.Writer, tags Tags) (*RawWriter, error) {
+	rw := &RawWriter{w: bufio.NewWriterSize(w, 64<<10), urls: make(map[string]uint64)}
+	b := append([]byte(nil), rawHeader...)
+	b = binary.AppendUvarint(b, uint64(len(tags)))
+	for _, k := range tags.Keys() {
+		b = appendRawString(b, k)
+		b = appendRawString(b, tags[k])
+	}
+	if _, err := rw.w.Write(b); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Write writes the record of r, the first error is returned by Flush.
+func (w *RawWriter) Write(r ConnResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+
+	b := binary.AppendUvarint(w.buf[:0], rawConnRecord)
+	b = binary.AppendUvarint(b, uint64(r.ID))
+	index, ok := w.urls[r.URL]
+	if !ok {
+		index = uint64(len(w.urls))
+		w.urls[r.URL] = index
+	}
+	b = binary.AppendUvarint(b, index)
+	if !ok {
+		b = appendRawString(b, r.URL)
+	}
+	var start int64
+	if !r.Start.IsZero() {
+		start = r.Start.UnixNano()
+	}
+	b = binary.AppendVarint(b, start)
+	for _, d := range []time.Duration{r.Connect, r.DNS, r.TCP, r.TLS, r.Upgrade, r.Handshake, r.FirstMessage, r.Duration} {
+		b = binary.AppendVarint(b, int64(d))
+	}
+	b = binary.AppendVarint(b, r.Messages)
+	b = binary.AppendVarint(b, r.Bytes)
+	b = binary.AppendVarint(b, r.SchemaViolations)
+	b = appendRawString(b, r.Close)
+	if r.Err != nil {
+		b = appendRawString(b, errorType(r.Err))
+		b = appendRawString(b, errorCategory(r.Err))
+		b = appendRawString(b, r.Err.Error())
+	} else {
+		b = appendRawString(b, "")
+	}
+	w.buf = b
+	_, w.err = w.w.Write(b)
+}
+
+// WriteLatency writes the record of latency l, the first error is returned
+// by Flush.
+func (w *RawWriter) WriteLatency(l MessageLatency) {
+	metric := -1
+	for i, m := range rawMetrics {
+		if m == l.Metric {
+			metric = i
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil || metric < 0 {
+		return
+	}
+
+	b := binary.AppendUvarint(w.buf[:0], rawLatencyRecord)
+	b = binary.AppendUvarint(b, uint64(l.ID))
+	b = binary.AppendUvarint(b, uint64(metric))
+	b = binary.AppendVarint(b, l.At.UnixNano())
+	b = binary.AppendVarint(b, int64(l.Latency))
+	w.buf = b
+	_, w.err = w.w.Write(b)
+}
+
+// Flush writes buffered records.
+func (w *RawWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func appendRawString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// rawError is an error of a connection read from raw results, with its
+// type and category when it was written.
+type rawError struct {
+	typ      string
+	category string
+	msg      string
+}
+
+func (e *rawError) Error() string {
+	return e.msg
+}
+
+// RawResults are results of connections of a run and latencies of their
+// messages, with its tags.
+type RawResults struct {
+	Tags      Tags
+	Results   []ConnResult
+	Latencies []MessageLatency
+}
+
+// ReadRaw reads results of connections and latencies written by RawWriter.
+func ReadRaw(r io.Reader) (*RawResults, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	header := make([]byte, len(rawHeader))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrNotRaw
+	}
+	v2 := bytes.Equal(header, rawHeaderV2)
+	if !v2 && !bytes.Equal(header, rawHeader) {
+		return nil, ErrNotRaw
+	}
+	raw := &RawResults{}
+	d := rawDecoder{r: br}
+	if n := d.uvarint(); n > 0 && d.err == nil {
+		raw.Tags = make(Tags)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			k := d.string()
+			raw.Tags[k] = d.string()
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("tags: %w", d.err)
+	}
+
+	var results []ConnResult
+	var urls []string
+	for {
+		// records of v2 files start with the id of connection records
+		first, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			raw.Results = results
+			return raw, nil
+		}
+		d := rawDecoder{r: br, err: err}
+		kind, id := uint64(rawConnRecord), first
+		if !v2 {
+			kind, id = first, d.uvarint()
+		}
+		if kind == rawLatencyRecord {
+			l := MessageLatency{ID: int(id)}
+			if metric := d.uvarint(); metric < uint64(len(rawMetrics)) {
+				l.Metric = rawMetrics[metric]
+			} else if d.err == nil {
+				d.err = fmt.Errorf("invalid metric %d", metric)
+			}
+			l.At = time.Unix(0, d.varint())
+			l.Latency = time.Duration(d.varint())
+			if d.err != nil {
+				return nil, fmt.Errorf("latency record %d: %w", len(raw.Latencies), d.err)
+			}
+			raw.Latencies = append(raw.Latencies, l)
+			continue
+		}
+		if kind != rawConnRecord && d.err == nil {
+			d.err = fmt.Errorf("invalid record kind %d", kind)
+		}
+		result := ConnResult{ID: int(id)}
+		index := d.uvarint()
+		switch {
+		case d.err != nil:
+		case index == uint64(len(urls)):
+			urls = append(urls, d.string())
+			result.URL = urls[index]
+		case index < uint64(len(urls)):
+			result.URL = urls[index]
+		default:
+			d.err = fmt.Errorf("invalid url index %d", index)
+		}
+		if start := d.varint(); start != 0 {
+			result.Start = time.Unix(0, start)
+		}
+		for _, p := range []*time.Duration{&result.Connect, &result.DNS, &result.TCP, &result.TLS,
+			&result.Upgrade, &result.Handshake, &result.FirstMessage, &result.Duration} {
+			*p = time.Duration(d.varint())
+		}
+		result.Messages = d.varint()
+		result.Bytes = d.varint()
+		result.SchemaViolations = d.varint()
+		result.Close = d.string()
+		if typ := d.string(); typ != "" {
+			result.Err = &rawError{typ: typ, category: d.string(), msg: d.string()}
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(results), d.err)
+		}
+		results = append(results, result)
+	}
+}
+
+// rawDecoder reads fields of a record, keeping the first error.
+type rawDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *rawDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+	return v
+}
+
+func (d *rawDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	var v int64
+	v, d.err = binary.ReadVarint(d.r)
+	return v
+}
+
+func (d *rawDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return string(b)
+}
+
+// Analyze recomputes the result of connections and latencies of their
+// messages from raw results, the timeline has a sample per interval from
+// the first start.
+func Analyze(raw *RawResults, interval time.Duration) *Result {
+	var s stats
+	results := raw.Results
+	for _, r := range results {
+		if r.Start.IsZero() {
+			continue
+		}
+		if s.Start.IsZero() || r.Start.Before(s.Start) {
+			s.Start = r.Start
+		}
+		if end := r.Start.Add(r.Duration); end.After(s.End) {
+			s.End = end
+		}
+	}
+
+	for _, r := range results {
+		s.Connections++
+		s.Messages += r.Messages
+		s.Bytes += r.Bytes
+		if r.Err != nil {
+			s.AddError(r.Err)
+		}
+		s.addRawClose(r.Close)
+		for _, l := range []struct {
+			latency *latency
+			d       time.Duration
+		}{{&s.DNS, r.DNS}, {&s.TCP, r.TCP}, {&s.TLS, r.TLS}, {&s.Upgrade, r.Upgrade},
+			{&s.Handshake, r.Handshake}, {&s.FirstMessage, r.FirstMessage}} {
+			if l.d > 0 {
+				l.latency.Add(l.d)
+			}
+		}
+	}
+	for _, l := range raw.Latencies {
+		if latency := s.messageLatency(l.Metric); latency != nil {
+			latency.Add(l.Latency)
+		}
+	}
+	s.timeline = rawTimeline(results, s.Start, s.End, interval)
+	for _, sample := range s.timeline {
+		if sample.Active > s.PeakActive {
+			s.PeakActive = sample.Active
+		}
+	}
+	return s.Result(nil)
+}
+
+// messageLatency returns the latency of messages of metric, nil if
+// unknown.
+func (s *stats) messageLatency(metric string) *latency {
+	switch metric {
+	case MetricRTT:
+		return &s.RTT
+	case MetricReply:
+		return &s.Reply
+	case MetricPongRTT:
+		return &s.PongRTT
+	case MetricFanout:
+		return &s.Fanout
+	}
+	return nil
+}
+
+// addRawClose counts the close of a raw result, 'client' or the close
+// code and reason from server.
+func (s *stats) addRawClose(close string) {
+	if close == "" {
+		return
+	}
+	code, reason := 0, ""
+	if close != "client" {
+		field, rest, _ := strings.Cut(close, " ")
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return
+		}
+		code, reason = n, rest
+	}
+	if s.closes == nil {
+		s.closes = make(map[int]*CloseResult)
+	}
+	c := s.closes[code]
+	if c == nil {
+		c = &CloseResult{Code: code, Reason: reason}
+		s.closes[code] = c
+	}
+	c.Count++
+}
+
+// rawTimeline returns samples of results every interval from start to
+// end. Connections are counted when they start and errors, messages and
+// bytes when they end.
+func rawTimeline(results []ConnResult, start, end time.Time, interval time.Duration) []Sample {
+	if start.IsZero() || interval <= 0 {
+		return nil
+	}
+	n := int(end.Sub(start)/interval) + 1
+	samples := make([]Sample, n)
+	active := make([]int64, n+1)
+	bucket := func(t time.Time) int {
+		i := int(t.Sub(start) / interval)
+		if i >= n {
+			i = n - 1
+		}
+		return i
+	}
+	for _, r := range results {
+		if r.Start.IsZero() {
+			continue
+		}
+		i, j := bucket(r.Start), bucket(r.Start.Add(r.Duration))
+		samples[i].Connections++
+		samples[j].Messages += r.Messages
+		samples[j].Bytes += r.Bytes
+		if r.Err != nil {
+			samples[j].Errors++
+		}
+		active[i]++
+		active[j+1]--
+	}
+	var alive int64
+	for i := range samples {
+		alive += active[i]
+		samples[i].Active = alive
+		samples[i].Elapsed = time.Duration(i+1) * interval
+		samples[i].Time = start.Add(samples[i].Elapsed)
+		samples[i].Interval = interval
+	}
+	return samples
+}
+
+// FilterRaw returns raw results of connections started in the window from
+// and to after the first start, to 0 meaning until the end, and latencies
+// of their messages.
+func FilterRaw(raw *RawResults, from, to time.Duration) *RawResults {
+	var first time.Time
+	for _, r := range raw.Results {
+		if !r.Start.IsZero() && (first.IsZero() || r.Start.Before(first)) {
+			first = r.Start
+		}
+	}
+	var filtered []ConnResult
+	for _, r := range raw.Results {
+		if r.Start.IsZero() {
+			continue
+		}
+		at := r.Start.Sub(first)
+		if at >= from && (to <= 0 || at < to) {
+			filtered = append(filtered, r)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].Start.Before(filtered[j].Start) })
+	return raw.of(filtered)
+}
+
+// FilterRawURL returns raw results of connections of urls matching re, and
+// latencies of their messages.
+func FilterRawURL(raw *RawResults, re *regexp.Regexp) *RawResults {
+	var filtered []ConnResult
+	for _, r := range raw.Results {
+		if re.MatchString(r.URL) {
+			filtered = append(filtered, r)
+		}
+	}
+	return raw.of(filtered)
+}
+
+// of returns raw results of results, a subset of raw.Results, with the
+// latencies of their messages.
+func (raw *RawResults) of(results []ConnResult) *RawResults {
+	ids := make(map[int]bool, len(results))
+	for _, r := range results {
+		ids[r.ID] = true
+	}
+	filtered := &RawResults{Tags: raw.Tags, Results: results}
+	for _, l := range raw.Latencies {
+		if ids[l.ID] {
+			filtered.Latencies = append(filtered.Latencies, l)
+		}
+	}
+	return filtered
+}
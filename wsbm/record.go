@@ -0,0 +1,116 @@
+package wsbm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame is a recorded message at Offset from connect.
+type Frame struct {
+	Offset time.Duration
+	Binary bool
+	Data   []byte
+}
+
+type frameJSON struct {
+	Offset float64 `json:"offset_ms"`
+	Type   string  `json:"type"`
+	Data   string  `json:"data"`
+}
+
+// MarshalJSON encodes offset in milliseconds and binary data in base64.
+func (f Frame) MarshalJSON() ([]byte, error) {
+	v := frameJSON{Offset: milliseconds(f.Offset), Type: "text", Data: string(f.Data)}
+	if f.Binary {
+		v.Type = "binary"
+		v.Data = base64.StdEncoding.EncodeToString(f.Data)
+	}
+	return json.Marshal(v)
+}
+
+func (f *Frame) UnmarshalJSON(data []byte) error {
+	var v frameJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	f.Offset = time.Duration(v.Offset * float64(time.Millisecond))
+	switch v.Type {
+	case "text":
+		f.Binary, f.Data = false, []byte(v.Data)
+	case "binary":
+		b, err := base64.StdEncoding.DecodeString(v.Data)
+		if err != nil {
+			return err
+		}
+		f.Binary, f.Data = true, b
+	default:
+		return fmt.Errorf("unknown frame type %q", v.Type)
+	}
+	return nil
+}
+
+// ReadFrames reads frames recorded as JSON lines.
+func ReadFrames(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var f Frame
+		if err := json.Unmarshal(line, &f); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames, scanner.Err()
+}
+
+// record writes a received message to output as a JSON line frame.
+func (b *Benchmark) record(t *task, msgType int, content []byte) {
+	data, err := json.Marshal(Frame{
+		Offset: time.Since(t.result.Start),
+		Binary: msgType == websocket.BinaryMessage,
+		Data:   content,
+	})
+	if err != nil {
+		return
+	}
+	t.output.Write(append(data, '\n'))
+}
+
+// replay sends Replay frames at their offsets from connect divided by
+// ReplaySpeed.
+func (b *Benchmark) replay(s *session) {
+	start := time.Now()
+	for _, f := range b.opts.Replay {
+		if b.opts.ReplaySpeed > 0 {
+			wait := time.Until(start.Add(time.Duration(float64(f.Offset) / b.opts.ReplaySpeed)))
+			if wait > 0 {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		msgType := websocket.TextMessage
+		if f.Binary {
+			msgType = websocket.BinaryMessage
+		}
+		if err := s.send(msgType, f.Data); err != nil {
+			b.log.Warn("replay", "task", s.id, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Thresholds of usage of the client flagged as its bottleneck.
+const (
+	clientCPUBusy   = 90
+	clientFDsBusy   = 90
+	clientGCCPUBusy = 10
+)
+
+// fdHeadroom are open files needed besides connections, by output files,
+// pollers, pre requests and closing connections.
+const fdHeadroom = 64
+
+// maxConnections returns the most connections opts open at once, 0 when
+// they are not bounded.
+func maxConnections(opts *Options) int {
+	n := opts.Concurrency
+	switch {
+	case opts.HTTP2 || opts.AutoTune != nil:
+		return 0
+	case opts.FindMax != nil:
+		n = opts.Requests
+	case opts.Arrival != nil:
+		n = opts.MaxInflight
+	case len(opts.Ramp) > 0:
+		n = 0
+		for _, stage := range opts.Ramp {
+			if stage.From > n {
+				n = stage.From
+			}
+			if stage.To > n {
+				n = stage.To
+			}
+		}
+	}
+	if opts.Requests > 0 && opts.Requests < n {
+		n = opts.Requests
+	}
+	return n
+}
+
+// checkFDLimit raises the soft limit of open files to fit connections of
+// opts up to the hard limit, failing when it can't.
+func checkFDLimit(opts *Options) error {
+	conns := maxConnections(opts)
+	if conns <= 0 {
+		return nil
+	}
+	need := uint64(conns + fdHeadroom)
+	from, to, err := raiseFDLimit(need)
+	switch {
+	case err != nil:
+		return fmt.Errorf("raise open files limit to %d: %s", need, err)
+	case to == 0:
+		// limits are unknown
+	case to < need:
+		return fmt.Errorf("%d connections need %d open files but the limit is %d, raise it with ulimit -n %d",
+			conns, need, to, need)
+	case to > from:
+		opts.Logger.Info("raise open files limit", "from", from, "to", to)
+	}
+	return nil
+}
+
+// ClientResult is usage of resources of the load generator itself during
+// the run, sampled every SampleInterval. CPU is in percent of Cores, and
+// FDs and CPU are 0 where unknown. Bottlenecks tell when the client rather
+// than the server may have limited the run.
+type ClientResult struct {
+	Samples      int           `json:"samples"`
+	Cores        int           `json:"cores"`
+	CPUAvg       float64       `json:"cpu_avg"`
+	CPUPeak      float64       `json:"cpu_peak"`
+	MemoryPeak   uint64        `json:"memory_peak"`
+	HeapPeak     uint64        `json:"heap_peak"`
+	Goroutines   int           `json:"goroutines_peak"`
+	FDs          int           `json:"fds_peak"`
+	FDLimit      uint64        `json:"fd_limit"`
+	GCs          uint32        `json:"gcs"`
+	GCPauseTotal time.Duration `json:"gc_pause_total_ns"`
+	GCPauseMax   time.Duration `json:"gc_pause_max_ns"`
+	GCCPU        float64       `json:"gc_cpu"`
+	Bottlenecks  []string      `json:"bottlenecks,omitempty"`
+}
+
+func (r *ClientResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "client cpu: avg %.1f%%, peak %.1f%% of %d cores, memory: %s, heap: %s, goroutines: %d\n",
+		r.CPUAvg, r.CPUPeak, r.Cores, formatSize(r.MemoryPeak), formatSize(r.HeapPeak), r.Goroutines)
+	if r.FDs > 0 {
+		fmt.Fprintf(w, "client fds: %d, limit: %d\n", r.FDs, r.FDLimit)
+	}
+	fmt.Fprintf(w, "client gc: %d, pause total: %s, max: %s, cpu: %.1f%%\n",
+		r.GCs, round(r.GCPauseTotal), round(r.GCPauseMax), r.GCCPU)
+	for _, b := range r.Bottlenecks {
+		fmt.Fprintf(w, "client bottleneck: %s\n", b)
+	}
+}
+
+// merge adds the usage of an agent, peaks are of the busiest agent.
+func (r *ClientResult) merge(o *ClientResult) {
+	if n := r.Samples + o.Samples; n > 0 {
+		r.CPUAvg = (r.CPUAvg*float64(r.Samples) + o.CPUAvg*float64(o.Samples)) / float64(n)
+	}
+	r.Samples += o.Samples
+	if o.CPUPeak > r.CPUPeak {
+		r.CPUPeak, r.Cores = o.CPUPeak, o.Cores
+	}
+	if o.MemoryPeak > r.MemoryPeak {
+		r.MemoryPeak = o.MemoryPeak
+	}
+	if o.HeapPeak > r.HeapPeak {
+		r.HeapPeak = o.HeapPeak
+	}
+	if o.Goroutines > r.Goroutines {
+		r.Goroutines = o.Goroutines
+	}
+	if o.FDs > r.FDs {
+		r.FDs, r.FDLimit = o.FDs, o.FDLimit
+	}
+	r.GCs += o.GCs
+	r.GCPauseTotal += o.GCPauseTotal
+	if o.GCPauseMax > r.GCPauseMax {
+		r.GCPauseMax = o.GCPauseMax
+	}
+	if o.GCCPU > r.GCCPU {
+		r.GCCPU = o.GCCPU
+	}
+	r.Bottlenecks = append(r.Bottlenecks, o.Bottlenecks...)
+}
+
+func formatSize(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+}
+
+// clientMonitor samples usage of resources of the process.
+type clientMonitor struct {
+	mu       sync.Mutex
+	result   ClientResult
+	cpuTotal float64
+	// cpuBusy and fdsBusy count samples over thresholds.
+	cpuBusy  int
+	fdsBusy  int
+	lastCPU  time.Duration
+	lastTime time.Time
+	lastGC   uint32
+	mem      runtime.MemStats
+	// startGC and startPause are collections before the run.
+	startGC    uint32
+	startPause uint64
+}
+
+func newClientMonitor() *clientMonitor {
+	m := &clientMonitor{lastCPU: processCPU(), lastTime: time.Now()}
+	m.result.Cores = runtime.GOMAXPROCS(0)
+	m.result.FDLimit = fdLimit()
+	runtime.ReadMemStats(&m.mem)
+	m.lastGC, m.startGC, m.startPause = m.mem.NumGC, m.mem.NumGC, m.mem.PauseTotalNs
+	return m
+}
+
+// sample records usage since the previous sample.
+func (m *clientMonitor) sample(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := &m.result
+
+	cpu := processCPU()
+	if wall := now.Sub(m.lastTime); wall > 0 {
+		pct := float64(cpu-m.lastCPU) / float64(wall) / float64(r.Cores) * 100
+		m.cpuTotal += pct
+		if pct > r.CPUPeak {
+			r.CPUPeak = pct
+		}
+		if pct >= clientCPUBusy {
+			m.cpuBusy++
+		}
+	}
+	m.lastCPU, m.lastTime = cpu, now
+	r.Samples++
+	r.CPUAvg = m.cpuTotal / float64(r.Samples)
+
+	runtime.ReadMemStats(&m.mem)
+	if m.mem.Sys > r.MemoryPeak {
+		r.MemoryPeak = m.mem.Sys
+	}
+	if m.mem.HeapInuse > r.HeapPeak {
+		r.HeapPeak = m.mem.HeapInuse
+	}
+	// pauses of the last 256 collections are kept by the runtime
+	gc := m.lastGC
+	if m.mem.NumGC > 256 && gc < m.mem.NumGC-256 {
+		gc = m.mem.NumGC - 256
+	}
+	for ; gc < m.mem.NumGC; gc++ {
+		if d := time.Duration(m.mem.PauseNs[gc%256]); d > r.GCPauseMax {
+			r.GCPauseMax = d
+		}
+	}
+	m.lastGC = m.mem.NumGC
+	if n := runtime.NumGoroutine(); n > r.Goroutines {
+		r.Goroutines = n
+	}
+	if fds := openFDs(); fds > 0 {
+		if fds > r.FDs {
+			r.FDs = fds
+		}
+		if r.FDLimit > 0 && uint64(fds)*100 >= r.FDLimit*clientFDsBusy {
+			m.fdsBusy++
+		}
+	}
+}
+
+// Result returns usage of the run with its bottlenecks.
+func (m *clientMonitor) Result() *ClientResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.result
+	r.GCs = m.mem.NumGC - m.startGC
+	r.GCPauseTotal = time.Duration(m.mem.PauseTotalNs - m.startPause)
+	r.GCCPU = m.mem.GCCPUFraction * 100
+
+	var bottlenecks []string
+	if m.cpuBusy > 0 {
+		bottlenecks = append(bottlenecks, fmt.Sprintf("cpu over %d%% in %d of %d samples", clientCPUBusy, m.cpuBusy, r.Samples))
+	}
+	if m.fdsBusy > 0 {
+		bottlenecks = append(bottlenecks, fmt.Sprintf("open fds over %d%% of limit %d in %d of %d samples",
+			clientFDsBusy, r.FDLimit, m.fdsBusy, r.Samples))
+	}
+	if r.GCCPU >= clientGCCPUBusy {
+		bottlenecks = append(bottlenecks, fmt.Sprintf("gc used %.1f%% of cpu", r.GCCPU))
+	}
+	r.Bottlenecks = bottlenecks
+	return &r
+}
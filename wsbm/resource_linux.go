@@ -0,0 +1,63 @@
+//go:build linux
+
+package wsbm
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// processCPU returns the user and system CPU time used by the process.
+func processCPU() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// openFDs returns the number of open file descriptors of the process.
+func openFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0
+	}
+	// the descriptor reading the directory is left out
+	return len(names) - 1
+}
+
+// raiseFDLimit raises the soft limit of open files to need, up to the hard
+// limit, and returns the limit before and after.
+func raiseFDLimit(need uint64) (from, to uint64, err error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, err
+	}
+	from = limit.Cur
+	if from >= need || from >= limit.Max {
+		return from, from, nil
+	}
+	limit.Cur = need
+	if limit.Cur > limit.Max {
+		limit.Cur = limit.Max
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return from, from, err
+	}
+	return from, limit.Cur, nil
+}
+
+// fdLimit returns the soft limit of open file descriptors.
+func fdLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return limit.Cur
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package wsbm
+
+import "time"
+
+// CPU time, open file descriptors and their limit of the process are only
+// read on linux.
+func processCPU() time.Duration { return 0 }
+
+func openFDs() int { return 0 }
+
+func fdLimit() uint64 { return 0 }
+
+func raiseFDLimit(need uint64) (from, to uint64, err error) { return 0, 0, nil }
@@ -0,0 +1,145 @@
+package wsbm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maxRetryBackoff caps the backoff of retries and the Retry-After honored.
+const maxRetryBackoff = 30 * time.Second
+
+// RetryResult counts handshakes of connections dialed with Retries.
+// Fatal are failures not worth retrying, Exhausted those failing the last
+// retry too.
+type RetryResult struct {
+	Dials     int64 `json:"dials"`
+	First     int64 `json:"first_attempt"`
+	Recovered int64 `json:"recovered"`
+	Retries   int64 `json:"retries"`
+	Fatal     int64 `json:"fatal"`
+	Exhausted int64 `json:"exhausted"`
+}
+
+// FirstSuccessRate returns the percentage of dials connected at the first
+// attempt.
+func (r RetryResult) FirstSuccessRate() float64 {
+	if r.Dials <= 0 {
+		return 0
+	}
+	return float64(r.First) * 100 / float64(r.Dials)
+}
+
+// FinalSuccessRate returns the percentage of dials connected at last.
+func (r RetryResult) FinalSuccessRate() float64 {
+	if r.Dials <= 0 {
+		return 0
+	}
+	return float64(r.First+r.Recovered) * 100 / float64(r.Dials)
+}
+
+func (r *RetryResult) merge(o RetryResult) {
+	r.Dials += o.Dials
+	r.First += o.First
+	r.Recovered += o.Recovered
+	r.Retries += o.Retries
+	r.Fatal += o.Fatal
+	r.Exhausted += o.Exhausted
+}
+
+func (r RetryResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "retries: %d, recovered: %d, fatal: %d, exhausted: %d, success first attempt: %.2f%%, final: %.2f%%\n",
+		r.Retries, r.Recovered, r.Fatal, r.Exhausted, r.FirstSuccessRate(), r.FinalSuccessRate())
+}
+
+// dialRetry calls dial of task t until it connects, fails fatally or
+// Retries are spent, backing off between attempts.
+func (b *Benchmark) dialRetry(ctx context.Context, t *task, dial func() error) error {
+	if b.opts.Retries <= 0 {
+		return dial()
+	}
+	atomic.AddInt64(&b.stats.RetryDials, 1)
+	for t.attempt = 0; ; t.attempt++ {
+		err := dial()
+		switch {
+		case ctx.Err() != nil:
+			return err
+		case err == nil && t.attempt == 0:
+			atomic.AddInt64(&b.stats.RetryFirst, 1)
+			return nil
+		case err == nil:
+			atomic.AddInt64(&b.stats.RetryRecovered, 1)
+			return nil
+		case !retryable(err):
+			atomic.AddInt64(&b.stats.RetryFatal, 1)
+			return err
+		case t.attempt >= b.opts.Retries:
+			atomic.AddInt64(&b.stats.RetryExhausted, 1)
+			return err
+		}
+
+		atomic.AddInt64(&b.stats.Retries, 1)
+		backoff := b.retryBackoff(t.attempt, err)
+		b.log.Debug("retry", "task", t.id, "backoff", backoff, "err", err)
+		if !sleepUntil(ctx, time.Now().Add(backoff)) {
+			return nil
+		}
+	}
+}
+
+// retryable tells whether a failed dial may succeed again, like timeouts,
+// refused connections and overloaded servers, unlike rejected requests.
+func retryable(err error) bool {
+	var handshakeErr *HandshakeError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &handshakeErr):
+		switch handshakeErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	case errors.Is(err, ErrHandshakeTimeout), isTimeout(err):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &opErr):
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBackoff returns how long to wait before retry attempt+1, doubling
+// RetryBackoff with jitter, or the Retry-After of err if longer.
+func (b *Benchmark) retryBackoff(attempt int, err error) time.Duration {
+	d := b.opts.RetryBackoff
+	for i := 0; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	d = d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		if secs, err := strconv.Atoi(handshakeErr.Header.Get("Retry-After")); err == nil {
+			if after := time.Duration(secs) * time.Second; after > d {
+				d = after
+			}
+		}
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
@@ -0,0 +1,260 @@
+package wsbm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrNotConnected = errors.New("not connected")
+
+// Scenario is a sequence of steps executed by every connection, eg:
+//
+//	steps:
+//	  - action: connect
+//	  - action: send
+//	    message: '{"op":"subscribe"}'
+//	  - action: expect
+//	    match: subscribed
+//	    timeout: 5s
+//	  - action: sleep
+//	    duration: 1s
+//	  - action: loop
+//	    count: 10
+//	    steps:
+//	      - action: send
+//	        message: '{"op":"ping"}'
+//	  - action: close
+type Scenario struct {
+	Steps []Step `yaml:"steps"`
+}
+
+type Step struct {
+	// Name in stats, defaults to index and action.
+	Name string `yaml:"name,omitempty"`
+	// Action is one of connect, send, expect, sleep, loop and close.
+	Action string `yaml:"action"`
+	// Message is the text sent by send.
+	Message string `yaml:"message,omitempty"`
+	// Match is the regexp expect waits for, empty matches any message.
+	Match string `yaml:"match,omitempty"`
+	// Strict expect fails when the next message doesn't match.
+	Strict bool `yaml:"strict,omitempty"`
+	// Timeout of expect, defaults to read timeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Duration of sleep.
+	Duration time.Duration `yaml:"duration,omitempty"`
+	// Count of loop iterations over Steps, 0 loops until the run stops.
+	Count int    `yaml:"count,omitempty"`
+	Steps []Step `yaml:"steps,omitempty"`
+
+	match *regexp.Regexp
+	// index is the index of the step in stats.
+	index int
+}
+
+func ParseScenario(data []byte) (*Scenario, error) {
+	var s Scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// YAML returns the scenario as parsed by ParseScenario.
+func (s *Scenario) YAML() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+// prepare names and checks steps and indexes them in stats.
+func (s *Scenario) prepare() error {
+	if len(s.Steps) == 0 {
+		return errors.New("scenario has no steps")
+	}
+	var index int
+	return prepareSteps(s.Steps, "", &index)
+}
+
+func prepareSteps(steps []Step, prefix string, index *int) error {
+	for i := range steps {
+		step := &steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("%s%d %s", prefix, i+1, step.Action)
+		}
+		step.index = *index
+		*index++
+		switch step.Action {
+		case "connect", "send", "sleep", "close":
+		case "expect":
+			re, err := regexp.Compile(step.Match)
+			if err != nil {
+				return fmt.Errorf("step %s: %s", step.Name, err)
+			}
+			step.match = re
+		case "loop":
+			if len(step.Steps) == 0 {
+				return fmt.Errorf("step %s: loop has no steps", step.Name)
+			}
+			if err := prepareSteps(step.Steps, fmt.Sprintf("%s%d.", prefix, i+1), index); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("step %s: unknown action %q", step.Name, step.Action)
+		}
+	}
+	return nil
+}
+
+// all returns steps and steps of loops in the order of their index.
+func (s *Scenario) all() []*Step {
+	var all []*Step
+	var walk func(steps []Step)
+	walk = func(steps []Step) {
+		for i := range steps {
+			all = append(all, &steps[i])
+			walk(steps[i].Steps)
+		}
+	}
+	walk(s.Steps)
+	return all
+}
+
+type scenarioTask struct {
+	*task
+	b *Benchmark
+	s *session
+	// sent is set after the first send, following sends pause by Think.
+	sent bool
+}
+
+func (b *Benchmark) runScenario(ctx context.Context, task *task) error {
+	t := &scenarioTask{task: task, b: b}
+	defer func() {
+		if t.s != nil {
+			t.s.Close()
+		}
+	}()
+
+	if err := t.runSteps(ctx, b.opts.Scenario.Steps); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	if t.s != nil && !t.s.closing {
+		t.s.shutdown()
+		return t.s.drain()
+	}
+	return nil
+}
+
+func (t *scenarioTask) runSteps(ctx context.Context, steps []Step) error {
+	for i := range steps {
+		step := &steps[i]
+		start := time.Now()
+		if err := t.runStep(ctx, step); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			if t.s != nil && atomic.LoadInt32(&t.s.dead) == 1 {
+				return t.s.err(err)
+			}
+			if step.Action == "loop" {
+				return err
+			}
+			return fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		t.b.stats.Steps[step.index].Add(time.Since(start))
+	}
+	return nil
+}
+
+func (t *scenarioTask) runStep(ctx context.Context, step *Step) error {
+	if t.s == nil && step.Action != "connect" && step.Action != "sleep" && step.Action != "loop" {
+		return ErrNotConnected
+	}
+
+	switch step.Action {
+	case "connect":
+		if t.s != nil {
+			return nil
+		}
+		s, err := t.b.open(ctx, t.task)
+		if s == nil {
+			if err == nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		t.s = s
+	case "send":
+		if t.sent && t.b.opts.Think != nil && !t.s.pause() {
+			return t.s.ctx.Err()
+		}
+		t.sent = true
+		msg, err := t.b.message(t.id, step.Message)
+		if err != nil {
+			return err
+		}
+		return t.s.send(websocket.TextMessage, msg)
+	case "expect":
+		return t.expect(step)
+	case "sleep":
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(step.Duration):
+		}
+	case "loop":
+		for i := 0; step.Count == 0 || i < step.Count; i++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := t.runSteps(ctx, step.Steps); err != nil {
+				return err
+			}
+		}
+	case "close":
+		t.s.shutdown()
+		return t.s.drain()
+	}
+	return nil
+}
+
+// expect reads messages until one matches the step.
+func (t *scenarioTask) expect(step *Step) error {
+	timeout := step.Timeout
+	if timeout <= 0 {
+		timeout = t.b.opts.ReadTimeout
+	}
+	if timeout > 0 {
+		t.s.setReadTimeout(timeout)
+		defer t.s.SetReadDeadline(time.Time{})
+	}
+
+	for {
+		_, content, err := t.s.read()
+		if err != nil {
+			if isTimeout(err) {
+				return fmt.Errorf("%w: %s", ErrReadTimeout, err)
+			}
+			return err
+		}
+		if step.match.Match(content) {
+			return nil
+		}
+		if step.Strict {
+			return fmt.Errorf("message %s doesn't match %s", truncate(content), step.match)
+		}
+	}
+}
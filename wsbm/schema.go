@@ -0,0 +1,543 @@
+package wsbm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Schema is a JSON Schema validating received messages, supporting the
+// keywords type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, uniqueItems, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, multipleOf, minLength, maxLength,
+// pattern, allOf, anyOf, oneOf, not and local $ref. Other keywords are
+// ignored.
+type Schema struct {
+	raw string
+	// never is the false schema.
+	never bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+
+	items       *Schema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+	ref   *Schema
+}
+
+// schemaParser resolves $ref of the document being parsed.
+type schemaParser struct {
+	doc  interface{}
+	refs map[string]*Schema
+}
+
+// ParseSchema parses a JSON Schema document.
+func ParseSchema(data []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("schema: %s", err)
+	}
+	p := &schemaParser{doc: doc, refs: make(map[string]*Schema)}
+	s, err := p.parse(doc, "#")
+	if err != nil {
+		return nil, fmt.Errorf("schema: %s", err)
+	}
+	s.raw = string(data)
+	return s, nil
+}
+
+func (s *Schema) String() string {
+	return s.raw
+}
+
+func (p *schemaParser) parse(v interface{}, at string) (*Schema, error) {
+	switch v := v.(type) {
+	case bool:
+		return &Schema{never: !v}, nil
+	case map[string]interface{}:
+		return p.parseObject(v, at)
+	default:
+		return nil, fmt.Errorf("%s is not a schema", at)
+	}
+}
+
+func (p *schemaParser) parseObject(m map[string]interface{}, at string) (*Schema, error) {
+	s := &Schema{}
+	var err error
+
+	if ref, ok := m["$ref"].(string); ok {
+		if s.ref, err = p.resolve(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	switch t := m["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type is invalid", at)
+			}
+			s.types = append(s.types, name)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("%s/type is invalid", at)
+	}
+
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return nil, fmt.Errorf("%s/enum is not an array", at)
+		}
+	}
+	if v, ok := m["const"]; ok {
+		s.constant = &v
+	}
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/properties is not an object", at)
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, prop := range props {
+			if s.properties[name], err = p.parse(prop, at+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["required"]; ok {
+		names, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s/required is not an array", at)
+		}
+		for _, name := range names {
+			name, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required is invalid", at)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if s.additionalProperties, err = p.parseKey(m, "additionalProperties", at); err != nil {
+		return nil, err
+	}
+
+	if s.items, err = p.parseKey(m, "items", at); err != nil {
+		return nil, err
+	}
+	if s.minItems, err = intKey(m, "minItems", at); err != nil {
+		return nil, err
+	}
+	if s.maxItems, err = intKey(m, "maxItems", at); err != nil {
+		return nil, err
+	}
+	s.uniqueItems, _ = m["uniqueItems"].(bool)
+
+	if s.minimum, err = numberKey(m, "minimum", at); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = numberKey(m, "maximum", at); err != nil {
+		return nil, err
+	}
+	// exclusiveMinimum and exclusiveMaximum are booleans in draft 4
+	if exclusive, ok := m["exclusiveMinimum"].(bool); ok {
+		if exclusive {
+			s.exclusiveMinimum, s.minimum = s.minimum, nil
+		}
+	} else if s.exclusiveMinimum, err = numberKey(m, "exclusiveMinimum", at); err != nil {
+		return nil, err
+	}
+	if exclusive, ok := m["exclusiveMaximum"].(bool); ok {
+		if exclusive {
+			s.exclusiveMaximum, s.maximum = s.maximum, nil
+		}
+	} else if s.exclusiveMaximum, err = numberKey(m, "exclusiveMaximum", at); err != nil {
+		return nil, err
+	}
+	if s.multipleOf, err = numberKey(m, "multipleOf", at); err != nil {
+		return nil, err
+	}
+
+	if s.minLength, err = intKey(m, "minLength", at); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = intKey(m, "maxLength", at); err != nil {
+		return nil, err
+	}
+	if v, ok := m["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern is not a string", at)
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %s", at, err)
+		}
+	}
+
+	if s.allOf, err = p.parseList(m, "allOf", at); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = p.parseList(m, "anyOf", at); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = p.parseList(m, "oneOf", at); err != nil {
+		return nil, err
+	}
+	if s.not, err = p.parseKey(m, "not", at); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resolve returns the schema of a local reference like
+// '#/definitions/item', a schema referencing itself is parsed once.
+func (p *schemaParser) resolve(ref string) (*Schema, error) {
+	if s, ok := p.refs[ref]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("$ref %s is not local", ref)
+	}
+
+	v := p.doc
+	if pointer := strings.TrimPrefix(ref, "#"); pointer != "" {
+		for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			switch node := v.(type) {
+			case map[string]interface{}:
+				v = node[token]
+			case []interface{}:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(node) {
+					return nil, fmt.Errorf("$ref %s is not found", ref)
+				}
+				v = node[i]
+			default:
+				v = nil
+			}
+			if v == nil {
+				return nil, fmt.Errorf("$ref %s is not found", ref)
+			}
+		}
+	}
+
+	// the placeholder is filled after parsing for references in the schema
+	s := &Schema{}
+	p.refs[ref] = s
+	parsed, err := p.parse(v, ref)
+	if err != nil {
+		return nil, err
+	}
+	*s = *parsed
+	return s, nil
+}
+
+func (p *schemaParser) parseKey(m map[string]interface{}, key, at string) (*Schema, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	return p.parse(v, at+"/"+key)
+}
+
+func (p *schemaParser) parseList(m map[string]interface{}, key, at string) ([]*Schema, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s/%s is not an array", at, key)
+	}
+	schemas := make([]*Schema, len(list))
+	for i, item := range list {
+		var err error
+		if schemas[i], err = p.parse(item, fmt.Sprintf("%s/%s/%d", at, key, i)); err != nil {
+			return nil, err
+		}
+	}
+	return schemas, nil
+}
+
+func numberKey(m map[string]interface{}, key, at string) (*float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s is not a number", at, key)
+	}
+	return &f, nil
+}
+
+func intKey(m map[string]interface{}, key, at string) (*int, error) {
+	f, err := numberKey(m, key, at)
+	if f == nil || err != nil {
+		return nil, err
+	}
+	if *f < 0 || *f != math.Trunc(*f) {
+		return nil, fmt.Errorf("%s/%s is not a non-negative integer", at, key)
+	}
+	n := int(*f)
+	return &n, nil
+}
+
+// Validate returns the first violation of the schema by a JSON message,
+// nil if the message is valid.
+func (s *Schema) Validate(content []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(content, &v); err != nil {
+		return fmt.Errorf("message is not JSON: %s", err)
+	}
+	return s.validate(v, "$")
+}
+
+func (s *Schema) validate(v interface{}, at string) error {
+	if s.never {
+		return fmt.Errorf("%s is not allowed", at)
+	}
+	if s.ref != nil {
+		if err := s.ref.validate(v, at); err != nil {
+			return err
+		}
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s is %s, want %s", at, jsonType(v), strings.Join(s.types, " or "))
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		return fmt.Errorf("%s is %s, not one of enum", at, jsonString(v))
+	}
+	if s.constant != nil && !reflect.DeepEqual(*s.constant, v) {
+		return fmt.Errorf("%s is %s, want %s", at, jsonString(v), jsonString(*s.constant))
+	}
+
+	var err error
+	switch v := v.(type) {
+	case map[string]interface{}:
+		err = s.validateObject(v, at)
+	case []interface{}:
+		err = s.validateArray(v, at)
+	case float64:
+		err = s.validateNumber(v, at)
+	case string:
+		err = s.validateString(v, at)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, at); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		valid := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, at) == nil {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%s matches none of anyOf", at)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s matches %d of oneOf, want 1", at, matched)
+		}
+	}
+	if s.not != nil && s.not.validate(v, at) == nil {
+		return fmt.Errorf("%s matches not", at)
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, at string) error {
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			return fmt.Errorf("%s has no %s", at, name)
+		}
+	}
+
+	// names are sorted for the same first violation of every message
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := s.properties[name]
+		if !ok {
+			prop = s.additionalProperties
+		}
+		if prop == nil {
+			continue
+		}
+		if err := prop.validate(m[name], at+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(a []interface{}, at string) error {
+	if s.minItems != nil && len(a) < *s.minItems {
+		return fmt.Errorf("%s has %d items, want at least %d", at, len(a), *s.minItems)
+	}
+	if s.maxItems != nil && len(a) > *s.maxItems {
+		return fmt.Errorf("%s has %d items, want at most %d", at, len(a), *s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := range a {
+			if containsValue(a[:i], a[i]) {
+				return fmt.Errorf("%s[%d] is not unique", at, i)
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range a {
+			if err := s.items.validate(item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(f float64, at string) error {
+	switch {
+	case s.minimum != nil && f < *s.minimum:
+		return fmt.Errorf("%s is %g, want at least %g", at, f, *s.minimum)
+	case s.maximum != nil && f > *s.maximum:
+		return fmt.Errorf("%s is %g, want at most %g", at, f, *s.maximum)
+	case s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum:
+		return fmt.Errorf("%s is %g, want more than %g", at, f, *s.exclusiveMinimum)
+	case s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum:
+		return fmt.Errorf("%s is %g, want less than %g", at, f, *s.exclusiveMaximum)
+	case s.multipleOf != nil && *s.multipleOf > 0:
+		if q := f / *s.multipleOf; q != math.Trunc(q) {
+			return fmt.Errorf("%s is %g, not a multiple of %g", at, f, *s.multipleOf)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(str string, at string) error {
+	n := utf8.RuneCountInString(str)
+	switch {
+	case s.minLength != nil && n < *s.minLength:
+		return fmt.Errorf("%s has length %d, want at least %d", at, n, *s.minLength)
+	case s.maxLength != nil && n > *s.maxLength:
+		return fmt.Errorf("%s has length %d, want at most %d", at, n, *s.maxLength)
+	case s.pattern != nil && !s.pattern.MatchString(str):
+		return fmt.Errorf("%s doesn't match %s", at, s.pattern)
+	}
+	return nil
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	t := jsonType(v)
+	for _, want := range s.types {
+		switch {
+		case want == t:
+			return true
+		case want == "number" && t == "integer":
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of v decoded by encoding/json,
+// integer for numbers without fraction.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSchema checks a received text message against Schema.
+func (s *session) validateSchema(msgType int, content []byte) {
+	if msgType != websocket.TextMessage {
+		return
+	}
+	atomic.AddInt64(&s.b.stats.SchemaChecked, 1)
+	err := s.b.opts.Schema.Validate(bytes.TrimSpace(content))
+	if err == nil {
+		return
+	}
+	atomic.AddInt64(&s.b.stats.SchemaViolations, 1)
+	if s.task.result.SchemaViolations == 0 {
+		atomic.AddInt64(&s.b.stats.SchemaConns, 1)
+		s.b.log.Warn("schema", "task", s.id, "err", err)
+	}
+	s.task.result.SchemaViolations++
+}
@@ -0,0 +1,79 @@
+package wsbm
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// sequence tracks sequence numbers received by a connection, numbers
+// skipped are missing until received out of order.
+type sequence struct {
+	started bool
+	max     int64
+	// missing are ranges [from, to] of skipped numbers.
+	missing [][2]int64
+}
+
+// add adds a received number, counting gaps, duplicates and out of order
+// numbers to stats.
+func (q *sequence) add(n int64, s *stats) {
+	switch {
+	case !q.started:
+		q.started, q.max = true, n
+	case n == q.max+1:
+		q.max = n
+	case n > q.max:
+		atomic.AddInt64(&s.SeqGaps, 1)
+		q.missing = append(q.missing, [2]int64{q.max + 1, n - 1})
+		q.max = n
+	case q.remove(n):
+		atomic.AddInt64(&s.SeqOutOfOrder, 1)
+	default:
+		atomic.AddInt64(&s.SeqDuplicates, 1)
+	}
+}
+
+// remove removes n from missing ranges, reporting whether it was missing.
+func (q *sequence) remove(n int64) bool {
+	for i, r := range q.missing {
+		if n < r[0] || n > r[1] {
+			continue
+		}
+		switch {
+		case r[0] == r[1]:
+			q.missing = append(q.missing[:i], q.missing[i+1:]...)
+		case n == r[0]:
+			q.missing[i][0]++
+		case n == r[1]:
+			q.missing[i][1]--
+		default:
+			q.missing = append(q.missing[:i+1], q.missing[i:]...)
+			q.missing[i][1] = n - 1
+			q.missing[i+1][0] = n + 1
+		}
+		return true
+	}
+	return false
+}
+
+// lost returns the count of numbers still missing.
+func (q *sequence) lost() int64 {
+	var n int64
+	for _, r := range q.missing {
+		n += r[1] - r[0] + 1
+	}
+	return n
+}
+
+// sequenced tracks the SeqJSONPath number of a received message.
+func (s *session) sequenced(content []byte) {
+	v, ok := s.b.opts.SeqJSONPath.LookupJSON(content)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(jsonString(v), 10, 64)
+	if err != nil {
+		return
+	}
+	s.seq.add(n, &s.b.stats)
+}
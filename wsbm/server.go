@@ -0,0 +1,172 @@
+package wsbm
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ServerOptions struct {
+	// Mode is echo, drain or broadcast.
+	Mode string
+	// Rate of broadcast messages per second.
+	Rate float64
+	// Size of broadcast messages in bytes.
+	Size   int
+	Logger *slog.Logger
+}
+
+// Server is a test WebSocket server, it echoes messages back, drains them,
+// or broadcasts generated messages to all clients.
+type Server struct {
+	opts     ServerOptions
+	upgrader websocket.Upgrader
+	done     chan struct{}
+
+	mu      sync.Mutex
+	clients map[*serverClient]struct{}
+	dropped int64
+}
+
+type serverClient struct {
+	conn *websocket.Conn
+	send chan *websocket.PreparedMessage
+}
+
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.New(discardHandler{})
+	}
+
+	s := &Server{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		done:    make(chan struct{}),
+		clients: make(map[*serverClient]struct{}),
+	}
+
+	switch opts.Mode {
+	case "echo", "drain":
+	case "broadcast":
+		if opts.Rate <= 0 {
+			return nil, fmt.Errorf("invalid broadcast rate %g", opts.Rate)
+		}
+		go s.broadcast()
+	default:
+		return nil, fmt.Errorf("unknown server mode %q", opts.Mode)
+	}
+	return s, nil
+}
+
+// Close stops broadcasting.
+func (s *Server) Close() {
+	close(s.done)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	switch s.opts.Mode {
+	case "echo":
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	case "drain":
+		s.drain(conn)
+	case "broadcast":
+		c := &serverClient{conn: conn, send: make(chan *websocket.PreparedMessage, 256)}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+		go c.write()
+
+		s.drain(conn)
+
+		s.mu.Lock()
+		delete(s.clients, c)
+		close(c.send)
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) drain(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *serverClient) write() {
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := c.conn.WritePreparedMessage(msg); err != nil {
+			c.conn.Close()
+			for range c.send {
+			}
+			return
+		}
+	}
+}
+
+// broadcast sends a message of Size bytes to all clients Rate times per
+// second, clients whose buffer is full miss it.
+func (s *Server) broadcast() {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.opts.Rate))
+	defer ticker.Stop()
+
+	for seq := int64(1); ; seq++ {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		msg, err := websocket.NewPreparedMessage(websocket.TextMessage, s.message(seq))
+		if err != nil {
+			s.opts.Logger.Warn("prepare message", "err", err)
+			continue
+		}
+
+		s.mu.Lock()
+		for c := range s.clients {
+			select {
+			case c.send <- msg:
+			default:
+				if atomic.AddInt64(&s.dropped, 1)%1000 == 1 {
+					s.opts.Logger.Warn("broadcast dropped messages of slow clients", "dropped", atomic.LoadInt64(&s.dropped))
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// message returns a broadcast message, compatible with echo mode messages.
+func (s *Server) message(seq int64) []byte {
+	ts := time.Now().UnixNano()
+	base := fmt.Sprintf(`{"seq":%d,"ts":%d,"data":""}`, seq, ts)
+	pad := s.opts.Size - len(base)
+	if pad < 0 {
+		pad = 0
+	}
+	return []byte(fmt.Sprintf(`{"seq":%d,"ts":%d,"data":"%s"}`, seq, ts, strings.Repeat("x", pad)))
+}
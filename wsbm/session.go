@@ -0,0 +1,371 @@
+package wsbm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// session is the connection of a task.
+type session struct {
+	*websocket.Conn
+	b    *Benchmark
+	id   int
+	task *task
+
+	// runCtx is done when the run stops, ctx also when session is closed.
+	runCtx context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	proto protocol
+	// buf is the pooled buffer messages are read into without protocol,
+	// decoded messages of protocols may keep slices of read ones.
+	buf *[]byte
+	// wmu serializes writes of senders and protocol replies.
+	wmu     sync.Mutex
+	pending []Message
+
+	// requests are send times of correlated requests by id.
+	rmu      sync.Mutex
+	requests map[string]time.Time
+	seq      sequence
+
+	goldenIndex int
+	diverged    bool
+	// classLast are times of the last message of classes.
+	classLast map[string]time.Time
+
+	// fanout is set for subscribers of fan-out runs.
+	fanout         bool
+	fanoutStart    int64
+	fanoutReceived int64
+
+	// trace logs frames sent and received, see TraceFrames.
+	trace bool
+	// stallAt is when reads stall next by ReadStall, zero if they don't.
+	stallAt time.Time
+	// dropped is set once ChaosDrop closed the connection.
+	dropped int32
+
+	received     int
+	closing      bool
+	assertFailed bool
+	pingSent     int64
+	dead         int32
+}
+
+// open dials url and starts the session, it returns a nil session with nil
+// error when ctx is done.
+func (b *Benchmark) open(ctx context.Context, t *task) (*session, error) {
+	proto := b.newProtocol()
+	if proto != nil {
+		if err := proto.prepare(ctx, t); err != nil || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	var conn *websocket.Conn
+	err := b.dialRetry(ctx, t, func() (err error) {
+		conn, err = b.dial(ctx, t)
+		return err
+	})
+	if conn == nil {
+		return nil, err
+	}
+
+	s := &session{Conn: conn, b: b, id: t.id, task: t, runCtx: ctx, proto: proto, trace: b.traced(t.id)}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	b.stats.AddActive()
+	if b.stalling(t.id) {
+		s.stallAt = time.Now().Add(b.opts.ReadStall.Every)
+	}
+
+	go s.closeOnDone()
+	s.scheduleDrop()
+	if s.trace {
+		s.traceControl()
+	}
+	if b.opts.PingInterval > 0 || s.trace {
+		s.SetPongHandler(s.pong)
+	}
+	if b.opts.PingInterval > 0 {
+		go s.keepalive()
+	}
+	if proto != nil {
+		err := proto.open(s)
+		s.SetReadDeadline(time.Time{})
+		if err != nil {
+			s.Close()
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, protocolError(b.opts.Protocol, err)
+		}
+	}
+	if b.opts.KeepaliveMessage != nil && b.opts.KeepalivePeriod > 0 {
+		go s.keepaliveMessages()
+	}
+	return s, nil
+}
+
+func (s *session) Close() error {
+	s.cancel()
+	s.lostReplies()
+	if lost := s.seq.lost(); lost > 0 {
+		atomic.AddInt64(&s.b.stats.SeqLost, lost)
+	}
+	if s.fanout {
+		s.fanoutLoss()
+	}
+	if s.b.opts.Golden != nil {
+		s.goldenMissing()
+	}
+	atomic.AddInt64(&s.b.stats.Active, -1)
+	err := s.Conn.Close()
+	s.releaseBuffer()
+	return err
+}
+
+// closeOnDone closes the connection gracefully when the run stops.
+func (s *session) closeOnDone() {
+	<-s.ctx.Done()
+	if s.runCtx.Err() != nil {
+		s.closeConn()
+	}
+}
+
+// shutdown starts the close handshake, following reads drain the connection.
+func (s *session) shutdown() {
+	s.closing = true
+	s.closeConn()
+}
+
+func (s *session) closeConn() {
+	if s.trace && s.b.opts.CloseMode != "rst" {
+		s.b.traceFrame(s.id, "send", websocket.CloseMessage, true, 2+len(s.b.opts.CloseReason))
+	}
+	s.b.closeConn(s.Conn)
+}
+
+func (s *session) setReadTimeout(timeout time.Duration) {
+	if timeout > 0 && !s.closing && !s.isDropped() && s.runCtx.Err() == nil {
+		s.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// write writes a frame, safe for concurrent use.
+func (s *session) write(msgType int, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.trace {
+		s.b.traceFrame(s.id, "send", msgType, true, len(data))
+	}
+	return s.WriteMessage(msgType, data)
+}
+
+// send sends a message once the run is not paused, framed by the protocol
+// if any.
+func (s *session) send(msgType int, data []byte) error {
+	if !s.b.control.wait(s.ctx) {
+		return s.ctx.Err()
+	}
+	return s.sendNow(msgType, data)
+}
+
+// sendNow sends a message even if the run is paused.
+func (s *session) sendNow(msgType int, data []byte) error {
+	if msgType == websocket.TextMessage && s.b.opts.CorrelateSend != nil {
+		s.sent(data)
+	}
+	if s.proto != nil {
+		var err error
+		if msgType, data, err = s.proto.encode(s, msgType, data); err != nil {
+			return err
+		}
+	}
+	return s.write(msgType, data)
+}
+
+// next returns the next message, decoded by the protocol if any.
+func (s *session) next() (int, []byte, error) {
+	for len(s.pending) == 0 {
+		if s.proto == nil {
+			return s.readMessage()
+		}
+		msgType, content, err := s.ReadMessage()
+		if err == nil && s.trace {
+			s.b.traceFrame(s.id, "recv", msgType, true, len(content))
+		}
+		if err != nil || s.closing {
+			return msgType, content, err
+		}
+		if s.pending, err = s.proto.decode(s, msgType, content); err != nil {
+			return msgType, nil, err
+		}
+	}
+
+	msg := s.pending[0]
+	s.pending = s.pending[1:]
+	if msg.Channel != "" {
+		s.b.stats.AddChannel(msg.Channel)
+	}
+	if msg.Binary {
+		return websocket.BinaryMessage, msg.Data, nil
+	}
+	return websocket.TextMessage, msg.Data, nil
+}
+
+// read reads a message, records it and writes it to output unless closing.
+// content is only valid until the next read.
+func (s *session) read() (int, []byte, error) {
+	s.stall()
+	msgType, content, err := s.next()
+	if err != nil || s.closing {
+		return msgType, content, err
+	}
+	if s.received == 0 {
+		s.task.result.FirstMessage = time.Since(s.task.result.Start)
+		s.b.stats.FirstMessage.Add(s.task.result.FirstMessage)
+	}
+	s.received++
+	s.task.result.Messages++
+	s.task.result.Bytes += int64(len(content))
+	s.b.receive(s.task, msgType, content)
+	if s.b.opts.CorrelateRecv != nil {
+		s.replied(content)
+	}
+	if s.b.opts.SeqJSONPath != nil {
+		s.sequenced(content)
+	}
+	if s.fanout {
+		s.delivered(content)
+	}
+	if s.b.opts.Golden != nil {
+		s.compareGolden(msgType, content)
+	}
+	if s.b.opts.Schema != nil {
+		s.validateSchema(msgType, content)
+	}
+	if s.b.opts.Classify != nil {
+		s.classify(content)
+	}
+	s.check(content)
+	return msgType, content, nil
+}
+
+func (s *session) check(content []byte) {
+	a := s.b.opts.Expect
+	if a == nil || (a.First && s.received > 1) {
+		return
+	}
+
+	atomic.AddInt64(&s.b.stats.Assertions, 1)
+	if err := a.Check(content); err != nil {
+		atomic.AddInt64(&s.b.stats.AssertFailures, 1)
+		if !s.assertFailed {
+			s.b.log.Warn("assert", "task", s.id, "err", err)
+		}
+		s.assertFailed = true
+	}
+}
+
+// drain reads until server closes the connection.
+func (s *session) drain() error {
+	for {
+		if _, _, err := s.ReadMessage(); err != nil {
+			return s.err(err)
+		}
+	}
+}
+
+// err maps the error ending a read loop to the task result, closing by us,
+// by the run or by ChaosDrop and expected closes from server are not
+// errors.
+func (s *session) err(err error) error {
+	closing := s.closing || s.isDropped() || s.runCtx.Err() != nil
+	s.task.result.Close = s.b.stats.addClose(closing, err)
+
+	if atomic.LoadInt32(&s.dead) == 1 {
+		return fmt.Errorf("%w: %s", ErrPongTimeout, err)
+	}
+	if closing || s.b.expectedClose(err) {
+		return nil
+	}
+	if isTimeout(err) {
+		return fmt.Errorf("%w: %s", ErrReadTimeout, err)
+	}
+	return err
+}
+
+// keepalive pings every PingInterval and kills the connection when a pong
+// is not received in PingTimeout.
+func (s *session) keepalive() {
+	ticker := time.NewTicker(s.b.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		ts := now.UnixNano()
+		data := []byte(strconv.FormatInt(ts, 10))
+		if s.trace {
+			s.b.traceFrame(s.id, "send", websocket.PingMessage, true, len(data))
+		}
+		if err := s.WriteControl(websocket.PingMessage, data, now.Add(time.Second)); err != nil {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.pingSent, 0, ts) && s.b.opts.PingTimeout > 0 {
+			time.AfterFunc(s.b.opts.PingTimeout, func() {
+				if atomic.LoadInt64(&s.pingSent) == ts {
+					atomic.StoreInt32(&s.dead, 1)
+					s.Conn.Close()
+				}
+			})
+		}
+	}
+}
+
+// keepaliveMessages sends KeepaliveMessage every KeepalivePeriod.
+func (s *session) keepaliveMessages() {
+	ticker := time.NewTicker(s.b.opts.KeepalivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		msgType, data, err := s.b.renderMessage(s.id, *s.b.opts.KeepaliveMessage)
+		if err == nil {
+			err = s.sendNow(msgType, data)
+		}
+		if err != nil {
+			s.b.log.Warn("keepalive", "task", s.id, "err", err)
+			return
+		}
+	}
+}
+
+func (s *session) pong(data string) error {
+	if s.trace {
+		s.b.traceFrame(s.id, "recv", websocket.PongMessage, true, len(data))
+	}
+	if ts, err := strconv.ParseInt(data, 10, 64); err == nil {
+		s.b.addLatency(MetricPongRTT, s.id, time.Since(time.Unix(0, ts)))
+	}
+	atomic.StoreInt64(&s.pingSent, 0)
+	return nil
+}
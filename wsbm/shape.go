@@ -0,0 +1,243 @@
+package wsbm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInjectedReset is the error of connections reset by Shape.
+var ErrInjectedReset = errors.New("injected reset")
+
+// shapeRetransmit is the delay of data lost by Shape, the minimum
+// retransmission timeout of TCP on Linux.
+const shapeRetransmit = 200 * time.Millisecond
+
+// Shape degrades the network of a Fraction of connections: data received
+// is delayed by Delay plus or minus up to Jitter, Loss of it is delayed by
+// a retransmission more, and reads and writes reset the connection with
+// probability Reset. Only data received is delayed, so Delay is the whole
+// added round trip time; data sent is not, as delaying writes would hold
+// back writers rather than the data.
+type Shape struct {
+	Delay  time.Duration
+	Jitter time.Duration
+	Loss   float64
+	Reset  float64
+	// Fraction of connections shaped, 0 or 1 means all. They are spread
+	// evenly, shifted from those of TraceFrames and ReadStall.
+	Fraction float64
+}
+
+// shaped reports whether connection id is shaped.
+func (b *Benchmark) shaped(id int) bool {
+	if b.opts.Shape == nil {
+		return false
+	}
+	f := b.opts.Shape.Fraction
+	if f <= 0 || f >= 1 {
+		return true
+	}
+	// two thirds of the spacing apart from traced connections
+	return picked(int64(id-1), f, 2.0/3)
+}
+
+// shapedConn returns conn shaped by Shape if its dial trace of ctx is
+// shaped.
+func (b *Benchmark) shapedConn(ctx context.Context, conn net.Conn) net.Conn {
+	if t := getDialTrace(ctx); t == nil || !t.shaped {
+		return conn
+	}
+	c := &shapeConn{
+		Conn:    conn,
+		shape:   b.opts.Shape,
+		chunks:  make(chan shapeChunk, 64),
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// delay returns the delay of data received now.
+func (s *Shape) delay() time.Duration {
+	d := s.Delay
+	if s.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * float64(s.Jitter))
+	}
+	if s.Loss > 0 && rand.Float64() < s.Loss {
+		d += shapeRetransmit
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// shapeChunk is data received, or the error ending it, due to be read at
+// due.
+type shapeChunk struct {
+	data []byte
+	err  error
+	due  time.Time
+}
+
+// shapeConn delays data received by a connection, read from it ahead by
+// receive, and resets it at random.
+type shapeConn struct {
+	net.Conn
+	shape  *Shape
+	chunks chan shapeChunk
+	// cur is the chunk being read.
+	cur shapeChunk
+
+	mu       sync.Mutex
+	deadline time.Time
+	// changed is closed when deadline is set.
+	changed chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// receive reads the connection into chunks until it fails or is closed,
+// chunks are due in order as TCP delivers them.
+func (c *shapeConn) receive() {
+	buf := make([]byte, 32<<10)
+	var due time.Time
+	for {
+		n, err := c.Conn.Read(buf)
+		at := time.Now().Add(c.shape.delay())
+		if at.Before(due) {
+			at = due
+		}
+		due = at
+		chunk := shapeChunk{err: err, due: due}
+		if n > 0 {
+			chunk.data = append([]byte(nil), buf[:n]...)
+		}
+		select {
+		case c.chunks <- chunk:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *shapeConn) Read(p []byte) (int, error) {
+	if c.resets() {
+		return 0, c.reset()
+	}
+	if len(c.cur.data) == 0 && c.cur.err == nil {
+		if err := c.wait(func(timeout <-chan time.Time, changed <-chan struct{}) (bool, error) {
+			select {
+			case c.cur = <-c.chunks:
+				return true, nil
+			case <-timeout:
+				return true, os.ErrDeadlineExceeded
+			case <-changed:
+				return false, nil
+			case <-c.closed:
+				return true, net.ErrClosed
+			}
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if d := time.Until(c.cur.due); d > 0 {
+		due := time.NewTimer(d)
+		defer due.Stop()
+		if err := c.wait(func(timeout <-chan time.Time, changed <-chan struct{}) (bool, error) {
+			select {
+			case <-due.C:
+				return true, nil
+			case <-timeout:
+				return true, os.ErrDeadlineExceeded
+			case <-changed:
+				return false, nil
+			case <-c.closed:
+				return true, net.ErrClosed
+			}
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.cur.data) == 0 {
+		return 0, c.cur.err
+	}
+	n := copy(p, c.cur.data)
+	c.cur.data = c.cur.data[n:]
+	return n, nil
+}
+
+// wait calls step with the timeout of the read deadline and a channel
+// closed when the deadline changes, until step is done, so reads blocked
+// wake up on deadlines set meanwhile.
+func (c *shapeConn) wait(step func(timeout <-chan time.Time, changed <-chan struct{}) (bool, error)) error {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		done, err := step(timeout, changed)
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return err
+		}
+	}
+}
+
+func (c *shapeConn) Write(p []byte) (int, error) {
+	if c.resets() {
+		return 0, c.reset()
+	}
+	return c.Conn.Write(p)
+}
+
+// SetDeadline sets the write deadline of the connection and the read one
+// of the shaped reads, the connection is read ahead without deadline.
+func (c *shapeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *shapeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *shapeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// resets reports whether the connection is reset by a read or write now.
+func (c *shapeConn) resets() bool {
+	return c.shape.Reset > 0 && rand.Float64() < c.shape.Reset
+}
+
+// reset closes the connection with a RST.
+func (c *shapeConn) reset() error {
+	if tc := tcpConn(c.Conn); tc != nil {
+		tc.SetLinger(0)
+	}
+	c.Close()
+	return ErrInjectedReset
+}
@@ -0,0 +1,254 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// signalRSeparator terminates records of the SignalR json protocol.
+const signalRSeparator = 0x1e
+
+// signalR speaks the SignalR json hub protocol, sent messages are
+// invocations like '{"target":"Send","arguments":["hi"]}' and the latency
+// of their completions is recorded by target. Received invocations and
+// stream items are counted by target.
+type signalR struct {
+	b      *Benchmark
+	lastID int64
+	// invocations are targets and start times of invocations by id.
+	invocations sync.Map
+}
+
+type signalRInvocation struct {
+	target string
+	start  time.Time
+}
+
+type signalRNegotiation struct {
+	NegotiateVersion int    `json:"negotiateVersion"`
+	ConnectionID     string `json:"connectionId"`
+	ConnectionToken  string `json:"connectionToken"`
+	URL              string `json:"url"`
+	AccessToken      string `json:"accessToken"`
+	Error            string `json:"error"`
+}
+
+type signalRMessage struct {
+	Type         int             `json:"type"`
+	InvocationID string          `json:"invocationId"`
+	Target       string          `json:"target"`
+	Arguments    json.RawMessage `json:"arguments"`
+	Item         json.RawMessage `json:"item"`
+	Error        string          `json:"error"`
+}
+
+// prepare negotiates a connection, following redirects to a service.
+func (p *signalR) prepare(ctx context.Context, t *task) error {
+	for redirects := 0; ; redirects++ {
+		n, err := p.negotiate(ctx, t)
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		if n.URL == "" {
+			id := n.ConnectionToken
+			if n.NegotiateVersion == 0 {
+				id = n.ConnectionID
+			}
+			u := wsURL(t.url)
+			q := u.Query()
+			q.Set("id", id)
+			u.RawQuery = q.Encode()
+			t.url = u
+			return nil
+		}
+
+		if redirects == 10 {
+			return protocolError("signalr", errors.New("too many negotiate redirects"))
+		}
+		if t.url, err = url.Parse(n.URL); err != nil {
+			return protocolError("signalr", err)
+		}
+		if n.AccessToken != "" {
+			t.header.Del("Authorization")
+			t.addHeader("Authorization", "Bearer "+n.AccessToken)
+		}
+	}
+}
+
+func (p *signalR) negotiate(ctx context.Context, t *task) (*signalRNegotiation, error) {
+	u := httpURL(t.url)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/negotiate"
+	q := u.Query()
+	q.Set("negotiateVersion", "1")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	h, err := p.b.header(t.id, u)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	resp, err := p.b.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		return nil, protocolError("signalr", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, protocolError("signalr", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, protocolError("signalr", fmt.Errorf("negotiate status %s", resp.Status))
+	}
+
+	var n signalRNegotiation
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, protocolError("signalr", fmt.Errorf("negotiate: %s", err))
+	}
+	if n.Error != "" {
+		return nil, protocolError("signalr", fmt.Errorf("negotiate error %s", n.Error))
+	}
+	return &n, nil
+}
+
+func (p *signalR) writeRecord(s *session, record []byte) error {
+	return s.write(websocket.TextMessage, append(record, signalRSeparator))
+}
+
+// open sends the handshake and starts pings of PingInterval, 15s by
+// default, messages after the handshake response are pending.
+func (p *signalR) open(s *session) error {
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	if err := p.writeRecord(s, []byte(`{"protocol":"json","version":1}`)); err != nil {
+		return err
+	}
+	_, data, err := s.ReadMessage()
+	if err != nil {
+		return err
+	}
+	record, rest, _ := bytes.Cut(data, []byte{signalRSeparator})
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(record, &resp); err != nil {
+		return fmt.Errorf("invalid handshake response %q", record)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("handshake error %s", resp.Error)
+	}
+	if len(rest) > 0 {
+		if s.pending, err = p.decode(s, websocket.TextMessage, rest); err != nil {
+			return err
+		}
+	}
+
+	interval := s.b.opts.PingInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	go p.ping(s, interval)
+	return nil
+}
+
+func (p *signalR) ping(s *session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.writeRecord(s, []byte(`{"type":6}`)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// encode adds type and invocation id to an invocation.
+func (p *signalR) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	var invocation map[string]json.RawMessage
+	if err := json.Unmarshal(data, &invocation); err != nil {
+		return 0, nil, fmt.Errorf("signalr: invalid invocation %q", data)
+	}
+	var target string
+	json.Unmarshal(invocation["target"], &target)
+	if _, ok := invocation["type"]; !ok {
+		invocation["type"] = json.RawMessage("1")
+	}
+	id := strconv.FormatInt(atomic.AddInt64(&p.lastID, 1), 10)
+	invocation["invocationId"], _ = json.Marshal(id)
+
+	data, err := json.Marshal(invocation)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.invocations.Store(id, signalRInvocation{target: target, start: time.Now()})
+	return websocket.TextMessage, append(data, signalRSeparator), nil
+}
+
+// decode returns arguments of invocations and stream items, completions
+// record the latency of their invocation.
+func (p *signalR) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	var msgs []Message
+	for _, record := range bytes.Split(data, []byte{signalRSeparator}) {
+		if len(record) == 0 {
+			continue
+		}
+		var msg signalRMessage
+		if err := json.Unmarshal(record, &msg); err != nil {
+			return nil, protocolError("signalr", fmt.Errorf("invalid message %q", record))
+		}
+		switch msg.Type {
+		case 1:
+			msgs = append(msgs, Message{Data: msg.Arguments, Channel: msg.Target})
+		case 2:
+			target := "stream"
+			if v, ok := p.invocations.Load(msg.InvocationID); ok {
+				target = v.(signalRInvocation).target
+			}
+			msgs = append(msgs, Message{Data: msg.Item, Channel: target})
+		case 3:
+			v, ok := p.invocations.LoadAndDelete(msg.InvocationID)
+			if !ok {
+				continue
+			}
+			invocation := v.(signalRInvocation)
+			if msg.Error != "" {
+				s.b.log.Warn("signalr invocation", "task", s.id, "target", invocation.target, "err", msg.Error)
+				continue
+			}
+			s.b.stats.AddCall(invocation.target, time.Since(invocation.start))
+		case 7:
+			if msg.Error == "" {
+				msg.Error = "closed by server"
+			}
+			return nil, protocolError("signalr", errors.New(msg.Error))
+		}
+	}
+	return msgs, nil
+}
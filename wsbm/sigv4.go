@@ -0,0 +1,113 @@
+package wsbm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SigV4 signs handshake requests with AWS Signature Version 4, like the
+// ones of API Gateway WebSocket APIs.
+type SigV4 struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+	// Service defaults to execute-api.
+	Service string
+}
+
+// emptyHash is the sha256 of the empty body of handshake requests.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds X-Amz-Date, X-Amz-Security-Token and Authorization headers
+// signing a GET request of u.
+func (s *SigV4) sign(h http.Header, u *url.URL, now time.Time) {
+	service := s.Service
+	if service == "" {
+		service = "execute-api"
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	h.Set("X-Amz-Date", amzDate)
+	headers := []string{"host:" + u.Host, "x-amz-date:" + amzDate}
+	signed := "host;x-amz-date"
+	if s.SessionToken != "" {
+		h.Set("X-Amz-Security-Token", s.SessionToken)
+		headers = append(headers, "x-amz-security-token:"+s.SessionToken)
+		signed += ";x-amz-security-token"
+	}
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		canonicalPath(u),
+		canonicalQuery(u.Query()),
+		strings.Join(headers, "\n") + "\n",
+		signed,
+		emptyHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, s.Region, service)
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	h.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func canonicalPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes all but unreserved characters of RFC 3986.
+func uriEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,198 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketIO speaks Socket.IO v5 over Engine.IO v4, the session is opened by
+// long polling and upgraded to the WebSocket connection, sent messages are
+// emitted as events like '["chat","hello"]' to the first Subscribe
+// namespace, received events are the JSON array of event name and args.
+type socketIO struct {
+	b   *Benchmark
+	sid string
+	// namespace is the prefix of event packets, empty for '/'.
+	namespace string
+}
+
+// engineOpen is the payload of the Engine.IO open packet.
+type engineOpen struct {
+	SID          string   `json:"sid"`
+	Upgrades     []string `json:"upgrades"`
+	PingInterval int      `json:"pingInterval"`
+	PingTimeout  int      `json:"pingTimeout"`
+}
+
+// socketIOURL returns the Engine.IO url of u, the path defaults to
+// /socket.io/.
+func socketIOURL(u *url.URL, transport, sid string) *url.URL {
+	v := *u
+	if v.Path == "" || v.Path == "/" {
+		v.Path = "/socket.io/"
+	}
+	q := v.Query()
+	q.Set("EIO", "4")
+	q.Set("transport", transport)
+	if sid != "" {
+		q.Set("sid", sid)
+	}
+	v.RawQuery = q.Encode()
+	return &v
+}
+
+// prepare opens an Engine.IO session by polling and points the task at its
+// websocket transport.
+func (p *socketIO) prepare(ctx context.Context, t *task) error {
+	u := httpURL(socketIOURL(t.url, "polling", ""))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	h, err := p.b.header(t.id, u)
+	if err != nil {
+		return err
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	resp, err := p.b.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return protocolError("socketio", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return protocolError("socketio", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return protocolError("socketio", fmt.Errorf("polling status %s", resp.Status))
+	}
+
+	// polling payloads are packets separated by record separators
+	packet, _, _ := bytes.Cut(body, []byte{0x1e})
+	if len(packet) == 0 || packet[0] != '0' {
+		return protocolError("socketio", fmt.Errorf("unexpected open packet %q", packet))
+	}
+	var open engineOpen
+	if err := json.Unmarshal(packet[1:], &open); err != nil {
+		return protocolError("socketio", fmt.Errorf("open packet: %s", err))
+	}
+	if open.SID == "" {
+		return protocolError("socketio", errors.New("no sid in open packet"))
+	}
+	p.sid = open.SID
+
+	// sticky sessions route the upgrade by cookies of the polling response
+	if p.b.opts.Jar == nil {
+		for _, c := range resp.Cookies() {
+			t.addHeader("Cookie", c.Name+"="+c.Value)
+		}
+	}
+	t.url = socketIOURL(t.url, "websocket", p.sid)
+	return nil
+}
+
+// open upgrades the transport and connects to the namespaces.
+func (p *socketIO) open(s *session) error {
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	if err := s.write(websocket.TextMessage, []byte("2probe")); err != nil {
+		return err
+	}
+	if err := p.expect(s, "3probe"); err != nil {
+		return err
+	}
+	if err := s.write(websocket.TextMessage, []byte("5")); err != nil {
+		return err
+	}
+
+	namespaces := s.b.opts.Subscribe
+	if len(namespaces) == 0 {
+		namespaces = []string{"/"}
+	}
+	for i, ns := range namespaces {
+		prefix := ""
+		if ns != "/" {
+			prefix = ns + ","
+		}
+		if i == 0 {
+			p.namespace = prefix
+		}
+		if err := s.write(websocket.TextMessage, []byte("40"+prefix)); err != nil {
+			return err
+		}
+		if err := p.expect(s, "40"+prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expect reads packets until one starting with want, answering pings.
+func (p *socketIO) expect(s *session, want string) error {
+	for {
+		_, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		packet := string(data)
+		switch {
+		case strings.HasPrefix(packet, want):
+			return nil
+		case packet == "2":
+			if err := s.write(websocket.TextMessage, []byte("3")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(packet, "44"):
+			return fmt.Errorf("connect error %s", packet[2:])
+		case strings.HasPrefix(packet, "1"):
+			return errors.New("closed by server")
+		}
+	}
+}
+
+func (p *socketIO) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	if msgType != websocket.TextMessage {
+		return 0, nil, errors.New("socketio: binary events are not supported")
+	}
+	packet := make([]byte, 0, 2+len(p.namespace)+len(data))
+	packet = append(packet, "42"...)
+	packet = append(packet, p.namespace...)
+	return msgType, append(packet, data...), nil
+}
+
+// decode answers pings and returns the JSON array of events, other packets
+// are not messages.
+func (p *socketIO) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	if msgType != websocket.TextMessage || len(data) == 0 {
+		return nil, nil
+	}
+	switch data[0] {
+	case '1':
+		return nil, protocolError("socketio", errors.New("closed by server"))
+	case '2':
+		return nil, s.write(websocket.TextMessage, []byte("3"))
+	case '4':
+		if len(data) < 2 || data[1] != '2' {
+			return nil, nil
+		}
+		// skip namespace and ack id before the event array
+		if i := bytes.IndexByte(data, '['); i >= 0 {
+			return []Message{{Data: data[i:]}}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,127 @@
+package wsbm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// sockJS speaks the SockJS websocket transport, sent messages are framed
+// as JSON arrays of strings and received 'a' frames are split into their
+// messages.
+type sockJS struct {
+	b *Benchmark
+}
+
+// prepare checks /info of the endpoint and points the task at a new
+// session url.
+func (p *sockJS) prepare(ctx context.Context, t *task) error {
+	base := strings.TrimSuffix(t.url.Path, "/")
+	u := httpURL(t.url)
+	u.Path = base + "/info"
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	h, err := p.b.header(t.id, u)
+	if err != nil {
+		return err
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	resp, err := p.b.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return protocolError("sockjs", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return protocolError("sockjs", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return protocolError("sockjs", fmt.Errorf("info status %s", resp.Status))
+	}
+	var info struct {
+		WebSocket bool `json:"websocket"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return protocolError("sockjs", fmt.Errorf("info: %s", err))
+	}
+	if !info.WebSocket {
+		return protocolError("sockjs", errors.New("websocket transport is disabled"))
+	}
+
+	v := *t.url
+	v.Path = fmt.Sprintf("%s/%03d/%s/websocket", base, rand.Intn(1000), strings.ReplaceAll(uuid(), "-", ""))
+	t.url = &v
+	return nil
+}
+
+// open waits for the open frame.
+func (p *sockJS) open(s *session) error {
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	for {
+		_, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(data) == 0:
+		case data[0] == 'o':
+			return nil
+		case data[0] == 'c':
+			return fmt.Errorf("closed by server %s", data[1:])
+		}
+	}
+}
+
+func (p *sockJS) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	if msgType != websocket.TextMessage {
+		return 0, nil, errors.New("sockjs: binary messages are not supported")
+	}
+	frame, err := json.Marshal([]string{string(data)})
+	return msgType, frame, err
+}
+
+// decode returns messages of array and message frames, heartbeats are not
+// messages.
+func (p *sockJS) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	switch data[0] {
+	case 'a':
+		var texts []string
+		if err := json.Unmarshal(data[1:], &texts); err != nil {
+			return nil, protocolError("sockjs", fmt.Errorf("invalid frame %q", data))
+		}
+		msgs := make([]Message, len(texts))
+		for i, text := range texts {
+			msgs[i] = Message{Data: []byte(text)}
+		}
+		return msgs, nil
+	case 'm':
+		var text string
+		if err := json.Unmarshal(data[1:], &text); err != nil {
+			return nil, protocolError("sockjs", fmt.Errorf("invalid frame %q", data))
+		}
+		return []Message{{Data: []byte(text)}}, nil
+	case 'c':
+		return nil, protocolError("sockjs", fmt.Errorf("closed by server %s", data[1:]))
+	default:
+		return nil, nil
+	}
+}
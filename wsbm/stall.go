@@ -0,0 +1,70 @@
+package wsbm
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReadStall stops reading of a Fraction of connections for Duration every
+// Every since they connected, so servers see blocked clients whose TCP
+// window fills up.
+type ReadStall struct {
+	Duration time.Duration
+	Every    time.Duration
+	// Fraction of connections stalling, 0 or 1 means all. They are spread
+	// evenly, shifted from those of TraceFrames and Shape.
+	Fraction float64
+}
+
+// ParseReadStall parses stalls like '5s/30s', stalling 5s every 30s.
+func ParseReadStall(spec string) (*ReadStall, error) {
+	stall, every, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid read stall %q, want duration/every", spec)
+	}
+	s := &ReadStall{}
+	var err error
+	if s.Duration, err = time.ParseDuration(strings.TrimSpace(stall)); err != nil || s.Duration <= 0 {
+		return nil, fmt.Errorf("invalid read stall %q, invalid duration %s", spec, stall)
+	}
+	if s.Every, err = time.ParseDuration(strings.TrimSpace(every)); err != nil || s.Every <= s.Duration {
+		return nil, fmt.Errorf("invalid read stall %q, every must be longer than the stall", spec)
+	}
+	return s, nil
+}
+
+func (s *ReadStall) String() string {
+	return s.Duration.String() + "/" + s.Every.String()
+}
+
+// stalling reports whether connection id stalls its reads.
+func (b *Benchmark) stalling(id int) bool {
+	if b.opts.ReadStall == nil {
+		return false
+	}
+	f := b.opts.ReadStall.Fraction
+	if f <= 0 || f >= 1 {
+		return true
+	}
+	// a third of the spacing apart from traced connections
+	return picked(int64(id-1), f, 1.0/3)
+}
+
+// stall stops reading until the end of the current stall once it's due,
+// and schedules the next one.
+func (s *session) stall() {
+	if s.stallAt.IsZero() || time.Now().Before(s.stallAt) {
+		return
+	}
+	rs := s.b.opts.ReadStall
+	atomic.AddInt64(&s.b.stats.ReadStalls, 1)
+	s.b.log.Debug("read stall", "task", s.id, "duration", rs.Duration)
+	end := s.stallAt.Add(rs.Duration)
+	sleepUntil(s.ctx, end)
+	for !s.stallAt.After(time.Now()) {
+		s.stallAt = s.stallAt.Add(rs.Every)
+	}
+	s.setReadTimeout(s.b.opts.ReadTimeout)
+}
@@ -0,0 +1,973 @@
+package wsbm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	ErrReadTimeout      = errors.New("read timeout")
+	ErrPongTimeout      = errors.New("pong timeout")
+)
+
+type stats struct {
+	Start          time.Time
+	End            time.Time
+	Connections    int64
+	Active         int64
+	PeakActive     int64
+	Messages       int64
+	Bytes          int64
+	Assertions     int64
+	AssertFailures int64
+	WireBytesIn    int64
+	WireBytesOut   int64
+	LostReplies    int64
+	SeqGaps        int64
+	SeqLost        int64
+	SeqDuplicates  int64
+	SeqOutOfOrder  int64
+	Diverged       int64
+	ReadStalls     int64
+	ChaosDrops     int64
+	PreRequest     latency
+	Handshake      latency
+	DNS            latency
+	TCP            latency
+	TLS            latency
+	Upgrade        latency
+	ProxyConnect   latency
+	FirstMessage   latency
+	RTT            latency
+	PongRTT        latency
+	Reply          latency
+	Fanout         latency
+	Steps          []latency
+
+	// FanoutExpected are messages published while subscribers were
+	// connected, FanoutMaxLost the most lost by a subscriber.
+	FanoutPublished        int64
+	FanoutDelivered        int64
+	FanoutExpected         int64
+	FanoutLost             int64
+	FanoutLossySubscribers int64
+	FanoutMaxLost          int64
+
+	// SchemaConns are connections with schema violations.
+	SchemaChecked    int64
+	SchemaViolations int64
+	SchemaConns      int64
+
+	// ArrivalDropped are arrivals beyond MaxInflight.
+	Arrivals       int64
+	ArrivalDropped int64
+	ArrivalLag     latency
+
+	// Done are tasks run.
+	Done int64
+
+	// HTTP2Conns are HTTP/2 connections dialed for HTTP2Streams.
+	HTTP2Conns   int64
+	HTTP2Streams int64
+
+	// RetryDials are connections dialed with retries, Retries the
+	// attempts after their first.
+	RetryDials     int64
+	RetryFirst     int64
+	RetryRecovered int64
+	Retries        int64
+	RetryFatal     int64
+	RetryExhausted int64
+
+	mu         sync.Mutex
+	errors     map[string]int64
+	extensions map[string]int64
+	channels   map[string]int64
+	calls      map[string]*latency
+	classes    map[string]*class
+	hashes     map[string]int64
+	diffs      []Divergence
+	alive      []AliveSample
+	timeline   []Sample
+	refusals   map[int]HandshakeError
+	categories map[string]*ErrorCategory
+	closes     map[int]*CloseResult
+	fuzz       map[string]*FuzzResult
+	// conformance are results of conformance cases by name.
+	conformance map[string]*ConformResult
+}
+
+func (s *stats) AddActive() {
+	active := atomic.AddInt64(&s.Active, 1)
+	for {
+		peak := atomic.LoadInt64(&s.PeakActive)
+		if active <= peak || atomic.CompareAndSwapInt64(&s.PeakActive, peak, active) {
+			return
+		}
+	}
+}
+
+func (s *stats) AddAlive(elapsed time.Duration, alive int64) {
+	s.mu.Lock()
+	s.alive = append(s.alive, AliveSample{Elapsed: elapsed, Alive: alive})
+	s.mu.Unlock()
+}
+
+func (s *stats) AddExtension(ext string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.extensions == nil {
+		s.extensions = make(map[string]int64)
+	}
+	s.extensions[ext]++
+}
+
+func (s *stats) AddChannel(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels == nil {
+		s.channels = make(map[string]int64)
+	}
+	s.channels[channel]++
+}
+
+// AddCall records the latency of a call of a protocol like an RPC method.
+func (s *stats) AddCall(name string, d time.Duration) {
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[string]*latency)
+	}
+	l := s.calls[name]
+	if l == nil {
+		l = &latency{}
+		s.calls[name] = l
+	}
+	s.mu.Unlock()
+	l.Add(d)
+}
+
+func (s *stats) AddHash(sum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hashes == nil {
+		s.hashes = make(map[string]int64)
+	}
+	s.hashes[sum]++
+}
+
+func (s *stats) AddDivergence(d Divergence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.diffs) < maxDivergences {
+		s.diffs = append(s.diffs, d)
+	}
+}
+
+func (s *stats) AddMessage(size int) {
+	atomic.AddInt64(&s.Messages, 1)
+	atomic.AddInt64(&s.Bytes, int64(size))
+}
+
+func (s *stats) AddError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errors == nil {
+		s.errors = make(map[string]int64)
+	}
+	s.errors[errorType(err)]++
+	s.addCategory(err)
+}
+
+func (s *stats) Errors() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyCounts(s.errors)
+}
+
+func (s *stats) Extensions() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyCounts(s.extensions)
+}
+
+func (s *stats) Channels() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels == nil {
+		return nil
+	}
+	return copyCounts(s.channels)
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	counts := make(map[string]int64, len(m))
+	for k, v := range m {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (s *stats) ErrorCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, v := range s.errors {
+		n += v
+	}
+	return n
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func errorType(err error) string {
+	var closeErr *websocket.CloseError
+	var opErr *net.OpError
+	var handshakeErr *HandshakeError
+	var rawErr *rawError
+	switch {
+	case errors.As(err, &rawErr):
+		return rawErr.typ
+	case errors.Is(err, ErrHandshakeTimeout):
+		return ErrHandshakeTimeout.Error()
+	case errors.Is(err, ErrReadTimeout):
+		return ErrReadTimeout.Error()
+	case errors.Is(err, ErrPongTimeout):
+		return ErrPongTimeout.Error()
+	case errors.Is(err, ErrPreRequest):
+		return ErrPreRequest.Error()
+	case errors.Is(err, ErrProtocol):
+		return ErrProtocol.Error()
+	case errors.Is(err, ErrInjectedReset):
+		return ErrInjectedReset.Error()
+	case errors.As(err, &closeErr):
+		return fmt.Sprintf("close %d", closeErr.Code)
+	case errors.As(err, &handshakeErr):
+		return handshakeErrorType(handshakeErr.StatusCode)
+	case errors.Is(err, websocket.ErrBadHandshake):
+		return "handshake"
+	case isTimeout(err):
+		return "timeout"
+	case errors.As(err, &opErr):
+		return opErr.Op
+	default:
+		return "other"
+	}
+}
+
+func (s *stats) Result(scenario *Scenario) *Result {
+	r := &Result{
+		Elapsed:        s.End.Sub(s.Start),
+		Connections:    atomic.LoadInt64(&s.Connections),
+		PeakActive:     atomic.LoadInt64(&s.PeakActive),
+		ErrorTypes:     s.Errors(),
+		Messages:       atomic.LoadInt64(&s.Messages),
+		Bytes:          atomic.LoadInt64(&s.Bytes),
+		Assertions:     atomic.LoadInt64(&s.Assertions),
+		AssertFailures: atomic.LoadInt64(&s.AssertFailures),
+		WireBytesIn:    atomic.LoadInt64(&s.WireBytesIn),
+		WireBytesOut:   atomic.LoadInt64(&s.WireBytesOut),
+		LostReplies:    atomic.LoadInt64(&s.LostReplies),
+		SeqGaps:        atomic.LoadInt64(&s.SeqGaps),
+		SeqLost:        atomic.LoadInt64(&s.SeqLost),
+		SeqDuplicates:  atomic.LoadInt64(&s.SeqDuplicates),
+		SeqOutOfOrder:  atomic.LoadInt64(&s.SeqOutOfOrder),
+		Diverged:       atomic.LoadInt64(&s.Diverged),
+		ReadStalls:     atomic.LoadInt64(&s.ReadStalls),
+		ChaosDrops:     atomic.LoadInt64(&s.ChaosDrops),
+		Extensions:     s.Extensions(),
+		Channels:       s.Channels(),
+		PreRequest:     s.PreRequest.Summary(),
+		Handshake:      s.Handshake.Summary(),
+		DNS:            s.DNS.Summary(),
+		TCP:            s.TCP.Summary(),
+		TLS:            s.TLS.Summary(),
+		Upgrade:        s.Upgrade.Summary(),
+		ProxyConnect:   s.ProxyConnect.Summary(),
+		FirstMessage:   s.FirstMessage.Summary(),
+		RTT:            s.RTT.Summary(),
+		PongRTT:        s.PongRTT.Summary(),
+		Reply:          s.Reply.Summary(),
+	}
+	for _, n := range r.ErrorTypes {
+		r.Errors += n
+	}
+	r.ConnectRate = r.connectRate()
+	s.mu.Lock()
+	r.Alive = append(r.Alive, s.alive...)
+	r.Timeline = append(r.Timeline, s.timeline...)
+	s.mu.Unlock()
+	r.Calls = s.callResults()
+	r.Classes = s.classResults()
+	s.mu.Lock()
+	r.Hashes = len(s.hashes)
+	r.Divergences = append(r.Divergences, s.diffs...)
+	s.mu.Unlock()
+	r.Refusals = s.Refusals()
+	r.Failures = s.Categories()
+	r.Closes = s.Closes()
+	r.Fuzz = s.fuzzResults()
+	r.Conformance = s.conformanceResults()
+	r.HTTP2 = HTTP2Result{
+		Connections: atomic.LoadInt64(&s.HTTP2Conns),
+		Streams:     atomic.LoadInt64(&s.HTTP2Streams),
+	}
+	r.Retry = RetryResult{
+		Dials:     atomic.LoadInt64(&s.RetryDials),
+		First:     atomic.LoadInt64(&s.RetryFirst),
+		Recovered: atomic.LoadInt64(&s.RetryRecovered),
+		Retries:   atomic.LoadInt64(&s.Retries),
+		Fatal:     atomic.LoadInt64(&s.RetryFatal),
+		Exhausted: atomic.LoadInt64(&s.RetryExhausted),
+	}
+	r.Arrival = ArrivalResult{
+		Scheduled: atomic.LoadInt64(&s.Arrivals),
+		Dropped:   atomic.LoadInt64(&s.ArrivalDropped),
+		Lag:       s.ArrivalLag.Summary(),
+	}
+	r.Schema = SchemaResult{
+		Checked:     atomic.LoadInt64(&s.SchemaChecked),
+		Violations:  atomic.LoadInt64(&s.SchemaViolations),
+		Connections: atomic.LoadInt64(&s.SchemaConns),
+	}
+	r.Fanout = FanoutResult{
+		Published:        atomic.LoadInt64(&s.FanoutPublished),
+		Delivered:        atomic.LoadInt64(&s.FanoutDelivered),
+		Expected:         atomic.LoadInt64(&s.FanoutExpected),
+		Lost:             atomic.LoadInt64(&s.FanoutLost),
+		LossySubscribers: atomic.LoadInt64(&s.FanoutLossySubscribers),
+		MaxLost:          atomic.LoadInt64(&s.FanoutMaxLost),
+		Latency:          s.Fanout.Summary(),
+	}
+	if scenario != nil {
+		for i, step := range scenario.all() {
+			r.Steps = append(r.Steps, StepResult{
+				Name:    step.Name,
+				Latency: s.Steps[i].Summary(),
+			})
+		}
+	}
+	return r
+}
+
+func (s *stats) callResults() []CallResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var calls []CallResult
+	for name, l := range s.calls {
+		calls = append(calls, CallResult{Name: name, Latency: l.Summary()})
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Name < calls[j].Name })
+	return calls
+}
+
+type LatencySummary struct {
+	Count int
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	// Histogram has values in microseconds.
+	Histogram *hdrhistogram.Histogram
+}
+
+func (s LatencySummary) Write(w io.Writer, name string) {
+	if s.Count == 0 {
+		fmt.Fprintf(w, "%-15s %8d\n", name+":", 0)
+		return
+	}
+	fmt.Fprintf(w, "%-15s %8d %10s %10s %10s %10s %10s %10s\n", name+":", s.Count,
+		round(s.Min), round(s.Avg), round(s.Max), round(s.P50), round(s.P90), round(s.P99))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// MarshalJSON encodes latencies in milliseconds.
+func (s LatencySummary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count int     `json:"count"`
+		Min   float64 `json:"min_ms"`
+		Avg   float64 `json:"avg_ms"`
+		Max   float64 `json:"max_ms"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P99   float64 `json:"p99_ms"`
+	}{
+		Count: s.Count,
+		Min:   milliseconds(s.Min),
+		Avg:   milliseconds(s.Avg),
+		Max:   milliseconds(s.Max),
+		P50:   milliseconds(s.P50),
+		P90:   milliseconds(s.P90),
+		P99:   milliseconds(s.P99),
+	})
+}
+
+func (s *LatencySummary) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Count int     `json:"count"`
+		Min   float64 `json:"min_ms"`
+		Avg   float64 `json:"avg_ms"`
+		Max   float64 `json:"max_ms"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P99   float64 `json:"p99_ms"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	*s = LatencySummary{Count: v.Count, Min: ms(v.Min), Avg: ms(v.Avg), Max: ms(v.Max),
+		P50: ms(v.P50), P90: ms(v.P90), P99: ms(v.P99)}
+	return nil
+}
+
+type Result struct {
+	Elapsed        time.Duration    `json:"-"`
+	Tags           Tags             `json:"tags,omitempty"`
+	Connections    int64            `json:"connections"`
+	ConnectRate    float64          `json:"connect_rate"`
+	PeakActive     int64            `json:"peak_active"`
+	Errors         int64            `json:"errors"`
+	ErrorTypes     map[string]int64 `json:"error_types"`
+	Failures       []ErrorCategory  `json:"error_categories,omitempty"`
+	Closes         []CloseResult    `json:"close_codes,omitempty"`
+	Messages       int64            `json:"messages"`
+	Bytes          int64            `json:"bytes"`
+	Assertions     int64            `json:"assertions"`
+	AssertFailures int64            `json:"assert_failures"`
+	WireBytesIn    int64            `json:"wire_bytes_in"`
+	WireBytesOut   int64            `json:"wire_bytes_out"`
+	LostReplies    int64            `json:"lost_replies"`
+	ReadStalls     int64            `json:"read_stalls,omitempty"`
+	ChaosDrops     int64            `json:"chaos_drops,omitempty"`
+	SeqGaps        int64            `json:"seq_gaps"`
+	SeqLost        int64            `json:"seq_lost"`
+	SeqDuplicates  int64            `json:"seq_duplicates"`
+	SeqOutOfOrder  int64            `json:"seq_out_of_order"`
+	Diverged       int64            `json:"diverged"`
+	Divergences    []Divergence     `json:"divergences,omitempty"`
+	Refusals       []HandshakeError `json:"handshake_refusals,omitempty"`
+	Fanout         FanoutResult     `json:"fanout"`
+	Schema         SchemaResult     `json:"schema"`
+	Arrival        ArrivalResult    `json:"arrival"`
+	HTTP2          HTTP2Result      `json:"http2"`
+	Retry          RetryResult      `json:"retry"`
+	AutoTune       *AutoTuneResult  `json:"auto_tune,omitempty"`
+	FindMax        *FindMaxResult   `json:"find_max,omitempty"`
+	Client         *ClientResult    `json:"client,omitempty"`
+	Hashes         int              `json:"distinct_hashes,omitempty"`
+	Extensions     map[string]int64 `json:"extensions"`
+	Channels       map[string]int64 `json:"channels,omitempty"`
+	PreRequest     LatencySummary   `json:"pre_request"`
+	Handshake      LatencySummary   `json:"handshake"`
+	DNS            LatencySummary   `json:"dns"`
+	TCP            LatencySummary   `json:"tcp_connect"`
+	TLS            LatencySummary   `json:"tls_handshake"`
+	Upgrade        LatencySummary   `json:"upgrade"`
+	ProxyConnect   LatencySummary   `json:"proxy_connect"`
+	FirstMessage   LatencySummary   `json:"first_message"`
+	RTT            LatencySummary   `json:"rtt"`
+	PongRTT        LatencySummary   `json:"pong_rtt"`
+	Reply          LatencySummary   `json:"reply"`
+	Steps          []StepResult     `json:"steps,omitempty"`
+	Calls          []CallResult     `json:"calls,omitempty"`
+	Classes        []ClassResult    `json:"classes,omitempty"`
+	Fuzz           []FuzzResult     `json:"fuzz,omitempty"`
+	Conformance    []ConformResult  `json:"conformance,omitempty"`
+	Alive          []AliveSample    `json:"alive,omitempty"`
+	Timeline       []Sample         `json:"timeline,omitempty"`
+	Targets        []TargetResult   `json:"targets,omitempty"`
+	Families       []FamilyResult   `json:"families,omitempty"`
+}
+
+// AliveSample is the number of open connections at elapsed time of a run.
+type AliveSample struct {
+	Elapsed time.Duration
+	Alive   int64
+}
+
+func (s AliveSample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Elapsed float64 `json:"elapsed_s"`
+		Alive   int64   `json:"alive"`
+	}{s.Elapsed.Seconds(), s.Alive})
+}
+
+func (s *AliveSample) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Elapsed float64 `json:"elapsed_s"`
+		Alive   int64   `json:"alive"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	s.Elapsed = time.Duration(v.Elapsed * float64(time.Second))
+	s.Alive = v.Alive
+	return nil
+}
+
+type StepResult struct {
+	Name    string         `json:"name"`
+	Latency LatencySummary `json:"latency"`
+}
+
+// SchemaResult is the validation of received text messages by Schema,
+// Connections are those with violations.
+type SchemaResult struct {
+	Checked     int64 `json:"checked"`
+	Violations  int64 `json:"violations"`
+	Connections int64 `json:"connections"`
+}
+
+// FanoutResult is the delivery of messages published to subscribers of a
+// fan-out run.
+type FanoutResult struct {
+	Published int64 `json:"published"`
+	Delivered int64 `json:"delivered"`
+	// Expected are deliveries of messages published while subscribers
+	// were connected, Lost those not delivered.
+	Expected         int64          `json:"expected"`
+	Lost             int64          `json:"lost"`
+	LossySubscribers int64          `json:"lossy_subscribers"`
+	MaxLost          int64          `json:"max_lost"`
+	Latency          LatencySummary `json:"latency"`
+}
+
+// LossRate returns the percentage of expected deliveries lost.
+func (f FanoutResult) LossRate() float64 {
+	if f.Expected <= 0 {
+		return 0
+	}
+	return float64(f.Lost) * 100 / float64(f.Expected)
+}
+
+func (f *FanoutResult) merge(o FanoutResult) {
+	f.Published += o.Published
+	f.Delivered += o.Delivered
+	f.Expected += o.Expected
+	f.Lost += o.Lost
+	f.LossySubscribers += o.LossySubscribers
+	if o.MaxLost > f.MaxLost {
+		f.MaxLost = o.MaxLost
+	}
+}
+
+func (f FanoutResult) Write(w io.Writer) {
+	fmt.Fprintf(w, "fan-out published: %d, delivered: %d, lost: %d (%.2f%%), lossy subscribers: %d, max lost: %d\n",
+		f.Published, f.Delivered, f.Lost, f.LossRate(), f.LossySubscribers, f.MaxLost)
+}
+
+// CallResult is the latency of calls by name, like invocations of a hub
+// method.
+type CallResult struct {
+	Name    string         `json:"name"`
+	Latency LatencySummary `json:"latency"`
+}
+
+func writeCounts(w io.Writer, counts map[string]int64) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-13s %8d\n", name+":", counts[name])
+	}
+}
+
+// writeRates writes counts with their rates per second.
+func writeRates(w io.Writer, counts map[string]int64, elapsed time.Duration) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(counts[name]) / elapsed.Seconds()
+		}
+		fmt.Fprintf(w, "  %-13s %8d %10.1f/s\n", name+":", counts[name], rate)
+	}
+}
+
+// connectRate returns connections dialed per second.
+func (r *Result) connectRate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Connections) / r.Elapsed.Seconds()
+}
+
+// latencies returns pointers to latency summaries of the result by name.
+func (r *Result) latencies() map[string]*LatencySummary {
+	latencies := map[string]*LatencySummary{
+		"pre_request":   &r.PreRequest,
+		"handshake":     &r.Handshake,
+		"dns":           &r.DNS,
+		"tcp_connect":   &r.TCP,
+		"tls_handshake": &r.TLS,
+		"upgrade":       &r.Upgrade,
+		"proxy_connect": &r.ProxyConnect,
+		"first_message": &r.FirstMessage,
+		"rtt":           &r.RTT,
+		"pong_rtt":      &r.PongRTT,
+		"reply":         &r.Reply,
+		"fanout":        &r.Fanout.Latency,
+		"arrival_lag":   &r.Arrival.Lag,
+	}
+	for i := range r.Steps {
+		latencies[fmt.Sprintf("step.%d", i)] = &r.Steps[i].Latency
+	}
+	for i := range r.Calls {
+		latencies["call."+r.Calls[i].Name] = &r.Calls[i].Latency
+	}
+	for i := range r.Classes {
+		latencies["class."+r.Classes[i].Name] = &r.Classes[i].Interval
+	}
+	return latencies
+}
+
+func addCounts(dst *map[string]int64, src map[string]int64) {
+	if *dst == nil {
+		*dst = make(map[string]int64)
+	}
+	for name, n := range src {
+		(*dst)[name] += n
+	}
+}
+
+func (r *Result) hasCall(name string) bool {
+	for _, call := range r.Calls {
+		if call.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge adds the result of another benchmark run at the same time, like
+// an agent of a distributed run. Latencies are merged from histograms.
+func (r *Result) Merge(o *Result) {
+	if o.Elapsed > r.Elapsed {
+		r.Elapsed = o.Elapsed
+	}
+	for k, v := range o.Tags {
+		if _, ok := r.Tags[k]; !ok {
+			if r.Tags == nil {
+				r.Tags = make(Tags)
+			}
+			r.Tags[k] = v
+		}
+	}
+	r.Connections += o.Connections
+	r.PeakActive += o.PeakActive
+	r.Errors += o.Errors
+	addCounts(&r.ErrorTypes, o.ErrorTypes)
+	r.mergeRefusals(o)
+	r.mergeCategories(o)
+	r.mergeCloses(o)
+	r.mergeFuzz(o)
+	r.mergeConformance(o)
+	r.Messages += o.Messages
+	r.Bytes += o.Bytes
+	r.Assertions += o.Assertions
+	r.AssertFailures += o.AssertFailures
+	r.WireBytesIn += o.WireBytesIn
+	r.WireBytesOut += o.WireBytesOut
+	r.LostReplies += o.LostReplies
+	r.ReadStalls += o.ReadStalls
+	r.ChaosDrops += o.ChaosDrops
+	r.SeqGaps += o.SeqGaps
+	r.SeqLost += o.SeqLost
+	r.SeqDuplicates += o.SeqDuplicates
+	r.SeqOutOfOrder += o.SeqOutOfOrder
+	r.Diverged += o.Diverged
+	for _, d := range o.Divergences {
+		if len(r.Divergences) < maxDivergences {
+			r.Divergences = append(r.Divergences, d)
+		}
+	}
+	r.Fanout.merge(o.Fanout)
+	if o.FindMax != nil {
+		if r.FindMax == nil {
+			r.FindMax = &FindMaxResult{}
+		}
+		r.FindMax.merge(o.FindMax)
+	}
+	if o.AutoTune != nil {
+		if r.AutoTune == nil {
+			r.AutoTune = &AutoTuneResult{}
+		}
+		r.AutoTune.merge(o.AutoTune)
+	}
+	if o.Client != nil {
+		if r.Client == nil {
+			r.Client = &ClientResult{}
+		}
+		r.Client.merge(o.Client)
+	}
+	r.HTTP2.Connections += o.HTTP2.Connections
+	r.HTTP2.Streams += o.HTTP2.Streams
+	r.Retry.merge(o.Retry)
+	r.Arrival.Scheduled += o.Arrival.Scheduled
+	r.Arrival.Dropped += o.Arrival.Dropped
+	r.Schema.Checked += o.Schema.Checked
+	r.Schema.Violations += o.Schema.Violations
+	r.Schema.Connections += o.Schema.Connections
+	// distinct hashes of agents don't add up, the most of an agent is kept
+	if o.Hashes > r.Hashes {
+		r.Hashes = o.Hashes
+	}
+	addCounts(&r.Extensions, o.Extensions)
+	if o.Channels != nil {
+		addCounts(&r.Channels, o.Channels)
+	}
+	r.ConnectRate = r.connectRate()
+
+	for i := len(r.Steps); i < len(o.Steps); i++ {
+		r.Steps = append(r.Steps, StepResult{Name: o.Steps[i].Name})
+	}
+	for _, call := range o.Calls {
+		if !r.hasCall(call.Name) {
+			r.Calls = append(r.Calls, CallResult{Name: call.Name})
+		}
+	}
+	sort.Slice(r.Calls, func(i, j int) bool { return r.Calls[i].Name < r.Calls[j].Name })
+	r.mergeClasses(o)
+	latencies := r.latencies()
+	for name, src := range o.latencies() {
+		if src.Histogram == nil {
+			continue
+		}
+		dst := latencies[name]
+		if dst.Histogram == nil {
+			*dst = summarize(hdrhistogram.Import(src.Histogram.Export()))
+			continue
+		}
+		dst.Histogram.Merge(src.Histogram)
+		*dst = summarize(dst.Histogram)
+	}
+
+	for i, sample := range o.Alive {
+		if i < len(r.Alive) {
+			r.Alive[i].Alive += sample.Alive
+		} else {
+			r.Alive = append(r.Alive, sample)
+		}
+	}
+	for i, sample := range o.Timeline {
+		if i < len(r.Timeline) {
+			r.Timeline[i].merge(sample)
+		} else {
+			r.Timeline = append(r.Timeline, sample)
+		}
+	}
+
+	for i, t := range o.Targets {
+		if i >= len(r.Targets) {
+			r.Targets = append(r.Targets, TargetResult{URL: t.URL, Result: &Result{}})
+		}
+		r.Targets[i].Merge(t.Result)
+	}
+	for i, f := range o.Families {
+		if i >= len(r.Families) {
+			r.Families = append(r.Families, FamilyResult{Network: f.Network, Result: &Result{}})
+		}
+		r.Families[i].Merge(f.Result)
+	}
+}
+
+// Write writes the result as text summary.
+func (r *Result) Write(w io.Writer) {
+	if len(r.Tags) > 0 {
+		fmt.Fprintf(w, "tags: %s\n", r.Tags.Format("=", ", "))
+	}
+	fmt.Fprintf(w, "elapsed: %s, connections: %d, errors: %d, messages: %d, bytes: %d\n",
+		round(r.Elapsed), r.Connections, r.Errors, r.Messages, r.Bytes)
+	writeCounts(w, r.ErrorTypes)
+	writeCategories(w, r.Failures)
+	writeRefusals(w, r)
+	writeCloses(w, r.Closes)
+	writeFuzz(w, r.Fuzz)
+	writeConformance(w, r.Conformance)
+	if r.Assertions > 0 {
+		fmt.Fprintf(w, "assertions: %d, failed: %d\n", r.Assertions, r.AssertFailures)
+	}
+	fmt.Fprintf(w, "connect rate: %.1f/s, peak active: %d\n", r.ConnectRate, r.PeakActive)
+	if r.AutoTune != nil {
+		r.AutoTune.Write(w)
+	}
+	if r.FindMax != nil {
+		r.FindMax.Write(w)
+	}
+	if r.HTTP2.Streams > 0 || r.HTTP2.Connections > 0 {
+		r.HTTP2.Write(w)
+	}
+	if r.Retry.Dials > 0 {
+		r.Retry.Write(w)
+	}
+	if r.Arrival.Scheduled > 0 {
+		fmt.Fprintf(w, "arrivals: %d, dropped: %d\n", r.Arrival.Scheduled, r.Arrival.Dropped)
+	}
+	fmt.Fprintf(w, "wire bytes in: %d, out: %d\n", r.WireBytesIn, r.WireBytesOut)
+	if r.Client != nil {
+		r.Client.Write(w)
+	}
+	if r.LostReplies > 0 {
+		fmt.Fprintf(w, "lost replies: %d\n", r.LostReplies)
+	}
+	if r.ReadStalls > 0 {
+		fmt.Fprintf(w, "read stalls: %d\n", r.ReadStalls)
+	}
+	if r.ChaosDrops > 0 {
+		fmt.Fprintf(w, "chaos drops: %d\n", r.ChaosDrops)
+	}
+	if r.Fanout.Published > 0 {
+		r.Fanout.Write(w)
+	}
+	if r.Schema.Checked > 0 {
+		fmt.Fprintf(w, "schema checked: %d, violations: %d, connections: %d\n",
+			r.Schema.Checked, r.Schema.Violations, r.Schema.Connections)
+	}
+	if r.Diverged > 0 {
+		fmt.Fprintf(w, "diverged connections: %d\n", r.Diverged)
+		for i, d := range r.Divergences {
+			if i == 10 {
+				fmt.Fprintf(w, "  ...\n")
+				break
+			}
+			fmt.Fprintf(w, "  conn %d at message %d: %s\n", d.Conn, d.Index, d.Reason)
+		}
+	}
+	if r.Hashes > 0 {
+		fmt.Fprintf(w, "distinct message hashes: %d\n", r.Hashes)
+	}
+	if r.SeqGaps+r.SeqDuplicates+r.SeqOutOfOrder > 0 {
+		fmt.Fprintf(w, "sequence gaps: %d, lost: %d, duplicates: %d, out of order: %d\n",
+			r.SeqGaps, r.SeqLost, r.SeqDuplicates, r.SeqOutOfOrder)
+	}
+	if len(r.Extensions) > 0 {
+		fmt.Fprintln(w, "extensions:")
+		writeCounts(w, r.Extensions)
+	}
+	if len(r.Channels) > 0 {
+		fmt.Fprintln(w, "channels:")
+		writeRates(w, r.Channels, r.Elapsed)
+	}
+	if len(r.Classes) > 0 {
+		writeClasses(w, r.Classes, r.Elapsed)
+	}
+
+	fmt.Fprintf(w, "%-15s %8s %10s %10s %10s %10s %10s %10s\n", "", "count",
+		"min", "avg", "max", "p50", "p90", "p99")
+	if r.PreRequest.Count > 0 {
+		r.PreRequest.Write(w, "pre request")
+	}
+	r.Handshake.Write(w, "handshake")
+	if r.DNS.Count > 0 {
+		r.DNS.Write(w, "  dns")
+	}
+	if r.TCP.Count > 0 {
+		r.TCP.Write(w, "  tcp connect")
+	}
+	if r.TLS.Count > 0 {
+		r.TLS.Write(w, "  tls")
+	}
+	if r.Upgrade.Count > 0 {
+		r.Upgrade.Write(w, "  upgrade")
+	}
+	if r.ProxyConnect.Count > 0 {
+		r.ProxyConnect.Write(w, "proxy connect")
+	}
+	r.FirstMessage.Write(w, "first message")
+	if r.RTT.Count > 0 {
+		r.RTT.Write(w, "rtt")
+	}
+	if r.PongRTT.Count > 0 {
+		r.PongRTT.Write(w, "pong rtt")
+	}
+	if r.Reply.Count > 0 || r.LostReplies > 0 {
+		r.Reply.Write(w, "reply")
+	}
+	if r.Fanout.Published > 0 {
+		r.Fanout.Latency.Write(w, "fan-out")
+	}
+	if r.Arrival.Scheduled > 0 {
+		r.Arrival.Lag.Write(w, "arrival lag")
+	}
+	for _, step := range r.Steps {
+		step.Latency.Write(w, step.Name)
+	}
+	if len(r.Calls) > 0 {
+		fmt.Fprintln(w, "calls:")
+		for _, call := range r.Calls {
+			call.Latency.Write(w, "  "+call.Name)
+		}
+	}
+
+	writeTargets(w, r.Targets)
+	writeFamilies(w, r.Families)
+
+	if len(r.Alive) > 0 {
+		fmt.Fprintln(w, "alive:")
+		for _, sample := range r.Alive {
+			fmt.Fprintf(w, "  %-13s %8d\n", sample.Elapsed.Truncate(time.Second), sample.Alive)
+		}
+	}
+}
+
+// WriteJSON writes the result as json report.
+func (r *Result) WriteJSON(w io.Writer) error {
+	type result Result
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Elapsed float64 `json:"elapsed_s"`
+		*result
+	}{r.Elapsed.Seconds(), (*result)(r)})
+}
+
+// ReadJSON reads a result written by WriteJSON, latencies have their
+// summary without histogram so results read can't be merged.
+func ReadJSON(r io.Reader) (*Result, error) {
+	type result Result
+	v := struct {
+		Elapsed float64 `json:"elapsed_s"`
+		*result
+	}{result: new(result)}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	res := (*Result)(v.result)
+	res.Elapsed = time.Duration(v.Elapsed * float64(time.Second))
+	for i := range res.Targets {
+		res.Targets[i].Elapsed = res.Elapsed
+	}
+	for i := range res.Families {
+		res.Families[i].Elapsed = res.Elapsed
+	}
+	return res, nil
+}
@@ -0,0 +1,194 @@
+package wsbm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stomp speaks STOMP 1.2 frames, it connects with heart-beats of
+// PingInterval, subscribes Subscribe destinations and sends messages to
+// Publish. Received MESSAGE bodies are counted by destination.
+type stomp struct {
+	b *Benchmark
+}
+
+type stompFrame struct {
+	command string
+	header  map[string]string
+	body    []byte
+}
+
+var stompEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+var stompUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+
+// marshalStomp encodes a frame, header is pairs of names and values.
+func marshalStomp(command string, header []string, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(command)
+	buf.WriteByte('\n')
+	for i := 0; i+1 < len(header); i += 2 {
+		buf.WriteString(stompEscaper.Replace(header[i]))
+		buf.WriteByte(':')
+		buf.WriteString(stompEscaper.Replace(header[i+1]))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.Write(body)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// parseStomp decodes a frame, a nil frame is a heart-beat.
+func parseStomp(data []byte) (*stompFrame, error) {
+	data = bytes.TrimLeft(data, "\r\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	head, body, ok := bytes.Cut(data, []byte("\n\n"))
+	if !ok {
+		if head, body, ok = bytes.Cut(data, []byte("\r\n\r\n")); !ok {
+			return nil, fmt.Errorf("invalid frame %q", data)
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	f := &stompFrame{command: lines[0], header: make(map[string]string)}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		// the first of repeated headers is used
+		name = stompUnescaper.Replace(name)
+		if _, ok := f.header[name]; !ok {
+			f.header[name] = stompUnescaper.Replace(value)
+		}
+	}
+	if n, err := strconv.Atoi(f.header["content-length"]); err == nil && n <= len(body) {
+		body = body[:n]
+	} else if i := bytes.IndexByte(body, 0); i >= 0 {
+		body = body[:i]
+	}
+	f.body = body
+	return f, nil
+}
+
+func (p *stomp) prepare(ctx context.Context, t *task) error {
+	t.addHeader("Sec-WebSocket-Protocol", "v12.stomp, v11.stomp")
+	return nil
+}
+
+// open connects, starts heart-beats and subscribes destinations.
+func (p *stomp) open(s *session) error {
+	heartBeat := int(s.b.opts.PingInterval / time.Millisecond)
+	header := []string{
+		"accept-version", "1.2,1.1",
+		"host", s.task.url.Hostname(),
+		"heart-beat", fmt.Sprintf("%d,%d", heartBeat, heartBeat),
+	}
+	if user := s.task.url.User; user != nil {
+		password, _ := user.Password()
+		header = append(header, "login", user.Username(), "passcode", password)
+	}
+
+	s.SetReadDeadline(s.b.handshakeTimeout())
+	if err := s.write(websocket.TextMessage, marshalStomp("CONNECT", header, nil)); err != nil {
+		return err
+	}
+	var connected *stompFrame
+	for connected == nil {
+		_, data, err := s.ReadMessage()
+		if err != nil {
+			return err
+		}
+		f, err := parseStomp(data)
+		if err != nil {
+			return err
+		}
+		switch {
+		case f == nil:
+		case f.command == "CONNECTED":
+			connected = f
+		case f.command == "ERROR":
+			return fmt.Errorf("connect error %s", f.header["message"])
+		}
+	}
+
+	// the client sends heart-beats as often as both sides agree to
+	if heartBeat > 0 {
+		_, want, _ := strings.Cut(connected.header["heart-beat"], ",")
+		if server, _ := strconv.Atoi(want); server > 0 {
+			if server > heartBeat {
+				heartBeat = server
+			}
+			go p.heartBeat(s, time.Duration(heartBeat)*time.Millisecond)
+		}
+	}
+
+	for i, destination := range s.b.opts.Subscribe {
+		frame := marshalStomp("SUBSCRIBE", []string{
+			"id", strconv.Itoa(i),
+			"destination", destination,
+			"ack", "auto",
+		}, nil)
+		if err := s.write(websocket.TextMessage, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *stomp) heartBeat(s *session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.write(websocket.TextMessage, []byte("\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *stomp) encode(s *session, msgType int, data []byte) (int, []byte, error) {
+	destination := s.b.publish()
+	if destination == "" {
+		return 0, nil, errors.New("stomp: no destination to send to")
+	}
+	header := []string{"destination", destination, "content-length", strconv.Itoa(len(data))}
+	if msgType == websocket.TextMessage {
+		header = append(header, "content-type", "text/plain")
+	}
+	return msgType, marshalStomp("SEND", header, data), nil
+}
+
+// decode returns bodies of MESSAGE frames on their destination.
+func (p *stomp) decode(s *session, msgType int, data []byte) ([]Message, error) {
+	f, err := parseStomp(data)
+	switch {
+	case err != nil:
+		return nil, protocolError("stomp", err)
+	case f == nil:
+		return nil, nil
+	case f.command == "MESSAGE":
+		return []Message{{
+			Binary:  msgType == websocket.BinaryMessage,
+			Data:    f.body,
+			Channel: f.header["destination"],
+		}}, nil
+	case f.command == "ERROR":
+		return nil, protocolError("stomp", fmt.Errorf("error %s", f.header["message"]))
+	default:
+		return nil, nil
+	}
+}
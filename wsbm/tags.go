@@ -0,0 +1,32 @@
+package wsbm
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tags label a run, like its build, region or server version, in its
+// results, raw results and metrics.
+type Tags map[string]string
+
+// Keys returns keys of tags sorted.
+func (t Tags) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Format joins tags sorted by key as key, kv and value, separated by sep.
+func (t Tags) Format(kv, sep string) string {
+	var b strings.Builder
+	for i, k := range t.Keys() {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(k + kv + t[k])
+	}
+	return b.String()
+}
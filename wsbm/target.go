@@ -0,0 +1,113 @@
+package wsbm
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Target is one of the URLs connections are distributed to.
+type Target struct {
+	URL string `json:"url"`
+	// Weight is the share of connections, < 1 means 1.
+	Weight int `json:"weight"`
+}
+
+// TargetResult is the result of connections to a target.
+type TargetResult struct {
+	URL string `json:"url"`
+	*Result
+}
+
+// target returns the index of the target of connection id, connections
+// are distributed round-robin by weight.
+func (b *Benchmark) target(id int) int {
+	total := 0
+	for _, t := range b.opts.Targets {
+		total += t.weight()
+	}
+	k := id % total
+	for i, t := range b.opts.Targets {
+		if k < t.weight() {
+			return i
+		}
+		k -= t.weight()
+	}
+	return 0
+}
+
+func (t Target) weight() int {
+	if t.Weight < 1 {
+		return 1
+	}
+	return t.Weight
+}
+
+// rawURL returns the url template of connection id.
+func (b *Benchmark) rawURL(id int) string {
+	if len(b.opts.Targets) == 0 {
+		return b.opts.URL
+	}
+	return b.opts.Targets[b.target(id)].URL
+}
+
+// addResult adds a connection result to stats of a target.
+func (s *stats) addResult(r ConnResult) {
+	if r.Err != nil {
+		s.AddError(r.Err)
+	}
+	if r.Start.IsZero() {
+		return
+	}
+	atomic.AddInt64(&s.Connections, 1)
+	atomic.AddInt64(&s.Messages, r.Messages)
+	atomic.AddInt64(&s.Bytes, r.Bytes)
+	for _, l := range []struct {
+		latency *latency
+		d       time.Duration
+	}{
+		{&s.Handshake, r.Handshake},
+		{&s.DNS, r.DNS},
+		{&s.TCP, r.TCP},
+		{&s.TLS, r.TLS},
+		{&s.Upgrade, r.Upgrade},
+		{&s.FirstMessage, r.FirstMessage},
+	} {
+		if l.d > 0 {
+			l.latency.Add(l.d)
+		}
+	}
+}
+
+func (b *Benchmark) targetResults() []TargetResult {
+	var results []TargetResult
+	for i := range b.targets {
+		s := &b.targets[i]
+		s.Start, s.End = b.stats.Start, b.stats.End
+		results = append(results, TargetResult{URL: b.opts.Targets[i].URL, Result: s.Result(nil)})
+	}
+	return results
+}
+
+// writeTargets writes per target summaries.
+func writeTargets(w io.Writer, targets []TargetResult) {
+	if len(targets) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "targets:")
+	for _, t := range targets {
+		writeBreakdown(w, t.URL, t.Result)
+	}
+}
+
+// writeBreakdown writes the summary of the part name of a run.
+func writeBreakdown(w io.Writer, name string, r *Result) {
+	fmt.Fprintf(w, "  %s\n", name)
+	fmt.Fprintf(w, "    connections: %d, errors: %d, messages: %d, bytes: %d\n",
+		r.Connections, r.Errors, r.Messages, r.Bytes)
+	r.Handshake.Write(w, "    handshake")
+	if r.FirstMessage.Count > 0 {
+		r.FirstMessage.Write(w, "    first message")
+	}
+}
@@ -0,0 +1,102 @@
+package wsbm
+
+import (
+	"errors"
+	"hash"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// task is a single connection run by a worker.
+type task struct {
+	id  int
+	url *url.URL
+	// header is added to the handshake request by protocols.
+	header http.Header
+	output io.Writer
+	// hash is the running checksum of received messages of OutputHash.
+	hash hash.Hash
+	// rand draws think times.
+	rand   *mrand.Rand
+	result ConnResult
+	// attempt is the retry of the dial, 0 for the first.
+	attempt int
+	// ends are run in reverse order when the task ends, see atEnd.
+	ends []func()
+	// resume ends a detached task with its error.
+	resume func(err error)
+}
+
+// errDetached is returned by tasks whose connection was handed over to a
+// poller, which ends them by resume when the connection ends.
+var errDetached = errors.New("task detached")
+
+// atEnd runs f when the task ends, like a defer of the task lasting as long
+// as its connection when it is detached.
+func (t *task) atEnd(f func()) {
+	t.ends = append(t.ends, f)
+}
+
+// end runs functions of atEnd in reverse order.
+func (t *task) end() {
+	for i := len(t.ends) - 1; i >= 0; i-- {
+		t.ends[i]()
+	}
+}
+
+// Metrics of MessageLatency, named like latencies of Result.
+const (
+	MetricRTT     = "rtt"
+	MetricReply   = "reply"
+	MetricPongRTT = "pong_rtt"
+	MetricFanout  = "fanout"
+)
+
+// MessageLatency is a latency of a message of connection ID measured At,
+// the round trip of an echo or ping, the reply to a correlated request or
+// the delivery of a fan-out message by Metric.
+type MessageLatency struct {
+	ID      int
+	Metric  string
+	At      time.Time
+	Latency time.Duration
+}
+
+// ConnResult is the result of a single connection.
+type ConnResult struct {
+	ID  int
+	URL string
+	// Start is when dial started, zero if the connection was not dialed.
+	Start time.Time
+	// Connect is the TCP connect time, through proxy if any.
+	Connect time.Duration
+	// DNS, TCP, TLS and Upgrade are phases of the handshake, DNS is zero
+	// for ip addresses and TLS for ws urls.
+	DNS       time.Duration
+	TCP       time.Duration
+	TLS       time.Duration
+	Upgrade   time.Duration
+	Handshake time.Duration
+	// FirstMessage is the time from dial start to the first message.
+	FirstMessage time.Duration
+	Messages     int64
+	Bytes        int64
+	// Duration from dial to end.
+	Duration time.Duration
+	// Close is 'client' when closed by us, or close code and reason from
+	// server, empty if connection was not closed by a close frame.
+	Close string
+	// SchemaViolations are received messages invalid by Schema.
+	SchemaViolations int64
+	// RTT summarizes round-trip times of echo messages, without histogram.
+	RTT LatencySummary
+	// Hash is the SHA-256 of received messages with OutputHash.
+	Hash string
+	// TraceID and SpanID are hex ids of the traceparent of Traceparent.
+	TraceID string
+	SpanID  string
+	Err     error
+}
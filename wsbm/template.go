@@ -0,0 +1,119 @@
+package wsbm
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var templateFuncs = template.FuncMap{
+	"uuid":      uuid,
+	"randInt":   randInt,
+	"timestamp": timestamp,
+}
+
+// uuid returns a random version 4 uuid.
+func uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// randInt returns a random int in [min, max].
+func randInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + mrand.Intn(max-min+1)
+}
+
+// timestamp returns unix time in milliseconds.
+func timestamp() int64 {
+	return time.Now().UnixMilli()
+}
+
+// templates caches parsed templates by text, text without actions is used as is.
+type templates map[string]*template.Template
+
+func (t templates) add(text string) error {
+	if !strings.Contains(text, "{{") || t[text] != nil {
+		return nil
+	}
+	tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	t[text] = tmpl
+	return nil
+}
+
+func (t templates) execute(text string, data map[string]interface{}) (string, error) {
+	tmpl := t[text]
+	if tmpl == nil {
+		return text, nil
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// templateData returns template variables of connection id, ID, the
+// values of the query picked by id and values extracted by PreRequest.
+func (b *Benchmark) templateData(id int) map[string]interface{} {
+	data := map[string]interface{}{"ID": id}
+	if len(b.opts.Queries) > 0 {
+		query := b.query(id)
+		for name := range query {
+			data[name] = query.Get(name)
+		}
+	}
+	if vars, ok := b.preVars.Load(id); ok {
+		for name, value := range vars.(map[string]string) {
+			data[name] = value
+		}
+	}
+	return data
+}
+
+func (b *Benchmark) parseTemplates() error {
+	texts := []string{b.opts.URL}
+	for _, t := range b.opts.Targets {
+		texts = append(texts, t.URL)
+	}
+	for _, values := range b.opts.Header {
+		texts = append(texts, values...)
+	}
+	for _, msg := range b.opts.Messages {
+		if !msg.Binary {
+			texts = append(texts, string(msg.Data))
+		}
+	}
+	if p := b.opts.PreRequest; p != nil {
+		texts = append(texts, p.URL, p.Body)
+		for _, values := range p.Header {
+			texts = append(texts, values...)
+		}
+	}
+	texts = append(texts, b.opts.Subscribe...)
+	texts = append(texts, b.opts.Publish, b.opts.FanoutMessage)
+	if b.opts.Scenario != nil {
+		for _, step := range b.opts.Scenario.all() {
+			texts = append(texts, step.Message)
+		}
+	}
+
+	b.templates = make(templates)
+	for _, text := range texts {
+		if err := b.templates.add(text); err != nil {
+			return fmt.Errorf("parse template %q err:%s", text, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package wsbm
+
+import (
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"strings"
+	"time"
+)
+
+// Think is the distribution of pauses between sends, like '100ms',
+// 'exp(200ms)', 'uniform(50ms,150ms)' or 'normal(100ms,20ms)'.
+type Think struct {
+	raw string
+	// dist is const, exp, uniform or normal, a and b are the duration, the
+	// mean, min and max, or mean and standard deviation.
+	dist string
+	a, b time.Duration
+}
+
+func ParseThink(spec string) (*Think, error) {
+	t := &Think{raw: spec}
+	spec = strings.TrimSpace(spec)
+	name, args, ok := strings.Cut(spec, "(")
+	if !ok {
+		d, err := time.ParseDuration(spec)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid think time %q", t.raw)
+		}
+		t.dist, t.a = "const", d
+		return t, nil
+	}
+	if !strings.HasSuffix(args, ")") {
+		return nil, fmt.Errorf("invalid think time %q, missing )", t.raw)
+	}
+
+	var ds []time.Duration
+	for _, arg := range strings.Split(strings.TrimSuffix(args, ")"), ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(arg))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid think time %q", t.raw)
+		}
+		ds = append(ds, d)
+	}
+
+	t.dist = strings.TrimSpace(name)
+	switch {
+	case t.dist == "exp" && len(ds) == 1:
+		t.a = ds[0]
+	case t.dist == "uniform" && len(ds) == 2 && ds[0] <= ds[1]:
+		t.a, t.b = ds[0], ds[1]
+	case t.dist == "normal" && len(ds) == 2:
+		t.a, t.b = ds[0], ds[1]
+	default:
+		return nil, fmt.Errorf("invalid think time %q, want duration, exp(mean), uniform(min,max) or normal(mean,stddev)", t.raw)
+	}
+	return t, nil
+}
+
+func (t *Think) String() string {
+	return t.raw
+}
+
+// next returns a think time drawn from r, normal times are 0 at least.
+func (t *Think) next(r *mrand.Rand) time.Duration {
+	switch t.dist {
+	case "exp":
+		return time.Duration(r.ExpFloat64() * float64(t.a))
+	case "uniform":
+		return t.a + time.Duration(r.Int63n(int64(t.b-t.a)+1))
+	case "normal":
+		return time.Duration(math.Max(0, r.NormFloat64()*float64(t.b)+float64(t.a)))
+	default:
+		return t.a
+	}
+}
+
+// thinkTime returns the pause of task t before its next send, a think
+// time or SendInterval without Think.
+func (b *Benchmark) thinkTime(t *task) time.Duration {
+	think := b.opts.Think
+	if think == nil {
+		return b.opts.SendInterval
+	}
+	if t.rand == nil {
+		t.rand = mrand.New(mrand.NewSource(b.opts.ThinkSeed + int64(t.id)))
+	}
+	return think.next(t.rand)
+}
+
+// pause waits the think time, or SendInterval without Think, before the
+// next send. It returns false when the session is done.
+func (s *session) pause() bool {
+	d := s.b.thinkTime(s.task)
+	if d <= 0 {
+		return s.ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,99 @@
+package wsbm
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// throttle paces bytes of a direction of a connection to rate per second,
+// in chunks of a tenth of a second.
+type throttle struct {
+	mu    sync.Mutex
+	rate  float64
+	chunk int
+	// next is when following bytes may be transferred.
+	next time.Time
+}
+
+func newThrottle(rate float64) *throttle {
+	chunk := int(rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	return &throttle{rate: rate, chunk: chunk}
+}
+
+// limit returns p cut to a chunk.
+func (t *throttle) limit(p []byte) []byte {
+	if len(p) > t.chunk {
+		return p[:t.chunk]
+	}
+	return p
+}
+
+// wait sleeps until n more bytes are within the rate.
+func (t *throttle) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	time.Sleep(t.next.Sub(now))
+}
+
+// throttleConn limits bandwidth of a connection by MaxRecvRate and
+// MaxSendRate, reads are slowed down so the server sees a slow consumer
+// filling its buffers and the TCP window.
+type throttleConn struct {
+	net.Conn
+	recv *throttle
+	send *throttle
+}
+
+// throttled returns conn limited by MaxRecvRate and MaxSendRate if set.
+func (b *Benchmark) throttled(conn net.Conn) net.Conn {
+	if b.opts.MaxRecvRate <= 0 && b.opts.MaxSendRate <= 0 {
+		return conn
+	}
+	c := &throttleConn{Conn: conn}
+	if b.opts.MaxRecvRate > 0 {
+		c.recv = newThrottle(b.opts.MaxRecvRate)
+	}
+	if b.opts.MaxSendRate > 0 {
+		c.send = newThrottle(b.opts.MaxSendRate)
+	}
+	return c
+}
+
+func (c *throttleConn) Read(p []byte) (int, error) {
+	if c.recv == nil {
+		return c.Conn.Read(p)
+	}
+	c.recv.mu.Lock()
+	defer c.recv.mu.Unlock()
+	n, err := c.Conn.Read(c.recv.limit(p))
+	c.recv.wait(n)
+	return n, err
+}
+
+func (c *throttleConn) Write(p []byte) (int, error) {
+	if c.send == nil {
+		return c.Conn.Write(p)
+	}
+	c.send.mu.Lock()
+	defer c.send.mu.Unlock()
+	var written int
+	for written < len(p) {
+		n, err := c.Conn.Write(c.send.limit(p[written:]))
+		written += n
+		c.send.wait(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,103 @@
+package wsbm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+type dialTraceKey struct{}
+
+// dialTrace collects timings of a single dial.
+type dialTrace struct {
+	proxied bool
+	// network forces the address family of the dial, tcp4 or tcp6.
+	network string
+	// shaped connections are wrapped by Shape.
+	shaped  bool
+	getConn time.Time
+	gotConn time.Time
+	// dns and tcp are set by netDialContext.
+	dns      time.Duration
+	tcp      time.Duration
+	tlsStart time.Time
+	tlsDone  time.Time
+}
+
+func withDialTrace(ctx context.Context) (context.Context, *dialTrace) {
+	t := &dialTrace{}
+	ctx = context.WithValue(ctx, dialTraceKey{}, t)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:           func(string) { t.getConn = time.Now() },
+		GotConn:           func(httptrace.GotConnInfo) { t.gotConn = time.Now() },
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+	})
+	return ctx, t
+}
+
+func getDialTrace(ctx context.Context) *dialTrace {
+	t, _ := ctx.Value(dialTraceKey{}).(*dialTrace)
+	return t
+}
+
+// record adds timings of a successful dial to stats and result.
+func (t *dialTrace) record(s *stats, r *ConnResult) {
+	if t.gotConn.IsZero() {
+		return
+	}
+	r.Connect = t.gotConn.Sub(t.getConn)
+	if t.proxied {
+		s.ProxyConnect.Add(r.Connect)
+	}
+
+	r.DNS, r.TCP = t.dns, t.tcp
+	if t.dns > 0 {
+		s.DNS.Add(t.dns)
+	}
+	// streams of HTTP2 connect without a new TCP connection
+	if t.tcp > 0 {
+		s.TCP.Add(t.tcp)
+	}
+	upgradeStart := t.gotConn
+	if !t.tlsDone.IsZero() {
+		r.TLS = t.tlsDone.Sub(t.tlsStart)
+		s.TLS.Add(r.TLS)
+		upgradeStart = t.tlsDone
+	}
+	r.Upgrade = r.Start.Add(r.Handshake).Sub(upgradeStart)
+	s.Upgrade.Add(r.Upgrade)
+}
+
+// proxy returns the proxy of req, Options.Proxy or the one from environment,
+// and marks the dial as proxied.
+func (b *Benchmark) proxy(req *http.Request) (*url.URL, error) {
+	u := b.opts.Proxy
+	if u == nil {
+		var err error
+		if u, err = http.ProxyFromEnvironment(req); err != nil {
+			return nil, err
+		}
+	}
+	if t := getDialTrace(req.Context()); t != nil && u != nil {
+		t.proxied = true
+	}
+	return u, nil
+}
+
+// traceparent returns the W3C traceparent header of the connection of t,
+// attempts of retries share its ids.
+func (t *task) traceparent() string {
+	if t.result.TraceID == "" {
+		var id [24]byte
+		rand.Read(id[:])
+		t.result.TraceID = hex.EncodeToString(id[:16])
+		t.result.SpanID = hex.EncodeToString(id[16:])
+	}
+	return "00-" + t.result.TraceID + "-" + t.result.SpanID + "-01"
+}